@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/parquet-go/parquet-go"
+)
+
+type parquetObservation struct {
+	DeviceID        string    `parquet:"deviceId"`
+	SensorID        string    `parquet:"sensorId"`
+	ObservationTime time.Time `parquet:"observationTime,timestamp(millisecond)"`
+	Value           *float64  `parquet:"value,optional"`
+	ValueString     *string   `parquet:"valueString,optional"`
+	ValueBoolean    *bool     `parquet:"valueBoolean,optional"`
+	QuantityKind    string    `parquet:"quantityKind"`
+}
+
+// runExport exports observations for an entity and its subtree to Parquet files, e.g.
+// api-rec export -id building-1 -type building -starting 2023-07-01T00:00:00Z -ending 2023-10-01T00:00:00Z -per sensor
+func runExport(ctx context.Context, args []string) {
+	var id, typeName, starting, ending, per, out string
+
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&id, "id", "", "Id of the entity to export observations for")
+	flags.StringVar(&typeName, "type", "building", "Type of the entity, e.g. building, space or sensor")
+	flags.StringVar(&starting, "starting", "1970-01-01T00:00:00Z", "Start of the time range (RFC3339)")
+	flags.StringVar(&ending, "ending", "", "End of the time range (RFC3339), defaults to now")
+	flags.StringVar(&per, "per", "entity", "Write one file per entity or one file per sensor (entity|sensor)")
+	flags.StringVar(&out, "out", ".", "Directory to write the Parquet files to")
+	flags.Parse(args)
+
+	if id == "" || (per != "entity" && per != "sensor") {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	startingTime, err := time.Parse(time.RFC3339, starting)
+	if err != nil {
+		fatal(ctx, "starting time in wrong format, must be RFC3339", err)
+	}
+
+	endingTime := time.Now().UTC()
+	if ending != "" {
+		endingTime, err = time.Parse(time.RFC3339, ending)
+		if err != nil {
+			fatal(ctx, "ending time in wrong format, must be RFC3339", err)
+		}
+	}
+
+	db, err := database.Connect(ctx, database.LoadConfiguration(ctx))
+	if err != nil {
+		fatal(ctx, "connect failed", err)
+	}
+
+	cfg, err := application.LoadConfiguration(ctx)
+	if err != nil {
+		fatal(ctx, "invalid configuration", err)
+	}
+
+	app := application.New(db, cfg)
+
+	root, err := app.GetEntity(ctx, id, database.GetTypeFromTypeName(typeName))
+	if err != nil {
+		fatal(ctx, fmt.Sprintf("failed to find %s %s", typeName, id), err)
+	}
+
+	sensorIDs, err := app.GetSensorIDs(ctx, root)
+	if err != nil {
+		fatal(ctx, "failed to find sensors", err)
+	}
+
+	files := map[string][]string{id: sensorIDs}
+	if per == "sensor" {
+		files = make(map[string][]string)
+		for _, sensorID := range sensorIDs {
+			files[sensorID] = []string{sensorID}
+		}
+	}
+
+	for name, ids := range files {
+		path := filepath.Join(out, fileName(name)+".parquet")
+
+		n, err := exportParquet(ctx, app, path, database.ObservationFilter{
+			SensorIDs: ids,
+			Starting:  startingTime,
+			Ending:    endingTime,
+		})
+		if err != nil {
+			fatal(ctx, fmt.Sprintf("failed to export observations to %s", path), err)
+		}
+
+		fmt.Fprintf(os.Stdout, "wrote %d observations to %s\n", n, path)
+	}
+}
+
+func exportParquet(ctx context.Context, app application.Application, path string, filter database.ObservationFilter) (int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w := parquet.NewGenericWriter[parquetObservation](f)
+
+	n := 0
+	err = app.StreamObservations(ctx, filter, func(deviceID string, o database.Observation) error {
+		n++
+		_, err := w.Write([]parquetObservation{{
+			DeviceID:        deviceID,
+			SensorID:        o.SensorId,
+			ObservationTime: o.ObservationTime.UTC(),
+			Value:           o.Value,
+			ValueString:     o.ValueString,
+			ValueBoolean:    o.ValueBoolean,
+			QuantityKind:    o.QuantityKind,
+		}})
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return n, err
+	}
+
+	return n, f.Close()
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// fileName makes an entity id, which may be a URI, usable as a file name
+func fileName(id string) string {
+	return unsafeFileNameChars.ReplaceAllString(id, "_")
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+	"github.com/parquet-go/parquet-go"
+)
+
+func TestExportParquet(t *testing.T) {
+	is := is.New(t)
+
+	v := 21.5
+	b := true
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	app := &appMock{observations: []database.Observation{
+		{SensorId: "sensor-1", ObservationTime: now, Value: &v, QuantityKind: "Temperature"},
+		{SensorId: "sensor-2", ObservationTime: now, ValueBoolean: &b, QuantityKind: "diwise:Presence"},
+	}}
+
+	path := filepath.Join(t.TempDir(), fileName("https://recref.com/building/1")+".parquet")
+
+	n, err := exportParquet(context.Background(), app, path, database.ObservationFilter{})
+	is.NoErr(err)
+	is.Equal(2, n)
+
+	rows, err := parquet.ReadFile[parquetObservation](path)
+	is.NoErr(err)
+	is.Equal(2, len(rows))
+	is.Equal("device-1", rows[0].DeviceID)
+	is.Equal(21.5, *rows[0].Value)
+	is.Equal(now, rows[0].ObservationTime.UTC())
+	is.True(rows[0].ValueBoolean == nil)
+	is.Equal(true, *rows[1].ValueBoolean)
+	is.Equal("https_recref.com_building_1.parquet", filepath.Base(path))
+}
+
+type appMock struct {
+	application.Application
+	observations []database.Observation
+}
+
+func (a *appMock) StreamObservations(ctx context.Context, filter database.ObservationFilter, fn func(deviceID string, o database.Observation) error) error {
+	for _, o := range a.observations {
+		if err := fn("device-1", o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
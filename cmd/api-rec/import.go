@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+)
+
+type columnFlags map[string]string
+
+func (c columnFlags) String() string {
+	return fmt.Sprint(map[string]string(c))
+}
+
+func (c columnFlags) Set(value string) error {
+	field, column, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected field=column but got %s", value)
+	}
+	c[field] = column
+	return nil
+}
+
+// runImport imports historical observations from a CSV file, e.g.
+// api-rec import -file readings.csv -column sensorId=meter -column observationTime=ts -dry-run
+func runImport(ctx context.Context, args []string) {
+	var file, deviceID, separator string
+	var dryRun bool
+	columns := columnFlags{}
+
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&file, "file", "", "A CSV file with observations to import")
+	flags.StringVar(&deviceID, "device", "", "Device id to use for rows without a device")
+	flags.StringVar(&separator, "separator", ",", "Column separator")
+	flags.BoolVar(&dryRun, "dry-run", false, "Parse and validate the file without storing anything")
+	flags.Var(columns, "column", "Maps an import field to a column in the file, as field=column (repeatable)")
+	flags.Parse(args)
+
+	if file == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		fatal(ctx, fmt.Sprintf("failed to open import file %s", file), err)
+	}
+	defer f.Close()
+
+	var db database.Database
+	if !dryRun {
+		db, err = database.Connect(ctx, database.LoadConfiguration(ctx))
+		if err != nil {
+			fatal(ctx, "connect failed", err)
+		}
+
+		err = db.Init(ctx)
+		if err != nil {
+			fatal(ctx, "init failed", err)
+		}
+	}
+
+	opts := application.ImportOptions{
+		Columns:  columns,
+		DeviceID: deviceID,
+		DryRun:   dryRun,
+		Progress: func(result application.ImportResult) {
+			fmt.Fprintf(os.Stderr, "read %d rows, skipped %d\n", result.Rows, result.Skipped)
+		},
+	}
+	opts.Separator, _ = utf8.DecodeRuneInString(separator)
+
+	cfg, err := application.LoadConfiguration(ctx)
+	if err != nil {
+		fatal(ctx, "invalid configuration", err)
+	}
+
+	app := application.New(db, cfg)
+
+	result, err := app.ImportObservations(ctx, f, opts)
+
+	for _, e := range result.Errors {
+		fmt.Fprintf(os.Stderr, "row %d: %s\n", e.Row, e.Message)
+	}
+
+	if err != nil {
+		fatal(ctx, "import failed", err)
+	}
+
+	verb := "imported"
+	if dryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(os.Stdout, "%s %d of %d rows, skipped %d\n", verb, result.Imported, result.Rows, result.Skipped)
+}
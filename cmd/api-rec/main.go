@@ -2,15 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
+	_ "time/tzdata" // time zones for energy reports, the container image may not have them
 
 	"github.com/diwise/api-rec/internal/pkg/application"
 	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/api-rec/internal/pkg/presentation/amqp"
 	"github.com/diwise/api-rec/internal/pkg/presentation/api"
+	"github.com/diwise/api-rec/internal/pkg/presentation/mqtt"
 	"github.com/diwise/service-chassis/pkg/infrastructure/buildinfo"
 	"github.com/diwise/service-chassis/pkg/infrastructure/env"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
@@ -23,13 +29,30 @@ import (
 const serviceName string = "api-rec"
 
 var recInputDataFile string
+var deduplicationFile string
+var reportingIntervalsFile string
+var qualityChecksFile string
 
 func main() {
 	serviceVersion := buildinfo.SourceVersion()
 	ctx, _, cleanup := o11y.Init(context.Background(), serviceName, serviceVersion)
 	defer cleanup()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			runImport(ctx, os.Args[2:])
+			return
+		case "export":
+			runExport(ctx, os.Args[2:])
+			return
+		}
+	}
+
 	flag.StringVar(&recInputDataFile, "input", "/opt/diwise/config/rec.csv", "A file containing a known REC structure (spaces, buildings, sensors...)")
+	flag.StringVar(&deduplicationFile, "deduplication", "/opt/diwise/config/deduplication.csv", "A file containing deduplication policies per quantityKind or sensor")
+	flag.StringVar(&reportingIntervalsFile, "reporting-intervals", "/opt/diwise/config/reporting-intervals.csv", "A file containing expected reporting intervals per quantityKind or sensor")
+	flag.StringVar(&qualityChecksFile, "quality-checks", "/opt/diwise/config/quality-checks.csv", "A file containing data quality checks per quantityKind or sensor")
 	flag.Parse()
 
 	db, err := database.Connect(ctx, database.LoadConfiguration(ctx))
@@ -57,20 +80,126 @@ func main() {
 		}()
 	}
 
-	app := application.New(db)
+	if _, err := os.Stat(deduplicationFile); err == nil {
+		func() {
+			f, err := os.Open(deduplicationFile)
+			if err != nil {
+				fatal(ctx, fmt.Sprintf("failed to open deduplication file %s", deduplicationFile), err)
+			}
+			defer f.Close()
+
+			err = db.LoadDeduplicationPolicies(ctx, f)
+			if err != nil {
+				fatal(ctx, "failed to load deduplication policies", err)
+			}
+		}()
+	}
+
+	cfg, err := application.LoadConfiguration(ctx)
+	if err != nil {
+		fatal(ctx, "invalid configuration", err)
+	}
+
+	app := application.New(db, cfg)
+
+	if _, err := os.Stat(reportingIntervalsFile); err == nil {
+		func() {
+			f, err := os.Open(reportingIntervalsFile)
+			if err != nil {
+				fatal(ctx, fmt.Sprintf("failed to open reporting intervals file %s", reportingIntervalsFile), err)
+			}
+			defer f.Close()
+
+			err = app.LoadReportingIntervals(ctx, f)
+			if err != nil {
+				fatal(ctx, "failed to load reporting intervals", err)
+			}
+		}()
+	}
+
+	if _, err := os.Stat(qualityChecksFile); err == nil {
+		func() {
+			f, err := os.Open(qualityChecksFile)
+			if err != nil {
+				fatal(ctx, fmt.Sprintf("failed to open quality checks file %s", qualityChecksFile), err)
+			}
+			defer f.Close()
+
+			err = app.LoadQualityChecks(ctx, f)
+			if err != nil {
+				fatal(ctx, "failed to load quality checks", err)
+			}
+		}()
+	}
+
+	app.Start(ctx)
+
+	mqttConfig := mqtt.LoadConfiguration(ctx)
+	var subscriber mqtt.Subscriber
+	if mqttConfig.Enabled() {
+		subscriber = mqtt.New(mqttConfig, app)
+		err = subscriber.Start(ctx)
+		if err != nil {
+			fatal(ctx, "failed to start mqtt subscriber", err)
+		}
+	}
+
+	amqpConfig := amqp.LoadConfiguration(ctx)
+	var consumer amqp.Consumer
+	if amqpConfig.Enabled() {
+		consumer = amqp.New(amqpConfig, app)
+		err = consumer.Start(ctx)
+		if err != nil {
+			fatal(ctx, "failed to start rabbitmq consumer", err)
+		}
+	}
 
 	router := chi.NewRouter()
 	router.Use(middleware.RequestID)
 	router.Use(middleware.RealIP)
 	router.Use(middleware.Recoverer)
-	router.Use(middleware.Timeout(10 * time.Second))
 
 	api.RegisterEndpoints(ctx, router, app)
 
 	servicePort := env.GetVariableOrDefault(ctx, "SERVICE_PORT", "8080")
-	err = http.ListenAndServe(":"+servicePort, router)
+	srv := &http.Server{
+		Addr:    ":" + servicePort,
+		Handler: router,
+	}
+
+	go func() {
+		err := srv.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal(ctx, "failed to start request router", err)
+		}
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+
+	logger := logging.GetFromContext(ctx)
+	logger.Info("shutting down, draining ingestion queue")
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	if subscriber != nil {
+		subscriber.Stop()
+	}
+
+	if consumer != nil {
+		consumer.Stop()
+	}
+
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		logger.Error("failed to shut down request router", "err", err.Error())
+	}
+
+	err = app.Shutdown(shutdownCtx)
 	if err != nil {
-		fatal(ctx, "failed to start request router", err)
+		logger.Error("failed to drain ingestion queue", "err", err.Error())
 	}
 }
 
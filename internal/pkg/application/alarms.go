@@ -0,0 +1,426 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/google/uuid"
+)
+
+var ErrInvalidRule = errors.New("invalid rule")
+var ErrAlarmStatus = errors.New("alarm status can not be changed")
+
+const ruleRefreshInterval = time.Minute
+
+// ruleMatcher is a rule with its root entity resolved to the sensors in its subtree
+type ruleMatcher struct {
+	database.Rule
+	filter   database.ObservationFilter
+	duration time.Duration
+}
+
+// evaluate reports whether the observation meets the condition of the rule. ok is false if the
+// observation has no value of the type that the condition compares with.
+func (r ruleMatcher) evaluate(o database.Observation) (met, ok bool) {
+	switch {
+	case r.Value != nil:
+		if o.Value == nil {
+			return false, false
+		}
+		switch r.Condition {
+		case database.RuleAbove:
+			return *o.Value > *r.Value, true
+		case database.RuleBelow:
+			return *o.Value < *r.Value, true
+		default:
+			return *o.Value == *r.Value, true
+		}
+	case r.ValueBoolean != nil:
+		if o.ValueBoolean == nil {
+			return false, false
+		}
+		return *o.ValueBoolean == *r.ValueBoolean, true
+	case r.ValueString != nil:
+		if o.ValueString == nil {
+			return false, false
+		}
+		return *o.ValueString == *r.ValueString, true
+	}
+
+	return false, false
+}
+
+type ruleSet struct {
+	mu       sync.RWMutex
+	matchers []ruleMatcher
+	reload   chan struct{}
+
+	// states are the rules and sensors that may have a rule state, so that observations that do not
+	// meet the condition of a rule only clear states that exist
+	states       map[string]struct{}
+	statesLoaded bool
+}
+
+func newRuleSet() *ruleSet {
+	return &ruleSet{
+		reload: make(chan struct{}, 1),
+		states: make(map[string]struct{}),
+	}
+}
+
+// loadStates adds the states stored by any instance. States that have been cleared by other instances
+// are kept until they are cleared here as well.
+func (rs *ruleSet) loadStates(states []database.RuleState) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, s := range states {
+		rs.states[s.RuleID+"/"+s.SensorId] = struct{}{}
+	}
+	rs.statesLoaded = true
+}
+
+func (rs *ruleSet) addState(ruleID, sensorID string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.states[ruleID+"/"+sensorID] = struct{}{}
+}
+
+func (rs *ruleSet) removeState(ruleID, sensorID string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	delete(rs.states, ruleID+"/"+sensorID)
+}
+
+// hasState reports whether a sensor may have a state for a rule. Until the stored states have been
+// loaded every sensor may have one.
+func (rs *ruleSet) hasState(ruleID, sensorID string) bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	_, ok := rs.states[ruleID+"/"+sensorID]
+	return ok || !rs.statesLoaded
+}
+
+func (rs *ruleSet) matching(o database.StoredObservation) []ruleMatcher {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	matchers := make([]ruleMatcher, 0)
+	for _, r := range rs.matchers {
+		if r.filter.Matches(o.DeviceID, o.Observation) {
+			matchers = append(matchers, r)
+		}
+	}
+	return matchers
+}
+
+func (rs *ruleSet) get(id string) (ruleMatcher, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, r := range rs.matchers {
+		if r.Id == id {
+			return r, true
+		}
+	}
+	return ruleMatcher{}, false
+}
+
+// AddRule validates and stores a new rule. ErrInvalidRule is returned if the rule has no quantity
+// kind, the condition and value do not match, the duration can not be parsed or the root entity
+// does not exist.
+func (a *app) AddRule(ctx context.Context, r database.Rule) (database.Rule, error) {
+	if r.QuantityKind == "" {
+		return database.Rule{}, fmt.Errorf("%w: quantityKind is required", ErrInvalidRule)
+	}
+	r.QuantityKind = NormaliseQuantityKind(r.QuantityKind)
+
+	values := 0
+	for _, set := range []bool{r.Value != nil, r.ValueString != nil, r.ValueBoolean != nil} {
+		if set {
+			values++
+		}
+	}
+
+	switch r.Condition {
+	case database.RuleAbove, database.RuleBelow:
+		if r.Value == nil || values != 1 {
+			return database.Rule{}, fmt.Errorf("%w: condition %s requires a numeric value", ErrInvalidRule, r.Condition)
+		}
+	case database.RuleEquals:
+		if values != 1 {
+			return database.Rule{}, fmt.Errorf("%w: condition %s requires exactly one of value, valueString or valueBoolean", ErrInvalidRule, r.Condition)
+		}
+	default:
+		return database.Rule{}, fmt.Errorf("%w: condition must be %s, %s or %s", ErrInvalidRule, database.RuleAbove, database.RuleBelow, database.RuleEquals)
+	}
+
+	if r.Duration != "" {
+		d, err := time.ParseDuration(r.Duration)
+		if err != nil || d < 0 {
+			return database.Rule{}, fmt.Errorf("%w: duration must be a positive duration, e.g. 10m", ErrInvalidRule)
+		}
+	}
+
+	if r.Root != nil {
+		if t := database.GetTypeFromTypeName(r.Root.Type); t != "" {
+			r.Root.Type = t
+		}
+
+		_, err := a.db.GetEntity(ctx, r.Root.Id, r.Root.Type)
+		if err != nil {
+			return database.Rule{}, fmt.Errorf("%w: root entity %s not found", ErrInvalidRule, r.Root.Id)
+		}
+	}
+
+	r.Id = uuid.NewString()
+	r.CreatedAt = time.Now().UTC()
+
+	err := a.db.AddRule(ctx, r)
+	if err != nil {
+		return database.Rule{}, err
+	}
+
+	signal(a.rules.reload)
+
+	return r, nil
+}
+
+func (a *app) GetRule(ctx context.Context, id string) (database.Rule, error) {
+	return a.db.GetRule(ctx, id)
+}
+
+func (a *app) GetRules(ctx context.Context, page, size int) (int64, []database.Rule, error) {
+	return a.db.GetRules(ctx, page, size)
+}
+
+// DeleteRule deletes a rule together with its alarms. ErrInvalidRule is returned for the built in rule
+// for stale sensors.
+func (a *app) DeleteRule(ctx context.Context, id string) error {
+	if id == database.StaleRuleID {
+		return fmt.Errorf("%w: the built in rule %s can not be deleted", ErrInvalidRule, id)
+	}
+
+	err := a.db.DeleteRule(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	signal(a.rules.reload)
+
+	return nil
+}
+
+func (a *app) GetAlarm(ctx context.Context, id int64) (database.Alarm, error) {
+	return a.db.GetAlarm(ctx, id)
+}
+
+func (a *app) GetAlarms(ctx context.Context, filter database.AlarmFilter, page, size int) (int64, []database.Alarm, error) {
+	return a.db.GetAlarms(ctx, filter, page, size)
+}
+
+// AcknowledgeAlarm acknowledges an open alarm. ErrAlarmStatus is returned if the alarm is not open.
+func (a *app) AcknowledgeAlarm(ctx context.Context, id int64) (database.Alarm, error) {
+	return a.changeAlarmStatus(ctx, id, database.AlarmAcknowledged, database.AlarmOpen)
+}
+
+// CloseAlarm closes an open or acknowledged alarm. ErrAlarmStatus is returned if the alarm is already
+// closed. A new alarm is opened if the sensor meets the condition of the rule again.
+func (a *app) CloseAlarm(ctx context.Context, id int64) (database.Alarm, error) {
+	alarm, err := a.changeAlarmStatus(ctx, id, database.AlarmClosed, database.AlarmOpen, database.AlarmAcknowledged)
+	if err != nil {
+		return database.Alarm{}, err
+	}
+
+	_, err = a.db.ClearRuleState(ctx, alarm.RuleID, alarm.SensorID, *alarm.ClosedAt)
+	if err != nil {
+		return database.Alarm{}, err
+	}
+
+	return alarm, nil
+}
+
+func (a *app) changeAlarmStatus(ctx context.Context, id int64, status string, from ...string) (database.Alarm, error) {
+	alarm, err := a.db.UpdateAlarmStatus(ctx, id, status, from, time.Now().UTC())
+	if errors.Is(err, database.ErrNotFound) {
+		existing, getErr := a.db.GetAlarm(ctx, id)
+		if getErr == nil {
+			return database.Alarm{}, fmt.Errorf("%w: alarm %d is %s", ErrAlarmStatus, id, existing.Status)
+		}
+	}
+
+	return alarm, err
+}
+
+// loadRules loads all rules and resolves their root entities to sensors, so that stored observations
+// can be matched without querying the database.
+func (a *app) loadRules(ctx context.Context) error {
+	const size = 100
+	matchers := make([]ruleMatcher, 0)
+
+	for page := 0; ; page++ {
+		total, rules, err := a.db.GetRules(ctx, page, size)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range rules {
+			m := ruleMatcher{
+				Rule:   r,
+				filter: database.ObservationFilter{QuantityKind: r.QuantityKind},
+			}
+
+			if r.Duration != "" {
+				m.duration, _ = time.ParseDuration(r.Duration)
+			}
+
+			if r.Root != nil {
+				m.filter.SensorIDs, err = a.resolveRoot(ctx, *r.Root)
+				if err != nil {
+					return err
+				}
+			}
+
+			matchers = append(matchers, m)
+		}
+
+		if int64((page+1)*size) >= total {
+			break
+		}
+	}
+
+	a.rules.mu.Lock()
+	a.rules.matchers = matchers
+	a.rules.mu.Unlock()
+
+	return nil
+}
+
+// refreshRules keeps the loaded rules up to date and opens alarms for sensors that have met the
+// condition of a rule for its duration, since sensors may only report when a value changes.
+func (a *app) refreshRules(ctx context.Context) {
+	log := logging.GetFromContext(ctx)
+
+	ticker := time.NewTicker(ruleRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		err := a.loadRules(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error("failed to load rules", "err", err.Error())
+		}
+
+		err = a.openDueAlarms(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error("failed to open alarms", "err", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.rules.reload:
+		}
+	}
+}
+
+func (a *app) openDueAlarms(ctx context.Context) error {
+	states, err := a.db.GetRuleStates(ctx)
+	if err != nil {
+		return err
+	}
+
+	a.rules.loadStates(states)
+
+	now := time.Now().UTC()
+
+	for _, s := range states {
+		r, ok := a.rules.get(s.RuleID)
+		if ok && now.Sub(s.Since) >= r.duration {
+			a.openAlarm(ctx, r, s)
+		}
+	}
+
+	return nil
+}
+
+// evaluateRules evaluates a stored observation against the rules for its sensor, opening an alarm
+// when the condition of a rule has been met for the duration of the rule and closing it, at the time of
+// the observation, when the condition is no longer met by an observation newer than those that met it.
+func (a *app) evaluateRules(ctx context.Context, o database.StoredObservation) {
+	log := logging.GetFromContext(ctx)
+
+	for _, r := range a.rules.matching(o) {
+		met, ok := r.evaluate(o.Observation)
+		if !ok {
+			continue
+		}
+
+		if !met {
+			if !a.rules.hasState(r.Id, o.SensorId) {
+				continue
+			}
+
+			// a late observation does not clear a state that a newer observation has met
+			cleared, err := a.db.ClearRuleState(ctx, r.Id, o.SensorId, o.ObservationTime.UTC())
+			if err != nil {
+				log.Error("failed to clear rule state", "rule_id", r.Id, "sensor_id", o.SensorId, "err", err.Error())
+				continue
+			}
+
+			if cleared {
+				a.rules.removeState(r.Id, o.SensorId)
+			}
+			continue
+		}
+
+		state, err := a.db.AddRuleState(ctx, database.RuleState{
+			RuleID:      r.Id,
+			DeviceID:    o.DeviceID,
+			Since:       o.ObservationTime,
+			Observation: o.Observation,
+		})
+		if err != nil {
+			log.Error("failed to add rule state", "rule_id", r.Id, "sensor_id", o.SensorId, "err", err.Error())
+			continue
+		}
+
+		a.rules.addState(r.Id, o.SensorId)
+
+		if o.ObservationTime.Sub(state.Since) >= r.duration {
+			a.openAlarm(ctx, r, state)
+		}
+	}
+}
+
+func (a *app) openAlarm(ctx context.Context, r ruleMatcher, s database.RuleState) {
+	log := logging.GetFromContext(ctx)
+
+	opened, err := a.db.OpenAlarm(ctx, database.Alarm{
+		RuleID:       r.Id,
+		SensorID:     s.SensorId,
+		DeviceID:     s.DeviceID,
+		QuantityKind: s.QuantityKind,
+		TriggeredAt:  s.Since,
+		Value:        s.Value,
+		ValueString:  s.ValueString,
+		ValueBoolean: s.ValueBoolean,
+		OpenedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		log.Error("failed to open alarm", "rule_id", r.Id, "sensor_id", s.SensorId, "err", err.Error())
+		return
+	}
+
+	if opened {
+		log.Info("alarm opened", "rule_id", r.Id, "rule_name", r.Name, "sensor_id", s.SensorId, "triggered_at", s.Since)
+	}
+}
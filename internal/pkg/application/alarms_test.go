@@ -0,0 +1,148 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestAddRuleIsValidated(t *testing.T) {
+	is := is.New(t)
+	a := New(&dbMock{}, NewConfig(false, ""))
+
+	value := 20.0
+	text := "open"
+
+	for _, r := range []database.Rule{
+		{Condition: database.RuleAbove, Value: &value},
+		{QuantityKind: "Temperature", Condition: "between", Value: &value},
+		{QuantityKind: "Temperature", Condition: database.RuleBelow, ValueString: &text},
+		{QuantityKind: "Temperature", Condition: database.RuleEquals, Value: &value, ValueString: &text},
+		{QuantityKind: "Temperature", Condition: database.RuleAbove, Value: &value, Duration: "ten minutes"},
+		{QuantityKind: "Temperature", Condition: database.RuleAbove, Value: &value, Root: &database.Property{Id: "building-1", Type: "building"}},
+	} {
+		_, err := a.AddRule(context.Background(), r)
+		is.True(errors.Is(err, ErrInvalidRule))
+	}
+}
+
+func TestRuleMatcherEvaluate(t *testing.T) {
+	is := is.New(t)
+
+	limit := 20.0
+	below, above := 19.5, 20.5
+	on, off := true, false
+
+	r := ruleMatcher{Rule: database.Rule{Condition: database.RuleAbove, Value: &limit}}
+
+	met, ok := r.evaluate(database.Observation{Value: &above})
+	is.True(ok)
+	is.True(met)
+
+	met, ok = r.evaluate(database.Observation{Value: &below})
+	is.True(ok)
+	is.True(!met)
+
+	_, ok = r.evaluate(database.Observation{ValueBoolean: &on})
+	is.True(!ok)
+
+	r = ruleMatcher{Rule: database.Rule{Condition: database.RuleEquals, ValueBoolean: &on}}
+
+	met, _ = r.evaluate(database.Observation{ValueBoolean: &on})
+	is.True(met)
+
+	met, _ = r.evaluate(database.Observation{ValueBoolean: &off})
+	is.True(!met)
+}
+
+func TestEvaluateRulesOpensAlarmAfterDuration(t *testing.T) {
+	is := is.New(t)
+	db := &dbMock{}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	limit := 20.0
+	a.rules.matchers = []ruleMatcher{
+		{
+			Rule:     database.Rule{Id: "too-warm", Condition: database.RuleAbove, Value: &limit},
+			filter:   database.ObservationFilter{QuantityKind: "Temperature"},
+			duration: 10 * time.Minute,
+		},
+	}
+
+	observation := func(id int64, value float64, at time.Time) database.StoredObservation {
+		o := storedObservation(id, "s1", "Temperature")
+		o.Value, o.ObservationTime = &value, at
+		return o
+	}
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	// an observation that does not meet the condition clears nothing when there is no state
+	a.rules.loadStates(nil)
+	a.evaluateRules(context.Background(), observation(0, 19, start.Add(-time.Minute)))
+	is.Equal(0, len(db.cleared))
+
+	a.evaluateRules(context.Background(), observation(1, 21, start))
+	a.evaluateRules(context.Background(), observation(2, 22, start.Add(5*time.Minute)))
+	is.Equal(0, len(db.alarms))
+
+	a.evaluateRules(context.Background(), observation(3, 23, start.Add(10*time.Minute)))
+	is.Equal(1, len(db.alarms))
+	is.Equal("s1", db.alarms[0].SensorID)
+	is.Equal(start, db.alarms[0].TriggeredAt)
+	is.Equal(21.0, *db.alarms[0].Value)
+
+	// a late observation that does not meet the condition does not clear a state met by newer observations
+	a.evaluateRules(context.Background(), observation(7, 19, start.Add(7*time.Minute)))
+	is.Equal(1, len(db.ruleStates))
+	is.Equal(0, len(db.cleared))
+
+	// an observation that does not meet the condition clears the state
+	a.evaluateRules(context.Background(), observation(4, 19, start.Add(15*time.Minute)))
+	is.Equal(0, len(db.ruleStates))
+	is.Equal([]string{"too-warm/s1"}, db.cleared)
+	is.Equal(start.Add(15*time.Minute), db.clearedAt)
+
+	a.evaluateRules(context.Background(), observation(5, 18, start.Add(20*time.Minute)))
+	is.Equal(1, len(db.cleared))
+
+	// observations of other quantity kinds are not evaluated
+	a.evaluateRules(context.Background(), storedObservation(6, "s1", "Humidity"))
+	is.Equal(1, len(db.cleared))
+}
+
+func (db *dbMock) AddRuleState(ctx context.Context, s database.RuleState) (database.RuleState, error) {
+	if db.ruleStates == nil {
+		db.ruleStates = make(map[string]database.RuleState)
+	}
+	existing, ok := db.ruleStates[s.RuleID+"/"+s.SensorId]
+	if ok {
+		if s.ObservationTime.After(existing.ObservationTime) {
+			existing.ObservationTime = s.ObservationTime
+			db.ruleStates[s.RuleID+"/"+s.SensorId] = existing
+		}
+		return existing, nil
+	}
+	db.ruleStates[s.RuleID+"/"+s.SensorId] = s
+	return s, nil
+}
+
+func (db *dbMock) ClearRuleState(ctx context.Context, ruleID, sensorID string, closedAt time.Time) (bool, error) {
+	s, ok := db.ruleStates[ruleID+"/"+sensorID]
+	if ok && !s.ObservationTime.Before(closedAt) {
+		return false, nil
+	}
+	delete(db.ruleStates, ruleID+"/"+sensorID)
+	db.cleared = append(db.cleared, ruleID+"/"+sensorID)
+	db.clearedAt = closedAt
+	return true, nil
+}
+
+func (db *dbMock) OpenAlarm(ctx context.Context, alarm database.Alarm) (bool, error) {
+	db.alarms = append(db.alarms, alarm)
+	return true, nil
+}
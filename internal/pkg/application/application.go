@@ -2,26 +2,193 @@ package application
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/env"
 )
 
+type Config struct {
+	autoRegisterSensors bool
+	unassignedSpaceID   string
+	eventRetention      time.Duration
+	timestampPolicy     TimestampPolicy
+
+	ingestionWorkers       int
+	ingestionQueueSize     int
+	ingestionBatchSize     int
+	ingestionFlushInterval time.Duration
+
+	webhookWorkers       int
+	webhookMaxAttempts   int
+	webhookRetryInterval time.Duration
+	webhookTimeout       time.Duration
+	deliveryRetention    time.Duration
+
+	reportingInterval time.Duration
+}
+
 type Application interface {
 	AddEntity(ctx context.Context, e database.Entity) error
 	GetEntity(ctx context.Context, entityID, entityType string) (database.Entity, error)
 	GetEntities(ctx context.Context, entityType string, page, size int) (int64, []database.Entity, error)
 	GetChildEntities(ctx context.Context, root database.Entity, entityType string) ([]database.Entity, error)
+	GetUnassignedSensors(ctx context.Context, page, size int) (int64, []database.Entity, error)
 	AddObservation(ctx context.Context, so database.SensorObservation) error
-	GetObservations(ctx context.Context, sensorId string, starting, ending time.Time, page, size int) (int64, []database.Observation, error)
+	ImportObservations(ctx context.Context, r io.Reader, opts ImportOptions) (ImportResult, error)
+	QueryObservations(ctx context.Context, filter database.ObservationFilter, page, size int) (int64, []database.Observation, error)
+	SetObservationQuality(ctx context.Context, q database.QualityOverride) (int64, error)
+	ResampleObservations(ctx context.Context, filter database.ObservationFilter, interval time.Duration, fill string) ([]database.Observation, error)
+	StreamObservations(ctx context.Context, filter database.ObservationFilter, fn func(deviceID string, o database.Observation) error) error
+	GetSensorIDs(ctx context.Context, root database.Entity) ([]string, error)
+	SubscribeObservations(filter database.ObservationFilter) (<-chan database.StoredObservation, func())
+	GetObservationsAfter(ctx context.Context, filter database.ObservationFilter, afterID int64, limit int) ([]database.StoredObservation, error)
+	HandleEvent(ctx context.Context, evt Event) error
+	StoreEvent(ctx context.Context, evt Event) error
+	HandleEvents(ctx context.Context, evts []Event) []EventResult
+	GetDeadLetter(ctx context.Context, id int64) (database.DeadLetter, error)
+	GetDeadLetters(ctx context.Context, page, size int) (int64, []database.DeadLetter, error)
+	ReplayDeadLetter(ctx context.Context, id int64) (database.DeadLetter, error)
+	AddSubscription(ctx context.Context, s database.Subscription) (database.Subscription, error)
+	GetSubscription(ctx context.Context, id string) (database.Subscription, error)
+	GetSubscriptions(ctx context.Context, page, size int) (int64, []database.Subscription, error)
+	DeleteSubscription(ctx context.Context, id string) error
+	GetDeliveries(ctx context.Context, subscriptionID string, page, size int) (int64, []database.Delivery, error)
+	AddRule(ctx context.Context, r database.Rule) (database.Rule, error)
+	GetRule(ctx context.Context, id string) (database.Rule, error)
+	GetRules(ctx context.Context, page, size int) (int64, []database.Rule, error)
+	DeleteRule(ctx context.Context, id string) error
+	GetAlarm(ctx context.Context, id int64) (database.Alarm, error)
+	GetAlarms(ctx context.Context, filter database.AlarmFilter, page, size int) (int64, []database.Alarm, error)
+	AcknowledgeAlarm(ctx context.Context, id int64) (database.Alarm, error)
+	CloseAlarm(ctx context.Context, id int64) (database.Alarm, error)
+	LoadReportingIntervals(ctx context.Context, reader io.Reader) error
+	LoadQualityChecks(ctx context.Context, reader io.Reader) error
+	GetSensorStatuses(ctx context.Context, filter database.SensorStatusFilter, page, size int) (int64, []database.SensorStatus, error)
+	GetObservationGaps(ctx context.Context, filter database.ObservationFilter) ([]database.ObservationGap, error)
+	GetBuildingEnergy(ctx context.Context, buildingID string, from, to time.Time, interval string, loc *time.Location) (EnergyReport, error)
+	GetOccupancy(ctx context.Context, filter database.ObservationFilter, interval string, loc *time.Location) (OccupancyReport, error)
+	AddVirtualSensor(ctx context.Context, v database.VirtualSensor) (database.VirtualSensor, error)
+	GetVirtualSensor(ctx context.Context, sensorID string) (database.VirtualSensor, error)
+	GetVirtualSensors(ctx context.Context, page, size int) (int64, []database.VirtualSensor, error)
+	DeleteVirtualSensor(ctx context.Context, sensorID string) error
+	AddCalibration(ctx context.Context, c database.Calibration) (database.Calibration, error)
+	GetCalibration(ctx context.Context, id int64) (database.Calibration, error)
+	GetCalibrations(ctx context.Context, sensorID string) ([]database.Calibration, error)
+	DeleteCalibration(ctx context.Context, id int64) error
+	Start(ctx context.Context)
+	Shutdown(ctx context.Context) error
 }
 
 type app struct {
-	db database.Database
+	db  database.Database
+	cfg Config
+
+	points *pointCache
+
+	lastEventPurge time.Time
+	eventPurgeMu   sync.Mutex
+
+	queue *ingestionQueue
+
+	hub      *observationHub
+	webhooks *webhooks
+	rules    *ruleSet
+
+	virtualSensors *virtualSensorSet
+	calibrations   *calibrationSet
+	quality        *qualityMonitor
+
+	intervals ReportingIntervals
+	monitor   *sensorMonitor
+
+	// stop stops listening for stored observations, delivering them to subscribers, evaluating rules and
+	// virtual sensors and monitoring sensors
+	stop context.CancelFunc
+}
+
+const (
+	defaultEventRetention         = 24 * time.Hour
+	defaultIngestionWorkers       = 4
+	defaultIngestionQueueSize     = 1000
+	defaultIngestionBatchSize     = 100
+	defaultIngestionFlushInterval = 500 * time.Millisecond
+	defaultWebhookWorkers         = 4
+	defaultWebhookMaxAttempts     = 10
+	defaultWebhookRetryInterval   = 10 * time.Second
+	defaultWebhookTimeout         = 10 * time.Second
+	defaultDeliveryRetention      = 7 * 24 * time.Hour
+	defaultReportingInterval      = 6 * time.Hour
+)
+
+// LoadConfiguration reads the configuration from the environment. An error is returned if
+// MISSING_TIMESTAMP_POLICY is not a known policy.
+func LoadConfiguration(ctx context.Context) (Config, error) {
+	timestampPolicy := TimestampPolicy(env.GetVariableOrDefault(ctx, "MISSING_TIMESTAMP_POLICY", string(TimestampPolicyReceived)))
+	if timestampPolicy != TimestampPolicyReceived && timestampPolicy != TimestampPolicyReject {
+		return Config{}, fmt.Errorf("unknown MISSING_TIMESTAMP_POLICY %s, must be %s or %s", timestampPolicy, TimestampPolicyReceived, TimestampPolicyReject)
+	}
+
+	return Config{
+		autoRegisterSensors:    env.GetVariableOrDefault(ctx, "AUTO_REGISTER_SENSORS", "false") == "true",
+		unassignedSpaceID:      env.GetVariableOrDefault(ctx, "UNASSIGNED_SPACE_ID", ""),
+		eventRetention:         getDurationOrDefault(ctx, "EVENT_RETENTION", defaultEventRetention),
+		timestampPolicy:        timestampPolicy,
+		ingestionWorkers:       getIntOrDefault(ctx, "INGESTION_WORKERS", defaultIngestionWorkers),
+		ingestionQueueSize:     getIntOrDefault(ctx, "INGESTION_QUEUE_SIZE", defaultIngestionQueueSize),
+		ingestionBatchSize:     getIntOrDefault(ctx, "INGESTION_BATCH_SIZE", defaultIngestionBatchSize),
+		ingestionFlushInterval: getDurationOrDefault(ctx, "INGESTION_FLUSH_INTERVAL", defaultIngestionFlushInterval),
+		webhookWorkers:         getIntOrDefault(ctx, "WEBHOOK_WORKERS", defaultWebhookWorkers),
+		webhookMaxAttempts:     getIntOrDefault(ctx, "WEBHOOK_MAX_ATTEMPTS", defaultWebhookMaxAttempts),
+		webhookRetryInterval:   getDurationOrDefault(ctx, "WEBHOOK_RETRY_INTERVAL", defaultWebhookRetryInterval),
+		webhookTimeout:         getDurationOrDefault(ctx, "WEBHOOK_TIMEOUT", defaultWebhookTimeout),
+		deliveryRetention:      getDurationOrDefault(ctx, "WEBHOOK_DELIVERY_RETENTION", defaultDeliveryRetention),
+		reportingInterval:      getDurationOrDefault(ctx, "REPORTING_INTERVAL", defaultReportingInterval),
+	}, nil
+}
+
+func NewConfig(autoRegisterSensors bool, unassignedSpaceID string) Config {
+	return Config{
+		autoRegisterSensors:    autoRegisterSensors,
+		unassignedSpaceID:      unassignedSpaceID,
+		eventRetention:         defaultEventRetention,
+		timestampPolicy:        TimestampPolicyReceived,
+		ingestionWorkers:       defaultIngestionWorkers,
+		ingestionQueueSize:     defaultIngestionQueueSize,
+		ingestionBatchSize:     defaultIngestionBatchSize,
+		ingestionFlushInterval: defaultIngestionFlushInterval,
+		webhookWorkers:         defaultWebhookWorkers,
+		webhookMaxAttempts:     defaultWebhookMaxAttempts,
+		webhookRetryInterval:   defaultWebhookRetryInterval,
+		webhookTimeout:         defaultWebhookTimeout,
+		deliveryRetention:      defaultDeliveryRetention,
+		reportingInterval:      defaultReportingInterval,
+	}
+}
+
+func getIntOrDefault(ctx context.Context, envVar string, defaultValue int) int {
+	v, err := strconv.Atoi(env.GetVariableOrDefault(ctx, envVar, strconv.Itoa(defaultValue)))
+	if err != nil || v <= 0 {
+		return defaultValue
+	}
+	return v
+}
+
+func getDurationOrDefault(ctx context.Context, envVar string, defaultValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(env.GetVariableOrDefault(ctx, envVar, defaultValue.String()))
+	if err != nil || d <= 0 {
+		return defaultValue
+	}
+	return d
 }
 
 func (a *app) AddEntity(ctx context.Context, e database.Entity) error {
-	return a.db.AddEntity(ctx, e)
+	return a.addEntity(ctx, e)
 }
 
 func (a *app) GetEntity(ctx context.Context, entityID string, entityType string) (database.Entity, error) {
@@ -36,16 +203,224 @@ func (a *app) GetChildEntities(ctx context.Context, root database.Entity, entity
 	return a.db.GetChildEntities(ctx, root, entityType)
 }
 
+func (a *app) GetUnassignedSensors(ctx context.Context, page, size int) (int64, []database.Entity, error) {
+	return a.db.GetUnassignedSensors(ctx, a.cfg.unassignedSpaceID, page, size)
+}
+
 func (a *app) AddObservation(ctx context.Context, so database.SensorObservation) error {
+	err := a.prepareObservation(ctx, so)
+	if err != nil {
+		return err
+	}
+
 	return a.db.AddObservation(ctx, so)
 }
 
-func (a *app) GetObservations(ctx context.Context, sensorId string, starting time.Time, ending time.Time, page int, size int) (int64, []database.Observation, error) {
-	return a.db.GetObservations(ctx, sensorId, starting, ending, page, size)
+// prepareObservation registers the device of a sensor observation, and calibrates and checks the
+// quality of its observations, before it is stored. Every ingestion path uses it so that none of
+// the steps is missed. The observations are prepared even if the device could not be registered,
+// since some callers store the observation anyway.
+func (a *app) prepareObservation(ctx context.Context, so database.SensorObservation) error {
+	err := a.registerDevice(ctx, so)
+
+	a.calibrate(so)
+	a.checkQuality(so)
+
+	return err
+}
+
+// registerDevice makes sure a device entity exists for the observed device and that it hosts
+// every observed sensor. Sensors that are not yet known are created if auto registration is
+// enabled, otherwise they are left out of the relation.
+func (a *app) registerDevice(ctx context.Context, so database.SensorObservation) error {
+	if so.DeviceID == "" {
+		return nil
+	}
+
+	points := make([]database.Property, 0)
+
+	for _, o := range so.Observations {
+		if known, unregistered := a.points.get(so.DeviceID, o.SensorId); known || unregistered {
+			continue
+		}
+
+		if _, err := a.db.GetEntity(ctx, o.SensorId, database.SensorType); err != nil {
+			if !a.cfg.autoRegisterSensors {
+				if errors.Is(err, database.ErrNotFound) {
+					a.points.addUnregistered(o.SensorId)
+				}
+				continue
+			}
+
+			err = a.registerSensor(ctx, o.SensorId)
+			if err != nil {
+				return err
+			}
+		}
+
+		points = append(points, database.Property{Id: o.SensorId, Type: database.SensorType})
+	}
+
+	if len(points) == 0 {
+		return nil
+	}
+
+	err := a.addEntity(ctx, database.Entity{
+		Context:  database.DeviceContext,
+		Id:       so.DeviceID,
+		Type:     database.DeviceType,
+		HasPoint: points,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range points {
+		a.points.add(so.DeviceID, p.Id)
+	}
+
+	return nil
+}
+
+const (
+	maxCachedPoints = 100000
+	// knownPointTTL is how long a device/sensor pair is known to be related, so that relations
+	// changed by other means are eventually registered again
+	knownPointTTL = time.Hour
+	// unregisteredSensorTTL is how long a sensor is known not to be registered before it is looked up again
+	unregisteredSensorTTL = 5 * time.Minute
+)
+
+// pointCache keeps track of device/sensor pairs known to be related, and of sensors known not to be
+// registered, so that the device of every observation does not have to be looked up. Entries expire
+// and expired entries are removed when the cache is full. If it is still full it is cleared.
+type pointCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newPointCache() *pointCache {
+	return &pointCache{
+		entries: make(map[string]time.Time),
+	}
+}
+
+// get reports whether the device and sensor are known to be related and whether the sensor is known
+// not to be registered.
+func (pc *pointCache) get(deviceID, sensorID string) (bool, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	now := time.Now()
+
+	if expires, ok := pc.entries[deviceID+"/"+sensorID]; ok && now.Before(expires) {
+		return true, false
+	}
+
+	expires, ok := pc.entries["/"+sensorID]
+	return false, ok && now.Before(expires)
+}
+
+func (pc *pointCache) add(deviceID, sensorID string) {
+	pc.put(deviceID+"/"+sensorID, knownPointTTL)
+}
+
+func (pc *pointCache) addUnregistered(sensorID string) {
+	pc.put("/"+sensorID, unregisteredSensorTTL)
 }
 
-func New(db database.Database) Application {
+func (pc *pointCache) put(key string, ttl time.Duration) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	now := time.Now()
+
+	if len(pc.entries) >= maxCachedPoints {
+		for k, expires := range pc.entries {
+			if !now.Before(expires) {
+				delete(pc.entries, k)
+			}
+		}
+
+		if len(pc.entries) >= maxCachedPoints {
+			pc.entries = make(map[string]time.Time)
+		}
+	}
+
+	pc.entries[key] = now.Add(ttl)
+}
+
+// registerSensor creates a sensor entity, part of the space for unassigned sensors if configured.
+func (a *app) registerSensor(ctx context.Context, sensorID string) error {
+	sensor := database.Entity{
+		Context: database.SensorContext,
+		Id:      sensorID,
+		Type:    database.SensorType,
+	}
+
+	if a.cfg.unassignedSpaceID != "" {
+		err := a.addEntity(ctx, database.Entity{
+			Context: database.SpaceContext,
+			Id:      a.cfg.unassignedSpaceID,
+			Type:    database.SpaceType,
+		})
+		if err != nil {
+			return err
+		}
+
+		sensor.IsPartOf = &database.Property{
+			Id:   a.cfg.unassignedSpaceID,
+			Type: database.SpaceType,
+		}
+	}
+
+	return a.addEntity(ctx, sensor)
+}
+
+func (a *app) QueryObservations(ctx context.Context, filter database.ObservationFilter, page, size int) (int64, []database.Observation, error) {
+	return a.db.QueryObservations(ctx, filter, page, size)
+}
+
+func (a *app) StreamObservations(ctx context.Context, filter database.ObservationFilter, fn func(deviceID string, o database.Observation) error) error {
+	return a.db.StreamObservations(ctx, filter, fn)
+}
+
+// GetSensorIDs returns the ids of all sensors in the subtree of root, or the id of root itself if it is a sensor.
+func (a *app) GetSensorIDs(ctx context.Context, root database.Entity) ([]string, error) {
+	if root.Type == database.SensorType {
+		return []string{root.Id}, nil
+	}
+
+	sensors, err := a.db.GetChildEntities(ctx, root, database.SensorType)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(sensors))
+	for _, s := range sensors {
+		ids = append(ids, s.Id)
+	}
+
+	return ids, nil
+}
+
+func New(db database.Database, cfg Config) Application {
 	return &app{
-		db: db,
+		db:     db,
+		cfg:    cfg,
+		points: newPointCache(),
+		queue: &ingestionQueue{
+			items: make(chan ingestionItem, cfg.ingestionQueueSize),
+		},
+		hub:      newObservationHub(),
+		webhooks: newWebhooks(),
+		rules:    newRuleSet(),
+
+		virtualSensors: newVirtualSensorSet(),
+		calibrations:   newCalibrationSet(),
+		quality:        newQualityMonitor(),
+
+		intervals: NewReportingIntervals(cfg.reportingInterval),
+		monitor:   &sensorMonitor{},
 	}
 }
@@ -1,9 +1,14 @@
 package application
 
 import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
 	"github.com/farshidtz/senml/v2"
 	"github.com/google/uuid"
 	"github.com/matryer/is"
@@ -51,8 +56,338 @@ func TestFunctionUpdated(t *testing.T) {
 		},
 	}
 
-	so, ok := fu.MapToObservation()
+	so, ok := fu.MapToObservation(time.Time{})
 
 	is.True(ok)
 	is.Equal(12.3, *so.Observations[0].Value)
 }
+
+func TestFunctionUpdatedLevelOffset(t *testing.T) {
+	is := is.New(t)
+
+	a := New(nil, NewConfig(false, "")).(*app)
+
+	so, err := a.mapEvent(Event{
+		Type: FunctionUpdatedName,
+		Time: time.Now(),
+		Data: []byte(`{"id":"fn","type":"level","level":{"current":1.5,"offset":0.25}}`),
+	})
+	is.NoErr(err)
+	is.Equal(1.75, *so.Observations[0].Value)
+	is.Equal(1.5, *so.Observations[0].RawValue)
+
+	so, err = a.mapEvent(Event{
+		Type: FunctionUpdatedName,
+		Time: time.Now(),
+		Data: []byte(`{"id":"fn","type":"level","level":{"current":1.5}}`),
+	})
+	is.NoErr(err)
+	is.Equal(1.5, *so.Observations[0].Value)
+	is.True(so.Observations[0].RawValue == nil)
+}
+
+func TestFunctionUpdatedObservationTime(t *testing.T) {
+	is := is.New(t)
+
+	eventTime := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	fu := FunctionUpdated{
+		Id:      uuid.NewString(),
+		Type:    "level",
+		SubType: "sand",
+		Level: &struct {
+			Current float64  `json:"current"`
+			Percent *float64 `json:"percent,omitempty"`
+			Offset  *float64 `json:"offset,omitempty"`
+		}{
+			Current: 1.5,
+		},
+	}
+
+	so, ok := fu.MapToObservation(eventTime)
+	is.True(ok)
+	is.Equal(eventTime, so.Observations[0].ObservationTime)
+
+	payloadTime := eventTime.Add(-1 * time.Hour)
+	fu.Timestamp = &payloadTime
+
+	so, ok = fu.MapToObservation(eventTime)
+	is.True(ok)
+	is.Equal(payloadTime, so.Observations[0].ObservationTime)
+
+	fu.Timestamp = nil
+
+	_, ok = fu.MapToObservation(time.Time{})
+	is.True(!ok)
+}
+
+func TestTimestampPolicy(t *testing.T) {
+	is := is.New(t)
+
+	eventTime := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	received := eventTime.Add(5 * time.Minute)
+
+	is.Equal(eventTime, TimestampPolicyReceived.Fallback(eventTime, received))
+	is.Equal(eventTime, TimestampPolicyReject.Fallback(eventTime, received))
+	is.Equal(received, TimestampPolicyReceived.Fallback(time.Time{}, received))
+	is.True(TimestampPolicyReject.Fallback(time.Time{}, received).IsZero())
+}
+
+func TestLoadConfigurationValidatesTimestampPolicy(t *testing.T) {
+	is := is.New(t)
+
+	t.Setenv("MISSING_TIMESTAMP_POLICY", "reject")
+	cfg, err := LoadConfiguration(context.Background())
+	is.NoErr(err)
+	is.Equal(TimestampPolicyReject, cfg.timestampPolicy)
+
+	t.Setenv("MISSING_TIMESTAMP_POLICY", "rejct")
+	_, err = LoadConfiguration(context.Background())
+	is.True(err != nil)
+}
+
+func TestEnqueueBackpressure(t *testing.T) {
+	is := is.New(t)
+
+	a := New(nil, Config{ingestionQueueSize: 1}).(*app)
+
+	item := ingestionItem{so: database.SensorObservation{DeviceID: uuid.NewString()}}
+
+	is.NoErr(a.enqueue(item))
+	is.Equal(ErrQueueFull, a.enqueue(item))
+}
+
+func TestEnqueueAfterShutdown(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	a := New(nil, Config{ingestionQueueSize: 1}).(*app)
+
+	is.NoErr(a.Shutdown(ctx))
+	is.Equal(ErrQueueClosed, a.enqueue(ingestionItem{}))
+}
+
+func TestMapEvent(t *testing.T) {
+	is := is.New(t)
+
+	a := New(nil, NewConfig(false, "")).(*app)
+
+	_, err := a.mapEvent(Event{Type: "unknown", Data: []byte("{}")})
+	is.True(errors.Is(err, ErrUnmappableEvent))
+
+	_, err = a.mapEvent(Event{Type: MessageAcceptedName, Data: []byte("not json")})
+	is.True(errors.Is(err, ErrUnmappableEvent))
+
+	_, err = a.mapEvent(Event{Type: MessageAcceptedName, Data: []byte(`{"sensorID":"sensor","pack":[]}`)})
+	is.True(errors.Is(err, ErrUnmappableEvent))
+
+	eventTime := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	so, err := a.mapEvent(Event{
+		Type:     FunctionUpdatedName,
+		Time:     eventTime,
+		Received: eventTime.Add(1 * time.Minute),
+		Data:     []byte(`{"id":"fn","type":"presence","subType":"lifebuoy","presence":{"state":true}}`),
+	})
+	is.NoErr(err)
+	is.Equal(eventTime, so.Observations[0].ObservationTime)
+	is.Equal("diwise:Lifebuoy", so.Observations[0].QuantityKind)
+}
+
+func TestMapEventRejectsFunctionsWithoutPayload(t *testing.T) {
+	a := New(nil, NewConfig(false, "")).(*app)
+
+	for _, data := range []string{
+		`{"id":"fn","type":"building"}`,
+		`{"id":"fn","type":"counter"}`,
+		`{"id":"fn","type":"level"}`,
+		`{"id":"fn","type":"presence"}`,
+		`{"id":"fn","type":"timer"}`,
+		`{"id":"fn","type":"timer","timer":{"startTime":"2023-10-01T12:00:00Z","state":false}}`,
+		`{"id":"fn","type":"waterquality"}`,
+	} {
+		t.Run(data, func(t *testing.T) {
+			is := is.New(t)
+
+			_, err := a.mapEvent(Event{Type: FunctionUpdatedName, Time: time.Now(), Data: []byte(data)})
+			is.True(errors.Is(err, ErrUnmappableEvent))
+		})
+	}
+}
+
+func TestHandleEventClaimsEventBeforeQueueing(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db := &dbMock{processed: map[string]bool{}}
+	a := New(db, Config{ingestionQueueSize: 1, eventRetention: time.Hour}).(*app)
+
+	evt := func(id string) Event {
+		return Event{
+			ID:     id,
+			Source: "source",
+			Type:   FunctionUpdatedName,
+			Time:   time.Now(),
+			Data:   []byte(`{"id":"fn","type":"presence","presence":{"state":true}}`),
+		}
+	}
+
+	is.NoErr(a.HandleEvent(ctx, evt("1")))
+	is.Equal(ErrEventProcessed, a.HandleEvent(ctx, evt("1")))
+
+	// the queue is full, so the claim is released and the event is handled again when it is redelivered
+	is.Equal(ErrQueueFull, a.HandleEvent(ctx, evt("2")))
+	is.Equal(ErrQueueFull, a.HandleEvent(ctx, evt("2")))
+	is.True(!db.processed["source/2"])
+}
+
+func TestHandleEventsCalibratesAndChecksObservations(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db := &dbMock{processed: map[string]bool{}}
+	a := New(db, Config{eventRetention: time.Hour}).(*app)
+	a.calibrations.set([]database.Calibration{
+		{SensorID: "fn", QuantityKind: "diwise:Level", Offset: 0.5, EffectiveFrom: time.Now().Add(-time.Hour)},
+	})
+
+	checks, err := readQualityChecks(strings.NewReader("quantityKind;sensorId;min;max;maxRate;outlierDeviations\ndiwise:Level;;0;1.8;;\n"))
+	is.NoErr(err)
+	a.quality.checks = checks
+
+	results := a.HandleEvents(ctx, []Event{{
+		ID:     "1",
+		Source: "source",
+		Type:   FunctionUpdatedName,
+		Time:   time.Now(),
+		Data:   []byte(`{"id":"fn","type":"level","level":{"current":1.5}}`),
+	}})
+
+	is.Equal(EventStored, results[0].Status)
+	is.Equal(1, len(db.stored))
+	is.Equal(2.0, *db.stored[0].Observations[0].Value)
+	is.Equal(1.5, *db.stored[0].Observations[0].RawValue)
+
+	// the quality is checked on the calibrated value
+	is.Equal(database.QualityBad, db.stored[0].Observations[0].Quality)
+	is.Equal(database.QualityReasonRange, db.stored[0].Observations[0].QualityReason)
+}
+
+func (db *dbMock) AddObservations(ctx context.Context, sos []database.SensorObservation) error {
+	db.stored = append(db.stored, sos...)
+	return nil
+}
+
+func (db *dbMock) AddProcessedEvent(ctx context.Context, source, eventID string, since time.Time) (bool, error) {
+	if db.processed[source+"/"+eventID] {
+		return false, nil
+	}
+	db.processed[source+"/"+eventID] = true
+	return true, nil
+}
+
+func (db *dbMock) DeleteProcessedEvent(ctx context.Context, source, eventID string) error {
+	delete(db.processed, source+"/"+eventID)
+	return nil
+}
+
+func (db *dbMock) DeleteProcessedEvents(ctx context.Context, before time.Time) error {
+	return nil
+}
+
+func TestReplayDeadLetterStoresEventOnce(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	data := `{"id":"fn","type":"presence","presence":{"state":true}}`
+	now := time.Now()
+	db := &dbMock{
+		processed: map[string]bool{"source/2": true},
+		deadLetters: []database.DeadLetter{
+			{Id: 1, EventID: "1", Source: "source", EventType: FunctionUpdatedName, EventTime: &now, Data: data},
+			{Id: 2, EventID: "2", Source: "source", EventType: FunctionUpdatedName, EventTime: &now, Data: data},
+			{Id: 3, EventID: "3", Source: "source", EventType: FunctionUpdatedName, EventTime: &now, Data: `{"id":"fn","type":"presence"}`},
+		},
+	}
+	a := New(db, Config{eventRetention: time.Hour}).(*app)
+
+	dl, err := a.ReplayDeadLetter(ctx, 1)
+	is.NoErr(err)
+	is.True(dl.ReplayedAt != nil)
+	is.Equal(1, len(db.stored))
+	is.True(db.processed["source/1"])
+
+	_, err = a.ReplayDeadLetter(ctx, 1)
+	is.True(errors.Is(err, ErrDeadLetterReplayed))
+	is.Equal(1, len(db.stored))
+
+	// the event has been stored by a redelivery since it was dead lettered
+	_, err = a.ReplayDeadLetter(ctx, 2)
+	is.True(errors.Is(err, ErrEventProcessed))
+	is.Equal(1, len(db.stored))
+
+	// a failed replay releases the event so that it can be replayed again
+	dl, err = a.ReplayDeadLetter(ctx, 3)
+	is.True(errors.Is(err, ErrUnmappableEvent))
+	is.True(dl.ReplayedAt == nil)
+	is.True(!db.processed["source/3"])
+}
+
+func (db *dbMock) GetDeadLetter(ctx context.Context, id int64) (database.DeadLetter, error) {
+	for _, dl := range db.deadLetters {
+		if dl.Id == id {
+			return dl, nil
+		}
+	}
+	return database.DeadLetter{}, database.ErrNotFound
+}
+
+func (db *dbMock) UpdateDeadLetter(ctx context.Context, id int64, reason string, replayedAt *time.Time) error {
+	for i := range db.deadLetters {
+		if db.deadLetters[i].Id == id {
+			db.deadLetters[i].Reason, db.deadLetters[i].ReplayedAt = reason, replayedAt
+		}
+	}
+	return nil
+}
+
+func (db *dbMock) AddDeadLetter(ctx context.Context, dl database.DeadLetter) error {
+	db.deadLetters = append(db.deadLetters, dl)
+	return nil
+}
+
+func TestRegisterDeviceCachesLookups(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	db := &dbMock{entities: map[string]database.Entity{
+		database.SensorType + "/sensor-1": {Id: "sensor-1", Type: database.SensorType},
+	}}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	so := func(sensorID string) database.SensorObservation {
+		return database.SensorObservation{DeviceID: "device-1", Observations: []database.Observation{{SensorId: sensorID}}}
+	}
+
+	is.NoErr(a.registerDevice(ctx, so("sensor-1")))
+	lookups := db.lookups
+	is.NoErr(a.registerDevice(ctx, so("sensor-1")))
+	is.Equal(lookups, db.lookups)
+
+	// a sensor that is not registered is not looked up again until the entry expires
+	is.NoErr(a.registerDevice(ctx, so("sensor-2")))
+	is.Equal(lookups+1, db.lookups)
+	is.NoErr(a.registerDevice(ctx, so("sensor-2")))
+	is.Equal(lookups+1, db.lookups)
+}
+
+func TestPointCacheIsBounded(t *testing.T) {
+	is := is.New(t)
+
+	pc := newPointCache()
+	for i := 0; i < maxCachedPoints+1; i++ {
+		pc.addUnregistered(strconv.Itoa(i))
+	}
+
+	is.True(len(pc.entries) <= maxCachedPoints)
+	_, unregistered := pc.get("device", strconv.Itoa(maxCachedPoints))
+	is.True(unregistered)
+}
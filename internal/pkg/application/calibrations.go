@@ -0,0 +1,269 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+var ErrInvalidCalibration = errors.New("invalid calibration")
+
+const calibrationRefreshInterval = time.Minute
+
+// recalibrationDelay is how long after a change of calibrations the stored observations are
+// recalibrated again, by when every instance has loaded the change and stored the observations it
+// calibrated before that.
+const recalibrationDelay = 2 * calibrationRefreshInterval
+
+// calibrationSet holds the calibrations per sensor and quantity kind, ordered by the time they are
+// effective from.
+type calibrationSet struct {
+	mu     sync.RWMutex
+	series map[string][]database.Calibration
+}
+
+func newCalibrationSet() *calibrationSet {
+	return &calibrationSet{
+		series: make(map[string][]database.Calibration),
+	}
+}
+
+func (cs *calibrationSet) set(calibrations []database.Calibration) {
+	series := make(map[string][]database.Calibration)
+	for _, c := range calibrations {
+		key := c.SensorID + "/" + c.QuantityKind
+		series[key] = append(series[key], c)
+	}
+
+	for _, s := range series {
+		sort.Slice(s, func(i, j int) bool { return s[i].EffectiveFrom.Before(s[j].EffectiveFrom) })
+	}
+
+	cs.mu.Lock()
+	cs.series = series
+	cs.mu.Unlock()
+}
+
+// get returns the calibration that is effective for an observation, if any.
+func (cs *calibrationSet) get(o database.Observation) (database.Calibration, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	s := cs.series[o.SensorId+"/"+o.QuantityKind]
+
+	i := sort.Search(len(s), func(i int) bool { return s[i].EffectiveFrom.After(o.ObservationTime) })
+	if i == 0 {
+		return database.Calibration{}, false
+	}
+
+	return s[i-1], true
+}
+
+// apply corrects the value of the observation with the calibration that is effective for it, keeping
+// the raw value. The observation is left without a value if the corrected value is outside the valid
+// range of the calibration.
+func (cs *calibrationSet) apply(o *database.Observation) {
+	raw := o.RawValue
+	if raw == nil {
+		raw = o.Value
+	}
+	if raw == nil {
+		return
+	}
+
+	c, ok := cs.get(*o)
+	if !ok {
+		return
+	}
+
+	o.RawValue = raw
+	o.Value = c.Apply(*raw)
+}
+
+// calibrate applies calibrations to the observations of a sensor observation.
+func (a *app) calibrate(so database.SensorObservation) {
+	for i := range so.Observations {
+		a.calibrations.apply(&so.Observations[i])
+	}
+}
+
+// AddCalibration validates and stores a calibration, replacing a calibration of the same sensor and
+// quantity kind that is effective from the same time, and recalibrates the stored observations it
+// applies to. The calibration is effective from now if no time is given. ErrInvalidCalibration is
+// returned if the calibration is not valid.
+func (a *app) AddCalibration(ctx context.Context, c database.Calibration) (database.Calibration, error) {
+	if c.SensorID == "" || c.QuantityKind == "" {
+		return database.Calibration{}, fmt.Errorf("%w: sensorId and quantityKind are required", ErrInvalidCalibration)
+	}
+	c.QuantityKind = NormaliseQuantityKind(c.QuantityKind)
+
+	if c.Scale == nil {
+		scale := 1.0
+		c.Scale = &scale
+	} else if *c.Scale == 0 {
+		return database.Calibration{}, fmt.Errorf("%w: scale can not be 0", ErrInvalidCalibration)
+	}
+
+	if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+		return database.Calibration{}, fmt.Errorf("%w: min can not be greater than max", ErrInvalidCalibration)
+	}
+
+	c.CreatedAt = time.Now().UTC()
+	if c.EffectiveFrom.IsZero() {
+		c.EffectiveFrom = c.CreatedAt
+	}
+	c.EffectiveFrom = c.EffectiveFrom.UTC()
+
+	c, err := a.db.AddCalibration(ctx, c)
+	if err != nil {
+		return database.Calibration{}, err
+	}
+
+	err = a.loadCalibrations(ctx)
+	if err != nil {
+		return database.Calibration{}, err
+	}
+
+	err = a.recalibrate(ctx, c)
+	if err != nil {
+		return database.Calibration{}, err
+	}
+
+	a.recalibrateLater(ctx, c.SensorID, c.QuantityKind, c.EffectiveFrom)
+
+	return c, nil
+}
+
+func (a *app) GetCalibration(ctx context.Context, id int64) (database.Calibration, error) {
+	return a.db.GetCalibration(ctx, id)
+}
+
+func (a *app) GetCalibrations(ctx context.Context, sensorID string) ([]database.Calibration, error) {
+	return a.db.GetCalibrations(ctx, sensorID)
+}
+
+// DeleteCalibration deletes a calibration and recalibrates the stored observations it applied to with
+// the calibration before it, or restores their raw values if there is none.
+func (a *app) DeleteCalibration(ctx context.Context, id int64) error {
+	deleted, err := a.db.DeleteCalibration(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = a.loadCalibrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	previous, ok := a.calibrations.get(database.Observation{
+		SensorId:        deleted.SensorID,
+		QuantityKind:    deleted.QuantityKind,
+		ObservationTime: deleted.EffectiveFrom.Add(-time.Microsecond),
+	})
+	if !ok {
+		previous = database.Calibration{SensorID: deleted.SensorID, QuantityKind: deleted.QuantityKind}
+	}
+	previous.EffectiveFrom = deleted.EffectiveFrom
+
+	err = a.recalibrate(ctx, previous)
+	if err != nil {
+		return err
+	}
+
+	a.recalibrateLater(ctx, deleted.SensorID, deleted.QuantityKind, deleted.EffectiveFrom)
+
+	return nil
+}
+
+// recalibrateLater recalibrates the stored observations of a sensor and quantity kind from a time
+// again after recalibrationDelay, since other instances store observations with the calibrations
+// they have loaded until they refresh them.
+func (a *app) recalibrateLater(ctx context.Context, sensorID, quantityKind string, from time.Time) {
+	ctx = context.WithoutCancel(ctx)
+
+	time.AfterFunc(recalibrationDelay, func() {
+		err := a.recalibrateFrom(ctx, sensorID, quantityKind, from)
+		if err != nil {
+			logging.GetFromContext(ctx).Error("failed to recalibrate observations", "sensor_id", sensorID, "quantity_kind", quantityKind, "err", err.Error())
+		}
+	})
+}
+
+// recalibrateFrom applies the calibration that is effective at a time, or none, to the stored
+// observations of a sensor and quantity kind from that time until the next calibration.
+func (a *app) recalibrateFrom(ctx context.Context, sensorID, quantityKind string, from time.Time) error {
+	err := a.loadCalibrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	c, ok := a.calibrations.get(database.Observation{SensorId: sensorID, QuantityKind: quantityKind, ObservationTime: from})
+	if !ok {
+		c = database.Calibration{SensorID: sensorID, QuantityKind: quantityKind}
+	}
+	c.EffectiveFrom = from
+
+	return a.recalibrate(ctx, c)
+}
+
+// recalibrate applies a calibration to the stored observations from the time it is effective from
+// until the next calibration of the same sensor and quantity kind.
+func (a *app) recalibrate(ctx context.Context, c database.Calibration) error {
+	var until *time.Time
+
+	a.calibrations.mu.RLock()
+	for _, next := range a.calibrations.series[c.SensorID+"/"+c.QuantityKind] {
+		if next.EffectiveFrom.After(c.EffectiveFrom) {
+			until = &next.EffectiveFrom
+			break
+		}
+	}
+	a.calibrations.mu.RUnlock()
+
+	n, err := a.db.RecalibrateObservations(ctx, c, until)
+	if err != nil {
+		return err
+	}
+
+	logging.GetFromContext(ctx).Info("recalibrated observations", "sensor_id", c.SensorID, "quantity_kind", c.QuantityKind, "effective_from", c.EffectiveFrom, "count", n)
+
+	return nil
+}
+
+func (a *app) loadCalibrations(ctx context.Context) error {
+	calibrations, err := a.db.GetCalibrations(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	a.calibrations.set(calibrations)
+
+	return nil
+}
+
+// refreshCalibrations keeps the loaded calibrations up to date with changes made by other instances.
+func (a *app) refreshCalibrations(ctx context.Context) {
+	log := logging.GetFromContext(ctx)
+
+	ticker := time.NewTicker(calibrationRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := a.loadCalibrations(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error("failed to load calibrations", "err", err.Error())
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestCalibrationSetAppliesEffectiveCalibration(t *testing.T) {
+	is := is.New(t)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	scale, max := 2.0, 50.0
+	cs := newCalibrationSet()
+	cs.set([]database.Calibration{
+		{SensorID: "s1", QuantityKind: "Temperature", Offset: 1, Scale: &scale, Max: &max, EffectiveFrom: day.Add(12 * time.Hour)},
+		{SensorID: "s1", QuantityKind: "Temperature", Offset: -0.5, EffectiveFrom: day},
+	})
+
+	observation := func(at time.Time, value float64) database.Observation {
+		return database.Observation{SensorId: "s1", QuantityKind: "Temperature", ObservationTime: at, Value: &value}
+	}
+
+	// observations before the first calibration are left as they are
+	o := observation(day.Add(-time.Hour), 20)
+	cs.apply(&o)
+	is.Equal(20.0, *o.Value)
+	is.True(o.RawValue == nil)
+
+	o = observation(day.Add(time.Hour), 20)
+	cs.apply(&o)
+	is.Equal(19.5, *o.Value)
+	is.Equal(20.0, *o.RawValue)
+
+	o = observation(day.Add(12*time.Hour), 20)
+	cs.apply(&o)
+	is.Equal(41.0, *o.Value)
+
+	// a value outside the valid range is dropped but the raw value is kept
+	o = observation(day.Add(13*time.Hour), 30)
+	cs.apply(&o)
+	is.True(o.Value == nil)
+	is.Equal(30.0, *o.RawValue)
+
+	// applying a calibration again starts from the raw value
+	o = observation(day.Add(time.Hour), 20)
+	cs.apply(&o)
+	cs.apply(&o)
+	is.Equal(19.5, *o.Value)
+
+	o = observation(day.Add(time.Hour), 20)
+	o.SensorId = "s2"
+	cs.apply(&o)
+	is.Equal(20.0, *o.Value)
+}
+
+func TestAddCalibrationRecalibratesUntilNextCalibration(t *testing.T) {
+	is := is.New(t)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	db := &dbMock{
+		calibrations: []database.Calibration{
+			{Id: 1, SensorID: "s1", QuantityKind: "Temperature", Offset: 1, EffectiveFrom: day.Add(12 * time.Hour)},
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	zero, min, max := 0.0, 10.0, 5.0
+	_, err := a.AddCalibration(context.Background(), database.Calibration{SensorID: "s1", QuantityKind: "Temperature", Scale: &zero})
+	is.True(errors.Is(err, ErrInvalidCalibration))
+	_, err = a.AddCalibration(context.Background(), database.Calibration{SensorID: "s1", QuantityKind: "Temperature", Min: &min, Max: &max})
+	is.True(errors.Is(err, ErrInvalidCalibration))
+	_, err = a.AddCalibration(context.Background(), database.Calibration{QuantityKind: "Temperature"})
+	is.True(errors.Is(err, ErrInvalidCalibration))
+
+	c, err := a.AddCalibration(context.Background(), database.Calibration{SensorID: "s1", QuantityKind: "Temperature", Offset: 2, EffectiveFrom: day})
+	is.NoErr(err)
+	is.Equal(1.0, *c.Scale)
+
+	is.Equal(1, len(db.recalibrations))
+	is.Equal(day, db.recalibrations[0].c.EffectiveFrom)
+	is.Equal(day.Add(12*time.Hour), *db.recalibrations[0].until)
+
+	// deleting the calibration restores the raw values until the next calibration
+	is.NoErr(a.DeleteCalibration(context.Background(), c.Id))
+	is.Equal(2, len(db.recalibrations))
+	is.Equal(0.0, db.recalibrations[1].c.Offset)
+	is.True(db.recalibrations[1].c.Scale == nil)
+	is.Equal(day.Add(12*time.Hour), *db.recalibrations[1].until)
+}
+
+func TestRecalibrateFromAppliesEffectiveCalibration(t *testing.T) {
+	is := is.New(t)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	db := &dbMock{
+		calibrations: []database.Calibration{
+			{Id: 1, SensorID: "s1", QuantityKind: "Temperature", Offset: 1, EffectiveFrom: day},
+			{Id: 2, SensorID: "s1", QuantityKind: "Temperature", Offset: 2, EffectiveFrom: day.Add(12 * time.Hour)},
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	is.NoErr(a.recalibrateFrom(context.Background(), "s1", "Temperature", day.Add(6*time.Hour)))
+	is.Equal(1, len(db.recalibrations))
+	is.Equal(1.0, db.recalibrations[0].c.Offset)
+	is.Equal(day.Add(6*time.Hour), db.recalibrations[0].c.EffectiveFrom)
+	is.Equal(day.Add(12*time.Hour), *db.recalibrations[0].until)
+
+	// without an effective calibration the raw values are restored
+	is.NoErr(a.recalibrateFrom(context.Background(), "s1", "Temperature", day.Add(-time.Hour)))
+	is.Equal(2, len(db.recalibrations))
+	is.Equal(0.0, db.recalibrations[1].c.Offset)
+	is.Equal(day, *db.recalibrations[1].until)
+}
+
+type recalibration struct {
+	c     database.Calibration
+	until *time.Time
+}
+
+func (db *dbMock) AddCalibration(ctx context.Context, c database.Calibration) (database.Calibration, error) {
+	c.Id = int64(len(db.calibrations) + 1)
+	db.calibrations = append(db.calibrations, c)
+	return c, nil
+}
+
+func (db *dbMock) GetCalibrations(ctx context.Context, sensorID string) ([]database.Calibration, error) {
+	return db.calibrations, nil
+}
+
+func (db *dbMock) DeleteCalibration(ctx context.Context, id int64) (database.Calibration, error) {
+	for i, c := range db.calibrations {
+		if c.Id == id {
+			db.calibrations = append(db.calibrations[:i], db.calibrations[i+1:]...)
+			return c, nil
+		}
+	}
+	return database.Calibration{}, database.ErrNotFound
+}
+
+func (db *dbMock) RecalibrateObservations(ctx context.Context, c database.Calibration, until *time.Time) (int64, error) {
+	db.recalibrations = append(db.recalibrations, recalibration{c: c, until: until})
+	return 0, nil
+}
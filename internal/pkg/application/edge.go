@@ -0,0 +1,252 @@
+package application
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+)
+
+// EdgeMessageFormat is the format of sensor observations mapped from incoming events
+const EdgeMessageFormat = "rec3.3"
+
+// quantityKindPrefixes are the namespaces a quantityKind may be given in, REC 3 uses the core
+// namespace while REC 4 moved quantity kinds to the root namespace.
+var quantityKindPrefixes = []string{
+	"https://w3id.org/rec/core/",
+	"https://w3id.org/rec/",
+	"rec:",
+}
+
+// NormaliseQuantityKind removes any REC namespace from a quantityKind so that it is stored by name,
+// e.g. https://w3id.org/rec/core/Temperature is stored as Temperature.
+func NormaliseQuantityKind(qk string) string {
+	for _, prefix := range quantityKindPrefixes {
+		if strings.HasPrefix(qk, prefix) {
+			return strings.TrimPrefix(qk, prefix)
+		}
+	}
+	return qk
+}
+
+// DecodeEdgeMessage decodes a REC edge message in any of the supported formats and normalises it
+// into a sensor observation. The format of the message is kept in the sensor observation.
+func DecodeEdgeMessage(b []byte) (database.SensorObservation, error) {
+	var probe struct {
+		Format string `json:"format"`
+	}
+
+	err := json.Unmarshal(b, &probe)
+	if err != nil {
+		return database.SensorObservation{}, err
+	}
+
+	var so database.SensorObservation
+
+	switch {
+	case strings.HasPrefix(probe.Format, "rec4"):
+		var msg rec4Message
+		err = json.Unmarshal(b, &msg)
+		if err != nil {
+			return database.SensorObservation{}, err
+		}
+		so, err = msg.toSensorObservation()
+		if err != nil {
+			return database.SensorObservation{}, err
+		}
+	default:
+		// rec3.x, unknown formats are decoded as rec3 and rejected by Validate
+		err = json.Unmarshal(b, &so)
+		if err != nil {
+			return database.SensorObservation{}, err
+		}
+	}
+
+	for i := range so.Observations {
+		so.Observations[i].QuantityKind = NormaliseQuantityKind(so.Observations[i].QuantityKind)
+	}
+
+	return so, nil
+}
+
+// rec4Message is a REC 4 edge message. Compared to rec3 the device and sensors may be given as
+// references, the time as time and the value as a typed or nested value.
+type rec4Message struct {
+	Format       string            `json:"format"`
+	DeviceID     reference         `json:"deviceId"`
+	Device       reference         `json:"device"`
+	Observations []rec4Observation `json:"observations"`
+}
+
+type rec4Observation struct {
+	ObservationTime *time.Time      `json:"observationTime"`
+	Time            *time.Time      `json:"time"`
+	SensorID        reference       `json:"sensorId"`
+	Sensor          reference       `json:"sensor"`
+	QuantityKind    reference       `json:"quantityKind"`
+	Value           json.RawMessage `json:"value"`
+	ValueString     *string         `json:"valueString"`
+	ValueBoolean    *bool           `json:"valueBoolean"`
+}
+
+func (m rec4Message) toSensorObservation() (database.SensorObservation, error) {
+	so := database.SensorObservation{
+		Format:       m.Format,
+		DeviceID:     firstOf(m.DeviceID, m.Device),
+		Observations: make([]database.Observation, 0, len(m.Observations)),
+	}
+
+	for i, o := range m.Observations {
+		obs := database.Observation{
+			SensorId:     firstOf(o.SensorID, o.Sensor),
+			QuantityKind: string(o.QuantityKind),
+			ValueString:  o.ValueString,
+			ValueBoolean: o.ValueBoolean,
+		}
+
+		if o.ObservationTime != nil {
+			obs.ObservationTime = o.ObservationTime.UTC()
+		} else if o.Time != nil {
+			obs.ObservationTime = o.Time.UTC()
+		}
+
+		err := decodeValue(o.Value, &obs)
+		if err != nil {
+			return database.SensorObservation{}, fmt.Errorf("observations[%d].value: %w", i, err)
+		}
+
+		so.Observations = append(so.Observations, obs)
+	}
+
+	return so, nil
+}
+
+// decodeValue sets the value of an observation from a number, string or boolean, or from an
+// object holding one of them in value or @value, e.g. {"value": 21.5, "unit": "..."}. A number
+// with a unit is converted to the unit observations of its quantityKind are stored in.
+func decodeValue(raw json.RawMessage, o *database.Observation) error {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil
+	}
+
+	if raw[0] == '{' {
+		var nested map[string]json.RawMessage
+		err := json.Unmarshal(raw, &nested)
+		if err != nil {
+			return err
+		}
+		for _, key := range []string{"value", "@value"} {
+			if v, ok := nested[key]; ok {
+				err = decodeValue(v, o)
+				if err != nil {
+					return err
+				}
+				return decodeUnit(nested["unit"], o)
+			}
+		}
+		return fmt.Errorf("no value in %s", string(raw))
+	}
+
+	var v any
+	err := json.Unmarshal(raw, &v)
+	if err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case float64:
+		o.Value = &value
+	case string:
+		o.ValueString = &value
+	case bool:
+		o.ValueBoolean = &value
+	default:
+		return fmt.Errorf("unsupported value %s", string(raw))
+	}
+
+	return nil
+}
+
+// qudtUnits maps QUDT units to the units that can be converted, see units
+var qudtUnits = map[string]string{
+	"W-HR":       "Wh",
+	"KiloW-HR":   "kWh",
+	"MegaW-HR":   "MWh",
+	"W":          "W",
+	"KiloW":      "kW",
+	"MegaW":      "MW",
+	"DEG_C":      "°C",
+	"K":          "K",
+	"M3":         "m3",
+	"L":          "L",
+	"PA":         "Pa",
+	"HectoPA":    "hPa",
+	"KiloPA":     "kPa",
+	"BAR":        "bar",
+	"PERCENT_RH": "%RH",
+	"PERCENT":    "%",
+}
+
+// decodeUnit converts the value of an observation from a unit, given by name or as a QUDT unit such
+// as https://qudt.org/vocab/unit/DEG_C, and rejects units that can not be converted.
+func decodeUnit(raw json.RawMessage, o *database.Observation) error {
+	if len(raw) == 0 || o.Value == nil {
+		return nil
+	}
+
+	var unit string
+	err := json.Unmarshal(raw, &unit)
+	if err != nil {
+		return fmt.Errorf("unsupported unit %s", string(raw))
+	}
+
+	if i := strings.LastIndexAny(unit, "/:"); i >= 0 {
+		if u, ok := qudtUnits[unit[i+1:]]; ok {
+			unit = u
+		}
+	}
+
+	v, err := convertUnit(NormaliseQuantityKind(o.QuantityKind), unit, *o.Value)
+	if err != nil {
+		return err
+	}
+	o.Value = &v
+
+	return nil
+}
+
+// reference is an identifier given either as a string or as an object with @id or id.
+type reference string
+
+func (r *reference) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*r = reference(s)
+		return nil
+	}
+
+	var obj struct {
+		JsonLdID string `json:"@id"`
+		ID       string `json:"id"`
+	}
+	err := json.Unmarshal(b, &obj)
+	if err != nil {
+		return err
+	}
+
+	*r = reference(firstOf(reference(obj.JsonLdID), reference(obj.ID)))
+	return nil
+}
+
+func firstOf(refs ...reference) string {
+	for _, r := range refs {
+		if r != "" {
+			return string(r)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package application
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestDecodeRec3EdgeMessage(t *testing.T) {
+	is := is.New(t)
+
+	so, err := DecodeEdgeMessage([]byte(`{
+		"format": "rec3.3",
+		"deviceId": "https://recref.com/device/64b65a99-a53c-47f5-b959-1c7a641d82d8",
+		"observations": [{
+			"observationTime": "2019-05-27T20:07:44Z",
+			"value": 16.1,
+			"quantityKind": "https://w3id.org/rec/core/Temperature",
+			"sensorId": "https://recref.com/sensor/e0d5120b-90f1-48d6-a47f-f8ccd7727b04"
+		}]
+	}`))
+
+	is.NoErr(err)
+	is.NoErr(Validate(so))
+	is.Equal("rec3.3", so.Format)
+	is.Equal("https://recref.com/device/64b65a99-a53c-47f5-b959-1c7a641d82d8", so.DeviceID)
+	is.Equal("Temperature", so.Observations[0].QuantityKind)
+	is.Equal(16.1, *so.Observations[0].Value)
+}
+
+func TestDecodeRec4EdgeMessage(t *testing.T) {
+	is := is.New(t)
+
+	so, err := DecodeEdgeMessage([]byte(`{
+		"format": "rec4.0",
+		"device": {"@id": "https://recref.com/device/64b65a99-a53c-47f5-b959-1c7a641d82d8"},
+		"observations": [
+			{
+				"time": "2023-10-01T12:00:00+02:00",
+				"value": {"value": 21.5, "unit": "https://qudt.org/vocab/unit/DEG_C"},
+				"quantityKind": "https://w3id.org/rec/Temperature",
+				"sensor": {"@id": "https://recref.com/sensor/e0d5120b-90f1-48d6-a47f-f8ccd7727b04"}
+			},
+			{
+				"observationTime": "2023-10-01T10:00:00Z",
+				"value": true,
+				"quantityKind": {"@id": "diwise:Presence"},
+				"sensorId": "presence-1"
+			},
+			{
+				"observationTime": "2023-10-01T10:00:00Z",
+				"value": {"@value": "open"},
+				"quantityKind": "diwise:DigitalInput",
+				"sensorId": "door-1"
+			}
+		]
+	}`))
+
+	is.NoErr(err)
+	is.NoErr(Validate(so))
+	is.Equal("rec4.0", so.Format)
+	is.Equal("https://recref.com/device/64b65a99-a53c-47f5-b959-1c7a641d82d8", so.DeviceID)
+	is.Equal(3, len(so.Observations))
+
+	is.Equal("https://recref.com/sensor/e0d5120b-90f1-48d6-a47f-f8ccd7727b04", so.Observations[0].SensorId)
+	is.Equal("Temperature", so.Observations[0].QuantityKind)
+	is.Equal(21.5, *so.Observations[0].Value)
+	is.Equal(time.Date(2023, 10, 1, 10, 0, 0, 0, time.UTC), so.Observations[0].ObservationTime)
+
+	is.Equal(true, *so.Observations[1].ValueBoolean)
+	is.Equal("diwise:Presence", so.Observations[1].QuantityKind)
+
+	is.Equal("open", *so.Observations[2].ValueString)
+}
+
+func TestDecodeRec4EdgeMessageWithInvalidValue(t *testing.T) {
+	is := is.New(t)
+
+	_, err := DecodeEdgeMessage([]byte(`{"format":"rec4.0","deviceId":"d","observations":[{"value":{"unit":"x"}}]}`))
+	is.True(err != nil)
+}
+
+func TestDecodeRec4EdgeMessageConvertsUnits(t *testing.T) {
+	is := is.New(t)
+
+	so, err := DecodeEdgeMessage([]byte(`{"format":"rec4.0","deviceId":"d","observations":[
+		{"sensorId":"e","quantityKind":"Energy","value":{"value":1500,"unit":"https://qudt.org/vocab/unit/W-HR"}},
+		{"sensorId":"t","quantityKind":"https://w3id.org/rec/Temperature","value":{"value":294.15,"unit":"unit:K"}},
+		{"sensorId":"p","quantityKind":"Power","value":{"value":2,"unit":"kW"}}
+	]}`))
+	is.NoErr(err)
+	is.Equal(1.5, *so.Observations[0].Value)
+	is.Equal(21.0, math.Round(*so.Observations[1].Value*100)/100)
+	is.Equal(2000.0, *so.Observations[2].Value)
+
+	// units that can not be converted are rejected rather than stored as if they were the stored unit
+	for _, value := range []string{
+		`{"value":70,"unit":"https://qudt.org/vocab/unit/DEG_F"}`,
+		`{"value":1500,"unit":"W"}`,
+		`{"value":21,"unit":{"@id":"unit:DEG_C"}}`,
+	} {
+		_, err = DecodeEdgeMessage([]byte(`{"format":"rec4.0","deviceId":"d","observations":[{"sensorId":"s","quantityKind":"Temperature","value":` + value + `}]}`))
+		is.True(err != nil)
+	}
+}
+
+func TestUnknownFormatIsRejected(t *testing.T) {
+	is := is.New(t)
+
+	so, err := DecodeEdgeMessage([]byte(`{"format":"rec5.0","deviceId":"d"}`))
+	is.NoErr(err)
+	is.True(Validate(so) != nil)
+}
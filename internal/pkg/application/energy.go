@@ -0,0 +1,222 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+)
+
+var ErrInvalidEnergyReport = errors.New("invalid energy report")
+
+// EnergyReport is the energy consumed in a building, computed from the cumulative Energy observations
+// of all meters under the building, together with the peak of the total Power of the meters.
+type EnergyReport struct {
+	BuildingID    string         `json:"buildingId"`
+	Interval      string         `json:"interval"`
+	From          time.Time      `json:"from"`
+	To            time.Time      `json:"to"`
+	Meters        int            `json:"meters"`
+	Resets        int            `json:"resets"`
+	Consumption   float64        `json:"consumption"`
+	PeakPower     *float64       `json:"peakPower,omitempty"`
+	PeakPowerTime *time.Time     `json:"peakPowerTime,omitempty"`
+	Buckets       []EnergyBucket `json:"buckets"`
+}
+
+type EnergyBucket struct {
+	Period
+	Consumption   float64    `json:"consumption"`
+	PeakPower     *float64   `json:"peakPower,omitempty"`
+	PeakPowerTime *time.Time `json:"peakPowerTime,omitempty"`
+}
+
+func newEnergyBuckets(from, to time.Time, interval string, loc *time.Location) ([]EnergyBucket, error) {
+	periods, err := newPeriods(from, to, interval, loc)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEnergyReport, err.Error())
+	}
+
+	buckets := make([]EnergyBucket, 0, len(periods))
+	for _, p := range periods {
+		buckets = append(buckets, EnergyBucket{Period: p})
+	}
+
+	return buckets, nil
+}
+
+// distribute spreads an amount consumed between from and to over the buckets in proportion to their
+// overlap with the period, so that consumption between readings that are far apart is not attributed
+// to a single bucket.
+func distribute(buckets []EnergyBucket, from, to time.Time, amount float64) {
+	span := to.Sub(from)
+
+	if span <= 0 {
+		i := sort.Search(len(buckets), func(i int) bool { return buckets[i].To.After(to) })
+		if i < len(buckets) && !to.Before(buckets[i].From) {
+			buckets[i].Consumption += amount
+		}
+		return
+	}
+
+	for i := sort.Search(len(buckets), func(i int) bool { return buckets[i].To.After(from) }); i < len(buckets) && buckets[i].From.Before(to); i++ {
+		buckets[i].Consumption += amount * buckets[i].overlap(from, to).Seconds() / span.Seconds()
+	}
+}
+
+// GetBuildingEnergy computes the energy consumed in a building per bucket of the interval, from the
+// differences between consecutive readings of the cumulative Energy observations of each meter under
+// the building. A reading that is lower than the previous reading is taken as a reset of the meter,
+// and the reading itself as the energy consumed since the reset.
+func (a *app) GetBuildingEnergy(ctx context.Context, buildingID string, from, to time.Time, interval string, loc *time.Location) (EnergyReport, error) {
+	buckets, err := newEnergyBuckets(from, to, interval, loc)
+	if err != nil {
+		return EnergyReport{}, err
+	}
+
+	building, err := a.db.GetEntity(ctx, buildingID, database.BuildingType)
+	if err != nil {
+		return EnergyReport{}, fmt.Errorf("building %s: %w", buildingID, database.ErrNotFound)
+	}
+
+	sensorIDs, err := a.GetSensorIDs(ctx, building)
+	if err != nil {
+		return EnergyReport{}, err
+	}
+
+	report := EnergyReport{
+		BuildingID: buildingID,
+		Interval:   interval,
+		From:       buckets[0].From,
+		To:         buckets[len(buckets)-1].To,
+	}
+
+	filter := database.ObservationFilter{
+		SensorIDs: sensorIDs,
+		Starting:  report.From,
+		Ending:    report.To,
+	}
+
+	filter.QuantityKind = "Energy"
+	readings, err := a.loadReadings(ctx, filter, hasValue)
+	if err != nil {
+		return EnergyReport{}, err
+	}
+
+	for _, r := range readings {
+		report.Meters++
+
+		for i := 1; i < len(r); i++ {
+			delta := *r[i].Value - *r[i-1].Value
+			if delta < 0 {
+				report.Resets++
+				delta = *r[i].Value
+			}
+
+			distribute(buckets, r[i-1].ObservationTime, r[i].ObservationTime, delta)
+		}
+	}
+
+	filter.QuantityKind = "Power"
+	readings, err = a.loadReadings(ctx, filter, hasValue)
+	if err != nil {
+		return EnergyReport{}, err
+	}
+
+	peakPower(buckets, readings)
+
+	for i, b := range buckets {
+		report.Consumption += b.Consumption
+
+		if b.PeakPower != nil && (report.PeakPower == nil || *b.PeakPower > *report.PeakPower) {
+			report.PeakPower, report.PeakPowerTime = buckets[i].PeakPower, buckets[i].PeakPowerTime
+		}
+	}
+
+	report.Buckets = buckets
+
+	return report, nil
+}
+
+// loadReadings returns the observations matching the filter that have a value kept by keep, per sensor,
+// ordered by time and including the latest observation before and the earliest observation after the
+// time range. Observations flagged as bad are left out.
+func (a *app) loadReadings(ctx context.Context, filter database.ObservationFilter, keep func(database.Observation) bool) (map[string][]database.Observation, error) {
+	readings := make(map[string][]database.Observation)
+
+	if filter.SensorIDs != nil && len(filter.SensorIDs) == 0 {
+		return readings, nil
+	}
+
+	add := func(o database.Observation) {
+		if o.Quality != database.QualityBad && keep(o) {
+			readings[o.SensorId] = append(readings[o.SensorId], o)
+		}
+	}
+
+	boundaries, err := a.db.GetBoundaryObservations(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range boundaries {
+		if o.ObservationTime.Before(filter.Starting) {
+			add(o.Observation)
+		}
+	}
+
+	err = a.db.StreamObservations(ctx, filter, func(deviceID string, o database.Observation) error {
+		add(o)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range boundaries {
+		if o.ObservationTime.After(filter.Ending) {
+			add(o.Observation)
+		}
+	}
+
+	return readings, nil
+}
+
+func hasValue(o database.Observation) bool {
+	return o.Value != nil
+}
+
+// peakPower sets the highest total power of the meters in each bucket, where the total is the sum of
+// the latest reading of each meter whenever a meter reports.
+func peakPower(buckets []EnergyBucket, readings map[string][]database.Observation) {
+	all := make([]database.Observation, 0)
+	for _, r := range readings {
+		all = append(all, r...)
+	}
+
+	slices.SortStableFunc(all, func(a, b database.Observation) int {
+		return a.ObservationTime.Compare(b.ObservationTime)
+	})
+
+	latest := make(map[string]float64)
+	total := 0.0
+
+	for _, o := range all {
+		total += *o.Value - latest[o.SensorId]
+		latest[o.SensorId] = *o.Value
+
+		i := sort.Search(len(buckets), func(i int) bool { return buckets[i].To.After(o.ObservationTime) })
+		if i == len(buckets) || o.ObservationTime.Before(buckets[i].From) {
+			continue
+		}
+
+		if buckets[i].PeakPower == nil || total > *buckets[i].PeakPower {
+			peak, at := total, o.ObservationTime
+			buckets[i].PeakPower, buckets[i].PeakPowerTime = &peak, &at
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestNewEnergyBucketsFollowsTimeZone(t *testing.T) {
+	is := is.New(t)
+
+	loc, err := time.LoadLocation("Europe/Stockholm")
+	is.NoErr(err)
+
+	// the day daylight saving time starts has 23 hours
+	buckets, err := newEnergyBuckets(time.Date(2024, 3, 30, 12, 0, 0, 0, loc), time.Date(2024, 4, 1, 0, 0, 0, 0, loc), IntervalDay, loc)
+	is.NoErr(err)
+	is.Equal(2, len(buckets))
+	is.Equal(time.Date(2024, 3, 29, 23, 0, 0, 0, time.UTC), buckets[0].From)
+	is.Equal(23*time.Hour, buckets[1].To.Sub(buckets[1].From))
+
+	buckets, err = newEnergyBuckets(time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), IntervalMonth, time.UTC)
+	is.NoErr(err)
+	is.Equal(2, len(buckets))
+
+	_, err = newEnergyBuckets(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), "week", time.UTC)
+	is.True(errors.Is(err, ErrInvalidEnergyReport))
+}
+
+func TestGetBuildingEnergyHandlesResetsAndGaps(t *testing.T) {
+	is := is.New(t)
+
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	reading := func(sensorID, quantityKind string, at time.Time, value float64) database.Observation {
+		return database.Observation{SensorId: sensorID, QuantityKind: quantityKind, ObservationTime: at, Value: &value}
+	}
+
+	db := &dbMock{
+		entities: map[string]database.Entity{
+			database.BuildingType + "/building-1": {Id: "building-1", Type: database.BuildingType},
+		},
+		children: []database.Entity{{Id: "m1"}, {Id: "m2"}},
+		boundaries: []database.StoredObservation{
+			{Observation: reading("m1", "Energy", day.Add(-12*time.Hour), 90)},
+		},
+		observations: []database.Observation{
+			reading("m1", "Energy", day.Add(12*time.Hour), 110),
+			reading("m2", "Energy", day.Add(6*time.Hour), 500),
+			reading("m2", "Power", day.Add(6*time.Hour), 3),
+			reading("m1", "Power", day.Add(12*time.Hour), 2),
+			reading("m2", "Energy", day.Add(30*time.Hour), 24),
+			reading("m2", "Power", day.Add(30*time.Hour), 1),
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	report, err := a.GetBuildingEnergy(context.Background(), "building-1", day, day.Add(48*time.Hour), IntervalDay, time.UTC)
+	is.NoErr(err)
+
+	is.Equal(2, report.Meters)
+	is.Equal(1, report.Resets)
+	is.Equal(2, len(report.Buckets))
+
+	// m1 consumed 20 over 24 hours, of which 10 during the first day, and m2 was reset and consumed 24
+	// over 24 hours, of which 18 during the first day
+	is.True(math.Abs(report.Buckets[0].Consumption-28) < 1e-9)
+	is.True(math.Abs(report.Buckets[1].Consumption-6) < 1e-9)
+	is.True(math.Abs(report.Consumption-34) < 1e-9)
+
+	is.Equal(5.0, *report.Buckets[0].PeakPower)
+	is.Equal(day.Add(12*time.Hour), *report.Buckets[0].PeakPowerTime)
+	is.Equal(3.0, *report.Buckets[1].PeakPower)
+	is.Equal(5.0, *report.PeakPower)
+
+	_, err = a.GetBuildingEnergy(context.Background(), "building-2", day, day.Add(48*time.Hour), IntervalDay, time.UTC)
+	is.True(errors.Is(err, database.ErrNotFound))
+}
+
+func (db *dbMock) GetChildEntities(ctx context.Context, root database.Entity, entityType string) ([]database.Entity, error) {
+	return db.children, nil
+}
+
+func (db *dbMock) GetBoundaryObservations(ctx context.Context, filter database.ObservationFilter) ([]database.StoredObservation, error) {
+	boundaries := make([]database.StoredObservation, 0)
+	for _, o := range db.boundaries {
+		if o.QuantityKind == filter.QuantityKind && (filter.SensorIDs == nil || slices.Contains(filter.SensorIDs, o.SensorId)) {
+			boundaries = append(boundaries, o)
+		}
+	}
+	return boundaries, nil
+}
+
+func (db *dbMock) StreamObservations(ctx context.Context, filter database.ObservationFilter, fn func(deviceID string, o database.Observation) error) error {
+	for _, o := range db.observations {
+		if filter.Matches("", o) {
+			err := fn("", o)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/farshidtz/senml/v2"
+)
+
+var ErrUnmappableEvent = errors.New("event could not be mapped to an observation")
+var ErrEventProcessed = errors.New("event has already been processed")
+var ErrDeadLetterReplayed = errors.New("dead letter has already been replayed")
+
+// Event is an incoming event, such as a cloudevent, carrying data that can be mapped to an observation.
+type Event struct {
+	ID       string
+	Source   string
+	Type     string
+	Time     time.Time
+	Received time.Time
+	Data     []byte
+}
+
+// HandleEvent maps the event to an observation and queues it for storage. ErrEventProcessed is
+// returned if the event has already been processed or queued. Events that can not be mapped are
+// stored as dead letters and ErrUnmappableEvent is returned.
+func (a *app) HandleEvent(ctx context.Context, evt Event) error {
+	claimed, err := a.claimEvent(ctx, evt)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrEventProcessed
+	}
+
+	so, err := a.mapEvent(evt)
+	if err != nil {
+		a.deadLetter(ctx, evt, err)
+		a.releaseEvent(ctx, evt)
+		return err
+	}
+
+	err = a.enqueue(ingestionItem{so: so, evt: &evt})
+	if err != nil {
+		a.releaseEvent(ctx, evt)
+		return err
+	}
+
+	return nil
+}
+
+// StoreEvent maps the event to an observation and stores it before returning, for callers that
+// must know that the observation is stored, e.g. before acknowledging a message. ErrEventProcessed
+// is returned if the event has already been processed. Events that can not be mapped are stored as
+// dead letters and ErrUnmappableEvent is returned.
+func (a *app) StoreEvent(ctx context.Context, evt Event) error {
+	claimed, err := a.claimEvent(ctx, evt)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return ErrEventProcessed
+	}
+
+	so, err := a.mapEvent(evt)
+	if err != nil {
+		a.deadLetter(ctx, evt, err)
+		a.releaseEvent(ctx, evt)
+		return err
+	}
+
+	err = a.AddObservation(ctx, so)
+	if err != nil {
+		a.releaseEvent(ctx, evt)
+		return err
+	}
+
+	return nil
+}
+
+const (
+	EventStored    = "stored"
+	EventDuplicate = "duplicate"
+	EventRejected  = "rejected"
+	EventFailed    = "failed"
+)
+
+// EventResult tells the sender of a batch of events what happened to each event. Events that
+// failed can be retried, rejected events are stored as dead letters.
+type EventResult struct {
+	ID     string `json:"id"`
+	Source string `json:"source"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// HandleEvents maps a batch of events to observations and stores them in one transaction.
+// The returned results are in the same order as the events.
+func (a *app) HandleEvents(ctx context.Context, evts []Event) []EventResult {
+	results := make([]EventResult, len(evts))
+	sos := make([]database.SensorObservation, 0, len(evts))
+	stored := make([]int, 0, len(evts))
+	seen := make(map[string]struct{})
+
+	for i, evt := range evts {
+		results[i] = EventResult{ID: evt.ID, Source: evt.Source}
+
+		key := evt.Source + "/" + evt.ID
+		if _, ok := seen[key]; ok {
+			results[i].Status = EventDuplicate
+			continue
+		}
+		seen[key] = struct{}{}
+
+		claimed, err := a.claimEvent(ctx, evt)
+		if err != nil {
+			results[i].Status, results[i].Reason = EventFailed, err.Error()
+			continue
+		}
+		if !claimed {
+			results[i].Status = EventDuplicate
+			continue
+		}
+
+		so, err := a.mapEvent(evt)
+		if err != nil {
+			a.deadLetter(ctx, evt, err)
+			a.releaseEvent(ctx, evt)
+			results[i].Status, results[i].Reason = EventRejected, err.Error()
+			continue
+		}
+
+		err = a.prepareObservation(ctx, so)
+		if err != nil {
+			a.releaseEvent(ctx, evt)
+			results[i].Status, results[i].Reason = EventFailed, err.Error()
+			continue
+		}
+
+		sos = append(sos, so)
+		stored = append(stored, i)
+	}
+
+	if len(sos) == 0 {
+		return results
+	}
+
+	err := a.db.AddObservations(ctx, sos)
+
+	for _, i := range stored {
+		if err != nil {
+			a.releaseEvent(ctx, evts[i])
+			results[i].Status, results[i].Reason = EventFailed, err.Error()
+			continue
+		}
+
+		results[i].Status = EventStored
+	}
+
+	return results
+}
+
+// claimEvent records an event as processed before it is stored, so that a redelivery of the event
+// is not handled again while the first delivery is queued. It returns false if the event has been
+// processed, or is being processed, within the retention window. Events without a source or id can
+// not be told apart and are always claimed. Records older than the retention window are purged at
+// most once per window.
+func (a *app) claimEvent(ctx context.Context, evt Event) (bool, error) {
+	if evt.Source == "" || evt.ID == "" {
+		return true, nil
+	}
+
+	now := time.Now().UTC()
+
+	claimed, err := a.db.AddProcessedEvent(ctx, evt.Source, evt.ID, now.Add(-a.cfg.eventRetention))
+	if err != nil {
+		return false, err
+	}
+	if !claimed {
+		return false, nil
+	}
+
+	a.eventPurgeMu.Lock()
+	defer a.eventPurgeMu.Unlock()
+
+	if now.Sub(a.lastEventPurge) < a.cfg.eventRetention {
+		return true, nil
+	}
+
+	err = a.db.DeleteProcessedEvents(ctx, now.Add(-a.cfg.eventRetention))
+	if err != nil {
+		logging.GetFromContext(ctx).Error("failed to purge processed events", "err", err.Error())
+		return true, nil
+	}
+
+	a.lastEventPurge = now
+
+	return true, nil
+}
+
+// releaseEvent removes the claim on an event that could not be stored, so that it is handled
+// again when it is redelivered.
+func (a *app) releaseEvent(ctx context.Context, evt Event) {
+	if evt.Source == "" || evt.ID == "" {
+		return
+	}
+
+	err := a.db.DeleteProcessedEvent(ctx, evt.Source, evt.ID)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("failed to release event", "source", evt.Source, "id", evt.ID, "err", err.Error())
+	}
+}
+
+func (a *app) mapEvent(evt Event) (database.SensorObservation, error) {
+	var so database.SensorObservation
+	var ok bool
+
+	switch evt.Type {
+	case MessageAcceptedName:
+		var ma MessageAccepted
+		err := json.Unmarshal(evt.Data, &ma)
+		if err != nil {
+			return database.SensorObservation{}, fmt.Errorf("%w: failed to parse %s: %s", ErrUnmappableEvent, evt.Type, err.Error())
+		}
+		so, ok = ma.MapToObservation()
+	case SensorObservationName:
+		var err error
+		so, err = DecodeEdgeMessage(evt.Data)
+		if err != nil {
+			return database.SensorObservation{}, fmt.Errorf("%w: failed to parse %s: %s", ErrUnmappableEvent, evt.Type, err.Error())
+		}
+		err = Validate(so)
+		if err != nil {
+			return database.SensorObservation{}, fmt.Errorf("%w: invalid %s: %s", ErrUnmappableEvent, evt.Type, err.Error())
+		}
+		ok = true
+	case SenMLName:
+		var pack senml.Pack
+		err := json.Unmarshal(evt.Data, &pack)
+		if err != nil {
+			return database.SensorObservation{}, fmt.Errorf("%w: failed to parse %s: %s", ErrUnmappableEvent, evt.Type, err.Error())
+		}
+		ma := MessageAccepted{Pack: pack, Timestamp: evt.Received}
+		if len(pack) > 0 {
+			ma.SensorID = pack[0].StringValue
+		}
+		so, ok = ma.MapToObservation()
+	case FunctionUpdatedName:
+		var fu FunctionUpdated
+		err := json.Unmarshal(evt.Data, &fu)
+		if err != nil {
+			return database.SensorObservation{}, fmt.Errorf("%w: failed to parse %s: %s", ErrUnmappableEvent, evt.Type, err.Error())
+		}
+		so, ok = fu.MapToObservation(a.cfg.timestampPolicy.Fallback(evt.Time, evt.Received))
+	default:
+		return database.SensorObservation{}, fmt.Errorf("%w: unknown event type %s", ErrUnmappableEvent, evt.Type)
+	}
+
+	if !ok {
+		return database.SensorObservation{}, fmt.Errorf("%w: no observation in %s", ErrUnmappableEvent, evt.Type)
+	}
+
+	return so, nil
+}
+
+func (a *app) deadLetter(ctx context.Context, evt Event, reason error) {
+	dl := database.DeadLetter{
+		EventID:    evt.ID,
+		Source:     evt.Source,
+		EventType:  evt.Type,
+		ReceivedAt: evt.Received.UTC(),
+		Reason:     reason.Error(),
+		Data:       string(evt.Data),
+	}
+
+	if !evt.Time.IsZero() {
+		t := evt.Time.UTC()
+		dl.EventTime = &t
+	}
+
+	err := a.db.AddDeadLetter(ctx, dl)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("failed to store dead letter", "source", evt.Source, "id", evt.ID, "err", err.Error())
+	}
+}
+
+func (a *app) GetDeadLetter(ctx context.Context, id int64) (database.DeadLetter, error) {
+	return a.db.GetDeadLetter(ctx, id)
+}
+
+func (a *app) GetDeadLetters(ctx context.Context, page, size int) (int64, []database.DeadLetter, error) {
+	return a.db.GetDeadLetters(ctx, page, size)
+}
+
+// ReplayDeadLetter maps and stores a dead letter again. If it still fails the reason is updated,
+// otherwise the dead letter is marked as replayed. ErrDeadLetterReplayed is returned if the dead
+// letter has already been replayed and ErrEventProcessed if the event has been stored since, e.g.
+// by a redelivery, so that the observations are not stored twice.
+func (a *app) ReplayDeadLetter(ctx context.Context, id int64) (database.DeadLetter, error) {
+	dl, err := a.db.GetDeadLetter(ctx, id)
+	if err != nil {
+		return database.DeadLetter{}, err
+	}
+
+	if dl.ReplayedAt != nil {
+		return dl, ErrDeadLetterReplayed
+	}
+
+	evt := Event{
+		ID:       dl.EventID,
+		Source:   dl.Source,
+		Type:     dl.EventType,
+		Received: dl.ReceivedAt,
+		Data:     []byte(dl.Data),
+	}
+
+	if dl.EventTime != nil {
+		evt.Time = *dl.EventTime
+	}
+
+	// the event is claimed before it is stored so that neither a redelivery nor another replay
+	// stores it at the same time
+	claimed, err := a.claimEvent(ctx, evt)
+	if err != nil {
+		return dl, err
+	}
+	if !claimed {
+		return dl, ErrEventProcessed
+	}
+
+	so, err := a.mapEvent(evt)
+	if err == nil {
+		err = a.AddObservation(ctx, so)
+	}
+
+	if err != nil {
+		a.releaseEvent(ctx, evt)
+
+		dl.Reason = err.Error()
+		if updateErr := a.db.UpdateDeadLetter(ctx, dl.Id, dl.Reason, dl.ReplayedAt); updateErr != nil {
+			return dl, updateErr
+		}
+		return dl, err
+	}
+
+	now := time.Now().UTC()
+	dl.ReplayedAt = &now
+
+	err = a.db.UpdateDeadLetter(ctx, dl.Id, dl.Reason, dl.ReplayedAt)
+	if err != nil {
+		return dl, err
+	}
+
+	return dl, nil
+}
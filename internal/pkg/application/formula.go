@@ -0,0 +1,154 @@
+package application
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"math"
+	"strconv"
+)
+
+// formula is an arithmetic expression over named inputs in Go syntax, e.g. "(a + b) / 2" or
+// "dewpoint(t, rh)".
+type formula struct {
+	expr ast.Expr
+}
+
+type formulaFunction struct {
+	arity int
+	fn    func(args []float64) float64
+}
+
+var formulaFunctions = map[string]formulaFunction{
+	"abs":      {1, func(x []float64) float64 { return math.Abs(x[0]) }},
+	"sqrt":     {1, func(x []float64) float64 { return math.Sqrt(x[0]) }},
+	"exp":      {1, func(x []float64) float64 { return math.Exp(x[0]) }},
+	"log":      {1, func(x []float64) float64 { return math.Log(x[0]) }},
+	"round":    {1, func(x []float64) float64 { return math.Round(x[0]) }},
+	"pow":      {2, func(x []float64) float64 { return math.Pow(x[0], x[1]) }},
+	"min":      {2, func(x []float64) float64 { return math.Min(x[0], x[1]) }},
+	"max":      {2, func(x []float64) float64 { return math.Max(x[0], x[1]) }},
+	"dewpoint": {2, func(x []float64) float64 { return dewPoint(x[0], x[1]) }},
+}
+
+// dewPoint returns the dew point in °C for a temperature in °C and a relative humidity in percent,
+// using the Magnus formula.
+func dewPoint(t, rh float64) float64 {
+	const a, b = 17.62, 243.12
+	gamma := math.Log(rh/100) + a*t/(b+t)
+	return b * gamma / (a - gamma)
+}
+
+// parseFormula parses a formula that may only refer to the named inputs and the formula functions.
+func parseFormula(src string, names map[string]struct{}) (formula, error) {
+	expr, err := parser.ParseExpr(src)
+	if err != nil {
+		return formula{}, fmt.Errorf("formula could not be parsed: %s", err.Error())
+	}
+
+	err = checkFormula(expr, names)
+	if err != nil {
+		return formula{}, err
+	}
+
+	return formula{expr: expr}, nil
+}
+
+func checkFormula(expr ast.Expr, names map[string]struct{}) error {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.INT && e.Kind != token.FLOAT {
+			return fmt.Errorf("formula may only contain numbers, found %s", e.Value)
+		}
+	case *ast.Ident:
+		if _, ok := names[e.Name]; !ok {
+			return fmt.Errorf("formula refers to unknown input %s", e.Name)
+		}
+	case *ast.ParenExpr:
+		return checkFormula(e.X, names)
+	case *ast.UnaryExpr:
+		if e.Op != token.ADD && e.Op != token.SUB {
+			return fmt.Errorf("formula may not contain the operator %s", e.Op)
+		}
+		return checkFormula(e.X, names)
+	case *ast.BinaryExpr:
+		switch e.Op {
+		case token.ADD, token.SUB, token.MUL, token.QUO:
+		default:
+			return fmt.Errorf("formula may not contain the operator %s", e.Op)
+		}
+		if err := checkFormula(e.X, names); err != nil {
+			return err
+		}
+		return checkFormula(e.Y, names)
+	case *ast.CallExpr:
+		name, ok := e.Fun.(*ast.Ident)
+		if !ok {
+			return fmt.Errorf("formula may only call functions by name")
+		}
+		f, ok := formulaFunctions[name.Name]
+		if !ok {
+			return fmt.Errorf("formula calls unknown function %s", name.Name)
+		}
+		if len(e.Args) != f.arity || e.Ellipsis.IsValid() {
+			return fmt.Errorf("function %s takes %d arguments", name.Name, f.arity)
+		}
+		for _, arg := range e.Args {
+			if err := checkFormula(arg, names); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("formula may only contain numbers, inputs, arithmetic and function calls")
+	}
+
+	return nil
+}
+
+// eval evaluates the formula with the values of its inputs. The result may be NaN or infinite, e.g.
+// when dividing by zero.
+func (f formula) eval(values map[string]float64) float64 {
+	return evalFormula(f.expr, values)
+}
+
+func evalFormula(expr ast.Expr, values map[string]float64) float64 {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		v, err := strconv.ParseFloat(e.Value, 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return v
+	case *ast.Ident:
+		return values[e.Name]
+	case *ast.ParenExpr:
+		return evalFormula(e.X, values)
+	case *ast.UnaryExpr:
+		if e.Op == token.SUB {
+			return -evalFormula(e.X, values)
+		}
+		return evalFormula(e.X, values)
+	case *ast.BinaryExpr:
+		x, y := evalFormula(e.X, values), evalFormula(e.Y, values)
+		switch e.Op {
+		case token.ADD:
+			return x + y
+		case token.SUB:
+			return x - y
+		case token.MUL:
+			return x * y
+		default:
+			return x / y
+		}
+	case *ast.CallExpr:
+		f := formulaFunctions[e.Fun.(*ast.Ident).Name]
+		args := make([]float64, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = evalFormula(arg, values)
+		}
+		return f.fn(args)
+	}
+
+	return math.NaN()
+}
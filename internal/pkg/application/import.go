@@ -0,0 +1,337 @@
+package application
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+)
+
+// Import fields that can be mapped to CSV columns. By default each field is read from a column with
+// the same name.
+const (
+	ImportSensorID        = "sensorId"
+	ImportObservationTime = "observationTime"
+	ImportValue           = "value"
+	ImportQuantityKind    = "quantityKind"
+	ImportDeviceID        = "deviceId"
+	ImportUnit            = "unit"
+	ImportQuality         = "quality"
+)
+
+var ErrInvalidImport = errors.New("invalid import")
+
+const maxImportErrors = 100
+const importProgressInterval = 10000
+
+type ImportOptions struct {
+	// Columns maps import fields to column names in the CSV header, e.g. sensorId -> meter_id
+	Columns   map[string]string
+	Separator rune
+	// DeviceID is used for rows without a device
+	DeviceID string
+	DryRun   bool
+	Progress func(ImportResult)
+}
+
+type ImportError struct {
+	Row     int64  `json:"row"`
+	Message string `json:"message"`
+}
+
+type ImportResult struct {
+	DryRun   bool          `json:"dryRun"`
+	Rows     int64         `json:"rows"`
+	Imported int64         `json:"imported"`
+	Skipped  int64         `json:"skipped"`
+	Errors   []ImportError `json:"errors,omitempty"`
+}
+
+// ImportObservations streams observations from a CSV file into the database and registers their
+// devices once all rows are stored. Rows that can not be parsed are skipped and reported in the result. In a dry run every row is parsed but nothing is stored.
+func (a *app) ImportObservations(ctx context.Context, r io.Reader, opts ImportOptions) (ImportResult, error) {
+	reader, err := newCsvObservationReader(ctx, a, r, opts)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	if opts.DryRun {
+		for reader.Next() {
+			reader.result.Imported++
+		}
+	} else {
+		// the calibrations are loaded here as well since an import may run without the app being started
+		err = a.loadCalibrations(ctx)
+		if err != nil {
+			return ImportResult{}, err
+		}
+
+		var registered database.RegisteredEntities
+
+		reader.result.Imported, registered, err = a.db.ImportObservations(ctx, reader, database.DeviceRegistration{
+			AutoRegisterSensors: a.cfg.autoRegisterSensors,
+			UnassignedSpaceID:   a.cfg.unassignedSpaceID,
+		})
+		if err == nil {
+			a.notifyRegisteredEntities(ctx, registered)
+		}
+	}
+
+	if err == nil {
+		err = reader.Err()
+	}
+
+	return reader.result, err
+}
+
+type csvObservationReader struct {
+	ctx     context.Context
+	app     *app
+	csv     *csv.Reader
+	opts    ImportOptions
+	columns map[string]int
+
+	deviceID    string
+	observation database.Observation
+	result      ImportResult
+	err         error
+}
+
+func newCsvObservationReader(ctx context.Context, a *app, r io.Reader, opts ImportOptions) (*csvObservationReader, error) {
+	reader := &csvObservationReader{
+		ctx:     ctx,
+		app:     a,
+		csv:     csv.NewReader(r),
+		opts:    opts,
+		columns: make(map[string]int),
+		result:  ImportResult{DryRun: opts.DryRun},
+	}
+
+	if opts.Separator != 0 {
+		reader.csv.Comma = opts.Separator
+	}
+	reader.csv.FieldsPerRecord = -1
+	reader.csv.ReuseRecord = true
+
+	header, err := reader.csv.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read header: %s", ErrInvalidImport, err.Error())
+	}
+
+	for _, field := range []string{ImportSensorID, ImportObservationTime, ImportValue, ImportQuantityKind, ImportDeviceID, ImportUnit, ImportQuality} {
+		name := field
+		if column, ok := opts.Columns[field]; ok {
+			name = column
+		}
+
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				reader.columns[field] = i
+				break
+			}
+		}
+	}
+
+	for _, required := range []string{ImportSensorID, ImportObservationTime, ImportValue, ImportQuantityKind} {
+		if _, ok := reader.columns[required]; !ok {
+			return nil, fmt.Errorf("%w: no column found for %s", ErrInvalidImport, required)
+		}
+	}
+
+	return reader, nil
+}
+
+func (r *csvObservationReader) Next() bool {
+	for {
+		if r.err != nil {
+			return false
+		}
+
+		if r.ctx.Err() != nil {
+			r.err = r.ctx.Err()
+			return false
+		}
+
+		row, err := r.csv.Read()
+		if errors.Is(err, io.EOF) {
+			r.progress()
+			return false
+		}
+
+		r.result.Rows++
+
+		if r.result.Rows%importProgressInterval == 0 {
+			r.progress()
+		}
+
+		if err == nil {
+			err = r.parse(row)
+		}
+
+		if err != nil {
+			r.result.Skipped++
+			if len(r.result.Errors) < maxImportErrors {
+				r.result.Errors = append(r.result.Errors, ImportError{Row: r.result.Rows, Message: err.Error()})
+			}
+			continue
+		}
+
+		return true
+	}
+}
+
+func (r *csvObservationReader) Observation() (string, database.Observation) {
+	return r.deviceID, r.observation
+}
+
+func (r *csvObservationReader) Err() error {
+	return r.err
+}
+
+func (r *csvObservationReader) progress() {
+	if r.opts.Progress != nil {
+		r.opts.Progress(r.result)
+	}
+}
+
+func (r *csvObservationReader) column(row []string, field string) string {
+	i, ok := r.columns[field]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+func (r *csvObservationReader) parse(row []string) error {
+	o := database.Observation{
+		SensorId:     r.column(row, ImportSensorID),
+		QuantityKind: NormaliseQuantityKind(r.column(row, ImportQuantityKind)),
+	}
+
+	if o.SensorId == "" {
+		return errors.New("sensorId is required")
+	}
+
+	if !isKnownQuantityKind(o.QuantityKind) {
+		return fmt.Errorf("unknown quantityKind %s", o.QuantityKind)
+	}
+
+	t, err := parseImportTime(r.column(row, ImportObservationTime))
+	if err != nil {
+		return err
+	}
+	o.ObservationTime = t
+
+	value := r.column(row, ImportValue)
+	if f, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64); err == nil {
+		f, err = convertUnit(o.QuantityKind, r.column(row, ImportUnit), f)
+		if err != nil {
+			return err
+		}
+		o.Value = &f
+	} else if b, err := strconv.ParseBool(value); err == nil {
+		o.ValueBoolean = &b
+	} else if value != "" {
+		o.ValueString = &value
+	} else {
+		return errors.New("value is required")
+	}
+
+	if quality := r.column(row, ImportQuality); quality != "" {
+		if !database.IsQuality(quality) {
+			return fmt.Errorf("unknown quality %s", quality)
+		}
+		o.Quality = quality
+	}
+
+	deviceID := r.column(row, ImportDeviceID)
+	if deviceID == "" {
+		deviceID = r.opts.DeviceID
+	}
+	if deviceID == "" {
+		deviceID = o.SensorId
+	}
+
+	r.app.calibrations.apply(&o)
+	r.app.quality.check(&o)
+
+	r.deviceID = deviceID
+	r.observation = o
+
+	return nil
+}
+
+var importTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04",
+}
+
+// parseImportTime parses a time in RFC 3339 or a similar layout, times without a zone are UTC.
+// A number is read as seconds since the Unix epoch.
+func parseImportTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("observationTime is required")
+	}
+
+	for _, layout := range importTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+
+	return time.Time{}, fmt.Errorf("unable to parse observationTime %s", s)
+}
+
+type unitConversion struct {
+	quantityKind string
+	factor       float64
+	offset       float64
+}
+
+// units maps units to the unit observations of a quantityKind are stored in
+var units = map[string]unitConversion{
+	"Wh":  {"Energy", 0.001, 0},
+	"kWh": {"Energy", 1, 0},
+	"MWh": {"Energy", 1000, 0},
+	"W":   {"Power", 1, 0},
+	"kW":  {"Power", 1000, 0},
+	"MW":  {"Power", 1000000, 0},
+	"Cel": {"Temperature", 1, 0},
+	"°C":  {"Temperature", 1, 0},
+	"K":   {"Temperature", 1, -273.15},
+	"m3":  {"Volume", 1, 0},
+	"l":   {"Volume", 0.001, 0},
+	"L":   {"Volume", 0.001, 0},
+	"Pa":  {"Pressure", 1, 0},
+	"hPa": {"Pressure", 100, 0},
+	"kPa": {"Pressure", 1000, 0},
+	"bar": {"Pressure", 100000, 0},
+	"%RH": {"RelativeHumidity", 1, 0},
+	"%":   {"RelativeHumidity", 1, 0},
+}
+
+func convertUnit(quantityKind, unit string, v float64) (float64, error) {
+	if unit == "" {
+		return v, nil
+	}
+
+	c, ok := units[unit]
+	if !ok || c.quantityKind != quantityKind {
+		return 0, fmt.Errorf("unit %s is not supported for %s", unit, quantityKind)
+	}
+
+	return v*c.factor + c.offset, nil
+}
@@ -0,0 +1,70 @@
+package application
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestImportObservationsDryRun(t *testing.T) {
+	is := is.New(t)
+
+	csv := `meter;ts;reading;qk;unit
+meter-1;2021-01-01T00:00:00Z;1,5;Energy;MWh
+meter-1;2021-01-01 01:00:00;1600;Energy;kWh
+meter-1;not a time;1700;Energy;
+meter-2;1609462800;true;diwise:Presence;
+meter-3;2021-01-01T00:00:00Z;20;Temperature;kWh
+`
+	a := New(nil, NewConfig(false, "")).(*app)
+
+	progress := 0
+	result, err := a.ImportObservations(context.Background(), strings.NewReader(csv), ImportOptions{
+		Columns: map[string]string{
+			ImportSensorID:        "meter",
+			ImportObservationTime: "ts",
+			ImportValue:           "reading",
+			ImportQuantityKind:    "qk",
+		},
+		Separator: ';',
+		DryRun:    true,
+		Progress:  func(ImportResult) { progress++ },
+	})
+
+	is.NoErr(err)
+	is.True(result.DryRun)
+	is.Equal(int64(5), result.Rows)
+	is.Equal(int64(3), result.Imported)
+	is.Equal(int64(2), result.Skipped)
+	is.Equal(int64(3), result.Errors[0].Row)
+	is.Equal(int64(5), result.Errors[1].Row)
+	is.Equal("unit kWh is not supported for Temperature", result.Errors[1].Message)
+	is.True(progress > 0)
+}
+
+func TestImportObservationsRequiresColumns(t *testing.T) {
+	is := is.New(t)
+
+	a := New(nil, NewConfig(false, "")).(*app)
+
+	_, err := a.ImportObservations(context.Background(), strings.NewReader("sensorId,value\n"), ImportOptions{DryRun: true})
+	is.True(err != nil)
+}
+
+func TestParseImportRow(t *testing.T) {
+	is := is.New(t)
+
+	a := New(nil, NewConfig(false, "")).(*app)
+	r, err := newCsvObservationReader(context.Background(), a, strings.NewReader("sensorId,observationTime,value,quantityKind,deviceId,unit\ns1,2021-01-01 00:00,1500,Energy,,Wh\n"), ImportOptions{DeviceID: "building-1", DryRun: true})
+	is.NoErr(err)
+
+	is.True(r.Next())
+	deviceID, o := r.Observation()
+	is.Equal("building-1", deviceID)
+	is.Equal(1.5, *o.Value)
+	is.Equal(time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), o.ObservationTime)
+	is.True(!r.Next())
+}
@@ -0,0 +1,170 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+var ErrQueueFull = errors.New("ingestion queue is full")
+var ErrQueueClosed = errors.New("ingestion queue is closed")
+
+type ingestionItem struct {
+	so  database.SensorObservation
+	evt *Event
+}
+
+type ingestionQueue struct {
+	items  chan ingestionItem
+	closed bool
+	mu     sync.RWMutex
+	wg     sync.WaitGroup
+}
+
+// enqueue queues a sensor observation for asynchronous storage. If the observation comes from an
+// event, the event has been claimed and the claim is released if the observation can not be
+// stored. ErrQueueFull is returned if the queue can not accept more observations.
+func (a *app) enqueue(item ingestionItem) error {
+	a.queue.mu.RLock()
+	defer a.queue.mu.RUnlock()
+
+	if a.queue.closed {
+		return ErrQueueClosed
+	}
+
+	select {
+	case a.queue.items <- item:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Start loads calibrations, starts the workers that store queued observations, starts listening
+// for stored observations to publish to subscribers, starts delivering events to webhook
+// subscriptions and starts evaluating rules and virtual sensors.
+func (a *app) Start(ctx context.Context) {
+	err := a.loadCalibrations(ctx)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("failed to load calibrations", "err", err.Error())
+	}
+
+	for i := 0; i < a.cfg.ingestionWorkers; i++ {
+		a.queue.wg.Add(1)
+		go a.ingest(ctx)
+	}
+
+	var bgCtx context.Context
+	bgCtx, a.stop = context.WithCancel(ctx)
+	go a.listenForObservations(bgCtx)
+
+	go a.refreshSubscriptions(bgCtx)
+	go a.consumeObservations(bgCtx, "webhooks", a.notifyObservation)
+	go a.refreshRules(bgCtx)
+	go a.consumeObservations(bgCtx, "rules", a.evaluateRules)
+	go a.refreshVirtualSensors(bgCtx)
+	go a.consumeObservations(bgCtx, "virtual-sensors", a.evaluateVirtualSensors)
+	go a.refreshCalibrations(bgCtx)
+	go a.monitorSensors(bgCtx)
+	for i := 0; i < a.cfg.webhookWorkers; i++ {
+		go a.deliverEvents(bgCtx)
+	}
+}
+
+// Shutdown stops accepting new observations and waits for queued observations to be stored.
+func (a *app) Shutdown(ctx context.Context) error {
+	if a.stop != nil {
+		a.stop()
+	}
+
+	a.queue.mu.Lock()
+	if !a.queue.closed {
+		a.queue.closed = true
+		close(a.queue.items)
+	}
+	a.queue.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.queue.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *app) ingest(ctx context.Context) {
+	defer a.queue.wg.Done()
+
+	batch := make([]ingestionItem, 0, a.cfg.ingestionBatchSize)
+
+	ticker := time.NewTicker(a.cfg.ingestionFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case item, ok := <-a.queue.items:
+			if !ok {
+				a.flush(ctx, batch)
+				return
+			}
+
+			batch = append(batch, item)
+			if len(batch) >= a.cfg.ingestionBatchSize {
+				a.flush(ctx, batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				a.flush(ctx, batch)
+				batch = batch[:0]
+			}
+		}
+	}
+}
+
+// flush stores a batch of observations in one transaction. If the batch fails each observation
+// is stored on its own so that one bad observation does not cause the whole batch to be lost.
+func (a *app) flush(ctx context.Context, batch []ingestionItem) {
+	if len(batch) == 0 {
+		return
+	}
+
+	log := logging.GetFromContext(ctx)
+
+	sos := make([]database.SensorObservation, 0, len(batch))
+
+	for _, item := range batch {
+		err := a.prepareObservation(ctx, item.so)
+		if err != nil {
+			log.Error("failed to register device", "device_id", item.so.DeviceID, "err", err.Error())
+		}
+		sos = append(sos, item.so)
+	}
+
+	err := a.db.AddObservations(ctx, sos)
+	if err != nil {
+		log.Warn("failed to store batch of observations, will store them one by one", "size", len(batch), "err", err.Error())
+
+		for _, item := range batch {
+			err := a.db.AddObservation(ctx, item.so)
+			if err != nil {
+				log.Error("failed to store observation", "device_id", item.so.DeviceID, "err", err.Error())
+				if item.evt != nil {
+					a.deadLetter(ctx, *item.evt, fmt.Errorf("failed to store observation: %w", err))
+					a.releaseEvent(ctx, *item.evt)
+				}
+			}
+		}
+	}
+}
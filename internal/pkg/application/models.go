@@ -13,10 +13,11 @@ import (
 const FunctionUpdatedName = "function.updated"
 
 type FunctionUpdated struct {
-	Id      string `json:"id"`
-	Type    string `json:"type"`
-	SubType string `json:"subType"`
-	Counter *struct {
+	Id        string     `json:"id"`
+	Type      string     `json:"type"`
+	SubType   string     `json:"subType"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Counter   *struct {
 		Counter int  `json:"counter"`
 		State   bool `json:"state"`
 	} `json:"counter,omitempty"`
@@ -44,17 +45,45 @@ type FunctionUpdated struct {
 	} `json:"building,omitempty"`
 }
 
-func (m FunctionUpdated) MapToObservation() (database.SensorObservation, bool) {
+// TimestampPolicy decides which time to use for an observation when neither
+// the function payload nor the cloudevent carries a timestamp.
+type TimestampPolicy string
+
+const (
+	TimestampPolicyReceived TimestampPolicy = "received"
+	TimestampPolicyReject   TimestampPolicy = "reject"
+)
+
+func (p TimestampPolicy) Fallback(eventTime, received time.Time) time.Time {
+	if !eventTime.IsZero() {
+		return eventTime.UTC()
+	}
+	if p == TimestampPolicyReject {
+		return time.Time{}
+	}
+	return received.UTC()
+}
+
+// MapToObservation maps the function to an observation. The observation time is taken
+// from the function payload if present, otherwise from eventTime. If both are missing, or the
+// payload of the function type is missing, the function can not be mapped.
+func (m FunctionUpdated) MapToObservation(eventTime time.Time) (database.SensorObservation, bool) {
 	so := database.SensorObservation{
-		Format:       "rec3.1.1",
+		Format:       EdgeMessageFormat,
 		DeviceID:     fmt.Sprintf("%s:%s:%s", m.Type, m.SubType, m.Id),
 		Observations: make([]database.Observation, 0),
 	}
 
-	ts := time.Now().UTC()
+	ts := eventTime.UTC()
+	if m.Timestamp != nil && !m.Timestamp.IsZero() {
+		ts = m.Timestamp.UTC()
+	}
 
 	switch m.Type {
 	case "building":
+		if m.Building == nil {
+			return database.SensorObservation{}, false
+		}
 		so.Observations = append(so.Observations, database.Observation{
 			ObservationTime: ts,
 			Value:           &m.Building.Energy,
@@ -67,6 +96,9 @@ func (m FunctionUpdated) MapToObservation() (database.SensorObservation, bool) {
 			SensorId:        m.Id,
 		})
 	case "counter":
+		if m.Counter == nil {
+			return database.SensorObservation{}, false
+		}
 		v := float64(m.Counter.Counter)
 		so.Observations = append(so.Observations, database.Observation{
 			ObservationTime: ts,
@@ -76,13 +108,26 @@ func (m FunctionUpdated) MapToObservation() (database.SensorObservation, bool) {
 			SensorId:        m.Id,
 		})
 	case "level":
-		so.Observations = append(so.Observations, database.Observation{
+		if m.Level == nil {
+			return database.SensorObservation{}, false
+		}
+		o := database.Observation{
 			ObservationTime: ts,
 			Value:           &m.Level.Current,
 			QuantityKind:    "diwise:Level",
 			SensorId:        m.Id,
-		})
+		}
+		// the offset of the function is applied like a calibration, a calibration of the sensor
+		// is applied to the raw value instead
+		if m.Level.Offset != nil {
+			v := m.Level.Current + *m.Level.Offset
+			o.RawValue, o.Value = &m.Level.Current, &v
+		}
+		so.Observations = append(so.Observations, o)
 	case "presence":
+		if m.Presence == nil {
+			return database.SensorObservation{}, false
+		}
 		if m.SubType == "lifebuoy" {
 			so.Observations = append(so.Observations, database.Observation{
 				ObservationTime: ts,
@@ -99,6 +144,9 @@ func (m FunctionUpdated) MapToObservation() (database.SensorObservation, bool) {
 			})
 		}
 	case "timer":
+		if m.Timer == nil || m.Timer.EndTime == nil || m.Timer.Duration == nil {
+			return database.SensorObservation{}, false
+		}
 		v := m.Timer.Duration.Seconds()
 		so.Observations = append(so.Observations, database.Observation{
 			ObservationTime: *m.Timer.EndTime,
@@ -108,6 +156,9 @@ func (m FunctionUpdated) MapToObservation() (database.SensorObservation, bool) {
 			SensorId:        m.Id,
 		})
 	case "waterquality":
+		if m.WaterQuality == nil {
+			return database.SensorObservation{}, false
+		}
 		so.Observations = append(so.Observations, database.Observation{
 			ObservationTime: m.WaterQuality.Timestamp,
 			Value:           mapFloatValue(&m.WaterQuality.Temperature, 1),
@@ -118,9 +169,21 @@ func (m FunctionUpdated) MapToObservation() (database.SensorObservation, bool) {
 		return database.SensorObservation{}, false
 	}
 
+	for _, o := range so.Observations {
+		if o.ObservationTime.IsZero() {
+			return database.SensorObservation{}, false
+		}
+	}
+
 	return so, true
 }
 
+// SensorObservationName is the event type used for REC edge messages, i.e. a SensorObservation
+const SensorObservationName = "rec.observation"
+
+// SenMLName is the event type used for LwM2M SenML packs, in the same format as in message.accepted
+const SenMLName = "senml"
+
 const MessageAcceptedName = "message.accepted"
 
 type MessageAccepted struct {
@@ -130,6 +193,10 @@ type MessageAccepted struct {
 }
 
 func (m MessageAccepted) MapToObservation() (database.SensorObservation, bool) {
+	if len(m.Pack) < 2 {
+		return database.SensorObservation{}, false
+	}
+
 	sensorId := m.Pack[0].StringValue
 	observationTime := mapTime(m.Pack[0].BaseTime)
 	quantityKind := mapQuantityKind(m)
@@ -150,7 +217,7 @@ func (m MessageAccepted) MapToObservation() (database.SensorObservation, bool) {
 	}
 
 	so := database.SensorObservation{
-		Format:   "rec3.1.1",
+		Format:   EdgeMessageFormat,
 		DeviceID: m.SensorID,
 		Observations: []database.Observation{
 			{
@@ -0,0 +1,160 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+)
+
+var ErrInvalidOccupancyReport = errors.New("invalid occupancy report")
+
+const presenceQuantityKind = "diwise:Presence"
+
+// OccupancyReport is the utilisation of the spaces covered by presence sensors, computed from the
+// boolean state changes reported by the sensors.
+type OccupancyReport struct {
+	Interval string            `json:"interval"`
+	From     time.Time         `json:"from"`
+	To       time.Time         `json:"to"`
+	Sensors  []SensorOccupancy `json:"sensors"`
+}
+
+// SensorOccupancy is the time a sensor has reported presence, the share of the elapsed time in percent
+// and the number of occupancy sessions, in total and per bucket. The peak is the bucket with the
+// highest utilisation.
+type SensorOccupancy struct {
+	SensorID        string            `json:"sensorId"`
+	Occupied        string            `json:"occupied"`
+	Utilisation     float64           `json:"utilisation"`
+	Sessions        int               `json:"sessions"`
+	PeakUtilisation *float64          `json:"peakUtilisation,omitempty"`
+	PeakTime        *time.Time        `json:"peakTime,omitempty"`
+	Buckets         []OccupancyBucket `json:"buckets"`
+}
+
+type OccupancyBucket struct {
+	Period
+	Occupied    string  `json:"occupied"`
+	Utilisation float64 `json:"utilisation"`
+	Sessions    int     `json:"sessions"`
+
+	occupied time.Duration
+}
+
+// GetOccupancy computes the occupancy per bucket of the interval for each sensor matching the filter
+// that has reported a boolean state. The state at the start of the time range is the latest state
+// reported before it, and a sensor that is occupied at the end of the time range, or now if that is
+// earlier, is occupied until then. A session that started before the time range is counted in the
+// first bucket.
+func (a *app) GetOccupancy(ctx context.Context, filter database.ObservationFilter, interval string, loc *time.Location) (OccupancyReport, error) {
+	periods, err := newPeriods(filter.Starting, filter.Ending, interval, loc)
+	if err != nil {
+		return OccupancyReport{}, fmt.Errorf("%w: %s", ErrInvalidOccupancyReport, err.Error())
+	}
+
+	report := OccupancyReport{
+		Interval: interval,
+		From:     periods[0].From,
+		To:       periods[len(periods)-1].To,
+		Sensors:  make([]SensorOccupancy, 0),
+	}
+
+	if filter.QuantityKind == "" {
+		filter.QuantityKind = presenceQuantityKind
+	}
+	filter.Starting, filter.Ending = report.From, report.To
+
+	end := time.Now().UTC()
+	if report.To.Before(end) {
+		end = report.To
+	}
+
+	readings, err := a.loadReadings(ctx, filter, func(o database.Observation) bool { return o.ValueBoolean != nil })
+	if err != nil {
+		return OccupancyReport{}, err
+	}
+
+	for sensorID, r := range readings {
+		report.Sensors = append(report.Sensors, newSensorOccupancy(sensorID, periods, r, report.From, end))
+	}
+
+	sort.Slice(report.Sensors, func(i, j int) bool {
+		return report.Sensors[i].SensorID < report.Sensors[j].SensorID
+	})
+
+	return report, nil
+}
+
+func newSensorOccupancy(sensorID string, periods []Period, readings []database.Observation, from, end time.Time) SensorOccupancy {
+	buckets := make([]OccupancyBucket, len(periods))
+	for i, p := range periods {
+		buckets[i] = OccupancyBucket{Period: p}
+	}
+
+	s := SensorOccupancy{
+		SensorID: sensorID,
+		Buckets:  buckets,
+	}
+
+	occupied := func(since, until time.Time) {
+		for i := range buckets {
+			buckets[i].occupied += buckets[i].overlap(since, until)
+		}
+	}
+
+	var occupiedSince *time.Time
+
+	for _, o := range readings {
+		t := o.ObservationTime
+		if !t.Before(end) {
+			break
+		}
+		if t.Before(from) {
+			t = from
+		}
+
+		if *o.ValueBoolean && occupiedSince == nil {
+			occupiedSince = &t
+			s.Sessions++
+			if i := findPeriod(periods, t); i >= 0 {
+				buckets[i].Sessions++
+			}
+		} else if !*o.ValueBoolean && occupiedSince != nil {
+			occupied(*occupiedSince, t)
+			occupiedSince = nil
+		}
+	}
+
+	if occupiedSince != nil {
+		occupied(*occupiedSince, end)
+	}
+
+	total := time.Duration(0)
+
+	for i, b := range buckets {
+		total += b.occupied
+		buckets[i].Occupied = b.occupied.String()
+		buckets[i].Utilisation = utilisation(b.occupied, b.overlap(from, end))
+
+		if b.occupied > 0 && (s.PeakUtilisation == nil || buckets[i].Utilisation > *s.PeakUtilisation) {
+			s.PeakUtilisation, s.PeakTime = &buckets[i].Utilisation, &buckets[i].From
+		}
+	}
+
+	s.Occupied = total.String()
+	s.Utilisation = utilisation(total, end.Sub(from))
+
+	return s
+}
+
+// utilisation returns the occupied share of the elapsed time in percent.
+func utilisation(occupied, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return 100 * occupied.Seconds() / elapsed.Seconds()
+}
@@ -0,0 +1,55 @@
+package application
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestGetOccupancyHandlesOpenIntervals(t *testing.T) {
+	is := is.New(t)
+
+	day := time.Date(2024, 1, 1, 8, 0, 0, 0, time.UTC)
+	state := func(sensorID string, at time.Time, occupied bool) database.Observation {
+		return database.Observation{SensorId: sensorID, QuantityKind: "diwise:Presence", ObservationTime: at, ValueBoolean: &occupied}
+	}
+
+	db := &dbMock{
+		boundaries: []database.StoredObservation{
+			{Observation: state("room-1", day.Add(-time.Hour), true)},
+		},
+		observations: []database.Observation{
+			state("room-1", day.Add(30*time.Minute), false),
+			state("room-1", day.Add(75*time.Minute), true),
+			state("room-1", day.Add(80*time.Minute), true),
+			state("room-1", day.Add(90*time.Minute), false),
+			state("room-2", day.Add(150*time.Minute), true),
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	report, err := a.GetOccupancy(context.Background(), database.ObservationFilter{Starting: day, Ending: day.Add(3 * time.Hour)}, IntervalHour, time.UTC)
+	is.NoErr(err)
+
+	is.Equal(2, len(report.Sensors))
+
+	// room-1 was occupied when the time range started and reported occupied twice in the second session
+	room := report.Sensors[0]
+	is.Equal("room-1", room.SensorID)
+	is.Equal(2, room.Sessions)
+	is.Equal("45m0s", room.Occupied)
+	is.Equal(50.0, room.Buckets[0].Utilisation)
+	is.Equal(1, room.Buckets[0].Sessions)
+	is.Equal(25.0, room.Buckets[1].Utilisation)
+	is.Equal(0.0, room.Buckets[2].Utilisation)
+	is.Equal(day, *room.PeakTime)
+
+	// room-2 is still occupied at the end of the time range
+	room = report.Sensors[1]
+	is.Equal("room-2", room.SensorID)
+	is.Equal("30m0s", room.Occupied)
+	is.Equal(50.0, room.Buckets[2].Utilisation)
+}
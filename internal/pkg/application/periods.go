@@ -0,0 +1,80 @@
+package application
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	IntervalHour  = "hour"
+	IntervalDay   = "day"
+	IntervalMonth = "month"
+)
+
+const maxPeriods = 10000
+
+type Period struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// newPeriods returns the consecutive periods of the interval that cover from to to, starting at the
+// beginning of the period that from is in, in the location loc.
+func newPeriods(from, to time.Time, interval string, loc *time.Location) ([]Period, error) {
+	from = from.In(loc)
+
+	var start time.Time
+	var next func(time.Time) time.Time
+
+	switch interval {
+	case IntervalHour:
+		start = from.Truncate(time.Hour)
+		next = func(t time.Time) time.Time { return t.Add(time.Hour) }
+	case IntervalDay:
+		start = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	case IntervalMonth:
+		start = time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, loc)
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+	default:
+		return nil, fmt.Errorf("interval must be %s, %s or %s", IntervalHour, IntervalDay, IntervalMonth)
+	}
+
+	if !from.Before(to) {
+		return nil, fmt.Errorf("the start of the time range must be before its end")
+	}
+
+	periods := make([]Period, 0)
+	for t := start; t.Before(to); t = next(t) {
+		if len(periods) == maxPeriods {
+			return nil, fmt.Errorf("the time range has more than %d periods", maxPeriods)
+		}
+		periods = append(periods, Period{From: t.UTC(), To: next(t).UTC()})
+	}
+
+	return periods, nil
+}
+
+// findPeriod returns the index of the period that t is in, or -1 if t is outside all periods.
+func findPeriod(periods []Period, t time.Time) int {
+	i := sort.Search(len(periods), func(i int) bool { return periods[i].To.After(t) })
+	if i == len(periods) || t.Before(periods[i].From) {
+		return -1
+	}
+	return i
+}
+
+// overlap returns how much of the period lies between from and to.
+func (p Period) overlap(from, to time.Time) time.Duration {
+	if from.Before(p.From) {
+		from = p.From
+	}
+	if to.After(p.To) {
+		to = p.To
+	}
+	if !from.Before(to) {
+		return 0
+	}
+	return to.Sub(from)
+}
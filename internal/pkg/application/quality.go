@@ -0,0 +1,286 @@
+package application
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+)
+
+var ErrInvalidQualityOverride = errors.New("invalid quality override")
+
+const (
+	// outlierWindow is the number of recent values per sensor that outliers are detected against
+	outlierWindow = 30
+	// outlierMinSamples is the number of values needed before outliers are detected
+	outlierMinSamples = 10
+)
+
+// QualityCheck is the checks an observation value is flagged by. Values outside Min and Max are bad,
+// values changing faster than MaxRate per hour from the previous value, or deviating more than
+// OutlierDeviations standard deviations from the mean of recent values, are suspect.
+type QualityCheck struct {
+	Min               *float64
+	Max               *float64
+	MaxRate           *float64
+	OutlierDeviations float64
+}
+
+// QualityChecks holds the checks per sensor and per quantity kind. Checks for a sensor take precedence
+// over checks for a quantity kind.
+type QualityChecks struct {
+	sensors       map[string]QualityCheck
+	quantityKinds map[string]QualityCheck
+}
+
+func NewQualityChecks() QualityChecks {
+	return QualityChecks{
+		sensors:       make(map[string]QualityCheck),
+		quantityKinds: make(map[string]QualityCheck),
+	}
+}
+
+func (qc QualityChecks) Get(sensorID, quantityKind string) (QualityCheck, bool) {
+	if c, ok := qc.sensors[sensorID]; ok {
+		return c, true
+	}
+	c, ok := qc.quantityKinds[quantityKind]
+	return c, ok
+}
+
+// readQualityChecks reads checks from a semicolon separated file with the columns
+// quantityKind;sensorId;min;max;maxRate;outlierDeviations
+// where either quantityKind or sensorId is set. Empty columns are not checked.
+func readQualityChecks(reader io.Reader) (QualityChecks, error) {
+	r := csv.NewReader(reader)
+	r.Comma = ';'
+
+	rows, err := r.ReadAll()
+	if err != nil {
+		return QualityChecks{}, err
+	}
+
+	checks := NewQualityChecks()
+
+	if len(rows) == 0 {
+		return checks, nil
+	}
+
+	for i, row := range rows[1:] {
+		if len(row) < 6 {
+			return QualityChecks{}, fmt.Errorf("row %d: expected 6 columns but found %d", i+1, len(row))
+		}
+
+		var c QualityCheck
+		var deviations *float64
+
+		for j, f := range []**float64{&c.Min, &c.Max, &c.MaxRate, &deviations} {
+			value := strings.TrimSpace(row[j+2])
+			if value == "" {
+				continue
+			}
+
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return QualityChecks{}, fmt.Errorf("row %d: %w", i+1, err)
+			}
+			*f = &v
+		}
+
+		if c.Min != nil && c.Max != nil && *c.Min > *c.Max {
+			return QualityChecks{}, fmt.Errorf("row %d: min can not be greater than max", i+1)
+		}
+		if c.MaxRate != nil && *c.MaxRate <= 0 {
+			return QualityChecks{}, fmt.Errorf("row %d: maxRate must be positive", i+1)
+		}
+		if deviations != nil {
+			if *deviations <= 0 {
+				return QualityChecks{}, fmt.Errorf("row %d: outlierDeviations must be positive", i+1)
+			}
+			c.OutlierDeviations = *deviations
+		}
+
+		quantityKind, sensorID := strings.TrimSpace(row[0]), strings.TrimSpace(row[1])
+
+		if sensorID != "" {
+			checks.sensors[sensorID] = c
+		} else if quantityKind != "" {
+			checks.quantityKinds[NormaliseQuantityKind(quantityKind)] = c
+		} else {
+			return QualityChecks{}, fmt.Errorf("row %d: either quantityKind or sensorId must be set", i+1)
+		}
+	}
+
+	return checks, nil
+}
+
+func (a *app) LoadQualityChecks(ctx context.Context, reader io.Reader) error {
+	checks, err := readQualityChecks(reader)
+	if err != nil {
+		return err
+	}
+
+	a.quality.mu.Lock()
+	a.quality.checks = checks
+	a.quality.mu.Unlock()
+
+	return nil
+}
+
+// qualitySeries is the latest value and the recent values of a sensor and quantity kind.
+type qualitySeries struct {
+	latest     time.Time
+	latestV    float64
+	recent     []float64
+	recentNext int
+}
+
+func (s *qualitySeries) add(t time.Time, v float64) {
+	s.latest, s.latestV = t, v
+
+	if len(s.recent) < outlierWindow {
+		s.recent = append(s.recent, v)
+		return
+	}
+
+	s.recent[s.recentNext] = v
+	s.recentNext = (s.recentNext + 1) % outlierWindow
+}
+
+// isOutlier reports whether v deviates more than deviations standard deviations from the mean of the
+// recent values.
+func (s *qualitySeries) isOutlier(v, deviations float64) bool {
+	if len(s.recent) < outlierMinSamples {
+		return false
+	}
+
+	mean := 0.0
+	for _, r := range s.recent {
+		mean += r
+	}
+	mean /= float64(len(s.recent))
+
+	variance := 0.0
+	for _, r := range s.recent {
+		variance += (r - mean) * (r - mean)
+	}
+	stddev := math.Sqrt(variance / float64(len(s.recent)))
+
+	return stddev > 0 && math.Abs(v-mean) > deviations*stddev
+}
+
+// qualityMonitor flags observations by the quality checks, keeping the recent values of each sensor
+// that rates of change and outliers are detected against.
+type qualityMonitor struct {
+	mu     sync.Mutex
+	checks QualityChecks
+	series map[string]*qualitySeries
+}
+
+func newQualityMonitor() *qualityMonitor {
+	return &qualityMonitor{
+		checks: NewQualityChecks(),
+		series: make(map[string]*qualitySeries),
+	}
+}
+
+// check sets the quality of an observation unless the source has set it already. Observations left
+// without a value by their calibration are bad. Rates of change and outliers are only checked for
+// observations that are newer than the latest value of the sensor, so that older observations, such as
+// imported history, are only checked against the valid range.
+func (qm *qualityMonitor) check(o *database.Observation) {
+	if o.Quality != "" {
+		return
+	}
+
+	if o.Value == nil {
+		o.Quality = database.QualityGood
+		if o.RawValue != nil {
+			o.Quality, o.QualityReason = database.QualityBad, database.QualityReasonCalibration
+		}
+		return
+	}
+
+	v := *o.Value
+	o.Quality = database.QualityGood
+
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+
+	c, ok := qm.checks.Get(o.SensorId, o.QuantityKind)
+	if !ok {
+		return
+	}
+
+	if (c.Min != nil && v < *c.Min) || (c.Max != nil && v > *c.Max) {
+		o.Quality, o.QualityReason = database.QualityBad, database.QualityReasonRange
+		return
+	}
+
+	if c.MaxRate == nil && c.OutlierDeviations == 0 {
+		return
+	}
+
+	key := o.SensorId + "/" + o.QuantityKind
+	s, found := qm.series[key]
+	if !found {
+		s = &qualitySeries{}
+		qm.series[key] = s
+	} else if !o.ObservationTime.After(s.latest) {
+		return
+	}
+
+	if found && c.MaxRate != nil && math.Abs(v-s.latestV)/o.ObservationTime.Sub(s.latest).Hours() > *c.MaxRate {
+		o.Quality, o.QualityReason = database.QualitySuspect, database.QualityReasonRate
+	} else if c.OutlierDeviations > 0 && s.isOutlier(v, c.OutlierDeviations) {
+		o.Quality, o.QualityReason = database.QualitySuspect, database.QualityReasonOutlier
+	}
+
+	// suspect values are kept so that a lasting change of level is not flagged for long
+	s.add(o.ObservationTime, v)
+}
+
+// checkQuality sets the quality of the observations of a sensor observation.
+func (a *app) checkQuality(so database.SensorObservation) {
+	for i := range so.Observations {
+		a.quality.check(&so.Observations[i])
+	}
+}
+
+// SetObservationQuality overrides the quality of the observations of a sensor within a time range and
+// returns the number of observations changed. ErrInvalidQualityOverride is returned if the override
+// is not valid.
+func (a *app) SetObservationQuality(ctx context.Context, q database.QualityOverride) (int64, error) {
+	if q.SensorID == "" {
+		return 0, fmt.Errorf("%w: sensorId is required", ErrInvalidQualityOverride)
+	}
+	if !database.IsQuality(q.Quality) {
+		return 0, fmt.Errorf("%w: unknown quality %s", ErrInvalidQualityOverride, q.Quality)
+	}
+	if q.From.IsZero() || q.To.IsZero() || q.To.Before(q.From) {
+		return 0, fmt.Errorf("%w: from and to are required and to can not be before from", ErrInvalidQualityOverride)
+	}
+
+	if q.Reason == "" {
+		q.Reason = database.QualityReasonManual
+	}
+
+	filter := database.ObservationFilter{
+		SensorIDs: []string{q.SensorID},
+		Starting:  q.From,
+		Ending:    q.To,
+	}
+	if q.QuantityKind != "" {
+		filter.QuantityKind = NormaliseQuantityKind(q.QuantityKind)
+	}
+
+	return a.db.SetObservationQuality(ctx, filter, q.Quality, q.Reason)
+}
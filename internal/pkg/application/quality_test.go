@@ -0,0 +1,115 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestReadQualityChecks(t *testing.T) {
+	is := is.New(t)
+
+	checks, err := readQualityChecks(strings.NewReader("quantityKind;sensorId;min;max;maxRate;outlierDeviations\nTemperature;;-30;50;10;4\n;s1;;;;\n"))
+	is.NoErr(err)
+
+	c, ok := checks.Get("s2", "Temperature")
+	is.True(ok)
+	is.Equal(-30.0, *c.Min)
+	is.Equal(10.0, *c.MaxRate)
+	is.Equal(4.0, c.OutlierDeviations)
+
+	// a sensor without checks is not checked even if its quantity kind is
+	c, ok = checks.Get("s1", "Temperature")
+	is.True(ok)
+	is.True(c.Min == nil && c.MaxRate == nil)
+
+	_, ok = checks.Get("s2", "Energy")
+	is.True(!ok)
+
+	_, err = readQualityChecks(strings.NewReader("quantityKind;sensorId;min;max;maxRate;outlierDeviations\nTemperature;;50;-30;;\n"))
+	is.True(err != nil)
+
+	_, err = readQualityChecks(strings.NewReader("quantityKind;sensorId;min;max;maxRate;outlierDeviations\nTemperature;;;;fast;\n"))
+	is.True(err != nil)
+}
+
+func TestQualityMonitorFlagsObservations(t *testing.T) {
+	is := is.New(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	checks, err := readQualityChecks(strings.NewReader("quantityKind;sensorId;min;max;maxRate;outlierDeviations\nTemperature;;-30;50;10;3\n"))
+	is.NoErr(err)
+
+	qm := newQualityMonitor()
+	qm.checks = checks
+
+	check := func(sensorID string, at time.Time, value float64) database.Observation {
+		o := database.Observation{SensorId: sensorID, QuantityKind: "Temperature", ObservationTime: at, Value: &value}
+		qm.check(&o)
+		return o
+	}
+
+	for i := 0; i < 12; i++ {
+		is.Equal(database.QualityGood, check("s1", start.Add(time.Duration(i)*time.Hour), 20+float64(i%2)).Quality)
+		is.Equal(database.QualityGood, check("s2", start.Add(time.Duration(i)*time.Hour), 20+float64(i%2)).Quality)
+	}
+
+	o := check("s1", start.Add(12*time.Hour), -40)
+	is.Equal(database.QualityBad, o.Quality)
+	is.Equal(database.QualityReasonRange, o.QualityReason)
+
+	// 14 degrees in an hour and 15 minutes is faster than 10 degrees per hour
+	o = check("s1", start.Add(12*time.Hour+15*time.Minute), 35)
+	is.Equal(database.QualitySuspect, o.Quality)
+	is.Equal(database.QualityReasonRate, o.QualityReason)
+
+	// 7 degrees in 8 hours is slow but far from the recent values
+	o = check("s2", start.Add(20*time.Hour), 28)
+	is.Equal(database.QualitySuspect, o.Quality)
+	is.Equal(database.QualityReasonOutlier, o.QualityReason)
+
+	// older observations are only checked against the valid range
+	o = check("s2", start, 45)
+	is.Equal(database.QualityGood, o.Quality)
+
+	o = database.Observation{SensorId: "s1", QuantityKind: "Temperature", ObservationTime: start.Add(21 * time.Hour), Value: new(float64), Quality: database.QualityEstimated}
+	qm.check(&o)
+	is.Equal(database.QualityEstimated, o.Quality)
+
+	raw := 100.0
+	o = database.Observation{SensorId: "s2", QuantityKind: "Temperature", ObservationTime: start, RawValue: &raw}
+	qm.check(&o)
+	is.Equal(database.QualityBad, o.Quality)
+	is.Equal(database.QualityReasonCalibration, o.QualityReason)
+}
+
+func TestSetObservationQualityIsValidated(t *testing.T) {
+	is := is.New(t)
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	db := &dbMock{}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	_, err := a.SetObservationQuality(context.Background(), database.QualityOverride{SensorID: "s1", From: from, To: from.Add(time.Hour), Quality: "fine"})
+	is.True(errors.Is(err, ErrInvalidQualityOverride))
+
+	_, err = a.SetObservationQuality(context.Background(), database.QualityOverride{SensorID: "s1", From: from, Quality: database.QualityBad})
+	is.True(errors.Is(err, ErrInvalidQualityOverride))
+
+	_, err = a.SetObservationQuality(context.Background(), database.QualityOverride{SensorID: "s1", QuantityKind: "Temperature", From: from, To: from.Add(time.Hour), Quality: database.QualityBad})
+	is.NoErr(err)
+
+	is.Equal([]string{"s1"}, db.qualityFilter.SensorIDs)
+	is.Equal("Temperature", db.qualityFilter.QuantityKind)
+	is.Equal(database.QualityBad+"/"+database.QualityReasonManual, db.quality)
+}
+
+func (db *dbMock) SetObservationQuality(ctx context.Context, filter database.ObservationFilter, quality, reason string) (int64, error) {
+	db.qualityFilter, db.quality = filter, quality+"/"+reason
+	return 1, nil
+}
@@ -0,0 +1,137 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+)
+
+var ErrInvalidResample = errors.New("invalid resample")
+
+const (
+	FillPrevious = "previous"
+	FillLinear   = "linear"
+	FillNull     = "null"
+)
+
+const maxResamplePoints = 10000
+
+// ResampleObservations returns the observations matching the filter as regular series, one per sensor,
+// with a point every interval from the first multiple of the interval at or after the start of the
+// filter until its end, or until now if the end is later. Since only changes are stored, the value
+// of a sensor at a point is the value of its latest observation, including observations before the
+// time range, unless fill says otherwise:
+//
+//   - previous carries the latest value forward
+//   - linear interpolates numeric values between the observations around the point, and carries the
+//     latest value forward when there is no later observation
+//   - null leaves points without a value unless an observation was made within the interval before it
+//
+// Points that are not at the time of an observation are estimated. Observations flagged as bad are not
+// used. ErrInvalidResample is returned if the interval or fill is not valid or there would be too many
+// points.
+func (a *app) ResampleObservations(ctx context.Context, filter database.ObservationFilter, interval time.Duration, fill string) ([]database.Observation, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("%w: interval must be positive", ErrInvalidResample)
+	}
+	if fill != FillPrevious && fill != FillLinear && fill != FillNull {
+		return nil, fmt.Errorf("%w: fill must be previous, linear or null", ErrInvalidResample)
+	}
+	if filter.QuantityKind == "" {
+		return nil, fmt.Errorf("%w: quantityKind is required", ErrInvalidResample)
+	}
+
+	end := time.Now().UTC()
+	if filter.Ending.Before(end) {
+		end = filter.Ending
+	}
+
+	start := filter.Starting.Truncate(interval)
+	if start.Before(filter.Starting) {
+		start = start.Add(interval)
+	}
+
+	if end.Before(start) {
+		return []database.Observation{}, nil
+	}
+	if end.Sub(start)/interval >= maxResamplePoints {
+		return nil, fmt.Errorf("%w: more than %d points per sensor", ErrInvalidResample, maxResamplePoints)
+	}
+
+	readings, err := a.loadReadings(ctx, filter, func(o database.Observation) bool {
+		return o.Value != nil || o.ValueString != nil || o.ValueBoolean != nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sensorIDs := make([]string, 0, len(readings))
+	for sensorID := range readings {
+		sensorIDs = append(sensorIDs, sensorID)
+	}
+	sort.Strings(sensorIDs)
+
+	points := make([]database.Observation, 0)
+	for _, sensorID := range sensorIDs {
+		points = append(points, resample(sensorID, filter.QuantityKind, readings[sensorID], start, end, interval, fill)...)
+	}
+
+	return points, nil
+}
+
+// resample returns the points of a series from the readings of a sensor, ordered by time.
+func resample(sensorID, quantityKind string, readings []database.Observation, start, end time.Time, interval time.Duration, fill string) []database.Observation {
+	points := make([]database.Observation, 0)
+
+	// i is the index of the first reading after the point
+	i := 0
+
+	for t := start; !t.After(end); t = t.Add(interval) {
+		for i < len(readings) && !readings[i].ObservationTime.After(t) {
+			i++
+		}
+
+		point := database.Observation{
+			SensorId:        sensorID,
+			QuantityKind:    quantityKind,
+			ObservationTime: t,
+		}
+
+		if i == 0 {
+			points = append(points, point)
+			continue
+		}
+
+		previous := readings[i-1]
+
+		if previous.ObservationTime.Equal(t) {
+			point.Value, point.ValueString, point.ValueBoolean = previous.Value, previous.ValueString, previous.ValueBoolean
+			point.Quality, point.QualityReason = previous.Quality, previous.QualityReason
+			points = append(points, point)
+			continue
+		}
+
+		if fill == FillNull && !previous.ObservationTime.After(t.Add(-interval)) {
+			points = append(points, point)
+			continue
+		}
+
+		point.Value, point.ValueString, point.ValueBoolean = previous.Value, previous.ValueString, previous.ValueBoolean
+		point.Quality = database.QualityEstimated
+
+		if fill == FillLinear && i < len(readings) && previous.Value != nil && readings[i].Value != nil {
+			next := readings[i]
+			share := t.Sub(previous.ObservationTime).Seconds() / next.ObservationTime.Sub(previous.ObservationTime).Seconds()
+			v := *previous.Value + (*next.Value-*previous.Value)*share
+			point.Value = &v
+		}
+
+		points = append(points, point)
+	}
+
+	return points
+}
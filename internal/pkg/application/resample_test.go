@@ -0,0 +1,70 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestResampleObservationsReconstructsStepSeries(t *testing.T) {
+	is := is.New(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	reading := func(at time.Time, value float64) database.Observation {
+		return database.Observation{SensorId: "s1", QuantityKind: "Temperature", ObservationTime: at, Value: &value, Quality: database.QualityGood}
+	}
+
+	db := &dbMock{
+		boundaries: []database.StoredObservation{
+			{Observation: reading(start.Add(-3*time.Hour), 20)},
+			{Observation: reading(start.Add(2*time.Hour), 24)},
+		},
+		observations: []database.Observation{
+			reading(start.Add(30*time.Minute), 22),
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	filter := database.ObservationFilter{SensorIDs: []string{"s1"}, QuantityKind: "Temperature", Starting: start.Add(-time.Minute), Ending: start.Add(time.Hour + 30*time.Minute)}
+
+	values := func(points []database.Observation) []any {
+		v := make([]any, 0, len(points))
+		for _, p := range points {
+			if p.Value == nil {
+				v = append(v, nil)
+			} else {
+				v = append(v, *p.Value)
+			}
+		}
+		return v
+	}
+
+	// the value before the time range is carried forward to the first points
+	points, err := a.ResampleObservations(context.Background(), filter, 30*time.Minute, FillPrevious)
+	is.NoErr(err)
+	is.Equal(4, len(points))
+	is.Equal(start, points[0].ObservationTime)
+	is.Equal([]any{20.0, 22.0, 22.0, 22.0}, values(points))
+	is.Equal(database.QualityEstimated, points[0].Quality)
+	is.Equal(database.QualityGood, points[1].Quality)
+
+	// points after the last observation in the time range are interpolated towards the observation after it
+	points, err = a.ResampleObservations(context.Background(), filter, 30*time.Minute, FillLinear)
+	is.NoErr(err)
+	is.Equal([]any{20.0 + 2.0/3.5*3, 22.0, 22.0 + 2.0/3, 22.0 + 4.0/3}, values(points))
+
+	points, err = a.ResampleObservations(context.Background(), filter, 30*time.Minute, FillNull)
+	is.NoErr(err)
+	is.Equal([]any{nil, 22.0, nil, nil}, values(points))
+
+	_, err = a.ResampleObservations(context.Background(), filter, 30*time.Minute, "zero")
+	is.True(errors.Is(err, ErrInvalidResample))
+
+	filter.Starting = start.AddDate(-1, 0, 0)
+	_, err = a.ResampleObservations(context.Background(), filter, time.Minute, FillPrevious)
+	is.True(errors.Is(err, ErrInvalidResample))
+}
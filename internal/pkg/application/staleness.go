@@ -0,0 +1,336 @@
+package application
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const sensorMonitorInterval = time.Minute
+
+// ReportingIntervals holds the expected reporting interval per sensor and per quantity kind. An
+// interval for a sensor takes precedence over an interval for a quantity kind. A sensor with an
+// interval of 0 is not monitored.
+type ReportingIntervals struct {
+	defaultInterval time.Duration
+	sensors         map[string]time.Duration
+	quantityKinds   map[string]time.Duration
+}
+
+func NewReportingIntervals(defaultInterval time.Duration) ReportingIntervals {
+	return ReportingIntervals{
+		defaultInterval: defaultInterval,
+		sensors:         make(map[string]time.Duration),
+		quantityKinds:   make(map[string]time.Duration),
+	}
+}
+
+func (ri ReportingIntervals) Get(sensorID, quantityKind string) time.Duration {
+	if d, ok := ri.sensors[sensorID]; ok {
+		return d
+	}
+	if d, ok := ri.quantityKinds[quantityKind]; ok {
+		return d
+	}
+	return ri.defaultInterval
+}
+
+// min returns the shortest interval that a sensor is monitored with.
+func (ri ReportingIntervals) min() time.Duration {
+	shortest := ri.defaultInterval
+	for _, m := range []map[string]time.Duration{ri.sensors, ri.quantityKinds} {
+		for _, d := range m {
+			if d > 0 && (shortest == 0 || d < shortest) {
+				shortest = d
+			}
+		}
+	}
+	return shortest
+}
+
+// readReportingIntervals reads intervals from a semicolon separated file with the columns
+// quantityKind;sensorId;interval
+// where either quantityKind or sensorId is set.
+func readReportingIntervals(reader io.Reader, defaultInterval time.Duration) (ReportingIntervals, error) {
+	r := csv.NewReader(reader)
+	r.Comma = ';'
+
+	rows, err := r.ReadAll()
+	if err != nil {
+		return ReportingIntervals{}, err
+	}
+
+	intervals := NewReportingIntervals(defaultInterval)
+
+	if len(rows) == 0 {
+		return intervals, nil
+	}
+
+	for i, row := range rows[1:] {
+		if len(row) < 3 {
+			return ReportingIntervals{}, fmt.Errorf("row %d: expected 3 columns but found %d", i+1, len(row))
+		}
+
+		d, err := time.ParseDuration(strings.TrimSpace(row[2]))
+		if err != nil {
+			return ReportingIntervals{}, fmt.Errorf("row %d: %w", i+1, err)
+		}
+		if d < 0 {
+			return ReportingIntervals{}, fmt.Errorf("row %d: interval must not be negative", i+1)
+		}
+
+		quantityKind, sensorID := strings.TrimSpace(row[0]), strings.TrimSpace(row[1])
+
+		if sensorID != "" {
+			intervals.sensors[sensorID] = d
+		} else if quantityKind != "" {
+			intervals.quantityKinds[NormaliseQuantityKind(quantityKind)] = d
+		} else {
+			return ReportingIntervals{}, fmt.Errorf("row %d: either quantityKind or sensorId must be set", i+1)
+		}
+	}
+
+	return intervals, nil
+}
+
+func (a *app) LoadReportingIntervals(ctx context.Context, reader io.Reader) error {
+	intervals, err := readReportingIntervals(reader, a.cfg.reportingInterval)
+	if err != nil {
+		return err
+	}
+
+	a.intervals = intervals
+
+	return nil
+}
+
+// GetSensorStatuses returns the status of sensors that have reported at least once, together with
+// their expected reporting interval.
+func (a *app) GetSensorStatuses(ctx context.Context, filter database.SensorStatusFilter, page, size int) (int64, []database.SensorStatus, error) {
+	total, statuses, err := a.db.GetSensorStatuses(ctx, filter, page, size)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for i, s := range statuses {
+		if d := a.intervals.Get(s.SensorID, s.QuantityKind); d > 0 {
+			statuses[i].ExpectedInterval = d.String()
+		}
+	}
+
+	return total, statuses, nil
+}
+
+// GetObservationGaps returns the periods within the time range of the filter where sensors have not
+// reported for longer than their expected reporting interval. Sensors that have reported at some time
+// but not within the time range have a single gap covering the whole range.
+func (a *app) GetObservationGaps(ctx context.Context, filter database.ObservationFilter) ([]database.ObservationGap, error) {
+	minGap := a.intervals.min()
+	if minGap == 0 {
+		return []database.ObservationGap{}, nil
+	}
+
+	found, err := a.db.GetObservationGaps(ctx, filter, minGap)
+	if err != nil {
+		return nil, err
+	}
+
+	gaps := make([]database.ObservationGap, 0)
+	reported := make(map[string]struct{})
+
+	for _, g := range found {
+		reported[g.SensorID] = struct{}{}
+
+		interval := a.intervals.Get(g.SensorID, g.QuantityKind)
+		if interval > 0 && g.To.Sub(g.From) > interval {
+			gaps = append(gaps, g)
+		}
+	}
+
+	const size = 1000
+	statusFilter := database.SensorStatusFilter{SensorIDs: filter.SensorIDs, QuantityKind: filter.QuantityKind}
+
+	for page := 0; ; page++ {
+		total, statuses, err := a.db.GetSensorStatuses(ctx, statusFilter, page, size)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, s := range statuses {
+			if _, ok := reported[s.SensorID]; ok {
+				continue
+			}
+
+			if filter.DeviceID != "" && filter.DeviceID != s.DeviceID {
+				continue
+			}
+
+			interval := a.intervals.Get(s.SensorID, s.QuantityKind)
+			if interval > 0 && filter.Ending.Sub(filter.Starting) > interval {
+				gaps = append(gaps, database.NewObservationGap(s.SensorID, s.QuantityKind, filter.Starting, filter.Ending))
+			}
+		}
+
+		if int64((page+1)*size) >= total {
+			break
+		}
+	}
+
+	return gaps, nil
+}
+
+// sensorMonitor keeps the number of stale sensors per quantity kind for the stale sensors metric
+type sensorMonitor struct {
+	mu    sync.Mutex
+	stale map[string]int64
+}
+
+func (m *sensorMonitor) set(stale map[string]int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stale = stale
+}
+
+func (m *sensorMonitor) observe(ctx context.Context, o metric.Int64Observer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for quantityKind, count := range m.stale {
+		o.Observe(count, metric.WithAttributes(attribute.String("quantity_kind", quantityKind)))
+	}
+	return nil
+}
+
+// monitorSensors keeps track of the latest observation from each sensor and marks sensors that have not
+// reported within their expected reporting interval as stale, opening an alarm for the built in stale
+// rule, until they report again.
+func (a *app) monitorSensors(ctx context.Context) {
+	log := logging.GetFromContext(ctx)
+
+	_, err := otel.Meter("api-rec/application").Int64ObservableGauge(
+		"diwise.sensors.stale",
+		metric.WithUnit("1"),
+		metric.WithDescription("Number of sensors that have not reported within their expected reporting interval"),
+		metric.WithInt64Callback(a.monitor.observe),
+	)
+	if err != nil {
+		log.Error("failed to create otel stale sensors gauge", "err", err.Error())
+	}
+
+	ticker := time.NewTicker(sensorMonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		err := a.checkSensors(ctx, time.Now().UTC())
+		if err != nil && ctx.Err() == nil {
+			log.Error("failed to check sensor status", "err", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *app) checkSensors(ctx context.Context, now time.Time) error {
+	err := a.db.RefreshSensorStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	const size = 1000
+	stale := make(map[string]int64)
+
+	for page := 0; ; page++ {
+		total, statuses, err := a.db.GetSensorStatuses(ctx, database.SensorStatusFilter{}, page, size)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range statuses {
+			interval := a.intervals.Get(s.SensorID, s.QuantityKind)
+			isStale := interval > 0 && now.Sub(s.LastObservationTime) > interval
+
+			if isStale {
+				stale[s.QuantityKind]++
+			}
+
+			switch {
+			case isStale && s.StaleSince == nil:
+				a.sensorStale(ctx, s, s.LastObservationTime.Add(interval), now)
+			case !isStale && s.StaleSince != nil:
+				a.sensorReporting(ctx, s, now)
+			}
+		}
+
+		if int64((page+1)*size) >= total {
+			break
+		}
+	}
+
+	a.monitor.set(stale)
+
+	return nil
+}
+
+func (a *app) sensorStale(ctx context.Context, s database.SensorStatus, staleSince, now time.Time) {
+	log := logging.GetFromContext(ctx)
+
+	changed, err := a.db.SetSensorStaleSince(ctx, s.SensorID, s.LastObservationTime, &staleSince)
+	if err != nil {
+		log.Error("failed to mark sensor as stale", "sensor_id", s.SensorID, "err", err.Error())
+		return
+	}
+
+	// another instance may already have marked the sensor as stale
+	if !changed {
+		return
+	}
+
+	log.Warn("sensor has stopped reporting", "sensor_id", s.SensorID, "device_id", s.DeviceID, "last_observation_time", s.LastObservationTime)
+
+	_, err = a.db.OpenAlarm(ctx, database.Alarm{
+		RuleID:       database.StaleRuleID,
+		SensorID:     s.SensorID,
+		DeviceID:     s.DeviceID,
+		QuantityKind: s.QuantityKind,
+		TriggeredAt:  staleSince,
+		OpenedAt:     now,
+	})
+	if err != nil {
+		log.Error("failed to open alarm for stale sensor", "sensor_id", s.SensorID, "err", err.Error())
+	}
+}
+
+func (a *app) sensorReporting(ctx context.Context, s database.SensorStatus, now time.Time) {
+	log := logging.GetFromContext(ctx)
+
+	changed, err := a.db.SetSensorStaleSince(ctx, s.SensorID, s.LastObservationTime, nil)
+	if err != nil {
+		log.Error("failed to mark sensor as reporting", "sensor_id", s.SensorID, "err", err.Error())
+		return
+	}
+
+	if !changed {
+		return
+	}
+
+	log.Info("sensor is reporting again", "sensor_id", s.SensorID, "device_id", s.DeviceID, "stale_since", *s.StaleSince)
+
+	_, err = a.db.ClearRuleState(ctx, database.StaleRuleID, s.SensorID, now)
+	if err != nil {
+		log.Error("failed to close alarm for stale sensor", "sensor_id", s.SensorID, "err", err.Error())
+	}
+}
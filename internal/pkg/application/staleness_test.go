@@ -0,0 +1,123 @@
+package application
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestReadReportingIntervals(t *testing.T) {
+	is := is.New(t)
+
+	intervals, err := readReportingIntervals(strings.NewReader("quantityKind;sensorId;interval\nTemperature;;2h\n;s1;15m\ndiwise:Presence;;0\n"), 6*time.Hour)
+	is.NoErr(err)
+
+	is.Equal(15*time.Minute, intervals.Get("s1", "Temperature"))
+	is.Equal(2*time.Hour, intervals.Get("s2", "Temperature"))
+	is.Equal(time.Duration(0), intervals.Get("s3", "diwise:Presence"))
+	is.Equal(6*time.Hour, intervals.Get("s4", "Energy"))
+	is.Equal(15*time.Minute, intervals.min())
+
+	_, err = readReportingIntervals(strings.NewReader("quantityKind;sensorId;interval\n;;1h\n"), 6*time.Hour)
+	is.True(err != nil)
+
+	_, err = readReportingIntervals(strings.NewReader("quantityKind;sensorId;interval\nTemperature;;often\n"), 6*time.Hour)
+	is.True(err != nil)
+}
+
+func TestCheckSensorsMarksStaleSensorsAndOpensAlarms(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	staleSince := now.Add(-time.Hour)
+
+	db := &dbMock{
+		statuses: []database.SensorStatus{
+			{SensorID: "silent", DeviceID: "d1", QuantityKind: "Temperature", LastObservationTime: now.Add(-7 * time.Hour)},
+			{SensorID: "reporting", DeviceID: "d1", QuantityKind: "Temperature", LastObservationTime: now.Add(-time.Minute)},
+			{SensorID: "back", DeviceID: "d2", QuantityKind: "Temperature", LastObservationTime: now.Add(-time.Minute), StaleSince: &staleSince},
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	is.NoErr(a.checkSensors(context.Background(), now))
+
+	is.Equal(1, len(db.alarms))
+	is.Equal(database.StaleRuleID, db.alarms[0].RuleID)
+	is.Equal("silent", db.alarms[0].SensorID)
+	is.Equal(now.Add(-time.Hour), db.alarms[0].TriggeredAt)
+	is.True(db.statuses[0].StaleSince != nil)
+
+	is.Equal([]string{database.StaleRuleID + "/back"}, db.cleared)
+	is.True(db.statuses[2].StaleSince == nil)
+
+	is.Equal(map[string]int64{"Temperature": 1}, a.monitor.stale)
+
+	// a sensor that is still stale does not open another alarm
+	is.NoErr(a.checkSensors(context.Background(), now.Add(time.Minute)))
+	is.Equal(1, len(db.alarms))
+}
+
+func TestGetObservationGapsUsesReportingIntervals(t *testing.T) {
+	is := is.New(t)
+	starting := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ending := starting.Add(24 * time.Hour)
+
+	db := &dbMock{
+		gaps: []database.ObservationGap{
+			database.NewObservationGap("s1", "Temperature", starting, starting.Add(time.Minute)),
+			database.NewObservationGap("s1", "Temperature", starting.Add(time.Hour), starting.Add(3*time.Hour)),
+			database.NewObservationGap("s1", "Temperature", starting.Add(20*time.Hour), ending),
+			database.NewObservationGap("s2", "Energy", starting.Add(time.Hour), starting.Add(3*time.Hour)),
+		},
+		statuses: []database.SensorStatus{
+			{SensorID: "s1", QuantityKind: "Temperature"},
+			{SensorID: "s2", QuantityKind: "Energy"},
+			{SensorID: "s3", QuantityKind: "Temperature"},
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	var err error
+	a.intervals, err = readReportingIntervals(strings.NewReader("quantityKind;sensorId;interval\nTemperature;;1h\n"), 6*time.Hour)
+	is.NoErr(err)
+
+	gaps, err := a.GetObservationGaps(context.Background(), database.ObservationFilter{Starting: starting, Ending: ending})
+	is.NoErr(err)
+
+	is.Equal(3, len(gaps))
+	is.Equal(starting.Add(time.Hour), gaps[0].From)
+	is.Equal("2h0m0s", gaps[0].Duration)
+	is.Equal(starting.Add(20*time.Hour), gaps[1].From)
+
+	// a sensor without observations in the time range has a gap covering the whole range
+	is.Equal("s3", gaps[2].SensorID)
+	is.Equal("24h0m0s", gaps[2].Duration)
+}
+
+func (db *dbMock) RefreshSensorStatus(ctx context.Context) error {
+	return nil
+}
+
+func (db *dbMock) GetSensorStatuses(ctx context.Context, filter database.SensorStatusFilter, page, size int) (int64, []database.SensorStatus, error) {
+	statuses := make([]database.SensorStatus, len(db.statuses))
+	copy(statuses, db.statuses)
+	return int64(len(statuses)), statuses, nil
+}
+
+func (db *dbMock) SetSensorStaleSince(ctx context.Context, sensorID string, lastObservationTime time.Time, staleSince *time.Time) (bool, error) {
+	for i, s := range db.statuses {
+		if s.SensorID == sensorID && s.LastObservationTime.Equal(lastObservationTime) && (s.StaleSince == nil) != (staleSince == nil) {
+			db.statuses[i].StaleSince = staleSince
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (db *dbMock) GetObservationGaps(ctx context.Context, filter database.ObservationFilter, minGap time.Duration) ([]database.ObservationGap, error) {
+	return db.gaps, nil
+}
@@ -0,0 +1,110 @@
+package application
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+const subscriberBufferSize = 256
+
+type subscriber struct {
+	filter database.ObservationFilter
+	ch     chan database.StoredObservation
+}
+
+// observationHub fans out stored observations to subscribers
+type observationHub struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+func newObservationHub() *observationHub {
+	return &observationHub{
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+func (h *observationHub) subscribe(filter database.ObservationFilter) (<-chan database.StoredObservation, func()) {
+	s := &subscriber{
+		filter: filter,
+		ch:     make(chan database.StoredObservation, subscriberBufferSize),
+	}
+
+	h.mu.Lock()
+	h.subscribers[s] = struct{}{}
+	h.mu.Unlock()
+
+	return s.ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.remove(s)
+	}
+}
+
+// remove must be called with the lock held
+func (h *observationHub) remove(s *subscriber) {
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.ch)
+	}
+}
+
+// publish sends an observation to every subscriber with a matching filter. A subscriber that does not
+// keep up is removed and its channel closed, so that it can resume from the last observation it received.
+func (h *observationHub) publish(o database.StoredObservation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for s := range h.subscribers {
+		if !s.filter.Matches(o.DeviceID, o.Observation) {
+			continue
+		}
+
+		select {
+		case s.ch <- o:
+		default:
+			h.remove(s)
+		}
+	}
+}
+
+// SubscribeObservations returns a channel that receives observations matching the filter as they are
+// stored, and a function to cancel the subscription. The channel is closed when the subscription is
+// cancelled or if the subscriber does not keep up.
+func (a *app) SubscribeObservations(filter database.ObservationFilter) (<-chan database.StoredObservation, func()) {
+	return a.hub.subscribe(filter)
+}
+
+// GetObservationsAfter returns observations stored after the observation with id afterID, used to
+// resume a subscription.
+func (a *app) GetObservationsAfter(ctx context.Context, filter database.ObservationFilter, afterID int64, limit int) ([]database.StoredObservation, error) {
+	return a.db.GetObservationsAfter(ctx, filter, afterID, limit)
+}
+
+// listenForObservations publishes stored observations to subscribers until ctx is done, reconnecting
+// to the database if the connection is lost.
+func (a *app) listenForObservations(ctx context.Context) {
+	log := logging.GetFromContext(ctx)
+	backoff := time.Second
+
+	for {
+		err := a.db.ListenForObservations(ctx, a.hub.publish)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Error("stopped listening for stored observations, will retry", "err", err.Error(), "retry_in", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff = min(backoff*2, time.Minute)
+	}
+}
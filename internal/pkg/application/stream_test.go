@@ -0,0 +1,54 @@
+package application
+
+import (
+	"testing"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestObservationHubPublishesMatchingObservations(t *testing.T) {
+	is := is.New(t)
+	hub := newObservationHub()
+
+	temperature, cancelTemperature := hub.subscribe(database.ObservationFilter{QuantityKind: "Temperature"})
+	defer cancelTemperature()
+	sensor, cancelSensor := hub.subscribe(database.ObservationFilter{SensorIDs: []string{"s2"}})
+	defer cancelSensor()
+
+	hub.publish(storedObservation(1, "s1", "Temperature"))
+	hub.publish(storedObservation(2, "s2", "Power"))
+
+	is.Equal(int64(1), (<-temperature).ID)
+	is.Equal(int64(2), (<-sensor).ID)
+	is.Equal(0, len(temperature))
+	is.Equal(0, len(sensor))
+}
+
+func TestObservationHubClosesSlowSubscribers(t *testing.T) {
+	is := is.New(t)
+	hub := newObservationHub()
+
+	observations, cancel := hub.subscribe(database.ObservationFilter{})
+	defer cancel()
+
+	for i := 0; i <= subscriberBufferSize; i++ {
+		hub.publish(storedObservation(int64(i), "s1", "Temperature"))
+	}
+
+	n := 0
+	for range observations {
+		n++
+	}
+
+	is.Equal(subscriberBufferSize, n)
+	is.Equal(0, len(hub.subscribers))
+}
+
+func storedObservation(id int64, sensorID, quantityKind string) database.StoredObservation {
+	return database.StoredObservation{
+		ID:          id,
+		DeviceID:    "d1",
+		Observation: database.Observation{SensorId: sensorID, QuantityKind: quantityKind},
+	}
+}
@@ -0,0 +1,475 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/google/uuid"
+)
+
+const (
+	ObservationStoredName = "observation.stored"
+	EntityCreatedName     = "entity.created"
+	EntityUpdatedName     = "entity.updated"
+)
+
+var subscriptionEventTypes = []string{ObservationStoredName, EntityCreatedName, EntityUpdatedName}
+
+var ErrInvalidSubscription = errors.New("invalid subscription")
+
+const subscriptionRefreshInterval = time.Minute
+
+// subscriptionMatcher is a subscription with its root entity resolved to the sensors in its subtree
+type subscriptionMatcher struct {
+	database.Subscription
+	filter database.ObservationFilter
+}
+
+func (m subscriptionMatcher) wants(eventType string) bool {
+	return len(m.Types) == 0 || slices.Contains(m.Types, eventType)
+}
+
+type webhooks struct {
+	mu       sync.RWMutex
+	matchers []subscriptionMatcher
+
+	// reload asks for subscriptions to be loaded again, wake tells delivery workers that there are new deliveries
+	reload chan struct{}
+	wake   chan struct{}
+
+	lastPurge time.Time
+}
+
+func newWebhooks() *webhooks {
+	return &webhooks{
+		reload: make(chan struct{}, 1),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (w *webhooks) active() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.matchers) > 0
+}
+
+func (w *webhooks) subscribers(eventType string) []subscriptionMatcher {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	matchers := make([]subscriptionMatcher, 0)
+	for _, m := range w.matchers {
+		if m.wants(eventType) {
+			matchers = append(matchers, m)
+		}
+	}
+	return matchers
+}
+
+// AddSubscription validates and stores a new subscription. ErrInvalidSubscription is returned if the
+// endpoint is not an http(s) url, an event type is unknown or the root entity does not exist.
+func (a *app) AddSubscription(ctx context.Context, s database.Subscription) (database.Subscription, error) {
+	u, err := url.ParseRequestURI(s.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return database.Subscription{}, fmt.Errorf("%w: endpoint must be an absolute http or https url", ErrInvalidSubscription)
+	}
+
+	for _, t := range s.Types {
+		if !slices.Contains(subscriptionEventTypes, t) {
+			return database.Subscription{}, fmt.Errorf("%w: unknown event type %s", ErrInvalidSubscription, t)
+		}
+	}
+
+	if s.Root != nil {
+		if t := database.GetTypeFromTypeName(s.Root.Type); t != "" {
+			s.Root.Type = t
+		}
+
+		_, err = a.db.GetEntity(ctx, s.Root.Id, s.Root.Type)
+		if err != nil {
+			return database.Subscription{}, fmt.Errorf("%w: root entity %s not found", ErrInvalidSubscription, s.Root.Id)
+		}
+	}
+
+	if s.QuantityKind != "" {
+		s.QuantityKind = NormaliseQuantityKind(s.QuantityKind)
+	}
+
+	s.Id = uuid.NewString()
+	s.CreatedAt = time.Now().UTC()
+
+	err = a.db.AddSubscription(ctx, s)
+	if err != nil {
+		return database.Subscription{}, err
+	}
+
+	signal(a.webhooks.reload)
+
+	return s, nil
+}
+
+func (a *app) GetSubscription(ctx context.Context, id string) (database.Subscription, error) {
+	return a.db.GetSubscription(ctx, id)
+}
+
+func (a *app) GetSubscriptions(ctx context.Context, page, size int) (int64, []database.Subscription, error) {
+	return a.db.GetSubscriptions(ctx, page, size)
+}
+
+func (a *app) DeleteSubscription(ctx context.Context, id string) error {
+	err := a.db.DeleteSubscription(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	signal(a.webhooks.reload)
+
+	return nil
+}
+
+func (a *app) GetDeliveries(ctx context.Context, subscriptionID string, page, size int) (int64, []database.Delivery, error) {
+	_, err := a.db.GetSubscription(ctx, subscriptionID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return a.db.GetDeliveries(ctx, subscriptionID, page, size)
+}
+
+// loadSubscriptions loads all subscriptions and resolves their root entities to sensors, so that
+// stored observations can be matched without querying the database.
+func (a *app) loadSubscriptions(ctx context.Context) error {
+	const size = 100
+	matchers := make([]subscriptionMatcher, 0)
+
+	for page := 0; ; page++ {
+		total, subscriptions, err := a.db.GetSubscriptions(ctx, page, size)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range subscriptions {
+			m := subscriptionMatcher{
+				Subscription: s,
+				filter:       database.ObservationFilter{QuantityKind: s.QuantityKind},
+			}
+
+			if s.SensorID != "" {
+				m.filter.SensorIDs = []string{s.SensorID}
+			} else if s.Root != nil {
+				m.filter.SensorIDs, err = a.resolveRoot(ctx, *s.Root)
+				if err != nil {
+					return err
+				}
+			}
+
+			matchers = append(matchers, m)
+		}
+
+		if int64((page+1)*size) >= total {
+			break
+		}
+	}
+
+	a.webhooks.mu.Lock()
+	a.webhooks.matchers = matchers
+	a.webhooks.mu.Unlock()
+
+	return nil
+}
+
+// refreshSubscriptions keeps the loaded subscriptions up to date, with subscriptions added by other
+// instances of the service and with changes to the entity hierarchy, and purges old deliveries.
+func (a *app) refreshSubscriptions(ctx context.Context) {
+	log := logging.GetFromContext(ctx)
+
+	ticker := time.NewTicker(subscriptionRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		err := a.loadSubscriptions(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error("failed to load subscriptions", "err", err.Error())
+		}
+
+		now := time.Now().UTC()
+		if now.Sub(a.webhooks.lastPurge) >= time.Hour {
+			err = a.db.DeleteDeliveries(ctx, now.Add(-a.cfg.deliveryRetention))
+			if err != nil && ctx.Err() == nil {
+				log.Error("failed to delete old deliveries", "err", err.Error())
+			} else {
+				a.webhooks.lastPurge = now
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.webhooks.reload:
+		}
+	}
+}
+
+// resolveRoot returns the ids of the sensors in the subtree of root. A root that does not exist has no sensors.
+func (a *app) resolveRoot(ctx context.Context, root database.Property) ([]string, error) {
+	e, err := a.db.GetEntity(ctx, root.Id, root.Type)
+	if err != nil {
+		logging.GetFromContext(ctx).Warn("root entity not found", "root_id", root.Id, "root_type", root.Type)
+		return []string{}, nil
+	}
+
+	return a.GetSensorIDs(ctx, e)
+}
+
+// consumedObservationSaveInterval is how often the last observation consumed is recorded
+const consumedObservationSaveInterval = 10 * time.Second
+
+// consumeObservations calls fn for every stored observation until ctx is done. The last observation
+// passed to fn is recorded for the consumer, so that consumption resumes from it when the service is
+// started again. If the subscription to the observation hub is dropped because fn does not keep up,
+// consumption resumes from the last observation seen. Observations may be passed to fn more than once.
+func (a *app) consumeObservations(ctx context.Context, consumer string, fn func(context.Context, database.StoredObservation)) {
+	log := logging.GetFromContext(ctx)
+
+	lastID, err := a.db.GetConsumedObservationID(ctx, consumer)
+	if err != nil {
+		log.Error("failed to get last consumed observation", "consumer", consumer, "err", err.Error())
+	}
+
+	savedID := lastID
+	save := func(ctx context.Context) {
+		if lastID == savedID {
+			return
+		}
+
+		err := a.db.SetConsumedObservationID(ctx, consumer, lastID)
+		if err != nil {
+			log.Error("failed to record last consumed observation", "consumer", consumer, "err", err.Error())
+			return
+		}
+
+		savedID = lastID
+	}
+
+	defer save(context.WithoutCancel(ctx))
+
+	ticker := time.NewTicker(consumedObservationSaveInterval)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		observations, cancel := a.hub.subscribe(database.ObservationFilter{})
+
+		for lastID > 0 {
+			batch, err := a.db.GetObservationsAfter(ctx, database.ObservationFilter{}, lastID, 1000)
+			if err != nil {
+				log.Error("failed to resume consumption of stored observations", "err", err.Error())
+				break
+			}
+
+			for _, o := range batch {
+				fn(ctx, o)
+				lastID = o.ID
+			}
+
+			save(ctx)
+
+			if len(batch) < 1000 {
+				break
+			}
+		}
+
+	receive:
+		for {
+			select {
+			case <-ctx.Done():
+				break receive
+			case <-ticker.C:
+				save(ctx)
+			case o, ok := <-observations:
+				if !ok {
+					log.Warn("consumption of stored observations fell behind, resuming", "last_id", lastID)
+					break receive
+				}
+				fn(ctx, o)
+				lastID = max(lastID, o.ID)
+			}
+		}
+
+		cancel()
+	}
+}
+
+func (a *app) notifyObservation(ctx context.Context, o database.StoredObservation) {
+	deliveries := make([]database.Delivery, 0)
+
+	for _, m := range a.webhooks.subscribers(ObservationStoredName) {
+		if !m.filter.Matches(o.DeviceID, o.Observation) {
+			continue
+		}
+
+		deliveries = append(deliveries, database.Delivery{
+			SubscriptionID: m.Id,
+			EventID:        "observation-" + strconv.FormatInt(o.ID, 10),
+			EventType:      ObservationStoredName,
+		})
+	}
+
+	a.addDeliveries(ctx, deliveries, o)
+}
+
+// addEntity adds an entity, or relations to an existing entity, and notifies subscribers if the entity
+// was created or its relations changed.
+func (a *app) addEntity(ctx context.Context, e database.Entity) error {
+	if !a.webhooks.active() {
+		return a.db.AddEntity(ctx, e)
+	}
+
+	before, err := a.db.GetEntity(ctx, e.Id, e.Type)
+	existed := err == nil
+
+	err = a.db.AddEntity(ctx, e)
+	if err != nil {
+		return err
+	}
+
+	after, err := a.db.GetEntity(ctx, e.Id, e.Type)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !existed:
+		a.notifyEntityChange(ctx, EntityCreatedName, after)
+	case !sameRelations(before, after):
+		a.notifyEntityChange(ctx, EntityUpdatedName, after)
+	default:
+		return nil
+	}
+
+	// the change may move sensors in or out of the subtree of a subscription
+	signal(a.webhooks.reload)
+
+	return nil
+}
+
+func sameRelations(a, b database.Entity) bool {
+	if (a.IsPartOf == nil) != (b.IsPartOf == nil) || (a.IsPartOf != nil && *a.IsPartOf != *b.IsPartOf) {
+		return false
+	}
+
+	if len(a.HasPoint) != len(b.HasPoint) {
+		return false
+	}
+
+	for _, p := range a.HasPoint {
+		if !slices.Contains(b.HasPoint, p) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// notifyRegisteredEntities notifies subscribers of entities that were registered without addEntity,
+// such as the devices of imported observations.
+func (a *app) notifyRegisteredEntities(ctx context.Context, registered database.RegisteredEntities) {
+	if !a.webhooks.active() || len(registered.Created)+len(registered.Updated) == 0 {
+		return
+	}
+
+	log := logging.GetFromContext(ctx)
+
+	for eventType, entities := range map[string][]database.Property{EntityCreatedName: registered.Created, EntityUpdatedName: registered.Updated} {
+		for _, p := range entities {
+			e, err := a.db.GetEntity(ctx, p.Id, p.Type)
+			if err != nil {
+				log.Error("failed to get registered entity", "entity_id", p.Id, "err", err.Error())
+				continue
+			}
+			a.notifyEntityChange(ctx, eventType, e)
+		}
+	}
+
+	// the change may move sensors in or out of the subtree of a subscription
+	signal(a.webhooks.reload)
+}
+
+func (a *app) notifyEntityChange(ctx context.Context, eventType string, e database.Entity) {
+	log := logging.GetFromContext(ctx)
+
+	deliveries := make([]database.Delivery, 0)
+	eventID := uuid.NewString()
+
+	for _, m := range a.webhooks.subscribers(eventType) {
+		if m.SensorID != "" && m.SensorID != e.Id {
+			continue
+		}
+
+		if m.Root != nil && (m.Root.Id != e.Id || m.Root.Type != e.Type) {
+			children, err := a.db.GetChildEntities(ctx, database.Entity{Id: m.Root.Id, Type: m.Root.Type}, e.Type)
+			if err != nil {
+				log.Error("failed to match entity change to subscription", "subscription_id", m.Id, "err", err.Error())
+				continue
+			}
+
+			if !slices.ContainsFunc(children, func(c database.Entity) bool { return c.Id == e.Id }) {
+				continue
+			}
+		}
+
+		deliveries = append(deliveries, database.Delivery{
+			SubscriptionID: m.Id,
+			EventID:        eventID,
+			EventType:      eventType,
+		})
+	}
+
+	a.addDeliveries(ctx, deliveries, e)
+}
+
+// addDeliveries stores deliveries of data and wakes up the delivery workers. Failures are logged
+// since they should not fail the change that is being notified.
+func (a *app) addDeliveries(ctx context.Context, deliveries []database.Delivery, data any) {
+	if len(deliveries) == 0 {
+		return
+	}
+
+	log := logging.GetFromContext(ctx)
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		log.Error("failed to marshal event data", "err", err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	for i := range deliveries {
+		deliveries[i].Data = b
+		deliveries[i].CreatedAt = now
+	}
+
+	err = a.db.AddDeliveries(ctx, deliveries)
+	if err != nil {
+		log.Error("failed to add deliveries", "event_type", deliveries[0].EventType, "count", len(deliveries), "err", err.Error())
+		return
+	}
+
+	signal(a.webhooks.wake)
+}
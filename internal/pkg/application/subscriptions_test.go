@@ -0,0 +1,193 @@
+package application
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestAddSubscriptionIsValidated(t *testing.T) {
+	is := is.New(t)
+	a := New(&dbMock{}, NewConfig(false, ""))
+
+	_, err := a.AddSubscription(context.Background(), database.Subscription{Endpoint: "not a url"})
+	is.True(errors.Is(err, ErrInvalidSubscription))
+
+	_, err = a.AddSubscription(context.Background(), database.Subscription{Endpoint: "https://example.com/hook", Types: []string{"entity.deleted"}})
+	is.True(errors.Is(err, ErrInvalidSubscription))
+
+	_, err = a.AddSubscription(context.Background(), database.Subscription{Endpoint: "https://example.com/hook", Root: &database.Property{Id: "building-1", Type: "building"}})
+	is.True(errors.Is(err, ErrInvalidSubscription))
+}
+
+func TestNotifyObservationAddsDeliveriesForMatchingSubscriptions(t *testing.T) {
+	is := is.New(t)
+	db := &dbMock{}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	a.webhooks.matchers = []subscriptionMatcher{
+		{Subscription: database.Subscription{Id: "all"}},
+		{Subscription: database.Subscription{Id: "temperature"}, filter: database.ObservationFilter{QuantityKind: "Temperature"}},
+		{Subscription: database.Subscription{Id: "s2"}, filter: database.ObservationFilter{SensorIDs: []string{"s2"}}},
+		{Subscription: database.Subscription{Id: "entities", Types: []string{EntityCreatedName}}},
+	}
+
+	a.notifyObservation(context.Background(), storedObservation(42, "s1", "Temperature"))
+
+	is.Equal(2, len(db.deliveries))
+	is.Equal("all", db.deliveries[0].SubscriptionID)
+	is.Equal("temperature", db.deliveries[1].SubscriptionID)
+	is.Equal("observation-42", db.deliveries[0].EventID)
+	is.Equal(ObservationStoredName, db.deliveries[0].EventType)
+
+	var o database.StoredObservation
+	is.NoErr(json.Unmarshal(db.deliveries[0].Data, &o))
+	is.Equal("s1", o.SensorId)
+}
+
+func TestAddEntityNotifiesSubscribers(t *testing.T) {
+	is := is.New(t)
+	db := &dbMock{}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	a.webhooks.matchers = []subscriptionMatcher{
+		{Subscription: database.Subscription{Id: "sensor", SensorID: "s1"}},
+		{Subscription: database.Subscription{Id: "other-sensor", SensorID: "s2"}},
+		{Subscription: database.Subscription{Id: "observations", Types: []string{ObservationStoredName}}},
+	}
+
+	sensor := database.Entity{Context: database.SensorContext, Id: "s1", Type: database.SensorType}
+
+	is.NoErr(a.AddEntity(context.Background(), sensor))
+	is.Equal(1, len(db.deliveries))
+	is.Equal("sensor", db.deliveries[0].SubscriptionID)
+	is.Equal(EntityCreatedName, db.deliveries[0].EventType)
+
+	// adding the same entity again changes nothing
+	is.NoErr(a.AddEntity(context.Background(), sensor))
+	is.Equal(1, len(db.deliveries))
+
+	sensor.IsPartOf = &database.Property{Id: "space-1", Type: database.SpaceType}
+	is.NoErr(a.AddEntity(context.Background(), sensor))
+	is.Equal(2, len(db.deliveries))
+	is.Equal(EntityUpdatedName, db.deliveries[1].EventType)
+}
+
+func TestConsumeObservationsResumesFromLastConsumed(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	db := &dbMock{
+		consumed: map[string]int64{"test": 2},
+		after: []database.StoredObservation{
+			storedObservation(1, "s1", "Temperature"),
+			storedObservation(2, "s1", "Temperature"),
+			storedObservation(3, "s1", "Temperature"),
+			storedObservation(4, "s1", "Temperature"),
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	consumed := make([]int64, 0)
+	done := make(chan struct{})
+
+	go func() {
+		a.consumeObservations(ctx, "test", func(ctx context.Context, o database.StoredObservation) {
+			consumed = append(consumed, o.ID)
+			if len(consumed) == 2 {
+				cancel()
+			}
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("consumption did not stop")
+	}
+
+	is.Equal([]int64{3, 4}, consumed)
+	is.Equal(int64(4), db.consumed["test"])
+}
+
+type dbMock struct {
+	database.Database
+	entities   map[string]database.Entity
+	lookups    int
+	deliveries []database.Delivery
+	ruleStates map[string]database.RuleState
+	cleared    []string
+	clearedAt  time.Time
+	alarms     []database.Alarm
+	statuses   []database.SensorStatus
+	gaps       []database.ObservationGap
+
+	children     []database.Entity
+	boundaries   []database.StoredObservation
+	observations []database.Observation
+
+	virtualSensors []database.VirtualSensor
+	stored         []database.SensorObservation
+
+	calibrations   []database.Calibration
+	recalibrations []recalibration
+
+	qualityFilter database.ObservationFilter
+	quality       string
+
+	processed   map[string]bool
+	consumed    map[string]int64
+	after       []database.StoredObservation
+	deadLetters []database.DeadLetter
+}
+
+func (db *dbMock) GetEntity(ctx context.Context, entityID, entityType string) (database.Entity, error) {
+	db.lookups++
+	e, ok := db.entities[entityType+"/"+entityID]
+	if !ok {
+		return database.Entity{}, database.ErrNotFound
+	}
+	return e, nil
+}
+
+func (db *dbMock) AddEntity(ctx context.Context, e database.Entity) error {
+	if db.entities == nil {
+		db.entities = make(map[string]database.Entity)
+	}
+	existing, ok := db.entities[e.Type+"/"+e.Id]
+	if ok && e.IsPartOf == nil {
+		e.IsPartOf = existing.IsPartOf
+	}
+	db.entities[e.Type+"/"+e.Id] = e
+	return nil
+}
+
+func (db *dbMock) AddDeliveries(ctx context.Context, deliveries []database.Delivery) error {
+	db.deliveries = append(db.deliveries, deliveries...)
+	return nil
+}
+
+func (db *dbMock) GetObservationsAfter(ctx context.Context, filter database.ObservationFilter, afterID int64, limit int) ([]database.StoredObservation, error) {
+	observations := make([]database.StoredObservation, 0)
+	for _, o := range db.after {
+		if o.ID > afterID && len(observations) < limit {
+			observations = append(observations, o)
+		}
+	}
+	return observations, nil
+}
+
+func (db *dbMock) GetConsumedObservationID(ctx context.Context, consumer string) (int64, error) {
+	return db.consumed[consumer], nil
+}
+
+func (db *dbMock) SetConsumedObservationID(ctx context.Context, consumer string, id int64) error {
+	db.consumed[consumer] = max(db.consumed[consumer], id)
+	return nil
+}
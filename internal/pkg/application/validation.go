@@ -0,0 +1,114 @@
+package application
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+)
+
+// ValidationError describes a problem with a field in a sensor observation. Observation is the
+// index of the observation the problem was found in, or nil if it concerns the message itself.
+type ValidationError struct {
+	Observation *int   `json:"observation,omitempty"`
+	Field       string `json:"field"`
+	Message     string `json:"message"`
+}
+
+type ValidationErrors []ValidationError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(v))
+	for _, e := range v {
+		if e.Observation != nil {
+			msgs = append(msgs, fmt.Sprintf("observations[%d].%s: %s", *e.Observation, e.Field, e.Message))
+		} else {
+			msgs = append(msgs, fmt.Sprintf("%s: %s", e.Field, e.Message))
+		}
+	}
+	return strings.Join(msgs, ", ")
+}
+
+var formatPattern = regexp.MustCompile(`^rec[34](\.[0-9]+)+$`)
+
+// quantityKinds are the values of the quantity_kind enum in the README, the quantity kinds defined
+// by REC together with the ones added by diwise
+var quantityKinds = map[string]struct{}{
+	"Acceleration": {}, "Angle": {}, "AngularAcceleration": {}, "AngularVelocity": {}, "Area": {},
+	"Capacitance": {}, "Concentration": {}, "Conductivity": {}, "DataRate": {}, "DataSize": {},
+	"Density": {}, "Distance": {}, "Efficiency": {}, "ElectricCharge": {}, "ElectricCurrent": {},
+	"Energy": {}, "Force": {}, "Frequency": {}, "Illuminance": {}, "Inductance": {}, "Irradiance": {},
+	"Length": {}, "Luminance": {}, "LuminousFlux": {}, "LuminousIntensity": {}, "MagneticFlux": {},
+	"MagneticFluxDensity": {}, "Mass": {}, "MassFlowRate": {}, "Power": {}, "PowerFactor": {},
+	"Pressure": {}, "RelativeHumidity": {}, "Resistance": {}, "SoundPressureLevel": {},
+	"Temperature": {}, "Thrust": {}, "Time": {}, "Torque": {}, "Velocity": {}, "Voltage": {},
+	"Volume": {}, "VolumeFlowRate": {},
+
+	"diwise:AirQuality": {}, "diwise:DigitalInput": {}, "diwise:Level": {}, "diwise:Lifebuoy": {},
+	"diwise:Presence": {}, "diwise:Timer": {},
+}
+
+func isKnownQuantityKind(qk string) bool {
+	_, ok := quantityKinds[NormaliseQuantityKind(qk)]
+	return ok
+}
+
+// Validate checks a sensor observation against the REC edge message schema and returns
+// ValidationErrors with every problem found, or nil if the observation is valid.
+func Validate(so database.SensorObservation) error {
+	errs := ValidationErrors{}
+
+	if so.Format == "" {
+		errs = append(errs, ValidationError{Field: "format", Message: "is required"})
+	} else if !formatPattern.MatchString(so.Format) {
+		errs = append(errs, ValidationError{Field: "format", Message: fmt.Sprintf("unsupported format %s", so.Format)})
+	}
+
+	if strings.TrimSpace(so.DeviceID) == "" {
+		errs = append(errs, ValidationError{Field: "deviceId", Message: "is required"})
+	}
+
+	if len(so.Observations) == 0 {
+		errs = append(errs, ValidationError{Field: "observations", Message: "at least one observation is required"})
+	}
+
+	for i, o := range so.Observations {
+		i := i
+
+		if o.ObservationTime.IsZero() {
+			errs = append(errs, ValidationError{Observation: &i, Field: "observationTime", Message: "is required"})
+		}
+
+		if strings.TrimSpace(o.SensorId) == "" {
+			errs = append(errs, ValidationError{Observation: &i, Field: "sensorId", Message: "is required"})
+		}
+
+		if o.QuantityKind == "" {
+			errs = append(errs, ValidationError{Observation: &i, Field: "quantityKind", Message: "is required"})
+		} else if !isKnownQuantityKind(o.QuantityKind) {
+			errs = append(errs, ValidationError{Observation: &i, Field: "quantityKind", Message: fmt.Sprintf("unknown quantityKind %s", o.QuantityKind)})
+		}
+
+		values := 0
+		for _, set := range []bool{o.Value != nil, o.ValueString != nil, o.ValueBoolean != nil} {
+			if set {
+				values++
+			}
+		}
+
+		if values != 1 {
+			errs = append(errs, ValidationError{Observation: &i, Field: "value", Message: "exactly one of value, valueString or valueBoolean is required"})
+		}
+
+		if o.Quality != "" && !database.IsQuality(o.Quality) {
+			errs = append(errs, ValidationError{Observation: &i, Field: "quality", Message: fmt.Sprintf("unknown quality %s", o.Quality)})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package application
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/farshidtz/senml/v2"
+	"github.com/matryer/is"
+)
+
+func TestValidate(t *testing.T) {
+	is := is.New(t)
+	v := 16.1
+
+	so := database.SensorObservation{
+		Format:   "rec3.3",
+		DeviceID: "https://recref.com/device/64b65a99-a53c-47f5-b959-1c7a641d82d8",
+		Observations: []database.Observation{
+			{
+				ObservationTime: time.Now(),
+				Value:           &v,
+				QuantityKind:    "https://w3id.org/rec/core/Temperature",
+				SensorId:        "https://recref.com/sensor/e0d5120b-90f1-48d6-a47f-f8ccd7727b04",
+			},
+			{
+				ObservationTime: time.Now(),
+				Value:           &v,
+				QuantityKind:    "diwise:Level",
+				SensorId:        "level-1",
+			},
+		},
+	}
+
+	is.NoErr(Validate(so))
+}
+
+func TestValidateAcceptsMappedQuantityKinds(t *testing.T) {
+	v := 1.0
+	now := time.Now()
+
+	packs := map[string]senml.Pack{}
+	for _, lwm2mType := range []string{AirQuality, Conductivity, DigitalInput, Distance, Energy, Humidity, Illuminance, Power, Presence, Pressure, Temperature, Watermeter} {
+		packs[lwm2mType] = senml.Pack{
+			{StringValue: "sensor-1", BaseTime: float64(now.Unix()), BaseName: lwm2mType},
+			{Name: "1", Value: &v},
+		}
+	}
+	packs["concentration"] = senml.Pack{
+		{StringValue: "sensor-1", BaseTime: float64(now.Unix()), BaseName: AirQuality},
+		{Name: "17", Value: &v},
+	}
+
+	for name, pack := range packs {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+
+			so, ok := MessageAccepted{SensorID: "device-1", Pack: pack, Timestamp: now}.MapToObservation()
+			is.True(ok)
+			is.NoErr(Validate(so))
+		})
+	}
+}
+
+func TestValidateReturnsErrorPerObservation(t *testing.T) {
+	is := is.New(t)
+	v := 16.1
+	s := "on"
+
+	so := database.SensorObservation{
+		Format: "rec2",
+		Observations: []database.Observation{
+			{
+				Value:        &v,
+				ValueString:  &s,
+				QuantityKind: "Temperature",
+				SensorId:     "sensor-1",
+			},
+			{
+				ObservationTime: time.Now(),
+				QuantityKind:    "Warmth",
+			},
+		},
+	}
+
+	err := Validate(so)
+	is.True(err != nil)
+
+	var verrs ValidationErrors
+	is.True(errors.As(err, &verrs))
+
+	fields := map[string]int{}
+	for _, e := range verrs {
+		key := e.Field
+		if e.Observation != nil {
+			key = fmt.Sprintf("%d.%s", *e.Observation, e.Field)
+		}
+		fields[key]++
+	}
+
+	is.Equal(map[string]int{
+		"format":            1,
+		"deviceId":          1,
+		"0.observationTime": 1,
+		"0.value":           1,
+		"1.sensorId":        1,
+		"1.quantityKind":    1,
+		"1.value":           1,
+	}, fields)
+}
+
+func TestValidateRequiresObservations(t *testing.T) {
+	is := is.New(t)
+
+	err := Validate(database.SensorObservation{Format: "rec3.3", DeviceID: "device-1"})
+	is.Equal("observations: at least one observation is required", err.Error())
+}
@@ -0,0 +1,471 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/token"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+var ErrInvalidVirtualSensor = errors.New("invalid virtual sensor")
+
+const virtualSensorRefreshInterval = time.Minute
+
+// virtualSensor is a virtual sensor with its formula parsed and, for an aggregate, its root entity
+// resolved to the sensors in its subtree
+type virtualSensor struct {
+	database.VirtualSensor
+	formula formula
+	maxAge  time.Duration
+	sources map[string]struct{}
+}
+
+// isSource reports whether the observation is one of the inputs of the virtual sensor.
+func (v virtualSensor) isSource(o database.Observation) bool {
+	if v.Aggregate != "" {
+		_, ok := v.sources[o.SensorId]
+		return ok && o.QuantityKind == v.SourceQuantityKind
+	}
+
+	for _, in := range v.Inputs {
+		if in.SensorID == o.SensorId && (in.QuantityKind == "" || in.QuantityKind == o.QuantityKind) {
+			return true
+		}
+	}
+	return false
+}
+
+type virtualSensorSet struct {
+	mu      sync.RWMutex
+	sensors []virtualSensor
+	reload  chan struct{}
+}
+
+func newVirtualSensorSet() *virtualSensorSet {
+	return &virtualSensorSet{
+		reload: make(chan struct{}, 1),
+	}
+}
+
+// matching returns the virtual sensors that the observation is an input of. Observations of virtual
+// sensors are never inputs, so that virtual sensors can not depend on each other.
+func (vs *virtualSensorSet) matching(o database.Observation) []virtualSensor {
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	sensors := make([]virtualSensor, 0)
+	for _, v := range vs.sensors {
+		if v.SensorID == o.SensorId {
+			return nil
+		}
+		if v.isSource(o) {
+			sensors = append(sensors, v)
+		}
+	}
+	return sensors
+}
+
+// AddVirtualSensor validates and stores a new virtual sensor and creates its sensor entity if it does
+// not exist, part of the root entity of an aggregate if the root is a space or a building.
+// ErrInvalidVirtualSensor is returned if the definition is not valid and database.ErrAlreadyExists
+// if the sensor already has a definition.
+func (a *app) AddVirtualSensor(ctx context.Context, v database.VirtualSensor) (database.VirtualSensor, error) {
+	if v.SensorID == "" || v.QuantityKind == "" {
+		return database.VirtualSensor{}, fmt.Errorf("%w: sensorId and quantityKind are required", ErrInvalidVirtualSensor)
+	}
+	v.QuantityKind = NormaliseQuantityKind(v.QuantityKind)
+
+	if v.MaxAge != "" {
+		d, err := time.ParseDuration(v.MaxAge)
+		if err != nil || d <= 0 {
+			return database.VirtualSensor{}, fmt.Errorf("%w: maxAge must be a positive duration, e.g. 1h", ErrInvalidVirtualSensor)
+		}
+	}
+
+	var err error
+
+	switch {
+	case v.Formula != "" && v.Aggregate == "":
+		err = a.validateFormula(ctx, &v)
+	case v.Aggregate != "" && v.Formula == "":
+		err = a.validateAggregate(ctx, &v)
+	default:
+		err = fmt.Errorf("%w: exactly one of formula and aggregate is required", ErrInvalidVirtualSensor)
+	}
+	if err != nil {
+		return database.VirtualSensor{}, err
+	}
+
+	if _, err := a.db.GetEntity(ctx, v.SensorID, database.SensorType); err != nil {
+		if v.Root != nil && (v.Root.Type == database.SpaceType || v.Root.Type == database.BuildingType) {
+			err = a.addEntity(ctx, database.Entity{
+				Context:  database.SensorContext,
+				Id:       v.SensorID,
+				Type:     database.SensorType,
+				IsPartOf: &database.Property{Id: v.Root.Id, Type: v.Root.Type},
+			})
+		} else {
+			err = a.registerSensor(ctx, v.SensorID)
+		}
+		if err != nil {
+			return database.VirtualSensor{}, err
+		}
+	}
+
+	v.CreatedAt = time.Now().UTC()
+
+	err = a.db.AddVirtualSensor(ctx, v)
+	if err != nil {
+		return database.VirtualSensor{}, err
+	}
+
+	signal(a.virtualSensors.reload)
+
+	return v, nil
+}
+
+func (a *app) validateFormula(ctx context.Context, v *database.VirtualSensor) error {
+	if len(v.Inputs) == 0 || v.Root != nil || v.SourceQuantityKind != "" {
+		return fmt.Errorf("%w: a formula requires inputs and no root or sourceQuantityKind", ErrInvalidVirtualSensor)
+	}
+
+	names := make(map[string]struct{})
+
+	for i, in := range v.Inputs {
+		if !token.IsIdentifier(in.Name) || in.SensorID == "" {
+			return fmt.Errorf("%w: every input requires a sensorId and a name that is a valid identifier", ErrInvalidVirtualSensor)
+		}
+		if _, ok := names[in.Name]; ok {
+			return fmt.Errorf("%w: input %s is defined more than once", ErrInvalidVirtualSensor, in.Name)
+		}
+		if _, ok := formulaFunctions[in.Name]; ok {
+			return fmt.Errorf("%w: input %s has the name of a function", ErrInvalidVirtualSensor, in.Name)
+		}
+		if in.SensorID == v.SensorID {
+			return fmt.Errorf("%w: a virtual sensor can not be its own input", ErrInvalidVirtualSensor)
+		}
+		if _, err := a.db.GetVirtualSensor(ctx, in.SensorID); err == nil {
+			return fmt.Errorf("%w: input %s is a virtual sensor", ErrInvalidVirtualSensor, in.Name)
+		}
+
+		names[in.Name] = struct{}{}
+		if in.QuantityKind != "" {
+			v.Inputs[i].QuantityKind = NormaliseQuantityKind(in.QuantityKind)
+		}
+	}
+
+	_, err := parseFormula(v.Formula, names)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidVirtualSensor, err.Error())
+	}
+
+	return nil
+}
+
+func (a *app) validateAggregate(ctx context.Context, v *database.VirtualSensor) error {
+	switch v.Aggregate {
+	case database.AggregateAverage, database.AggregateSum, database.AggregateMin, database.AggregateMax:
+	default:
+		return fmt.Errorf("%w: aggregate must be %s, %s, %s or %s", ErrInvalidVirtualSensor, database.AggregateAverage, database.AggregateSum, database.AggregateMin, database.AggregateMax)
+	}
+
+	if v.Root == nil || len(v.Inputs) > 0 {
+		return fmt.Errorf("%w: an aggregate requires a root and no inputs", ErrInvalidVirtualSensor)
+	}
+
+	if t := database.GetTypeFromTypeName(v.Root.Type); t != "" {
+		v.Root.Type = t
+	}
+
+	_, err := a.db.GetEntity(ctx, v.Root.Id, v.Root.Type)
+	if err != nil {
+		return fmt.Errorf("%w: root entity %s not found", ErrInvalidVirtualSensor, v.Root.Id)
+	}
+
+	if v.SourceQuantityKind == "" {
+		v.SourceQuantityKind = v.QuantityKind
+	}
+	v.SourceQuantityKind = NormaliseQuantityKind(v.SourceQuantityKind)
+
+	return nil
+}
+
+func (a *app) GetVirtualSensor(ctx context.Context, sensorID string) (database.VirtualSensor, error) {
+	return a.db.GetVirtualSensor(ctx, sensorID)
+}
+
+func (a *app) GetVirtualSensors(ctx context.Context, page, size int) (int64, []database.VirtualSensor, error) {
+	return a.db.GetVirtualSensors(ctx, page, size)
+}
+
+// DeleteVirtualSensor stops computing observations for a virtual sensor. Its sensor entity and the
+// observations computed so far are kept.
+func (a *app) DeleteVirtualSensor(ctx context.Context, sensorID string) error {
+	err := a.db.DeleteVirtualSensor(ctx, sensorID)
+	if err != nil {
+		return err
+	}
+
+	signal(a.virtualSensors.reload)
+
+	return nil
+}
+
+// loadVirtualSensors loads all virtual sensors, parses their formulas and resolves the root entities
+// of aggregates to the sensors in their subtrees, leaving out virtual sensors.
+func (a *app) loadVirtualSensors(ctx context.Context) error {
+	const size = 100
+	definitions := make([]database.VirtualSensor, 0)
+
+	for page := 0; ; page++ {
+		total, sensors, err := a.db.GetVirtualSensors(ctx, page, size)
+		if err != nil {
+			return err
+		}
+
+		definitions = append(definitions, sensors...)
+
+		if int64((page+1)*size) >= total {
+			break
+		}
+	}
+
+	virtual := make(map[string]struct{})
+	for _, d := range definitions {
+		virtual[d.SensorID] = struct{}{}
+	}
+
+	sensors := make([]virtualSensor, 0, len(definitions))
+
+	for _, d := range definitions {
+		v := virtualSensor{VirtualSensor: d}
+
+		if d.MaxAge != "" {
+			v.maxAge, _ = time.ParseDuration(d.MaxAge)
+		}
+
+		if d.Formula != "" {
+			names := make(map[string]struct{})
+			for _, in := range d.Inputs {
+				names[in.Name] = struct{}{}
+			}
+
+			var err error
+			v.formula, err = parseFormula(d.Formula, names)
+			if err != nil {
+				logging.GetFromContext(ctx).Error("invalid formula for virtual sensor", "sensor_id", d.SensorID, "err", err.Error())
+				continue
+			}
+		}
+
+		if d.Root != nil {
+			ids, err := a.resolveRoot(ctx, *d.Root)
+			if err != nil {
+				return err
+			}
+
+			v.sources = make(map[string]struct{})
+			for _, id := range ids {
+				if _, ok := virtual[id]; !ok {
+					v.sources[id] = struct{}{}
+				}
+			}
+		}
+
+		sensors = append(sensors, v)
+	}
+
+	a.virtualSensors.mu.Lock()
+	a.virtualSensors.sensors = sensors
+	a.virtualSensors.mu.Unlock()
+
+	return nil
+}
+
+// refreshVirtualSensors keeps the loaded virtual sensors up to date, since sensors may be added to or
+// removed from the subtree of an aggregate.
+func (a *app) refreshVirtualSensors(ctx context.Context) {
+	log := logging.GetFromContext(ctx)
+
+	ticker := time.NewTicker(virtualSensorRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		err := a.loadVirtualSensors(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Error("failed to load virtual sensors", "err", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.virtualSensors.reload:
+		}
+	}
+}
+
+// evaluateVirtualSensors computes the virtual sensors that a stored observation is an input of, at the
+// time of the observation, and stores the results as observations of the virtual sensors.
+func (a *app) evaluateVirtualSensors(ctx context.Context, o database.StoredObservation) {
+	log := logging.GetFromContext(ctx)
+
+	for _, v := range a.virtualSensors.matching(o.Observation) {
+		value, ok, err := a.computeVirtualSensor(ctx, v, o.ObservationTime)
+		if err != nil {
+			log.Error("failed to compute virtual sensor", "sensor_id", v.SensorID, "err", err.Error())
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		err = a.db.AddObservation(ctx, database.SensorObservation{
+			Observations: []database.Observation{{
+				SensorId:        v.SensorID,
+				QuantityKind:    v.QuantityKind,
+				ObservationTime: o.ObservationTime,
+				Value:           &value,
+			}},
+		})
+		if err != nil {
+			log.Error("failed to store observation of virtual sensor", "sensor_id", v.SensorID, "err", err.Error())
+		}
+	}
+}
+
+// computeVirtualSensor computes the value of a virtual sensor from the latest observations of its
+// inputs at a point in time. ok is false if an input of a formula is missing or too old, if no input of
+// an aggregate is recent enough or if the result is not a finite number.
+func (a *app) computeVirtualSensor(ctx context.Context, v virtualSensor, at time.Time) (value float64, ok bool, err error) {
+	recent := func(o database.Observation) bool {
+		return v.maxAge == 0 || at.Sub(o.ObservationTime) <= v.maxAge
+	}
+
+	if v.Aggregate != "" {
+		ids := make([]string, 0, len(v.sources))
+		for id := range v.sources {
+			ids = append(ids, id)
+		}
+
+		latest, err := a.latestValues(ctx, ids, v.SourceQuantityKind, at)
+		if err != nil {
+			return 0, false, err
+		}
+
+		values := make([]float64, 0, len(latest))
+		for _, o := range latest {
+			if recent(o) {
+				values = append(values, numericValue(o))
+			}
+		}
+
+		if len(values) == 0 {
+			return 0, false, nil
+		}
+
+		value = aggregate(v.Aggregate, values)
+	} else {
+		byQuantityKind := make(map[string][]string)
+		for _, in := range v.Inputs {
+			byQuantityKind[in.QuantityKind] = append(byQuantityKind[in.QuantityKind], in.SensorID)
+		}
+
+		latest := make(map[string]database.Observation)
+		for quantityKind, ids := range byQuantityKind {
+			values, err := a.latestValues(ctx, ids, quantityKind, at)
+			if err != nil {
+				return 0, false, err
+			}
+			for id, o := range values {
+				latest[quantityKind+"/"+id] = o
+			}
+		}
+
+		values := make(map[string]float64)
+		for _, in := range v.Inputs {
+			o, found := latest[in.QuantityKind+"/"+in.SensorID]
+			if !found || !recent(o) {
+				return 0, false, nil
+			}
+			values[in.Name] = numericValue(o)
+		}
+
+		value = v.formula.eval(values)
+	}
+
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false, nil
+	}
+
+	return value, true, nil
+}
+
+// latestValues returns the latest observation with a numeric or boolean value at or before a point in
+// time for each of the sensors, of the quantity kind if set.
+func (a *app) latestValues(ctx context.Context, sensorIDs []string, quantityKind string, at time.Time) (map[string]database.Observation, error) {
+	latest := make(map[string]database.Observation)
+
+	if len(sensorIDs) == 0 {
+		return latest, nil
+	}
+
+	// observation times are stored with microsecond precision
+	after := at.Add(time.Microsecond)
+
+	boundaries, err := a.db.GetBoundaryObservations(ctx, database.ObservationFilter{
+		SensorIDs:    sensorIDs,
+		QuantityKind: quantityKind,
+		Starting:     after,
+		Ending:       after,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range boundaries {
+		if o.ObservationTime.Before(after) && (o.Value != nil || o.ValueBoolean != nil) {
+			latest[o.SensorId] = o.Observation
+		}
+	}
+
+	return latest, nil
+}
+
+// numericValue returns the value of an observation, with true as 1 and false as 0.
+func numericValue(o database.Observation) float64 {
+	if o.Value != nil {
+		return *o.Value
+	}
+	if o.ValueBoolean != nil && *o.ValueBoolean {
+		return 1
+	}
+	return 0
+}
+
+func aggregate(fn string, values []float64) float64 {
+	result := values[0]
+
+	for _, v := range values[1:] {
+		switch fn {
+		case database.AggregateMin:
+			result = math.Min(result, v)
+		case database.AggregateMax:
+			result = math.Max(result, v)
+		default:
+			result += v
+		}
+	}
+
+	if fn == database.AggregateAverage {
+		result /= float64(len(values))
+	}
+
+	return result
+}
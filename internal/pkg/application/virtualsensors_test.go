@@ -0,0 +1,137 @@
+package application
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestParseFormula(t *testing.T) {
+	is := is.New(t)
+	names := map[string]struct{}{"t": {}, "rh": {}}
+
+	f, err := parseFormula("(t + 2*rh) / 2 - -1", names)
+	is.NoErr(err)
+	is.Equal(51.0, f.eval(map[string]float64{"t": 20, "rh": 40}))
+
+	f, err = parseFormula("dewpoint(t, rh)", names)
+	is.NoErr(err)
+	is.True(math.Abs(f.eval(map[string]float64{"t": 20, "rh": 50})-9.26) < 0.01)
+
+	for _, src := range []string{"t +", "t % rh", "x * 2", "sin(t)", "pow(t)", `t + "1"`, "t.value", "t == rh"} {
+		_, err = parseFormula(src, names)
+		is.True(err != nil) // formula should not be accepted
+	}
+}
+
+func TestAddVirtualSensorIsValidated(t *testing.T) {
+	is := is.New(t)
+
+	db := &dbMock{
+		entities: map[string]database.Entity{
+			database.BuildingType + "/building-1": {Id: "building-1", Type: database.BuildingType},
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+
+	invalid := []database.VirtualSensor{
+		{SensorID: "v1", QuantityKind: "Temperature"},
+		{SensorID: "v1", QuantityKind: "Temperature", Formula: "a", Aggregate: database.AggregateAverage},
+		{SensorID: "v1", QuantityKind: "Temperature", Formula: "a + b", Inputs: []database.VirtualSensorInput{{Name: "a", SensorID: "s1"}}},
+		{SensorID: "v1", QuantityKind: "Temperature", Formula: "abs", Inputs: []database.VirtualSensorInput{{Name: "abs", SensorID: "s1"}}},
+		{SensorID: "v1", QuantityKind: "Temperature", Aggregate: "median", Root: &database.Property{Id: "building-1", Type: "building"}},
+		{SensorID: "v1", QuantityKind: "Temperature", Aggregate: database.AggregateAverage, Root: &database.Property{Id: "building-2", Type: "building"}},
+		{SensorID: "v1", QuantityKind: "Temperature", Aggregate: database.AggregateAverage, Root: &database.Property{Id: "building-1", Type: "building"}, MaxAge: "often"},
+	}
+
+	for _, v := range invalid {
+		_, err := a.AddVirtualSensor(context.Background(), v)
+		is.True(errors.Is(err, ErrInvalidVirtualSensor))
+	}
+
+	v, err := a.AddVirtualSensor(context.Background(), database.VirtualSensor{
+		SensorID: "v1", QuantityKind: "Temperature", Aggregate: database.AggregateAverage, Root: &database.Property{Id: "building-1", Type: "building"},
+	})
+	is.NoErr(err)
+	is.Equal("Temperature", v.SourceQuantityKind)
+	is.Equal(database.BuildingType, v.Root.Type)
+
+	// the sensor entity of the virtual sensor is placed in the root of the aggregate
+	sensor, ok := db.entities[database.SensorType+"/v1"]
+	is.True(ok)
+	is.Equal("building-1", sensor.IsPartOf.Id)
+}
+
+func TestEvaluateVirtualSensorsStoresComputedObservations(t *testing.T) {
+	is := is.New(t)
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	reading := func(sensorID, quantityKind string, at time.Time, value float64) database.StoredObservation {
+		return database.StoredObservation{Observation: database.Observation{SensorId: sensorID, QuantityKind: quantityKind, ObservationTime: at, Value: &value}}
+	}
+
+	db := &dbMock{
+		entities: map[string]database.Entity{
+			database.BuildingType + "/building-1": {Id: "building-1", Type: database.BuildingType},
+		},
+		children: []database.Entity{{Id: "t1"}, {Id: "t2"}, {Id: "t3"}, {Id: "avg"}},
+		boundaries: []database.StoredObservation{
+			reading("t1", "Temperature", now, 20),
+			reading("t2", "Temperature", now.Add(-time.Minute), 22),
+			reading("t3", "Temperature", now.Add(-2*time.Hour), 50),
+			reading("avg", "Temperature", now.Add(-time.Minute), 0),
+		},
+		virtualSensors: []database.VirtualSensor{
+			{SensorID: "avg", QuantityKind: "Temperature", Aggregate: database.AggregateAverage, Root: &database.Property{Id: "building-1", Type: database.BuildingType}, SourceQuantityKind: "Temperature", MaxAge: "1h"},
+			{SensorID: "diff", QuantityKind: "Temperature", Formula: "a - b", Inputs: []database.VirtualSensorInput{{Name: "a", SensorID: "t1", QuantityKind: "Temperature"}, {Name: "b", SensorID: "t2", QuantityKind: "Temperature"}}},
+		},
+	}
+	a := New(db, NewConfig(false, "")).(*app)
+	is.NoErr(a.loadVirtualSensors(context.Background()))
+
+	a.evaluateVirtualSensors(context.Background(), reading("t1", "Temperature", now, 20))
+
+	is.Equal(2, len(db.stored))
+
+	// t3 is too old and avg is a virtual sensor, so neither is part of the average
+	avg := db.stored[0].Observations[0]
+	is.Equal("avg", avg.SensorId)
+	is.Equal(now, avg.ObservationTime)
+	is.Equal(21.0, *avg.Value)
+
+	diff := db.stored[1].Observations[0]
+	is.Equal("diff", diff.SensorId)
+	is.Equal(-2.0, *diff.Value)
+
+	// observations of virtual sensors are never inputs
+	a.evaluateVirtualSensors(context.Background(), reading("avg", "Temperature", now, 21))
+	is.Equal(2, len(db.stored))
+}
+
+func (db *dbMock) GetVirtualSensor(ctx context.Context, sensorID string) (database.VirtualSensor, error) {
+	for _, v := range db.virtualSensors {
+		if v.SensorID == sensorID {
+			return v, nil
+		}
+	}
+	return database.VirtualSensor{}, database.ErrNotFound
+}
+
+func (db *dbMock) GetVirtualSensors(ctx context.Context, page, size int) (int64, []database.VirtualSensor, error) {
+	return int64(len(db.virtualSensors)), db.virtualSensors, nil
+}
+
+func (db *dbMock) AddVirtualSensor(ctx context.Context, v database.VirtualSensor) error {
+	db.virtualSensors = append(db.virtualSensors, v)
+	return nil
+}
+
+func (db *dbMock) AddObservation(ctx context.Context, so database.SensorObservation) error {
+	db.stored = append(db.stored, so)
+	return nil
+}
@@ -0,0 +1,145 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/cloudevents/sdk-go/v2/binding"
+	cehttp "github.com/cloudevents/sdk-go/v2/protocol/http"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+const webhookEventSource = "github.com/diwise/api-rec"
+
+const (
+	deliveryBatchSize    = 10
+	deliveryPollInterval = 5 * time.Second
+	maxRetryInterval     = time.Hour
+)
+
+// deliverEvents sends pending deliveries to subscribers until ctx is done. Deliveries are claimed
+// from the database so that several workers, in any instance of the service, can deliver at once.
+func (a *app) deliverEvents(ctx context.Context) {
+	log := logging.GetFromContext(ctx)
+
+	client := &http.Client{Timeout: a.cfg.webhookTimeout}
+	lease := deliveryBatchSize*a.cfg.webhookTimeout + time.Minute
+
+	for {
+		deliveries, err := a.db.ClaimDeliveries(ctx, deliveryBatchSize, lease)
+		if err != nil && ctx.Err() == nil {
+			log.Error("failed to claim deliveries", "err", err.Error())
+		}
+
+		for _, d := range deliveries {
+			d = a.deliver(ctx, client, d)
+
+			err = a.db.UpdateDelivery(ctx, d)
+			if err != nil {
+				log.Error("failed to update delivery", "delivery_id", d.Id, "err", err.Error())
+			}
+		}
+
+		if len(deliveries) == deliveryBatchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.webhooks.wake:
+		case <-time.After(deliveryPollInterval):
+		}
+	}
+}
+
+// deliver posts the delivery as a cloudevent to the endpoint of its subscription and returns the
+// delivery updated with the outcome. Failed deliveries are retried with exponential backoff until
+// the maximum number of attempts has been made.
+func (a *app) deliver(ctx context.Context, client *http.Client, d database.Delivery) database.Delivery {
+	log := logging.GetFromContext(ctx)
+
+	d.Attempts++
+	d.LastStatusCode = nil
+	d.LastError = nil
+
+	statusCode, err := send(ctx, client, d)
+	if statusCode != 0 {
+		d.LastStatusCode = &statusCode
+	}
+
+	now := time.Now().UTC()
+
+	if err == nil {
+		d.Status = database.DeliveryDelivered
+		d.DeliveredAt = &now
+		d.NextAttemptAt = nil
+		return d
+	}
+
+	msg := err.Error()
+	d.LastError = &msg
+
+	if d.Attempts >= a.cfg.webhookMaxAttempts {
+		log.Warn("giving up delivery to subscriber", "subscription_id", d.SubscriptionID, "event_id", d.EventID, "attempts", d.Attempts, "err", msg)
+		d.Status = database.DeliveryFailed
+		d.NextAttemptAt = nil
+		return d
+	}
+
+	next := now.Add(retryInterval(a.cfg.webhookRetryInterval, d.Attempts))
+	d.NextAttemptAt = &next
+
+	return d
+}
+
+// retryInterval doubles the interval for every attempt made, up to an hour
+func retryInterval(interval time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts && interval < maxRetryInterval; i++ {
+		interval *= 2
+	}
+	return min(interval, maxRetryInterval)
+}
+
+// send posts the delivery as a cloudevent in binary mode and returns the status code of the response
+func send(ctx context.Context, client *http.Client, d database.Delivery) (int, error) {
+	event := cloudevents.NewEvent()
+	event.SetID(d.EventID)
+	event.SetSource(webhookEventSource)
+	event.SetType(d.EventType)
+	event.SetTime(d.CreatedAt)
+
+	err := event.SetData(cloudevents.ApplicationJSON, []byte(d.Data))
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.Endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	err = cehttp.WriteRequest(ctx, binding.ToMessage(&event), req)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp.StatusCode, fmt.Errorf("subscriber responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+
+	return resp.StatusCode, nil
+}
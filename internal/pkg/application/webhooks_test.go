@@ -0,0 +1,83 @@
+package application
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/matryer/is"
+)
+
+func TestDeliverPostsCloudevent(t *testing.T) {
+	is := is.New(t)
+
+	var header http.Header
+	var body []byte
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	a := New(&dbMock{}, NewConfig(false, "")).(*app)
+
+	d := a.deliver(context.Background(), server.Client(), database.Delivery{
+		Endpoint:  server.URL,
+		EventID:   "observation-42",
+		EventType: ObservationStoredName,
+		Data:      []byte(`{"id":42}`),
+		Status:    database.DeliveryPending,
+		CreatedAt: time.Now().UTC(),
+	})
+
+	is.Equal(database.DeliveryDelivered, d.Status)
+	is.Equal(1, d.Attempts)
+	is.Equal(http.StatusAccepted, *d.LastStatusCode)
+	is.True(d.DeliveredAt != nil)
+	is.Equal("observation-42", header.Get("Ce-Id"))
+	is.Equal(ObservationStoredName, header.Get("Ce-Type"))
+	is.Equal(webhookEventSource, header.Get("Ce-Source"))
+	is.Equal(`{"id":42}`, string(body))
+}
+
+func TestDeliverRetriesUntilMaxAttempts(t *testing.T) {
+	is := is.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	a := New(&dbMock{}, NewConfig(false, "")).(*app)
+
+	d := database.Delivery{Endpoint: server.URL, EventID: "1", EventType: EntityCreatedName, Data: []byte(`{}`), Status: database.DeliveryPending}
+
+	d = a.deliver(context.Background(), server.Client(), d)
+	is.Equal(database.DeliveryPending, d.Status)
+	is.Equal(http.StatusServiceUnavailable, *d.LastStatusCode)
+	is.True(d.LastError != nil)
+	is.True(d.NextAttemptAt.After(time.Now().Add(defaultWebhookRetryInterval - time.Second)))
+
+	for d.Status == database.DeliveryPending {
+		d = a.deliver(context.Background(), server.Client(), d)
+	}
+
+	is.Equal(database.DeliveryFailed, d.Status)
+	is.Equal(defaultWebhookMaxAttempts, d.Attempts)
+	is.True(d.NextAttemptAt == nil)
+}
+
+func TestRetryInterval(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(10*time.Second, retryInterval(10*time.Second, 1))
+	is.Equal(20*time.Second, retryInterval(10*time.Second, 2))
+	is.Equal(80*time.Second, retryInterval(10*time.Second, 4))
+	is.Equal(time.Hour, retryInterval(10*time.Second, 20))
+}
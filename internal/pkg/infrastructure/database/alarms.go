@@ -0,0 +1,250 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (db *databaseImpl) AddRule(ctx context.Context, r Rule) error {
+	var rootID, rootType *string
+	if r.Root != nil {
+		rootID, rootType = &r.Root.Id, &r.Root.Type
+	}
+
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO rules (rule_id, name, quantity_kind, root_id, root_type, condition, value, value_string, value_boolean, duration, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`,
+		r.Id, r.Name, r.QuantityKind, rootID, rootType, r.Condition, r.Value, r.ValueString, r.ValueBoolean, r.Duration, r.CreatedAt)
+	return err
+}
+
+const ruleColumns = "rule_id, name, quantity_kind, root_id, root_type, condition, value, value_string, value_boolean, duration, created_at"
+
+func scanRule(row pgx.Row, extra ...any) (Rule, error) {
+	var r Rule
+	var rootID, rootType *string
+
+	dest := append([]any{&r.Id, &r.Name, &r.QuantityKind, &rootID, &rootType, &r.Condition, &r.Value, &r.ValueString, &r.ValueBoolean, &r.Duration, &r.CreatedAt}, extra...)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	if rootID != nil && rootType != nil {
+		r.Root = &Property{Id: *rootID, Type: *rootType}
+	}
+
+	return r, nil
+}
+
+func (db *databaseImpl) GetRule(ctx context.Context, id string) (Rule, error) {
+	row := db.pool.QueryRow(ctx, "SELECT "+ruleColumns+" FROM rules WHERE rule_id = $1", id)
+
+	r, err := scanRule(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Rule{}, ErrNotFound
+		}
+		return Rule{}, err
+	}
+
+	return r, nil
+}
+
+func (db *databaseImpl) GetRules(ctx context.Context, page, size int) (int64, []Rule, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+ruleColumns+`, count(*) OVER() AS full_count
+		FROM rules
+		ORDER BY created_at ASC, rule_id ASC
+		OFFSET $1 LIMIT $2`, page*size, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]Rule, 0)
+	var fullCount int64
+
+	for rows.Next() {
+		r, err := scanRule(rows, &fullCount)
+		if err != nil {
+			return 0, nil, err
+		}
+		rules = append(rules, r)
+	}
+
+	return fullCount, rules, rows.Err()
+}
+
+// DeleteRule deletes a rule together with its alarms.
+func (db *databaseImpl) DeleteRule(ctx context.Context, id string) error {
+	tag, err := db.pool.Exec(ctx, "DELETE FROM rules WHERE rule_id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+const ruleStateColumns = "rule_id, sensor_id, device_id, since, observation_time, value, value_string, value_boolean, quantity_kind"
+
+func scanRuleState(row pgx.Row) (RuleState, error) {
+	var s RuleState
+	err := row.Scan(&s.RuleID, &s.SensorId, &s.DeviceID, &s.Since, &s.ObservationTime, &s.Value, &s.ValueString, &s.ValueBoolean, &s.QuantityKind)
+	return s, err
+}
+
+// AddRuleState records that a sensor meets the condition of a rule and returns the state, which
+// keeps the time and observation from when the condition was first met and the time of the latest
+// observation that met it.
+func (db *databaseImpl) AddRuleState(ctx context.Context, s RuleState) (RuleState, error) {
+	row := db.pool.QueryRow(ctx, `
+		INSERT INTO rule_states (`+ruleStateColumns+`)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (rule_id, sensor_id) DO UPDATE SET
+			since = LEAST(rule_states.since, EXCLUDED.since),
+			observation_time = GREATEST(rule_states.observation_time, EXCLUDED.observation_time)
+		RETURNING `+ruleStateColumns,
+		s.RuleID, s.SensorId, s.DeviceID, s.Since, s.ObservationTime, s.Value, s.ValueString, s.ValueBoolean, s.QuantityKind)
+
+	return scanRuleState(row)
+}
+
+func (db *databaseImpl) GetRuleStates(ctx context.Context) ([]RuleState, error) {
+	rows, err := db.pool.Query(ctx, "SELECT "+ruleStateColumns+" FROM rule_states ORDER BY since ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	states := make([]RuleState, 0)
+
+	for rows.Next() {
+		s, err := scanRuleState(rows)
+		if err != nil {
+			return nil, err
+		}
+		states = append(states, s)
+	}
+
+	return states, rows.Err()
+}
+
+// ClearRuleState records that a sensor no longer meets the condition of a rule at closedAt and closes
+// its alarm, if any. A state that was met by an observation at or after closedAt, and an alarm that was
+// triggered after closedAt, are kept since a late observation must not clear a newer state. It reports
+// whether the sensor no longer has a state for the rule.
+func (db *databaseImpl) ClearRuleState(ctx context.Context, ruleID, sensorID string, closedAt time.Time) (bool, error) {
+	var cleared bool
+
+	err := db.pool.QueryRow(ctx, `
+		WITH cleared AS (
+			DELETE FROM rule_states WHERE rule_id = $1 AND sensor_id = $2 AND observation_time < $4
+		), closed AS (
+			UPDATE alarms SET status = $3, closed_at = $4
+			WHERE rule_id = $1 AND sensor_id = $2 AND status <> $3 AND triggered_at <= $4
+			  AND NOT EXISTS (SELECT 1 FROM rule_states WHERE rule_id = $1 AND sensor_id = $2 AND observation_time >= $4)
+		)
+		SELECT NOT EXISTS (SELECT 1 FROM rule_states WHERE rule_id = $1 AND sensor_id = $2 AND observation_time >= $4)`,
+		ruleID, sensorID, AlarmClosed, closedAt).Scan(&cleared)
+
+	return cleared, err
+}
+
+// OpenAlarm opens an alarm unless the sensor already has an alarm for the rule that is not closed,
+// and reports whether an alarm was opened.
+func (db *databaseImpl) OpenAlarm(ctx context.Context, a Alarm) (bool, error) {
+	tag, err := db.pool.Exec(ctx, `
+		INSERT INTO alarms (rule_id, sensor_id, device_id, quantity_kind, status, triggered_at, value, value_string, value_boolean, opened_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (rule_id, sensor_id) WHERE status <> 'closed' DO NOTHING`,
+		a.RuleID, a.SensorID, a.DeviceID, a.QuantityKind, AlarmOpen, a.TriggeredAt, a.Value, a.ValueString, a.ValueBoolean, a.OpenedAt)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+const alarmColumns = "alarm_id, rule_id, sensor_id, device_id, quantity_kind, status, triggered_at, value, value_string, value_boolean, opened_at, acknowledged_at, closed_at"
+
+func scanAlarm(row pgx.Row, extra ...any) (Alarm, error) {
+	var a Alarm
+
+	dest := append([]any{&a.Id, &a.RuleID, &a.SensorID, &a.DeviceID, &a.QuantityKind, &a.Status, &a.TriggeredAt, &a.Value, &a.ValueString, &a.ValueBoolean, &a.OpenedAt, &a.AcknowledgedAt, &a.ClosedAt}, extra...)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Alarm{}, ErrNotFound
+		}
+		return Alarm{}, err
+	}
+
+	return a, nil
+}
+
+func (db *databaseImpl) GetAlarm(ctx context.Context, id int64) (Alarm, error) {
+	return scanAlarm(db.pool.QueryRow(ctx, "SELECT "+alarmColumns+" FROM alarms WHERE alarm_id = $1", id))
+}
+
+// GetAlarms returns alarms matching the filter, newest first.
+func (db *databaseImpl) GetAlarms(ctx context.Context, filter AlarmFilter, page, size int) (int64, []Alarm, error) {
+	clauses := []string{"TRUE"}
+	args := []any{}
+
+	for _, c := range [][2]string{{"status", filter.Status}, {"rule_id", filter.RuleID}, {"sensor_id", filter.SensorID}} {
+		if c[1] != "" {
+			args = append(args, c[1])
+			clauses = append(clauses, fmt.Sprintf("%s = $%d", c[0], len(args)))
+		}
+	}
+
+	args = append(args, page*size, size)
+
+	rows, err := db.pool.Query(ctx, fmt.Sprintf(`
+		SELECT %s, count(*) OVER() AS full_count
+		FROM alarms
+		WHERE %s
+		ORDER BY alarm_id DESC
+		OFFSET $%d LIMIT $%d`, alarmColumns, strings.Join(clauses, " AND "), len(args)-1, len(args)), args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	alarms := make([]Alarm, 0)
+	var fullCount int64
+
+	for rows.Next() {
+		a, err := scanAlarm(rows, &fullCount)
+		if err != nil {
+			return 0, nil, err
+		}
+		alarms = append(alarms, a)
+	}
+
+	return fullCount, alarms, rows.Err()
+}
+
+// UpdateAlarmStatus changes the status of an alarm that has one of the statuses in from. ErrNotFound
+// is returned if there is no such alarm.
+func (db *databaseImpl) UpdateAlarmStatus(ctx context.Context, id int64, status string, from []string, at time.Time) (Alarm, error) {
+	return scanAlarm(db.pool.QueryRow(ctx, `
+		UPDATE alarms SET
+			status = $2,
+			acknowledged_at = CASE WHEN $2 = '`+AlarmAcknowledged+`' THEN $4 ELSE acknowledged_at END,
+			closed_at = CASE WHEN $2 = '`+AlarmClosed+`' THEN $4 ELSE closed_at END
+		WHERE alarm_id = $1 AND status = ANY($3)
+		RETURNING `+alarmColumns, id, status, from, at))
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const calibrationColumns = "calibration_id, sensor_id, quantity_kind, value_offset, value_scale, min_value, max_value, effective_from, created_at"
+
+func scanCalibration(row pgx.Row) (Calibration, error) {
+	var c Calibration
+	var scale float64
+
+	err := row.Scan(&c.Id, &c.SensorID, &c.QuantityKind, &c.Offset, &scale, &c.Min, &c.Max, &c.EffectiveFrom, &c.CreatedAt)
+	if err != nil {
+		return Calibration{}, err
+	}
+
+	c.Scale = &scale
+
+	return c, nil
+}
+
+// AddCalibration stores a calibration, replacing any calibration of the same sensor and quantity kind
+// that is effective from the same time.
+func (db *databaseImpl) AddCalibration(ctx context.Context, c Calibration) (Calibration, error) {
+	scale := 1.0
+	if c.Scale != nil {
+		scale = *c.Scale
+	}
+
+	row := db.pool.QueryRow(ctx, `
+		INSERT INTO calibrations (sensor_id, quantity_kind, value_offset, value_scale, min_value, max_value, effective_from, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (sensor_id, quantity_kind, effective_from) DO UPDATE SET
+			value_offset = EXCLUDED.value_offset,
+			value_scale = EXCLUDED.value_scale,
+			min_value = EXCLUDED.min_value,
+			max_value = EXCLUDED.max_value,
+			created_at = EXCLUDED.created_at
+		RETURNING `+calibrationColumns,
+		c.SensorID, c.QuantityKind, c.Offset, scale, c.Min, c.Max, c.EffectiveFrom, c.CreatedAt)
+
+	return scanCalibration(row)
+}
+
+func (db *databaseImpl) GetCalibration(ctx context.Context, id int64) (Calibration, error) {
+	row := db.pool.QueryRow(ctx, "SELECT "+calibrationColumns+" FROM calibrations WHERE calibration_id = $1", id)
+
+	c, err := scanCalibration(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Calibration{}, ErrNotFound
+		}
+		return Calibration{}, err
+	}
+
+	return c, nil
+}
+
+// GetCalibrations returns the calibrations of a sensor, or of all sensors if sensorID is empty,
+// ordered by sensor, quantity kind and the time they are effective from.
+func (db *databaseImpl) GetCalibrations(ctx context.Context, sensorID string) ([]Calibration, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+calibrationColumns+`
+		FROM calibrations
+		WHERE $1 = '' OR sensor_id = $1
+		ORDER BY sensor_id ASC, quantity_kind ASC, effective_from ASC`, sensorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	calibrations := make([]Calibration, 0)
+
+	for rows.Next() {
+		c, err := scanCalibration(rows)
+		if err != nil {
+			return nil, err
+		}
+		calibrations = append(calibrations, c)
+	}
+
+	return calibrations, rows.Err()
+}
+
+// DeleteCalibration deletes a calibration and returns it. The observations it was applied to are not
+// changed.
+func (db *databaseImpl) DeleteCalibration(ctx context.Context, id int64) (Calibration, error) {
+	row := db.pool.QueryRow(ctx, "DELETE FROM calibrations WHERE calibration_id = $1 RETURNING "+calibrationColumns, id)
+
+	c, err := scanCalibration(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Calibration{}, ErrNotFound
+		}
+		return Calibration{}, err
+	}
+
+	return c, nil
+}
+
+// RecalibrateObservations applies a calibration to the raw values of the stored observations of its
+// sensor and quantity kind from the time it is effective from until, if set, and returns the number of
+// observations changed. Observations that were stored without calibration keep their value as the
+// raw value. Observations outside the valid range of the calibration are flagged as bad, and are no
+// longer flagged when a later calibration brings them back within range.
+func (db *databaseImpl) RecalibrateObservations(ctx context.Context, c Calibration, until *time.Time) (int64, error) {
+	scale := 1.0
+	if c.Scale != nil {
+		scale = *c.Scale
+	}
+
+	tag, err := db.pool.Exec(ctx, `
+		WITH calibrated AS (
+			SELECT observation_id, COALESCE(raw_value, value) AS raw, COALESCE(raw_value, value) * $3::numeric + $4::numeric AS corrected
+			FROM observations
+			WHERE sensor_id = $1
+			  AND quantity_kind = $2
+			  AND observation_time >= $5
+			  AND ($6::timestamptz IS NULL OR observation_time < $6)
+			  AND COALESCE(raw_value, value) IS NOT NULL
+		)
+		UPDATE observations o SET
+			raw_value = c.raw,
+			value = CASE WHEN c.valid THEN c.corrected ELSE NULL END,
+			quality = CASE
+				WHEN NOT c.valid THEN $9
+				WHEN o.quality_reason = $10 THEN $11
+				ELSE o.quality
+			END,
+			quality_reason = CASE
+				WHEN NOT c.valid THEN $10
+				WHEN o.quality_reason = $10 THEN ''
+				ELSE o.quality_reason
+			END
+		FROM (
+			SELECT *, ($7::numeric IS NULL OR corrected >= $7) AND ($8::numeric IS NULL OR corrected <= $8) AS valid
+			FROM calibrated
+		) c
+		WHERE o.observation_id = c.observation_id`,
+		c.SensorID, c.QuantityKind, scale, c.Offset, c.EffectiveFrom, until, c.Min, c.Max, QualityBad, QualityReasonCalibration, QualityGood)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
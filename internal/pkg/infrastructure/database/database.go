@@ -5,14 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"slices"
 	"time"
 
 	"github.com/diwise/service-chassis/pkg/infrastructure/env"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 )
 
+var ErrNotFound = errors.New("not found")
+var ErrAlreadyExists = errors.New("already exists")
+
 type Config struct {
 	host     string
 	user     string
@@ -25,16 +32,72 @@ type Config struct {
 type Database interface {
 	Init(ctx context.Context) error
 	Seed(ctx context.Context, reader io.Reader) error
+	LoadDeduplicationPolicies(ctx context.Context, reader io.Reader) error
 	AddEntity(ctx context.Context, e Entity) error
 	GetEntity(ctx context.Context, entityID, entityType string) (Entity, error)
 	GetEntities(ctx context.Context, entityType string, page, size int) (int64, []Entity, error)
 	GetChildEntities(ctx context.Context, root Entity, entityType string) ([]Entity, error)
+	GetUnassignedSensors(ctx context.Context, unassignedSpaceID string, page, size int) (int64, []Entity, error)
 	AddObservation(ctx context.Context, so SensorObservation) error
+	AddObservations(ctx context.Context, sos []SensorObservation) error
+	ImportObservations(ctx context.Context, r ObservationReader, reg DeviceRegistration) (int64, RegisteredEntities, error)
 	GetObservations(ctx context.Context, sensorId string, starting, ending time.Time, page, size int) (int64, []Observation, error)
+	GetDeviceObservations(ctx context.Context, deviceId string, starting, ending time.Time, page, size int) (int64, []Observation, error)
+	StreamObservations(ctx context.Context, filter ObservationFilter, fn func(deviceID string, o Observation) error) error
+	ListenForObservations(ctx context.Context, fn func(StoredObservation)) error
+	GetObservationsAfter(ctx context.Context, filter ObservationFilter, afterID int64, limit int) ([]StoredObservation, error)
+	GetBoundaryObservations(ctx context.Context, filter ObservationFilter) ([]StoredObservation, error)
+	QueryObservations(ctx context.Context, filter ObservationFilter, page, size int) (int64, []Observation, error)
+	SetObservationQuality(ctx context.Context, filter ObservationFilter, quality, reason string) (int64, error)
+	AddProcessedEvent(ctx context.Context, source, eventID string, since time.Time) (bool, error)
+	DeleteProcessedEvent(ctx context.Context, source, eventID string) error
+	DeleteProcessedEvents(ctx context.Context, before time.Time) error
+	AddDeadLetter(ctx context.Context, dl DeadLetter) error
+	GetDeadLetter(ctx context.Context, id int64) (DeadLetter, error)
+	GetDeadLetters(ctx context.Context, page, size int) (int64, []DeadLetter, error)
+	UpdateDeadLetter(ctx context.Context, id int64, reason string, replayedAt *time.Time) error
+	AddSubscription(ctx context.Context, s Subscription) error
+	GetSubscription(ctx context.Context, id string) (Subscription, error)
+	GetSubscriptions(ctx context.Context, page, size int) (int64, []Subscription, error)
+	DeleteSubscription(ctx context.Context, id string) error
+	AddDeliveries(ctx context.Context, deliveries []Delivery) error
+	ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]Delivery, error)
+	UpdateDelivery(ctx context.Context, d Delivery) error
+	GetDeliveries(ctx context.Context, subscriptionID string, page, size int) (int64, []Delivery, error)
+	DeleteDeliveries(ctx context.Context, before time.Time) error
+	GetConsumedObservationID(ctx context.Context, consumer string) (int64, error)
+	SetConsumedObservationID(ctx context.Context, consumer string, id int64) error
+	AddRule(ctx context.Context, r Rule) error
+	GetRule(ctx context.Context, id string) (Rule, error)
+	GetRules(ctx context.Context, page, size int) (int64, []Rule, error)
+	DeleteRule(ctx context.Context, id string) error
+	AddRuleState(ctx context.Context, s RuleState) (RuleState, error)
+	GetRuleStates(ctx context.Context) ([]RuleState, error)
+	ClearRuleState(ctx context.Context, ruleID, sensorID string, closedAt time.Time) (bool, error)
+	OpenAlarm(ctx context.Context, a Alarm) (bool, error)
+	GetAlarm(ctx context.Context, id int64) (Alarm, error)
+	GetAlarms(ctx context.Context, filter AlarmFilter, page, size int) (int64, []Alarm, error)
+	UpdateAlarmStatus(ctx context.Context, id int64, status string, from []string, at time.Time) (Alarm, error)
+	RefreshSensorStatus(ctx context.Context) error
+	GetSensorStatuses(ctx context.Context, filter SensorStatusFilter, page, size int) (int64, []SensorStatus, error)
+	SetSensorStaleSince(ctx context.Context, sensorID string, lastObservationTime time.Time, staleSince *time.Time) (bool, error)
+	GetObservationGaps(ctx context.Context, filter ObservationFilter, minGap time.Duration) ([]ObservationGap, error)
+	AddVirtualSensor(ctx context.Context, v VirtualSensor) error
+	GetVirtualSensor(ctx context.Context, sensorID string) (VirtualSensor, error)
+	GetVirtualSensors(ctx context.Context, page, size int) (int64, []VirtualSensor, error)
+	DeleteVirtualSensor(ctx context.Context, sensorID string) error
+	AddCalibration(ctx context.Context, c Calibration) (Calibration, error)
+	GetCalibration(ctx context.Context, id int64) (Calibration, error)
+	GetCalibrations(ctx context.Context, sensorID string) ([]Calibration, error)
+	DeleteCalibration(ctx context.Context, id int64) (Calibration, error)
+	RecalibrateObservations(ctx context.Context, c Calibration, until *time.Time) (int64, error)
 }
 
 type databaseImpl struct {
-	pool *pgxpool.Pool
+	pool     *pgxpool.Pool
+	policies DeduplicationPolicies
+
+	suppressedCounter metric.Int64Counter
 }
 
 func LoadConfiguration(ctx context.Context) Config {
@@ -77,8 +140,19 @@ func Connect(ctx context.Context, cfg Config) (Database, error) {
 	log := logging.GetFromContext(ctx)
 	log.Debug("connected to host", "host", cfg.host)
 
+	suppressedCounter, err := otel.Meter("api-rec/database").Int64Counter(
+		"diwise.observations.suppressed",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of observations dropped by the deduplication policy"),
+	)
+	if err != nil {
+		log.Error("failed to create otel suppressed observations counter", "err", err.Error())
+	}
+
 	db := databaseImpl{
-		pool: conn,
+		pool:              conn,
+		policies:          NewDeduplicationPolicies(),
+		suppressedCounter: suppressedCounter,
 	}
 
 	return &db, nil
@@ -102,9 +176,12 @@ func (db *databaseImpl) Init(ctx context.Context) error {
 			);
 
 			CREATE TYPE quantity_kind AS ENUM (
-				'diwise:AirQuality'
+				'diwise:AirQuality',
 				'diwise:DigitalInput',
+				'diwise:Level',
+				'diwise:Lifebuoy',
 				'diwise:Presence',
+				'diwise:Timer',
 				'Acceleration',
 				'Angle',
 				'AngularAcceleration',
@@ -170,6 +247,8 @@ func (db *databaseImpl) Init(ctx context.Context) error {
 		);
 		
 		CREATE INDEX IF NOT EXISTS relation_child_parent_indx ON relation(child, parent);
+
+		ALTER TABLE relation ADD COLUMN IF NOT EXISTS relation_type TEXT NOT NULL DEFAULT 'isPartOf';
 				
 		CREATE TABLE IF NOT EXISTS observations (
 			observation_id 		BIGSERIAL PRIMARY KEY,
@@ -184,7 +263,165 @@ func (db *databaseImpl) Init(ctx context.Context) error {
 
 		ALTER TABLE observations DROP CONSTRAINT IF EXISTS observations_device_id_sensor_id_observation_time_value_val_key;
 
+		ALTER TABLE observations ADD COLUMN IF NOT EXISTS raw_value NUMERIC NULL;
+		ALTER TABLE observations ADD COLUMN IF NOT EXISTS quality TEXT NOT NULL DEFAULT 'good';
+		ALTER TABLE observations ADD COLUMN IF NOT EXISTS quality_reason TEXT NOT NULL DEFAULT '';
+
 		CREATE INDEX IF NOT EXISTS observations_device_id_sensor_id_observation_time_quantity_kind_indx ON observations (device_id, sensor_id, observation_time, quantity_kind);
+
+		CREATE TABLE IF NOT EXISTS processed_events (
+			source			TEXT NOT NULL,
+			event_id		TEXT NOT NULL,
+			processed_at	TIMESTAMPTZ NOT NULL,
+			PRIMARY KEY (source, event_id)
+		);
+
+		CREATE INDEX IF NOT EXISTS processed_events_processed_at_indx ON processed_events (processed_at);
+
+		CREATE TABLE IF NOT EXISTS dead_letters (
+			dead_letter_id	BIGSERIAL PRIMARY KEY,
+			event_id		TEXT NOT NULL,
+			source			TEXT NOT NULL,
+			event_type		TEXT NOT NULL,
+			event_time		TIMESTAMPTZ NULL,
+			received_at		TIMESTAMPTZ NOT NULL,
+			reason			TEXT NOT NULL,
+			data			TEXT NOT NULL,
+			replayed_at		TIMESTAMPTZ NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS subscriptions (
+			subscription_id	TEXT PRIMARY KEY,
+			endpoint		TEXT NOT NULL,
+			types			TEXT[] NOT NULL,
+			root_id			TEXT NULL,
+			root_type		TEXT NULL,
+			sensor_id		TEXT NULL,
+			quantity_kind	TEXT NULL,
+			created_at		TIMESTAMPTZ NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS subscription_deliveries (
+			delivery_id			BIGSERIAL PRIMARY KEY,
+			subscription_id		TEXT NOT NULL REFERENCES subscriptions (subscription_id) ON DELETE CASCADE,
+			event_id			TEXT NOT NULL,
+			event_type			TEXT NOT NULL,
+			data				TEXT NOT NULL,
+			status				TEXT NOT NULL,
+			attempts			INTEGER NOT NULL DEFAULT 0,
+			created_at			TIMESTAMPTZ NOT NULL,
+			next_attempt_at		TIMESTAMPTZ NULL,
+			delivered_at		TIMESTAMPTZ NULL,
+			last_status_code	INTEGER NULL,
+			last_error			TEXT NULL,
+			UNIQUE (subscription_id, event_id)
+		);
+
+		CREATE INDEX IF NOT EXISTS subscription_deliveries_status_next_attempt_at_indx ON subscription_deliveries (status, next_attempt_at);
+
+		CREATE TABLE IF NOT EXISTS rules (
+			rule_id			TEXT PRIMARY KEY,
+			name			TEXT NOT NULL,
+			quantity_kind	TEXT NOT NULL,
+			root_id			TEXT NULL,
+			root_type		TEXT NULL,
+			condition		TEXT NOT NULL,
+			value			NUMERIC NULL,
+			value_string	TEXT NULL,
+			value_boolean	BOOLEAN NULL,
+			duration		TEXT NOT NULL,
+			created_at		TIMESTAMPTZ NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS rule_states (
+			rule_id				TEXT NOT NULL REFERENCES rules (rule_id) ON DELETE CASCADE,
+			sensor_id			TEXT NOT NULL,
+			device_id			TEXT NOT NULL,
+			since				TIMESTAMPTZ NOT NULL,
+			observation_time	TIMESTAMPTZ NOT NULL,
+			value				NUMERIC NULL,
+			value_string		TEXT NULL,
+			value_boolean		BOOLEAN NULL,
+			quantity_kind		TEXT NOT NULL,
+			PRIMARY KEY (rule_id, sensor_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS alarms (
+			alarm_id		BIGSERIAL PRIMARY KEY,
+			rule_id			TEXT NOT NULL REFERENCES rules (rule_id) ON DELETE CASCADE,
+			sensor_id		TEXT NOT NULL,
+			device_id		TEXT NOT NULL,
+			quantity_kind	TEXT NOT NULL,
+			status			TEXT NOT NULL,
+			triggered_at	TIMESTAMPTZ NOT NULL,
+			value			NUMERIC NULL,
+			value_string	TEXT NULL,
+			value_boolean	BOOLEAN NULL,
+			opened_at		TIMESTAMPTZ NOT NULL,
+			acknowledged_at	TIMESTAMPTZ NULL,
+			closed_at		TIMESTAMPTZ NULL
+		);
+
+		CREATE UNIQUE INDEX IF NOT EXISTS alarms_rule_id_sensor_id_active_indx ON alarms (rule_id, sensor_id) WHERE status <> 'closed';
+
+		CREATE INDEX IF NOT EXISTS alarms_status_indx ON alarms (status);
+
+		INSERT INTO rules (rule_id, name, quantity_kind, condition, duration, created_at)
+		VALUES ('stale', 'Sensor has stopped reporting', '', 'stale', '', now())
+		ON CONFLICT (rule_id) DO NOTHING;
+
+		CREATE TABLE IF NOT EXISTS sensor_status (
+			sensor_id				TEXT PRIMARY KEY,
+			device_id				TEXT NOT NULL,
+			quantity_kind			TEXT NOT NULL,
+			last_observation_id		BIGINT NOT NULL,
+			last_observation_time	TIMESTAMPTZ NOT NULL,
+			stale_since				TIMESTAMPTZ NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS virtual_sensors (
+			sensor_id				TEXT PRIMARY KEY,
+			quantity_kind			TEXT NOT NULL,
+			formula					TEXT NOT NULL,
+			inputs					TEXT NOT NULL,
+			aggregate				TEXT NOT NULL,
+			root_id					TEXT NULL,
+			root_type				TEXT NULL,
+			source_quantity_kind	TEXT NOT NULL,
+			max_age					TEXT NOT NULL,
+			created_at				TIMESTAMPTZ NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS calibrations (
+			calibration_id	BIGSERIAL PRIMARY KEY,
+			sensor_id		TEXT NOT NULL,
+			quantity_kind	TEXT NOT NULL,
+			value_offset	NUMERIC NOT NULL,
+			value_scale		NUMERIC NOT NULL,
+			min_value		NUMERIC NULL,
+			max_value		NUMERIC NULL,
+			effective_from	TIMESTAMPTZ NOT NULL,
+			created_at		TIMESTAMPTZ NOT NULL,
+			UNIQUE (sensor_id, quantity_kind, effective_from)
+		);
+
+		CREATE TABLE IF NOT EXISTS observation_consumers (
+			consumer			TEXT PRIMARY KEY,
+			last_observation_id	BIGINT NOT NULL,
+			updated_at			TIMESTAMPTZ NOT NULL
+		);
+
+		CREATE OR REPLACE FUNCTION notify_observation() RETURNS trigger AS $$
+		BEGIN
+			IF coalesce(current_setting('api_rec.skip_notify', true), '') <> 'on' THEN
+				PERFORM pg_notify('observations', NEW.observation_id::text);
+			END IF;
+			RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		CREATE OR REPLACE TRIGGER observations_notify AFTER INSERT ON observations
+			FOR EACH ROW EXECUTE FUNCTION notify_observation();
 	`)
 	return err
 }
@@ -202,7 +439,7 @@ func (db *databaseImpl) AddEntity(ctx context.Context, e Entity) error {
 		return err
 	}
 
-	if e.IsPartOf == nil {
+	if e.IsPartOf == nil && len(e.HasPoint) == 0 {
 		return nil
 	}
 
@@ -210,27 +447,42 @@ func (db *databaseImpl) AddEntity(ctx context.Context, e Entity) error {
 	if err != nil {
 		return err
 	}
-	partOfNodeId, err := db.getNodeID(ctx, e.IsPartOf.Id, e.IsPartOf.Type)
-	if err != nil {
-		return err
+
+	if e.IsPartOf != nil {
+		partOfNodeId, err := db.getNodeID(ctx, e.IsPartOf.Id, e.IsPartOf.Type)
+		if err != nil {
+			return err
+		}
+
+		err = db.addRelation(ctx, partOfNodeId, nodeId, isPartOfRelation)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = db.addRelation(ctx, partOfNodeId, nodeId)
-	if err != nil {
-		return err
+	for _, p := range e.HasPoint {
+		pointNodeId, err := db.getNodeID(ctx, p.Id, p.Type)
+		if err != nil {
+			return err
+		}
+
+		err = db.addRelation(ctx, nodeId, pointNodeId, hasPointRelation)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (db *databaseImpl) addRelation(ctx context.Context, parent, child int64) error {
-	_, err := db.pool.Exec(ctx, "INSERT INTO relation (parent, child) VALUES ($1, $2) ON CONFLICT DO NOTHING", parent, child)
+func (db *databaseImpl) addRelation(ctx context.Context, parent, child int64, relationType string) error {
+	_, err := db.pool.Exec(ctx, "INSERT INTO relation (parent, child, relation_type) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", parent, child, relationType)
 	return err
 }
 
 func (db *databaseImpl) getParentEntity(ctx context.Context, nodeId int64) (Entity, error) {
 	var parentId int64
-	relRow := db.pool.QueryRow(ctx, "SELECT parent FROM relation WHERE child = $1", nodeId)
+	relRow := db.pool.QueryRow(ctx, "SELECT parent FROM relation WHERE child = $1 AND relation_type = $2", nodeId, isPartOfRelation)
 	err := relRow.Scan(&parentId)
 	if err != nil {
 		return Entity{}, err
@@ -249,6 +501,33 @@ func (db *databaseImpl) getParentEntity(ctx context.Context, nodeId int64) (Enti
 	}, nil
 }
 
+func (db *databaseImpl) getPoints(ctx context.Context, nodeId int64) ([]Property, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT entity.entity_id, entity.entity_type
+		FROM relation JOIN
+		entity ON relation.child = entity.node_id
+		WHERE relation.parent = $1
+		  AND relation.relation_type = $2
+		ORDER BY entity.entity_id ASC`, nodeId, hasPointRelation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := make([]Property, 0)
+
+	for rows.Next() {
+		var p Property
+		err := rows.Scan(&p.Id, &p.Type)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, p)
+	}
+
+	return points, nil
+}
+
 func (db *databaseImpl) GetChildEntities(ctx context.Context, root Entity, entityType string) ([]Entity, error) {
 	rows, err := db.pool.Query(ctx, `
 		WITH RECURSIVE traverse(node_id, entity_type, entity_id) AS (
@@ -337,6 +616,13 @@ func (db *databaseImpl) GetEntities(ctx context.Context, entityType string, page
 			}
 		}
 
+		if e.Type == DeviceType {
+			e.HasPoint, err = db.getPoints(ctx, nodeId_)
+			if err != nil {
+				return 0, nil, err
+			}
+		}
+
 		entities = append(entities, e)
 	}
 
@@ -355,6 +641,9 @@ func (db *databaseImpl) GetEntity(ctx context.Context, entityID, entityType stri
 
 	err := row.Scan(&nodeId_, &entityId_, &entityType_, &entityContext_)
 	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Entity{}, ErrNotFound
+		}
 		return Entity{}, err
 	}
 
@@ -372,9 +661,83 @@ func (db *databaseImpl) GetEntity(ctx context.Context, entityID, entityType stri
 		}
 	}
 
+	if e.Type == DeviceType {
+		e.HasPoint, err = db.getPoints(ctx, nodeId_)
+		if err != nil {
+			return Entity{}, err
+		}
+	}
+
 	return e, nil
 }
 
+// GetUnassignedSensors returns sensors that have reported observations but are not part of
+// the entity hierarchy, either because they are not registered at all or because they are
+// only part of the space used for unassigned sensors. The sensors that have reported are taken
+// from the sensor status, so a sensor is listed once its status has been refreshed.
+func (db *databaseImpl) GetUnassignedSensors(ctx context.Context, unassignedSpaceID string, page, size int) (int64, []Entity, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT s.sensor_id, e.entity_id IS NOT NULL AS registered, count(*) OVER() AS full_count
+		FROM sensor_status s
+		LEFT JOIN entity e ON e.entity_id = s.sensor_id AND e.entity_type = $1
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM relation r JOIN
+			entity p ON p.node_id = r.parent
+			WHERE r.child = e.node_id
+			  AND r.relation_type = $2
+			  AND NOT (p.entity_id = $3 AND p.entity_type = $4)
+		)
+		ORDER BY s.sensor_id ASC
+		OFFSET $5 LIMIT $6`, SensorType, isPartOfRelation, unassignedSpaceID, SpaceType, page*size, size)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	type unassigned struct {
+		sensorId   string
+		registered bool
+	}
+
+	sensors := make([]unassigned, 0)
+	var fullCount int64
+
+	for rows.Next() {
+		var u unassigned
+		err := rows.Scan(&u.sensorId, &u.registered, &fullCount)
+		if err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		sensors = append(sensors, u)
+	}
+	rows.Close()
+
+	entities := make([]Entity, 0, len(sensors))
+
+	for _, u := range sensors {
+		if !u.registered {
+			entities = append(entities, Entity{
+				Context: SensorContext,
+				Id:      u.sensorId,
+				Type:    SensorType,
+			})
+			continue
+		}
+
+		e, err := db.GetEntity(ctx, u.sensorId, SensorType)
+		if err != nil {
+			return 0, nil, err
+		}
+		entities = append(entities, e)
+	}
+
+	return fullCount, entities, nil
+}
+
+// AddObservation stores the observations in one transaction. Observations are dropped according
+// to the deduplication policy for their sensor or quantity kind. Concurrent writes to the same series
+// are serialized so that the duplicate check and the insert are atomic.
 func (db *databaseImpl) AddObservation(ctx context.Context, so SensorObservation) error {
 	tx, err := db.pool.BeginTx(ctx, pgx.TxOptions{
 		IsoLevel:       pgx.ReadCommitted,
@@ -385,35 +748,29 @@ func (db *databaseImpl) AddObservation(ctx context.Context, so SensorObservation
 		return err
 	}
 
+	err = lockSeries(ctx, tx, []SensorObservation{so})
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
 	for _, o := range so.Observations {
-		row := db.pool.QueryRow(ctx, `
-			SELECT value, value_string, value_boolean 
-			FROM observations 
-			WHERE device_id = $1
-				AND sensor_id = $2					  
-				AND quantity_kind = $3
-				AND observation_time > $4
-			ORDER BY observation_time DESC
-			LIMIT 1
-			`, so.DeviceID, o.SensorId, o.QuantityKind, o.ObservationTime.Add(-1*time.Minute))
-
-		var v *float64
-		var vs *string
-		var vb *bool
-
-		err := row.Scan(&v, &vs, &vb)
-		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		policy := db.policies.Get(o.SensorId, o.QuantityKind)
+
+		latest, err := latestObservation(ctx, tx, so.DeviceID, o, policy)
+		if err != nil {
 			tx.Rollback(ctx)
 			return err
 		}
 
-		if err == nil && isValueEqual(o, v, vs, vb) {
+		if policy.isDuplicate(o, latest) {
+			db.suppressed(ctx, o)
 			continue
 		}
 
-		_, err = db.pool.Exec(ctx, `
-			INSERT INTO observations (device_id, sensor_id, observation_time, value, value_string, value_boolean, quantity_kind) 
-			VALUES ($1, $2, $3, $4, $5, $6, $7)`, so.DeviceID, o.SensorId, o.ObservationTime, o.Value, o.ValueString, o.ValueBoolean, o.QuantityKind)
+		_, err = tx.Exec(ctx, `
+			INSERT INTO observations (device_id, sensor_id, observation_time, value, raw_value, value_string, value_boolean, quantity_kind, quality, quality_reason) 
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`, so.DeviceID, o.SensorId, o.ObservationTime, o.Value, o.RawValue, o.ValueString, o.ValueBoolean, o.QuantityKind, o.quality(), o.QualityReason)
 		if err != nil {
 			tx.Rollback(ctx)
 			return err
@@ -423,6 +780,333 @@ func (db *databaseImpl) AddObservation(ctx context.Context, so SensorObservation
 	return tx.Commit(ctx)
 }
 
+// AddObservations stores observations from several sensor observations in one transaction using COPY.
+// Observations are deduplicated against both stored observations and earlier observations in the same batch.
+func (db *databaseImpl) AddObservations(ctx context.Context, sos []SensorObservation) error {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = lockSeries(ctx, tx, sos)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	rows := make([][]any, 0)
+	batched := make(map[string][]Observation)
+
+	for _, so := range sos {
+		for _, o := range so.Observations {
+			key := seriesKey(so.DeviceID, o)
+			policy := db.policies.Get(o.SensorId, o.QuantityKind)
+
+			latest, err := latestObservation(ctx, tx, so.DeviceID, o, policy)
+			if err != nil {
+				tx.Rollback(ctx)
+				return err
+			}
+
+			for i, b := range batched[key] {
+				if b.ObservationTime.After(o.ObservationTime) {
+					continue
+				}
+				if latest == nil || b.ObservationTime.After(latest.ObservationTime) {
+					latest = &batched[key][i]
+				}
+			}
+
+			if policy.isDuplicate(o, latest) {
+				db.suppressed(ctx, o)
+				continue
+			}
+
+			batched[key] = append(batched[key], o)
+			rows = append(rows, []any{so.DeviceID, o.SensorId, o.ObservationTime, o.Value, o.RawValue, o.ValueString, o.ValueBoolean, o.QuantityKind, o.quality(), o.QualityReason})
+		}
+	}
+
+	_, err = tx.CopyFrom(ctx,
+		pgx.Identifier{"observations"},
+		[]string{"device_id", "sensor_id", "observation_time", "value", "raw_value", "value_string", "value_boolean", "quantity_kind", "quality", "quality_reason"},
+		pgx.CopyFromRows(rows),
+	)
+	if err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// ObservationReader is a stream of observations to import, read until Next returns false.
+type ObservationReader interface {
+	Next() bool
+	Observation() (deviceID string, o Observation)
+	Err() error
+}
+
+// DeviceRegistration is how the devices of imported observations are registered. Sensors that are
+// not known are created if AutoRegisterSensors is set, as part of the space UnassignedSpaceID if it
+// is set, otherwise they are left out of the device.
+type DeviceRegistration struct {
+	AutoRegisterSensors bool
+	UnassignedSpaceID   string
+}
+
+// RegisteredEntities are the entities that were created, or got new points, when registering devices.
+type RegisteredEntities struct {
+	Created []Property
+	Updated []Property
+}
+
+// ImportObservations streams observations into the observations table with a single COPY. The
+// observations are not deduplicated, it is meant for importing historical data. The distinct
+// devices and sensors of the observations are registered after the COPY in the same transaction.
+func (db *databaseImpl) ImportObservations(ctx context.Context, r ObservationReader, reg DeviceRegistration) (int64, RegisteredEntities, error) {
+	tx, err := db.pool.Begin(ctx)
+	if err != nil {
+		return 0, RegisteredEntities{}, err
+	}
+
+	// imported observations are not announced to listeners
+	_, err = tx.Exec(ctx, "SET LOCAL api_rec.skip_notify = 'on'")
+	if err != nil {
+		tx.Rollback(ctx)
+		return 0, RegisteredEntities{}, err
+	}
+
+	src := &observationCopySource{r: r, devices: make(map[string]map[string]struct{})}
+
+	n, err := tx.CopyFrom(ctx,
+		pgx.Identifier{"observations"},
+		[]string{"device_id", "sensor_id", "observation_time", "value", "raw_value", "value_string", "value_boolean", "quantity_kind", "quality", "quality_reason"},
+		src,
+	)
+	if err != nil {
+		tx.Rollback(ctx)
+		return 0, RegisteredEntities{}, err
+	}
+
+	registered, err := registerDevices(ctx, tx, src.devices, reg)
+	if err != nil {
+		tx.Rollback(ctx)
+		return 0, RegisteredEntities{}, err
+	}
+
+	return n, registered, tx.Commit(ctx)
+}
+
+// registerDevices makes sure a device entity exists for every device in devices and that it hosts
+// each of its sensors.
+func registerDevices(ctx context.Context, tx pgx.Tx, devices map[string]map[string]struct{}, reg DeviceRegistration) (RegisteredEntities, error) {
+	registered := RegisteredEntities{
+		Created: make([]Property, 0),
+		Updated: make([]Property, 0),
+	}
+
+	var spaceNodeID int64
+
+	if reg.AutoRegisterSensors && reg.UnassignedSpaceID != "" {
+		created, nodeID, err := insertEntity(ctx, tx, Entity{Id: reg.UnassignedSpaceID, Type: SpaceType, Context: SpaceContext})
+		if err != nil {
+			return RegisteredEntities{}, err
+		}
+		if created {
+			registered.Created = append(registered.Created, Property{Id: reg.UnassignedSpaceID, Type: SpaceType})
+		}
+		spaceNodeID = nodeID
+	}
+
+	deviceIDs := make([]string, 0, len(devices))
+	for deviceID := range devices {
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	slices.Sort(deviceIDs)
+
+	for _, deviceID := range deviceIDs {
+		sensorNodeIDs := make([]int64, 0, len(devices[deviceID]))
+
+		for sensorID := range devices[deviceID] {
+			var nodeID int64
+
+			err := tx.QueryRow(ctx, "SELECT node_id FROM entity WHERE entity_id = $1 AND entity_type = $2", sensorID, SensorType).Scan(&nodeID)
+			if errors.Is(err, pgx.ErrNoRows) {
+				if !reg.AutoRegisterSensors {
+					continue
+				}
+
+				_, nodeID, err = insertEntity(ctx, tx, Entity{Id: sensorID, Type: SensorType, Context: SensorContext})
+				if err != nil {
+					return RegisteredEntities{}, err
+				}
+				registered.Created = append(registered.Created, Property{Id: sensorID, Type: SensorType})
+
+				if spaceNodeID != 0 {
+					_, err = tx.Exec(ctx, "INSERT INTO relation (parent, child, relation_type) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING", spaceNodeID, nodeID, isPartOfRelation)
+					if err != nil {
+						return RegisteredEntities{}, err
+					}
+				}
+			} else if err != nil {
+				return RegisteredEntities{}, err
+			}
+
+			sensorNodeIDs = append(sensorNodeIDs, nodeID)
+		}
+
+		if len(sensorNodeIDs) == 0 {
+			continue
+		}
+
+		created, deviceNodeID, err := insertEntity(ctx, tx, Entity{Id: deviceID, Type: DeviceType, Context: DeviceContext})
+		if err != nil {
+			return RegisteredEntities{}, err
+		}
+
+		tag, err := tx.Exec(ctx, `
+			INSERT INTO relation (parent, child, relation_type)
+			SELECT $1, child, $3 FROM unnest($2::bigint[]) AS child
+			ON CONFLICT DO NOTHING`, deviceNodeID, sensorNodeIDs, hasPointRelation)
+		if err != nil {
+			return RegisteredEntities{}, err
+		}
+
+		if created {
+			registered.Created = append(registered.Created, Property{Id: deviceID, Type: DeviceType})
+		} else if tag.RowsAffected() > 0 {
+			registered.Updated = append(registered.Updated, Property{Id: deviceID, Type: DeviceType})
+		}
+	}
+
+	return registered, nil
+}
+
+// insertEntity creates an entity unless it exists and returns whether it was created and its node id.
+func insertEntity(ctx context.Context, tx pgx.Tx, e Entity) (bool, int64, error) {
+	var nodeID int64
+
+	err := tx.QueryRow(ctx, `
+		INSERT INTO entity (entity_id, entity_type, entity_context) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+		RETURNING node_id`, e.Id, e.Type, e.Context).Scan(&nodeID)
+	if err == nil {
+		return true, nodeID, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return false, 0, err
+	}
+
+	err = tx.QueryRow(ctx, "SELECT node_id FROM entity WHERE entity_id = $1 AND entity_type = $2", e.Id, e.Type).Scan(&nodeID)
+	return false, nodeID, err
+}
+
+type observationCopySource struct {
+	r       ObservationReader
+	devices map[string]map[string]struct{}
+}
+
+func (s *observationCopySource) Next() bool {
+	return s.r.Next()
+}
+
+func (s *observationCopySource) Values() ([]any, error) {
+	deviceID, o := s.r.Observation()
+
+	sensors, ok := s.devices[deviceID]
+	if !ok {
+		sensors = make(map[string]struct{})
+		s.devices[deviceID] = sensors
+	}
+	sensors[o.SensorId] = struct{}{}
+
+	return []any{deviceID, o.SensorId, o.ObservationTime, o.Value, o.RawValue, o.ValueString, o.ValueBoolean, o.QuantityKind, o.quality(), o.QualityReason}, nil
+}
+
+func (s *observationCopySource) Err() error {
+	return s.r.Err()
+}
+
+func (db *databaseImpl) suppressed(ctx context.Context, o Observation) {
+	if db.suppressedCounter == nil {
+		return
+	}
+	db.suppressedCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("quantity_kind", o.QuantityKind)))
+}
+
+func seriesKey(deviceID string, o Observation) string {
+	return fmt.Sprintf("%s|%s|%s", deviceID, o.SensorId, o.QuantityKind)
+}
+
+// lockSeries takes a transaction level advisory lock for every series (device, sensor and quantity kind)
+// in sos. Locks are taken in a fixed order to avoid deadlocks between concurrent transactions.
+func lockSeries(ctx context.Context, tx pgx.Tx, sos []SensorObservation) error {
+	keys := make([]string, 0)
+
+	for _, so := range sos {
+		for _, o := range so.Observations {
+			keys = append(keys, seriesKey(so.DeviceID, o))
+		}
+	}
+
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	for _, key := range keys {
+		_, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtextextended($1, 0))", key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type querier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// latestObservation returns the latest stored observation before the observation o, limited by
+// how far back the policy looks, or nil if there is none or the policy stores every observation.
+func latestObservation(ctx context.Context, q querier, deviceID string, o Observation, policy DeduplicationPolicy) (*Observation, error) {
+	if policy.Mode == DeduplicationAlways {
+		return nil, nil
+	}
+
+	after := time.Time{}
+	if lookback := policy.lookback(); lookback > 0 {
+		after = o.ObservationTime.Add(-lookback)
+	}
+
+	row := q.QueryRow(ctx, `
+		SELECT observation_time, value, value_string, value_boolean 
+		FROM observations 
+		WHERE device_id = $1
+			AND sensor_id = $2					  
+			AND quantity_kind = $3
+			AND observation_time > $4
+			AND observation_time <= $5
+		ORDER BY observation_time DESC
+		LIMIT 1
+		`, deviceID, o.SensorId, o.QuantityKind, after, o.ObservationTime)
+
+	latest := Observation{
+		SensorId:     o.SensorId,
+		QuantityKind: o.QuantityKind,
+	}
+
+	err := row.Scan(&latest.ObservationTime, &latest.Value, &latest.ValueString, &latest.ValueBoolean)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &latest, nil
+}
+
 func isValueEqual(observation Observation, v *float64, vs *string, vb *bool) bool {
 	eqV, eqVs, eqVb := false, false, false
 
@@ -448,16 +1132,25 @@ func isValueEqual(observation Observation, v *float64, vs *string, vb *bool) boo
 }
 
 func (db *databaseImpl) GetObservations(ctx context.Context, sensorId string, starting, ending time.Time, page, size int) (int64, []Observation, error) {
-	limit := size
-	offset := page * size
+	return db.QueryObservations(ctx, ObservationFilter{SensorIDs: []string{sensorId}, Starting: starting, Ending: ending}, page, size)
+}
 
-	rows, err := db.pool.Query(ctx, `
-		SELECT observation_time, value, value_string, value_boolean, quantity_kind, count(*) OVER() AS full_count 
+func (db *databaseImpl) GetDeviceObservations(ctx context.Context, deviceId string, starting, ending time.Time, page, size int) (int64, []Observation, error) {
+	return db.QueryObservations(ctx, ObservationFilter{DeviceID: deviceId, Starting: starting, Ending: ending}, page, size)
+}
+
+// QueryObservations returns a page of the observations that match the filter, ordered by time, together
+// with the total number of matching observations.
+func (db *databaseImpl) QueryObservations(ctx context.Context, filter ObservationFilter, page, size int) (int64, []Observation, error) {
+	where, args := filter.where()
+	args = append(args, page*size, size)
+
+	rows, err := db.pool.Query(ctx, fmt.Sprintf(`
+		SELECT sensor_id, observation_time, value, raw_value, value_string, value_boolean, quantity_kind, quality, quality_reason, count(*) OVER() AS full_count 
 		FROM observations
-		WHERE sensor_id = $1
-		  AND observation_time BETWEEN $2 AND $3
+		WHERE %s
 		ORDER BY observation_time ASC
-		OFFSET $4 LIMIT $5`, sensorId, starting, ending, offset, limit)
+		OFFSET $%d LIMIT $%d`, where, len(args)-1, len(args)), args...)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -467,28 +1160,187 @@ func (db *databaseImpl) GetObservations(ctx context.Context, sensorId string, st
 	var fullCount int64
 
 	for rows.Next() {
-		var ot time.Time
-		var v *float64
-		var vs *string
-		var vb *bool
-		var qk string
+		var o Observation
 
-		err := rows.Scan(&ot, &v, &vs, &vb, &qk, &fullCount)
+		err := rows.Scan(&o.SensorId, &o.ObservationTime, &o.Value, &o.RawValue, &o.ValueString, &o.ValueBoolean, &o.QuantityKind, &o.Quality, &o.QualityReason, &fullCount)
 		if err != nil {
 			return 0, nil, err
 		}
 
-		observation := Observation{
-			SensorId:        sensorId,
-			ObservationTime: ot,
-			Value:           v,
-			ValueString:     vs,
-			ValueBoolean:    vb,
-			QuantityKind:    qk,
+		observations = append(observations, o)
+	}
+
+	return fullCount, observations, rows.Err()
+}
+
+// StreamObservations calls fn for every observation that matches the filter, ordered by time. The
+// observations are read from a cursor so that result sets of any size can be streamed.
+func (db *databaseImpl) StreamObservations(ctx context.Context, filter ObservationFilter, fn func(deviceID string, o Observation) error) error {
+	where, args := filter.where()
+
+	rows, err := db.pool.Query(ctx, `
+		SELECT device_id, sensor_id, observation_time, value, raw_value, value_string, value_boolean, quantity_kind, quality, quality_reason
+		FROM observations
+		WHERE `+where+`
+		ORDER BY observation_time ASC`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var deviceID string
+		var o Observation
+
+		err := rows.Scan(&deviceID, &o.SensorId, &o.ObservationTime, &o.Value, &o.RawValue, &o.ValueString, &o.ValueBoolean, &o.QuantityKind, &o.Quality, &o.QualityReason)
+		if err != nil {
+			return err
+		}
+
+		err = fn(deviceID, o)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetBoundaryObservations returns, for each sensor matching the filter apart from its time range, the
+// latest observation before the start and the earliest observation after the end of the time range.
+func (db *databaseImpl) GetBoundaryObservations(ctx context.Context, filter ObservationFilter) ([]StoredObservation, error) {
+	unbounded := filter
+	unbounded.Starting, unbounded.Ending = time.Time{}, time.Time{}
+
+	where, args := unbounded.where()
+	args = append(args, filter.Starting, filter.Ending)
+
+	rows, err := db.pool.Query(ctx, fmt.Sprintf(`
+		(SELECT DISTINCT ON (sensor_id) observation_id, device_id, sensor_id, observation_time, value, raw_value, value_string, value_boolean, quantity_kind, quality, quality_reason
+		FROM observations
+		WHERE %[1]s AND observation_time < $%[2]d
+		ORDER BY sensor_id, observation_time DESC)
+		UNION ALL
+		(SELECT DISTINCT ON (sensor_id) observation_id, device_id, sensor_id, observation_time, value, raw_value, value_string, value_boolean, quantity_kind, quality, quality_reason
+		FROM observations
+		WHERE %[1]s AND observation_time > $%[3]d
+		ORDER BY sensor_id, observation_time ASC)`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	observations := make([]StoredObservation, 0)
+
+	for rows.Next() {
+		var so StoredObservation
+
+		err := rows.Scan(&so.ID, &so.DeviceID, &so.SensorId, &so.ObservationTime, &so.Value, &so.RawValue, &so.ValueString, &so.ValueBoolean, &so.QuantityKind, &so.Quality, &so.QualityReason)
+		if err != nil {
+			return nil, err
+		}
+
+		observations = append(observations, so)
+	}
+
+	return observations, rows.Err()
+}
+
+// SetObservationQuality sets the quality of the observations that match the filter and returns the
+// number of observations changed.
+func (db *databaseImpl) SetObservationQuality(ctx context.Context, filter ObservationFilter, quality, reason string) (int64, error) {
+	where, args := filter.where()
+	args = append(args, quality, reason)
+
+	tag, err := db.pool.Exec(ctx, fmt.Sprintf(`
+		UPDATE observations SET quality = $%d, quality_reason = $%d
+		WHERE %s`, len(args)-1, len(args), where), args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// AddProcessedEvent records an event as processed and returns false, without changing anything, if
+// it has already been processed after since. Records from before since are taken over, so that the
+// check and the insert are one statement and two instances can not both record the same event.
+func (db *databaseImpl) AddProcessedEvent(ctx context.Context, source, eventID string, since time.Time) (bool, error) {
+	tag, err := db.pool.Exec(ctx, `
+		INSERT INTO processed_events (source, event_id, processed_at) 
+		VALUES ($1, $2, $3) 
+		ON CONFLICT (source, event_id) DO UPDATE SET processed_at = EXCLUDED.processed_at
+		WHERE processed_events.processed_at <= $4`, source, eventID, time.Now().UTC(), since)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (db *databaseImpl) DeleteProcessedEvent(ctx context.Context, source, eventID string) error {
+	_, err := db.pool.Exec(ctx, "DELETE FROM processed_events WHERE source = $1 AND event_id = $2", source, eventID)
+	return err
+}
+
+func (db *databaseImpl) DeleteProcessedEvents(ctx context.Context, before time.Time) error {
+	_, err := db.pool.Exec(ctx, "DELETE FROM processed_events WHERE processed_at < $1", before)
+	return err
+}
+
+func (db *databaseImpl) AddDeadLetter(ctx context.Context, dl DeadLetter) error {
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO dead_letters (event_id, source, event_type, event_time, received_at, reason, data) 
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, dl.EventID, dl.Source, dl.EventType, dl.EventTime, dl.ReceivedAt, dl.Reason, dl.Data)
+	return err
+}
+
+func (db *databaseImpl) GetDeadLetter(ctx context.Context, id int64) (DeadLetter, error) {
+	var dl DeadLetter
+
+	row := db.pool.QueryRow(ctx, `
+		SELECT dead_letter_id, event_id, source, event_type, event_time, received_at, reason, data, replayed_at 
+		FROM dead_letters 
+		WHERE dead_letter_id = $1`, id)
+
+	err := row.Scan(&dl.Id, &dl.EventID, &dl.Source, &dl.EventType, &dl.EventTime, &dl.ReceivedAt, &dl.Reason, &dl.Data, &dl.ReplayedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return DeadLetter{}, ErrNotFound
 		}
+		return DeadLetter{}, err
+	}
+
+	return dl, nil
+}
+
+func (db *databaseImpl) GetDeadLetters(ctx context.Context, page, size int) (int64, []DeadLetter, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT dead_letter_id, event_id, source, event_type, event_time, received_at, reason, data, replayed_at, count(*) OVER() AS full_count 
+		FROM dead_letters 
+		ORDER BY dead_letter_id DESC
+		OFFSET $1 LIMIT $2`, page*size, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	deadLetters := make([]DeadLetter, 0)
+	var fullCount int64
 
-		observations = append(observations, observation)
+	for rows.Next() {
+		var dl DeadLetter
+		err := rows.Scan(&dl.Id, &dl.EventID, &dl.Source, &dl.EventType, &dl.EventTime, &dl.ReceivedAt, &dl.Reason, &dl.Data, &dl.ReplayedAt, &fullCount)
+		if err != nil {
+			return 0, nil, err
+		}
+		deadLetters = append(deadLetters, dl)
 	}
 
-	return fullCount, observations, nil
+	return fullCount, deadLetters, nil
+}
+
+func (db *databaseImpl) UpdateDeadLetter(ctx context.Context, id int64, reason string, replayedAt *time.Time) error {
+	_, err := db.pool.Exec(ctx, "UPDATE dead_letters SET reason = $2, replayed_at = $3 WHERE dead_letter_id = $1", id, reason, replayedAt)
+	return err
 }
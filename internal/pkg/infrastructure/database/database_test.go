@@ -2,9 +2,11 @@ package database
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -273,6 +275,235 @@ func TestAddAndGetObservations(t *testing.T) {
 	}
 }
 
+func TestAddObservationConcurrently(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	now := time.Now().UTC()
+	v := 42.0
+	deviceID := uuid.New().String()
+	sensorID := uuid.New().String()
+
+	so := SensorObservation{
+		DeviceID: deviceID,
+		Observations: []Observation{
+			{
+				ObservationTime: now,
+				Value:           &v,
+				QuantityKind:    "Float",
+				SensorId:        sensorID,
+			},
+		},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- db.AddObservation(ctx, so)
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Logf("failed to add observation: %s", err.Error())
+			t.FailNow()
+		}
+	}
+
+	count, _, err := db.GetObservations(ctx, sensorID, now.Add(-5*time.Second), now.Add(1*time.Minute), 0, 10)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if count != 1 {
+		t.Logf("%d != 1, parallel identical observations should be stored exactly once", count)
+		t.Fail()
+	}
+}
+
+func TestGetUnassignedSensors(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	v := 1.0
+	unassignedSpaceID := uuid.New().String()
+	deviceID := uuid.New().String()
+	sensorID := uuid.New().String()
+
+	err = db.AddObservation(ctx, SensorObservation{
+		DeviceID: deviceID,
+		Observations: []Observation{
+			{
+				ObservationTime: time.Now().UTC(),
+				Value:           &v,
+				QuantityKind:    "Float",
+				SensorId:        sensorID,
+			},
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+
+	err = db.RefreshSensorStatus(ctx)
+	if err != nil {
+		t.FailNow()
+	}
+
+	isUnassigned := func() bool {
+		_, e, err := db.GetUnassignedSensors(ctx, unassignedSpaceID, 0, 100000)
+		if err != nil {
+			t.FailNow()
+		}
+		return slices.ContainsFunc(e, func(e Entity) bool {
+			return e.Id == sensorID
+		})
+	}
+
+	if !isUnassigned() {
+		t.Log("unregistered sensor should be unassigned")
+		t.FailNow()
+	}
+
+	err = db.AddEntity(ctx, Entity{Context: SpaceContext, Id: unassignedSpaceID, Type: SpaceType})
+	if err != nil {
+		t.FailNow()
+	}
+	err = db.AddEntity(ctx, Entity{Context: SensorContext, Id: sensorID, Type: SensorType, IsPartOf: &Property{Id: unassignedSpaceID, Type: SpaceType}})
+	if err != nil {
+		t.FailNow()
+	}
+
+	if !isUnassigned() {
+		t.Log("sensor in unassigned space should be unassigned")
+		t.FailNow()
+	}
+
+	buildingID := uuid.New().String()
+	err = db.AddEntity(ctx, Entity{Context: BuildingContext, Id: buildingID, Type: BuildingType})
+	if err != nil {
+		t.FailNow()
+	}
+	err = db.AddEntity(ctx, Entity{Context: SensorContext, Id: sensorID, Type: SensorType, IsPartOf: &Property{Id: buildingID, Type: BuildingType}})
+	if err != nil {
+		t.FailNow()
+	}
+
+	if isUnassigned() {
+		t.Log("sensor in building should not be unassigned")
+		t.FailNow()
+	}
+}
+
+func TestProcessedEvents(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	source := "test"
+	eventID := uuid.New().String()
+	since := time.Now().UTC().Add(-1 * time.Hour)
+
+	added, err := db.AddProcessedEvent(ctx, source, eventID, since)
+	is.NoErr(err)
+	is.True(added)
+
+	// adding the same event again should not fail, but report that it has been processed
+	added, err = db.AddProcessedEvent(ctx, source, eventID, since)
+	is.NoErr(err)
+	is.True(!added)
+
+	added, err = db.AddProcessedEvent(ctx, "other", eventID, since)
+	is.NoErr(err)
+	is.True(added)
+
+	// a record from before since is taken over
+	added, err = db.AddProcessedEvent(ctx, source, eventID, time.Now().UTC().Add(1*time.Minute))
+	is.NoErr(err)
+	is.True(added)
+
+	err = db.DeleteProcessedEvent(ctx, source, eventID)
+	is.NoErr(err)
+
+	added, err = db.AddProcessedEvent(ctx, source, eventID, since)
+	is.NoErr(err)
+	is.True(added)
+
+	err = db.DeleteProcessedEvents(ctx, time.Now().UTC().Add(1*time.Minute))
+	is.NoErr(err)
+
+	added, err = db.AddProcessedEvent(ctx, source, eventID, since)
+	is.NoErr(err)
+	is.True(added)
+}
+
+func TestDeadLetters(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	eventID := uuid.New().String()
+
+	err = db.AddDeadLetter(ctx, DeadLetter{
+		EventID:    eventID,
+		Source:     "test",
+		EventType:  "message.accepted",
+		ReceivedAt: time.Now().UTC(),
+		Reason:     "test",
+		Data:       "{}",
+	})
+	is.NoErr(err)
+
+	_, deadLetters, err := db.GetDeadLetters(ctx, 0, 10)
+	is.NoErr(err)
+
+	i := slices.IndexFunc(deadLetters, func(dl DeadLetter) bool {
+		return dl.EventID == eventID
+	})
+	is.True(i >= 0)
+
+	now := time.Now().UTC()
+	err = db.UpdateDeadLetter(ctx, deadLetters[i].Id, "replayed", &now)
+	is.NoErr(err)
+
+	dl, err := db.GetDeadLetter(ctx, deadLetters[i].Id)
+	is.NoErr(err)
+	is.Equal("replayed", dl.Reason)
+	is.True(dl.ReplayedAt != nil)
+
+	_, err = db.GetDeadLetter(ctx, -1)
+	is.True(errors.Is(err, ErrNotFound))
+}
+
 func TestSeed(t *testing.T) {
 	ctx, cancel, db, err := connect()
 	defer cancel()
@@ -319,6 +550,69 @@ spaces;buildings;sensors
 	}
 }
 
+func TestSeedWithDevices(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	spaceID := uuid.New().String()
+	buildingID := uuid.New().String()
+	sensorID := uuid.New().String()
+	deviceID := uuid.New().String()
+
+	csv := fmt.Sprintf(`spaces;buildings;sensors;devices
+%s;%s;%s-1;%s
+%s;%s;%s-2;%s`, spaceID, buildingID, sensorID, deviceID, spaceID, buildingID, sensorID, deviceID)
+
+	err = db.Seed(ctx, strings.NewReader(csv))
+	if err != nil {
+		t.FailNow()
+	}
+
+	device, err := db.GetEntity(ctx, deviceID, DeviceType)
+	if err != nil {
+		t.Log("could not find device")
+		t.FailNow()
+	}
+
+	if len(device.HasPoint) != 2 {
+		t.Logf("device should host two sensors, found %d", len(device.HasPoint))
+		t.FailNow()
+	}
+
+	sensor, err := db.GetEntity(ctx, sensorID+"-1", SensorType)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if sensor.IsPartOf.Id != buildingID {
+		t.Logf("expected %s but got %s", buildingID, sensor.IsPartOf.Id)
+		t.FailNow()
+	}
+}
+
+func TestGetRecFromRows(t *testing.T) {
+	is := is.New(t)
+
+	recs := getRecFromRows([][]string{
+		{"spaces", "buildings", "sensors"},
+		{"space", "building", "sensor"},
+	})
+	is.Equal(1, len(recs))
+	is.Equal("", recs[0].Device)
+
+	recs = getRecFromRows([][]string{
+		{"spaces", "buildings", "sensors", "devices"},
+		{"space", "building", "sensor", "device"},
+	})
+	is.Equal(1, len(recs))
+	is.Equal("device", recs[0].Device)
+}
+
 func TestIsValueEqual(t *testing.T) {
 	is := is.New(t)
 
@@ -349,3 +643,415 @@ func TestIsValueEqual(t *testing.T) {
 	o.Value = nil
 	is.True(isValueEqual(o, nil, &vs, &vb))
 }
+
+func TestImportObservations(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	sensorID := uuid.New().String()
+	now := time.Now().UTC().Truncate(time.Second)
+	v := 1.0
+
+	r := &sliceObservationReader{
+		deviceID: "device-" + sensorID,
+		observations: []Observation{
+			{SensorId: sensorID, ObservationTime: now.Add(-2 * time.Hour), Value: &v, QuantityKind: "Temperature"},
+			{SensorId: sensorID, ObservationTime: now.Add(-1 * time.Hour), Value: &v, QuantityKind: "Temperature"},
+		},
+		i: -1,
+	}
+
+	n, registered, err := db.ImportObservations(ctx, r, DeviceRegistration{AutoRegisterSensors: true})
+	is.NoErr(err)
+	is.Equal(int64(2), n)
+	is.Equal([]Property{{Id: sensorID, Type: SensorType}, {Id: r.deviceID, Type: DeviceType}}, registered.Created)
+
+	device, err := db.GetEntity(ctx, r.deviceID, DeviceType)
+	is.NoErr(err)
+	is.Equal([]Property{{Id: sensorID, Type: SensorType}}, device.HasPoint)
+
+	total, _, err := db.GetObservations(ctx, sensorID, now.Add(-3*time.Hour), now, 0, 10)
+	is.NoErr(err)
+	is.Equal(int64(2), total) // imported observations are not deduplicated
+}
+
+type sliceObservationReader struct {
+	deviceID     string
+	observations []Observation
+	i            int
+}
+
+func (r *sliceObservationReader) Next() bool {
+	r.i++
+	return r.i < len(r.observations)
+}
+
+func (r *sliceObservationReader) Observation() (string, Observation) {
+	return r.deviceID, r.observations[r.i]
+}
+
+func (r *sliceObservationReader) Err() error {
+	return nil
+}
+
+func TestSubscriptionDeliveries(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	s := Subscription{
+		Id:        uuid.NewString(),
+		Endpoint:  "https://example.com/hook",
+		Types:     []string{"observation.stored"},
+		SensorID:  uuid.NewString(),
+		CreatedAt: time.Now().UTC(),
+	}
+	is.NoErr(db.AddSubscription(ctx, s))
+
+	stored, err := db.GetSubscription(ctx, s.Id)
+	is.NoErr(err)
+	is.Equal(s.SensorID, stored.SensorID)
+	is.Equal(s.Types, stored.Types)
+	is.True(stored.Root == nil)
+
+	d := Delivery{SubscriptionID: s.Id, EventID: "observation-1", EventType: "observation.stored", Data: []byte(`{"id":1}`), CreatedAt: time.Now().UTC().Add(-time.Second)}
+
+	// the same event is only delivered once to a subscription
+	is.NoErr(db.AddDeliveries(ctx, []Delivery{d, d}))
+
+	claimed, err := db.ClaimDeliveries(ctx, 100, time.Minute)
+	is.NoErr(err)
+
+	claimed = slices.DeleteFunc(claimed, func(c Delivery) bool { return c.SubscriptionID != s.Id })
+	is.Equal(1, len(claimed))
+	is.Equal(s.Endpoint, claimed[0].Endpoint)
+
+	// a claimed delivery is not claimed again until its lease has expired
+	again, err := db.ClaimDeliveries(ctx, 100, time.Minute)
+	is.NoErr(err)
+	is.True(!slices.ContainsFunc(again, func(c Delivery) bool { return c.SubscriptionID == s.Id }))
+
+	now := time.Now().UTC()
+	claimed[0].Status, claimed[0].Attempts, claimed[0].DeliveredAt, claimed[0].NextAttemptAt = DeliveryDelivered, 1, &now, nil
+	is.NoErr(db.UpdateDelivery(ctx, claimed[0]))
+
+	total, deliveries, err := db.GetDeliveries(ctx, s.Id, 0, 10)
+	is.NoErr(err)
+	is.Equal(int64(1), total)
+	is.Equal(DeliveryDelivered, deliveries[0].Status)
+	is.Equal(`{"id":1}`, string(deliveries[0].Data))
+
+	is.NoErr(db.DeleteSubscription(ctx, s.Id))
+	is.True(errors.Is(db.DeleteSubscription(ctx, s.Id), ErrNotFound))
+}
+
+func TestRulesAndAlarms(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	limit := 20.0
+	r := Rule{
+		Id:           uuid.NewString(),
+		Name:         "too warm",
+		QuantityKind: "Temperature",
+		Condition:    RuleAbove,
+		Value:        &limit,
+		Duration:     "10m",
+		CreatedAt:    time.Now().UTC(),
+	}
+	is.NoErr(db.AddRule(ctx, r))
+
+	stored, err := db.GetRule(ctx, r.Id)
+	is.NoErr(err)
+	is.Equal(r.Duration, stored.Duration)
+	is.Equal(limit, *stored.Value)
+
+	sensorID := uuid.NewString()
+	since := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	value := 21.0
+
+	state, err := db.AddRuleState(ctx, RuleState{RuleID: r.Id, DeviceID: "device", Since: since, Observation: Observation{SensorId: sensorID, QuantityKind: "Temperature", ObservationTime: since, Value: &value}})
+	is.NoErr(err)
+
+	// a later observation does not move the time the condition was first met
+	state, err = db.AddRuleState(ctx, RuleState{RuleID: r.Id, DeviceID: "device", Since: since.Add(time.Minute), Observation: Observation{SensorId: sensorID, QuantityKind: "Temperature", ObservationTime: since.Add(time.Minute), Value: &value}})
+	is.NoErr(err)
+	is.True(state.Since.Equal(since))
+
+	alarm := Alarm{RuleID: r.Id, SensorID: sensorID, DeviceID: "device", QuantityKind: "Temperature", TriggeredAt: since, Value: &value, OpenedAt: time.Now().UTC()}
+
+	// a sensor only has one alarm per rule that is not closed
+	opened, err := db.OpenAlarm(ctx, alarm)
+	is.NoErr(err)
+	is.True(opened)
+
+	opened, err = db.OpenAlarm(ctx, alarm)
+	is.NoErr(err)
+	is.True(!opened)
+
+	total, alarms, err := db.GetAlarms(ctx, AlarmFilter{RuleID: r.Id, Status: AlarmOpen}, 0, 10)
+	is.NoErr(err)
+	is.Equal(int64(1), total)
+
+	acknowledged, err := db.UpdateAlarmStatus(ctx, alarms[0].Id, AlarmAcknowledged, []string{AlarmOpen}, time.Now().UTC())
+	is.NoErr(err)
+	is.Equal(AlarmAcknowledged, acknowledged.Status)
+	is.True(acknowledged.AcknowledgedAt != nil)
+
+	_, err = db.UpdateAlarmStatus(ctx, alarms[0].Id, AlarmAcknowledged, []string{AlarmOpen}, time.Now().UTC())
+	is.True(errors.Is(err, ErrNotFound))
+
+	is.True(state.ObservationTime.Equal(since.Add(time.Minute)))
+
+	// a late observation does not clear a state met by a newer observation, nor close its alarm
+	cleared, err := db.ClearRuleState(ctx, r.Id, sensorID, since.Add(30*time.Second))
+	is.NoErr(err)
+	is.True(!cleared)
+
+	notClosed, err := db.GetAlarm(ctx, alarms[0].Id)
+	is.NoErr(err)
+	is.Equal(AlarmAcknowledged, notClosed.Status)
+
+	cleared, err = db.ClearRuleState(ctx, r.Id, sensorID, time.Now().UTC())
+	is.NoErr(err)
+	is.True(cleared)
+
+	closed, err := db.GetAlarm(ctx, alarms[0].Id)
+	is.NoErr(err)
+	is.Equal(AlarmClosed, closed.Status)
+
+	is.NoErr(db.DeleteRule(ctx, r.Id))
+
+	_, err = db.GetAlarm(ctx, alarms[0].Id)
+	is.True(errors.Is(err, ErrNotFound))
+}
+
+func TestSensorStatusAndGaps(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	sensorID := uuid.NewString()
+	starting := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+	value := 21.0
+
+	observations := make([]Observation, 0)
+	for _, offset := range []time.Duration{time.Hour, 2 * time.Hour, 6 * time.Hour, 7 * time.Hour} {
+		observations = append(observations, Observation{SensorId: sensorID, ObservationTime: starting.Add(offset), Value: &value, QuantityKind: "Temperature"})
+	}
+	is.NoErr(db.AddObservation(ctx, SensorObservation{DeviceID: "device", Observations: observations}))
+
+	is.NoErr(db.RefreshSensorStatus(ctx))
+
+	total, statuses, err := db.GetSensorStatuses(ctx, SensorStatusFilter{SensorIDs: []string{sensorID}}, 0, 10)
+	is.NoErr(err)
+	is.Equal(int64(1), total)
+	is.True(statuses[0].LastObservationTime.Equal(starting.Add(7 * time.Hour)))
+	is.Equal(SensorReporting, statuses[0].Status)
+
+	staleSince := statuses[0].LastObservationTime.Add(time.Hour)
+	changed, err := db.SetSensorStaleSince(ctx, sensorID, statuses[0].LastObservationTime, &staleSince)
+	is.NoErr(err)
+	is.True(changed)
+
+	changed, err = db.SetSensorStaleSince(ctx, sensorID, statuses[0].LastObservationTime, &staleSince)
+	is.NoErr(err)
+	is.True(!changed)
+
+	total, _, err = db.GetSensorStatuses(ctx, SensorStatusFilter{SensorIDs: []string{sensorID}, Status: SensorStale}, 0, 10)
+	is.NoErr(err)
+	is.Equal(int64(1), total)
+
+	gaps, err := db.GetObservationGaps(ctx, ObservationFilter{SensorIDs: []string{sensorID}, Starting: starting, Ending: starting.Add(24 * time.Hour)}, 2*time.Hour)
+	is.NoErr(err)
+	is.Equal(3, len(gaps))
+	is.Equal("1h0m0s", gaps[0].Duration)
+	is.Equal("4h0m0s", gaps[1].Duration)
+	is.Equal("17h0m0s", gaps[2].Duration)
+}
+
+func TestVirtualSensors(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	v := VirtualSensor{
+		SensorID:     uuid.NewString(),
+		QuantityKind: "Temperature",
+		Formula:      "dewpoint(t, rh)",
+		Inputs: []VirtualSensorInput{
+			{Name: "t", SensorID: uuid.NewString(), QuantityKind: "Temperature"},
+			{Name: "rh", SensorID: uuid.NewString(), QuantityKind: "RelativeHumidity"},
+		},
+		CreatedAt: time.Now().UTC(),
+	}
+	is.NoErr(db.AddVirtualSensor(ctx, v))
+	is.True(errors.Is(db.AddVirtualSensor(ctx, v), ErrAlreadyExists))
+
+	stored, err := db.GetVirtualSensor(ctx, v.SensorID)
+	is.NoErr(err)
+	is.Equal(v.Inputs, stored.Inputs)
+	is.True(stored.Root == nil)
+
+	is.NoErr(db.DeleteVirtualSensor(ctx, v.SensorID))
+
+	_, err = db.GetVirtualSensor(ctx, v.SensorID)
+	is.True(errors.Is(err, ErrNotFound))
+	is.True(errors.Is(db.DeleteVirtualSensor(ctx, v.SensorID), ErrNotFound))
+}
+
+func TestCalibrations(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	sensorID := uuid.NewString()
+	starting := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+
+	observations := make([]Observation, 0)
+	for i, v := range []float64{10, 20, 30} {
+		value := v
+		observations = append(observations, Observation{SensorId: sensorID, ObservationTime: starting.Add(time.Duration(i) * time.Hour), Value: &value, QuantityKind: "Temperature"})
+	}
+	is.NoErr(db.AddObservation(ctx, SensorObservation{DeviceID: "device", Observations: observations}))
+
+	scale, max := 2.0, 50.0
+	c, err := db.AddCalibration(ctx, Calibration{SensorID: sensorID, QuantityKind: "Temperature", Offset: 1, Scale: &scale, Max: &max, EffectiveFrom: starting.Add(time.Hour), CreatedAt: time.Now().UTC()})
+	is.NoErr(err)
+	is.True(c.Id > 0)
+
+	calibrations, err := db.GetCalibrations(ctx, sensorID)
+	is.NoErr(err)
+	is.Equal(1, len(calibrations))
+
+	n, err := db.RecalibrateObservations(ctx, c, nil)
+	is.NoErr(err)
+	is.Equal(int64(2), n)
+
+	_, stored, err := db.GetObservations(ctx, sensorID, starting, starting.Add(3*time.Hour), 0, 10)
+	is.NoErr(err)
+	is.Equal(3, len(stored))
+	is.Equal(10.0, *stored[0].Value)
+	is.True(stored[0].RawValue == nil)
+	is.Equal(41.0, *stored[1].Value)
+	is.Equal(20.0, *stored[1].RawValue)
+	is.True(stored[2].Value == nil) // 61 is above max
+	is.Equal(30.0, *stored[2].RawValue)
+
+	deleted, err := db.DeleteCalibration(ctx, c.Id)
+	is.NoErr(err)
+	is.Equal(c.Id, deleted.Id)
+
+	_, err = db.GetCalibration(ctx, c.Id)
+	is.True(errors.Is(err, ErrNotFound))
+
+	// recalibrating with an identity calibration restores the raw values
+	_, err = db.RecalibrateObservations(ctx, Calibration{SensorID: sensorID, QuantityKind: "Temperature", EffectiveFrom: deleted.EffectiveFrom}, nil)
+	is.NoErr(err)
+
+	_, stored, err = db.GetObservations(ctx, sensorID, starting, starting.Add(3*time.Hour), 0, 10)
+	is.NoErr(err)
+	is.Equal(30.0, *stored[2].Value)
+}
+
+func TestObservationQuality(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	sensorID := uuid.NewString()
+	starting := time.Now().UTC().Add(-24 * time.Hour).Truncate(time.Second)
+
+	observations := make([]Observation, 0)
+	for i, q := range []string{"", QualityBad, QualitySuspect} {
+		value := float64(i)
+		observations = append(observations, Observation{SensorId: sensorID, ObservationTime: starting.Add(time.Duration(i) * time.Hour), Value: &value, QuantityKind: "Temperature", Quality: q})
+	}
+	is.NoErr(db.AddObservation(ctx, SensorObservation{DeviceID: "device", Observations: observations}))
+
+	filter := ObservationFilter{SensorIDs: []string{sensorID}, Quality: []string{QualityGood, QualitySuspect}}
+
+	total, stored, err := db.QueryObservations(ctx, filter, 0, 10)
+	is.NoErr(err)
+	is.Equal(int64(2), total)
+	is.Equal(QualityGood, stored[0].Quality)
+	is.Equal(QualitySuspect, stored[1].Quality)
+
+	n, err := db.SetObservationQuality(ctx, ObservationFilter{SensorIDs: []string{sensorID}, Starting: starting.Add(time.Hour)}, QualityEstimated, QualityReasonManual)
+	is.NoErr(err)
+	is.Equal(int64(2), n)
+
+	total, stored, err = db.QueryObservations(ctx, ObservationFilter{SensorIDs: []string{sensorID}, Quality: []string{QualityEstimated}}, 0, 10)
+	is.NoErr(err)
+	is.Equal(int64(2), total)
+	is.Equal(QualityReasonManual, stored[0].QualityReason)
+}
+
+func TestConsumedObservationID(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	consumer := "test-" + uuid.NewString()
+
+	id, err := db.GetConsumedObservationID(ctx, consumer)
+	is.NoErr(err)
+	is.Equal(int64(0), id)
+
+	is.NoErr(db.SetConsumedObservationID(ctx, consumer, 42))
+	is.NoErr(db.SetConsumedObservationID(ctx, consumer, 17))
+
+	id, err = db.GetConsumedObservationID(ctx, consumer)
+	is.NoErr(err)
+	is.Equal(int64(42), id)
+}
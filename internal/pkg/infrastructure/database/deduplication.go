@@ -0,0 +1,171 @@
+package database
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DeduplicationMode string
+
+const (
+	// DeduplicationWindow drops an observation if it is equal to the latest observation within the window
+	DeduplicationWindow DeduplicationMode = "window"
+	// DeduplicationOnChange drops an observation if it is equal to the latest observation, regardless of age
+	DeduplicationOnChange DeduplicationMode = "change"
+	// DeduplicationAlways stores every observation
+	DeduplicationAlways DeduplicationMode = "always"
+)
+
+type DeduplicationPolicy struct {
+	Mode              DeduplicationMode
+	Window            time.Duration
+	AbsoluteTolerance float64
+	RelativeTolerance float64
+}
+
+var defaultDeduplicationPolicy = DeduplicationPolicy{
+	Mode:   DeduplicationWindow,
+	Window: 1 * time.Minute,
+}
+
+// DeduplicationPolicies holds policies per sensor and per quantity kind. A policy for a
+// sensor takes precedence over a policy for a quantity kind.
+type DeduplicationPolicies struct {
+	sensors       map[string]DeduplicationPolicy
+	quantityKinds map[string]DeduplicationPolicy
+}
+
+func NewDeduplicationPolicies() DeduplicationPolicies {
+	return DeduplicationPolicies{
+		sensors:       make(map[string]DeduplicationPolicy),
+		quantityKinds: make(map[string]DeduplicationPolicy),
+	}
+}
+
+func (dp DeduplicationPolicies) Get(sensorID, quantityKind string) DeduplicationPolicy {
+	if p, ok := dp.sensors[sensorID]; ok {
+		return p
+	}
+	if p, ok := dp.quantityKinds[quantityKind]; ok {
+		return p
+	}
+	return defaultDeduplicationPolicy
+}
+
+// isDuplicate reports whether o should be dropped given the latest stored observation before it.
+func (p DeduplicationPolicy) isDuplicate(o Observation, latest *Observation) bool {
+	if latest == nil || p.Mode == DeduplicationAlways {
+		return false
+	}
+
+	if p.Mode == DeduplicationWindow && !latest.ObservationTime.After(o.ObservationTime.Add(-p.Window)) {
+		return false
+	}
+
+	if o.Value == nil || latest.Value == nil || (p.AbsoluteTolerance == 0 && p.RelativeTolerance == 0) {
+		return isValueEqual(o, latest.Value, latest.ValueString, latest.ValueBoolean)
+	}
+
+	diff := math.Abs(*o.Value - *latest.Value)
+	if diff > p.AbsoluteTolerance && diff > p.RelativeTolerance*math.Abs(*latest.Value) {
+		return false
+	}
+
+	// the value is within tolerance, string and boolean values must still be equal
+	return isValueEqual(o, o.Value, latest.ValueString, latest.ValueBoolean)
+}
+
+// lookback returns how far back to look for the latest observation, 0 means no limit.
+func (p DeduplicationPolicy) lookback() time.Duration {
+	if p.Mode == DeduplicationWindow {
+		return p.Window
+	}
+	return 0
+}
+
+func (db *databaseImpl) LoadDeduplicationPolicies(ctx context.Context, reader io.Reader) error {
+	policies, err := readDeduplicationPolicies(reader)
+	if err != nil {
+		return err
+	}
+
+	db.policies = policies
+
+	return nil
+}
+
+// readDeduplicationPolicies reads policies from a semicolon separated file with the columns
+// quantityKind;sensorId;mode;window;absoluteTolerance;relativeTolerance
+// where either quantityKind or sensorId is set.
+func readDeduplicationPolicies(reader io.Reader) (DeduplicationPolicies, error) {
+	r := csv.NewReader(reader)
+	r.Comma = ';'
+
+	rows, err := r.ReadAll()
+	if err != nil {
+		return DeduplicationPolicies{}, err
+	}
+
+	policies := NewDeduplicationPolicies()
+
+	if len(rows) == 0 {
+		return policies, nil
+	}
+
+	for i, row := range rows[1:] {
+		if len(row) < 6 {
+			return DeduplicationPolicies{}, fmt.Errorf("row %d: expected 6 columns but found %d", i+1, len(row))
+		}
+
+		p := defaultDeduplicationPolicy
+
+		if mode := strings.TrimSpace(row[2]); mode != "" {
+			p.Mode = DeduplicationMode(strings.ToLower(mode))
+		}
+
+		switch p.Mode {
+		case DeduplicationWindow, DeduplicationOnChange, DeduplicationAlways:
+		default:
+			return DeduplicationPolicies{}, fmt.Errorf("row %d: unknown mode %s", i+1, p.Mode)
+		}
+
+		if window := strings.TrimSpace(row[3]); window != "" {
+			p.Window, err = time.ParseDuration(window)
+			if err != nil {
+				return DeduplicationPolicies{}, fmt.Errorf("row %d: %w", i+1, err)
+			}
+		}
+
+		if abs := strings.TrimSpace(row[4]); abs != "" {
+			p.AbsoluteTolerance, err = strconv.ParseFloat(abs, 64)
+			if err != nil {
+				return DeduplicationPolicies{}, fmt.Errorf("row %d: %w", i+1, err)
+			}
+		}
+
+		if rel := strings.TrimSpace(row[5]); rel != "" {
+			p.RelativeTolerance, err = strconv.ParseFloat(rel, 64)
+			if err != nil {
+				return DeduplicationPolicies{}, fmt.Errorf("row %d: %w", i+1, err)
+			}
+		}
+
+		quantityKind, sensorID := strings.TrimSpace(row[0]), strings.TrimSpace(row[1])
+
+		if sensorID != "" {
+			policies.sensors[sensorID] = p
+		} else if quantityKind != "" {
+			policies.quantityKinds[quantityKind] = p
+		} else {
+			return DeduplicationPolicies{}, fmt.Errorf("row %d: either quantityKind or sensorId must be set", i+1)
+		}
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestReadDeduplicationPolicies(t *testing.T) {
+	is := is.New(t)
+
+	csv := `quantityKind;sensorId;mode;window;absoluteTolerance;relativeTolerance
+Energy;;always;;;
+Temperature;;window;5m;0.2;
+;sensor-1;change;;;0.01`
+
+	policies, err := readDeduplicationPolicies(strings.NewReader(csv))
+	is.NoErr(err)
+
+	is.Equal(DeduplicationAlways, policies.Get("any", "Energy").Mode)
+	is.Equal(5*time.Minute, policies.Get("any", "Temperature").Window)
+	is.Equal(0.2, policies.Get("any", "Temperature").AbsoluteTolerance)
+	is.Equal(DeduplicationOnChange, policies.Get("sensor-1", "Temperature").Mode)
+	is.Equal(defaultDeduplicationPolicy, policies.Get("any", "Pressure"))
+
+	_, err = readDeduplicationPolicies(strings.NewReader("quantityKind;sensorId;mode;window;absoluteTolerance;relativeTolerance\nEnergy;;sometimes;;;"))
+	is.True(err != nil)
+}
+
+func TestIsDuplicate(t *testing.T) {
+	is := is.New(t)
+
+	now := time.Now().UTC()
+	v1, v2 := 20.0, 20.1
+
+	latest := &Observation{ObservationTime: now.Add(-30 * time.Second), Value: &v1}
+	o := Observation{ObservationTime: now, Value: &v1}
+
+	is.True(defaultDeduplicationPolicy.isDuplicate(o, latest))
+	is.True(!defaultDeduplicationPolicy.isDuplicate(o, nil))
+
+	// outside of the window
+	latest.ObservationTime = now.Add(-2 * time.Minute)
+	is.True(!defaultDeduplicationPolicy.isDuplicate(o, latest))
+	is.True(DeduplicationPolicy{Mode: DeduplicationOnChange}.isDuplicate(o, latest))
+
+	is.True(!DeduplicationPolicy{Mode: DeduplicationAlways}.isDuplicate(o, latest))
+
+	// deadband
+	o.Value = &v2
+	is.True(!DeduplicationPolicy{Mode: DeduplicationOnChange}.isDuplicate(o, latest))
+	is.True(DeduplicationPolicy{Mode: DeduplicationOnChange, AbsoluteTolerance: 0.2}.isDuplicate(o, latest))
+	is.True(DeduplicationPolicy{Mode: DeduplicationOnChange, RelativeTolerance: 0.01}.isDuplicate(o, latest))
+	is.True(!DeduplicationPolicy{Mode: DeduplicationOnChange, RelativeTolerance: 0.001}.isDuplicate(o, latest))
+}
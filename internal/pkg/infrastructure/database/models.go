@@ -1,6 +1,9 @@
 package database
 
 import (
+	"encoding/json"
+	"fmt"
+	"slices"
 	"strings"
 	"time"
 )
@@ -11,10 +14,11 @@ type Property struct {
 }
 
 type Entity struct {
-	Context  string    `json:"@context"`
-	Id       string    `json:"@id"`
-	Type     string    `json:"@type"`
-	IsPartOf *Property `json:"isPartOf,omitempty"`
+	Context  string     `json:"@context"`
+	Id       string     `json:"@id"`
+	Type     string     `json:"@type"`
+	IsPartOf *Property  `json:"isPartOf,omitempty"`
+	HasPoint []Property `json:"hasPoint,omitempty"`
 }
 
 type SensorObservation struct {
@@ -26,10 +30,343 @@ type SensorObservation struct {
 type Observation struct {
 	ObservationTime time.Time `json:"observationTime"`
 	Value           *float64  `json:"value,omitempty"`
+	RawValue        *float64  `json:"rawValue,omitempty"`
 	ValueString     *string   `json:"valueString,omitempty"`
 	ValueBoolean    *bool     `json:"valueBoolean,omitempty"`
 	QuantityKind    string    `json:"quantityKind"`
 	SensorId        string    `json:"sensorId"`
+	Quality         string    `json:"quality,omitempty"`
+	QualityReason   string    `json:"qualityReason,omitempty"`
+}
+
+const (
+	QualityGood      string = "good"
+	QualitySuspect   string = "suspect"
+	QualityBad       string = "bad"
+	QualityEstimated string = "estimated"
+)
+
+// Reasons an observation is flagged with. An observation is bad by calibration when its corrected value
+// is outside the valid range of its calibration.
+const (
+	QualityReasonCalibration string = "calibration"
+	QualityReasonRange       string = "range"
+	QualityReasonRate        string = "rate"
+	QualityReasonOutlier     string = "outlier"
+	QualityReasonManual      string = "manual"
+)
+
+func IsQuality(q string) bool {
+	return q == QualityGood || q == QualitySuspect || q == QualityBad || q == QualityEstimated
+}
+
+// quality returns the quality the observation is stored with, good unless it has been flagged.
+func (o Observation) quality() string {
+	if o.Quality == "" {
+		return QualityGood
+	}
+	return o.Quality
+}
+
+// ObservationFilter selects observations from sensors or a device within a time range. Empty fields
+// are not used for filtering, except SensorIDs where only a nil slice means any sensor.
+type ObservationFilter struct {
+	SensorIDs    []string
+	DeviceID     string
+	QuantityKind string
+	Quality      []string
+	Starting     time.Time
+	Ending       time.Time
+}
+
+func (f ObservationFilter) where() (string, []any) {
+	clauses := []string{"TRUE"}
+	args := []any{}
+
+	if !f.Starting.IsZero() {
+		args = append(args, f.Starting)
+		clauses = append(clauses, fmt.Sprintf("observation_time >= $%d", len(args)))
+	}
+	if !f.Ending.IsZero() {
+		args = append(args, f.Ending)
+		clauses = append(clauses, fmt.Sprintf("observation_time <= $%d", len(args)))
+	}
+
+	if f.SensorIDs != nil {
+		args = append(args, f.SensorIDs)
+		clauses = append(clauses, fmt.Sprintf("sensor_id = ANY($%d)", len(args)))
+	}
+	if f.DeviceID != "" {
+		args = append(args, f.DeviceID)
+		clauses = append(clauses, fmt.Sprintf("device_id = $%d", len(args)))
+	}
+	if f.QuantityKind != "" {
+		args = append(args, f.QuantityKind)
+		clauses = append(clauses, fmt.Sprintf("quantity_kind = $%d", len(args)))
+	}
+	if len(f.Quality) > 0 {
+		args = append(args, f.Quality)
+		clauses = append(clauses, fmt.Sprintf("quality = ANY($%d)", len(args)))
+	}
+
+	return strings.Join(clauses, " AND "), args
+}
+
+// Matches reports whether an observation from the device matches the filter.
+func (f ObservationFilter) Matches(deviceID string, o Observation) bool {
+	if f.SensorIDs != nil && !slices.Contains(f.SensorIDs, o.SensorId) {
+		return false
+	}
+	if f.DeviceID != "" && f.DeviceID != deviceID {
+		return false
+	}
+	if f.QuantityKind != "" && f.QuantityKind != o.QuantityKind {
+		return false
+	}
+	if len(f.Quality) > 0 && !slices.Contains(f.Quality, o.quality()) {
+		return false
+	}
+	if !f.Starting.IsZero() && o.ObservationTime.Before(f.Starting) {
+		return false
+	}
+	if !f.Ending.IsZero() && o.ObservationTime.After(f.Ending) {
+		return false
+	}
+	return true
+}
+
+// StoredObservation is an observation together with its id and device, as it is stored.
+type StoredObservation struct {
+	ID       int64  `json:"id"`
+	DeviceID string `json:"deviceId"`
+	Observation
+}
+
+type DeadLetter struct {
+	Id         int64      `json:"id"`
+	EventID    string     `json:"eventId"`
+	Source     string     `json:"source"`
+	EventType  string     `json:"eventType"`
+	EventTime  *time.Time `json:"eventTime,omitempty"`
+	ReceivedAt time.Time  `json:"receivedAt"`
+	Reason     string     `json:"reason"`
+	Data       string     `json:"data"`
+	ReplayedAt *time.Time `json:"replayedAt,omitempty"`
+}
+
+// Subscription is a registered webhook that is sent events of the given types, or of all types if
+// Types is empty, for observations and entities matching the filters.
+type Subscription struct {
+	Id           string    `json:"id"`
+	Endpoint     string    `json:"endpoint"`
+	Types        []string  `json:"types,omitempty"`
+	Root         *Property `json:"root,omitempty"`
+	SensorID     string    `json:"sensorId,omitempty"`
+	QuantityKind string    `json:"quantityKind,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+const (
+	DeliveryPending   string = "pending"
+	DeliveryDelivered string = "delivered"
+	DeliveryFailed    string = "failed"
+)
+
+// Delivery is an event to be sent, or already sent, to the endpoint of a subscription.
+type Delivery struct {
+	Id             int64           `json:"id"`
+	SubscriptionID string          `json:"subscriptionId"`
+	Endpoint       string          `json:"-"`
+	EventID        string          `json:"eventId"`
+	EventType      string          `json:"eventType"`
+	Data           json.RawMessage `json:"data"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	NextAttemptAt  *time.Time      `json:"nextAttemptAt,omitempty"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+	LastStatusCode *int            `json:"lastStatusCode,omitempty"`
+	LastError      *string         `json:"lastError,omitempty"`
+}
+
+const (
+	RuleAbove  string = "above"
+	RuleBelow  string = "below"
+	RuleEquals string = "equals"
+	// RuleStale is the condition of the built in rule that raises an alarm when a sensor stops reporting
+	RuleStale string = "stale"
+)
+
+// StaleRuleID is the id of the built in rule for sensors that have stopped reporting
+const StaleRuleID = "stale"
+
+// Rule raises an alarm for a sensor when its observations of the quantity kind meet the condition,
+// for at least Duration if set, e.g. "10m".
+type Rule struct {
+	Id           string    `json:"id"`
+	Name         string    `json:"name,omitempty"`
+	QuantityKind string    `json:"quantityKind"`
+	Root         *Property `json:"root,omitempty"`
+	Condition    string    `json:"condition"`
+	Value        *float64  `json:"value,omitempty"`
+	ValueString  *string   `json:"valueString,omitempty"`
+	ValueBoolean *bool     `json:"valueBoolean,omitempty"`
+	Duration     string    `json:"duration,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// RuleState records since when the condition of a rule has been met by a sensor, and the
+// observation that first met it. ObservationTime is the time of the latest observation that met it.
+type RuleState struct {
+	RuleID   string
+	DeviceID string
+	Since    time.Time
+	Observation
+}
+
+const (
+	AlarmOpen         string = "open"
+	AlarmAcknowledged string = "acknowledged"
+	AlarmClosed       string = "closed"
+)
+
+// Alarm is raised when a sensor meets the condition of a rule. It stays open, or acknowledged, until
+// the condition is no longer met or it is closed.
+type Alarm struct {
+	Id             int64      `json:"id"`
+	RuleID         string     `json:"ruleId"`
+	SensorID       string     `json:"sensorId"`
+	DeviceID       string     `json:"deviceId"`
+	QuantityKind   string     `json:"quantityKind"`
+	Status         string     `json:"status"`
+	TriggeredAt    time.Time  `json:"triggeredAt"`
+	Value          *float64   `json:"value,omitempty"`
+	ValueString    *string    `json:"valueString,omitempty"`
+	ValueBoolean   *bool      `json:"valueBoolean,omitempty"`
+	OpenedAt       time.Time  `json:"openedAt"`
+	AcknowledgedAt *time.Time `json:"acknowledgedAt,omitempty"`
+	ClosedAt       *time.Time `json:"closedAt,omitempty"`
+}
+
+// AlarmFilter selects alarms by status, rule and sensor. Empty fields are not used for filtering.
+type AlarmFilter struct {
+	Status   string
+	RuleID   string
+	SensorID string
+}
+
+// Calibration corrects the numeric observations of the quantity kind from a sensor, from EffectiveFrom
+// until the next calibration of the same sensor and quantity kind, as raw value * Scale + Offset. A
+// corrected value outside the valid range from Min to Max, if set, is stored without a value.
+type Calibration struct {
+	Id            int64     `json:"id"`
+	SensorID      string    `json:"sensorId"`
+	QuantityKind  string    `json:"quantityKind"`
+	Offset        float64   `json:"offset"`
+	Scale         *float64  `json:"scale,omitempty"`
+	Min           *float64  `json:"min,omitempty"`
+	Max           *float64  `json:"max,omitempty"`
+	EffectiveFrom time.Time `json:"effectiveFrom"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// QualityOverride sets the quality of the observations of a sensor within a time range, optionally
+// only those of a quantity kind.
+type QualityOverride struct {
+	SensorID     string    `json:"sensorId"`
+	QuantityKind string    `json:"quantityKind,omitempty"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Quality      string    `json:"quality"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+// Apply returns the corrected value of a raw value, or nil if it is outside the valid range.
+func (c Calibration) Apply(raw float64) *float64 {
+	v := raw + c.Offset
+	if c.Scale != nil {
+		v = raw*(*c.Scale) + c.Offset
+	}
+
+	if (c.Min != nil && v < *c.Min) || (c.Max != nil && v > *c.Max) {
+		return nil
+	}
+
+	return &v
+}
+
+const (
+	AggregateAverage string = "avg"
+	AggregateSum     string = "sum"
+	AggregateMin     string = "min"
+	AggregateMax     string = "max"
+)
+
+// VirtualSensor is a sensor whose observations are computed from the latest observations of other
+// sensors, either by a formula over named inputs or by an aggregate over the sensors in the subtree of
+// a root entity that observe the source quantity kind. Inputs older than MaxAge, if set, are left out.
+type VirtualSensor struct {
+	SensorID           string               `json:"sensorId"`
+	QuantityKind       string               `json:"quantityKind"`
+	Formula            string               `json:"formula,omitempty"`
+	Inputs             []VirtualSensorInput `json:"inputs,omitempty"`
+	Aggregate          string               `json:"aggregate,omitempty"`
+	Root               *Property            `json:"root,omitempty"`
+	SourceQuantityKind string               `json:"sourceQuantityKind,omitempty"`
+	MaxAge             string               `json:"maxAge,omitempty"`
+	CreatedAt          time.Time            `json:"createdAt"`
+}
+
+// VirtualSensorInput names the latest observation of a sensor, of the quantity kind if set, in the
+// formula of a virtual sensor.
+type VirtualSensorInput struct {
+	Name         string `json:"name"`
+	SensorID     string `json:"sensorId"`
+	QuantityKind string `json:"quantityKind,omitempty"`
+}
+
+const (
+	SensorReporting string = "reporting"
+	SensorStale     string = "stale"
+)
+
+// SensorStatus is the time of the latest observation from a sensor, and since when the sensor has
+// been stale if it has not reported within its expected reporting interval.
+type SensorStatus struct {
+	SensorID            string     `json:"sensorId"`
+	DeviceID            string     `json:"deviceId"`
+	QuantityKind        string     `json:"quantityKind"`
+	LastObservationTime time.Time  `json:"lastObservationTime"`
+	ExpectedInterval    string     `json:"expectedInterval,omitempty"`
+	Status              string     `json:"status"`
+	StaleSince          *time.Time `json:"staleSince,omitempty"`
+}
+
+// SensorStatusFilter selects sensor statuses by sensor, quantity kind and status. Empty fields are
+// not used for filtering, except SensorIDs where only a nil slice means any sensor.
+type SensorStatusFilter struct {
+	SensorIDs    []string
+	QuantityKind string
+	Status       string
+}
+
+// ObservationGap is a period without observations from a sensor.
+type ObservationGap struct {
+	SensorID     string    `json:"sensorId"`
+	QuantityKind string    `json:"quantityKind,omitempty"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	Duration     string    `json:"duration"`
+}
+
+func NewObservationGap(sensorID, quantityKind string, from, to time.Time) ObservationGap {
+	return ObservationGap{
+		SensorID:     sensorID,
+		QuantityKind: quantityKind,
+		From:         from,
+		To:           to,
+		Duration:     to.Sub(from).String(),
+	}
 }
 
 const (
@@ -42,11 +379,19 @@ const (
 	SensorContext            string = "https://dev.realestatecore.io/contexts/Sensor.jsonld"
 	SensorType               string = "dtmi:org:brickschema:schema:Brick:Sensor;1"
 	SensorTypeName           string = "sensor"
+	DeviceContext            string = "https://dev.realestatecore.io/contexts/Device.jsonld"
+	DeviceType               string = "dtmi:org:w3id:rec:Device;1"
+	DeviceTypeName           string = "device"
 	ObservationEventContext  string = "https://dev.realestatecore.io/contexts/ObservationEvent.jsonld"
 	ObservationEventType     string = "dtmi:org:w3id:rec:ObservationEvent;1"
 	ObservationEventTypeName string = "observationevent"
 )
 
+const (
+	isPartOfRelation string = "isPartOf"
+	hasPointRelation string = "hasPoint"
+)
+
 func GetTypeFromTypeName(typeName string) string {
 	switch strings.ToLower(typeName) {
 	case SpaceTypeName:
@@ -55,6 +400,8 @@ func GetTypeFromTypeName(typeName string) string {
 		return BuildingType
 	case SensorTypeName:
 		return SensorType
+	case DeviceTypeName:
+		return DeviceType
 	case ObservationEventTypeName:
 		return ObservationEventType
 	}
@@ -0,0 +1,138 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+const observationsChannel = "observations"
+
+const maxNotificationBatch = 1000
+
+// ListenForObservations calls fn for every observation stored by any instance of the service
+// until ctx is done or the connection is lost. New observations are announced by a trigger on the
+// observations table, imported observations are not announced.
+func (db *databaseImpl) ListenForObservations(ctx context.Context, fn func(StoredObservation)) error {
+	conn, err := db.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		conn.Exec(context.Background(), "UNLISTEN *")
+		conn.Release()
+	}()
+
+	_, err = conn.Exec(ctx, "LISTEN "+observationsChannel)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	ids := make(chan int64, 10*maxNotificationBatch)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		db.fetchNotifiedObservations(ctx, ids, fn)
+	}()
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			close(ids)
+			<-done
+			return err
+		}
+
+		id, err := strconv.ParseInt(n.Payload, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		ids <- id
+	}
+}
+
+// fetchNotifiedObservations reads notified ids in batches so that observations stored in the same
+// transaction are fetched with one query.
+func (db *databaseImpl) fetchNotifiedObservations(ctx context.Context, ids <-chan int64, fn func(StoredObservation)) {
+	log := logging.GetFromContext(ctx)
+
+	for id := range ids {
+		batch := []int64{id}
+
+	drain:
+		for len(batch) < maxNotificationBatch {
+			select {
+			case id, ok := <-ids:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, id)
+			default:
+				break drain
+			}
+		}
+
+		observations, err := db.getStoredObservations(ctx, "observation_id = ANY($1)", 0, batch)
+		if err != nil {
+			log.Error("failed to fetch notified observations", "count", len(batch), "err", err.Error())
+			continue
+		}
+
+		for _, o := range observations {
+			fn(o)
+		}
+	}
+}
+
+// GetObservationsAfter returns at most limit observations matching the filter that were stored
+// after the observation with id afterID, ordered by id.
+func (db *databaseImpl) GetObservationsAfter(ctx context.Context, filter ObservationFilter, afterID int64, limit int) ([]StoredObservation, error) {
+	where, args := filter.where()
+
+	args = append(args, afterID)
+	where = fmt.Sprintf("%s AND observation_id > $%d", where, len(args))
+
+	return db.getStoredObservations(ctx, where, limit, args...)
+}
+
+// getStoredObservations returns observations matching where, ordered by id. A limit of 0 means no limit.
+func (db *databaseImpl) getStoredObservations(ctx context.Context, where string, limit int, args ...any) ([]StoredObservation, error) {
+	query := `
+		SELECT observation_id, device_id, sensor_id, observation_time, value, raw_value, value_string, value_boolean, quantity_kind, quality, quality_reason
+		FROM observations
+		WHERE ` + where + `
+		ORDER BY observation_id ASC`
+
+	if limit > 0 {
+		args = append(args, limit)
+		query = fmt.Sprintf("%s LIMIT $%d", query, len(args))
+	}
+
+	rows, err := db.pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	observations := make([]StoredObservation, 0)
+
+	for rows.Next() {
+		var so StoredObservation
+
+		err := rows.Scan(&so.ID, &so.DeviceID, &so.SensorId, &so.ObservationTime, &so.Value, &so.RawValue, &so.ValueString, &so.ValueBoolean, &so.QuantityKind, &so.Quality, &so.QualityReason)
+		if err != nil {
+			return nil, err
+		}
+
+		observations = append(observations, so)
+	}
+
+	return observations, rows.Err()
+}
@@ -10,6 +10,7 @@ type rec struct {
 	Space    string
 	Building string
 	Sensor   string
+	Device   string
 }
 
 func (db *databaseImpl) Seed(ctx context.Context, reader io.Reader) error {
@@ -65,6 +66,24 @@ func (db *databaseImpl) Seed(ctx context.Context, reader io.Reader) error {
 		if err != nil {
 			return err
 		}
+
+		if r.Device != "" {
+			device := Entity{
+				Context: DeviceContext,
+				Id:      r.Device,
+				Type:    DeviceType,
+				HasPoint: []Property{
+					{
+						Id:   r.Sensor,
+						Type: SensorType,
+					},
+				},
+			}
+			err := db.AddEntity(ctx, device)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -90,11 +109,16 @@ func getRecFromRows(rows [][]string) []rec {
 	}
 
 	for _, row := range rows[1:] {
-		recs = append(recs, rec{
+		r := rec{
 			Space:    row[0],
 			Building: row[1],
 			Sensor:   row[2],
-		})
+		}
+		// the devices column is optional
+		if len(row) > 3 {
+			r.Device = row[3]
+		}
+		recs = append(recs, r)
 	}
 	return recs
 }
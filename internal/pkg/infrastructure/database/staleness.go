@@ -0,0 +1,188 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const sensorStatusBatchSize = 10000
+
+// RefreshSensorStatus updates the time of the latest observation from each sensor with the observations
+// stored since the last refresh. An observation that is committed after an observation with a higher id
+// is not counted, which only delays the status of the sensor until it reports again.
+func (db *databaseImpl) RefreshSensorStatus(ctx context.Context) error {
+	var afterID int64
+	err := db.pool.QueryRow(ctx, "SELECT coalesce(max(last_observation_id), 0) FROM sensor_status").Scan(&afterID)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var count int
+		err = db.pool.QueryRow(ctx, `
+			WITH batch AS (
+				SELECT observation_id, device_id, sensor_id, observation_time, quantity_kind
+				FROM observations
+				WHERE observation_id > $1
+				ORDER BY observation_id ASC
+				LIMIT $2
+			), latest AS (
+				SELECT DISTINCT ON (sensor_id) sensor_id, device_id, quantity_kind, observation_time
+				FROM batch
+				ORDER BY sensor_id, observation_time DESC
+			), upserted AS (
+				INSERT INTO sensor_status (sensor_id, device_id, quantity_kind, last_observation_id, last_observation_time)
+				SELECT sensor_id, device_id, quantity_kind, (SELECT max(observation_id) FROM batch), observation_time
+				FROM latest
+				ON CONFLICT (sensor_id) DO UPDATE SET
+					device_id = CASE WHEN EXCLUDED.last_observation_time > sensor_status.last_observation_time THEN EXCLUDED.device_id ELSE sensor_status.device_id END,
+					quantity_kind = CASE WHEN EXCLUDED.last_observation_time > sensor_status.last_observation_time THEN EXCLUDED.quantity_kind ELSE sensor_status.quantity_kind END,
+					last_observation_id = GREATEST(sensor_status.last_observation_id, EXCLUDED.last_observation_id),
+					last_observation_time = GREATEST(sensor_status.last_observation_time, EXCLUDED.last_observation_time)
+			)
+			SELECT count(*), coalesce(max(observation_id), $1) FROM batch`, afterID, sensorStatusBatchSize).Scan(&count, &afterID)
+		if err != nil {
+			return err
+		}
+
+		if count < sensorStatusBatchSize {
+			return nil
+		}
+	}
+}
+
+const sensorStatusColumns = "sensor_id, device_id, quantity_kind, last_observation_time, stale_since"
+
+func scanSensorStatus(row pgx.Row, extra ...any) (SensorStatus, error) {
+	var s SensorStatus
+
+	dest := append([]any{&s.SensorID, &s.DeviceID, &s.QuantityKind, &s.LastObservationTime, &s.StaleSince}, extra...)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return SensorStatus{}, err
+	}
+
+	s.Status = SensorReporting
+	if s.StaleSince != nil {
+		s.Status = SensorStale
+	}
+
+	return s, nil
+}
+
+func (db *databaseImpl) GetSensorStatuses(ctx context.Context, filter SensorStatusFilter, page, size int) (int64, []SensorStatus, error) {
+	clauses := []string{"TRUE"}
+	args := []any{}
+
+	if filter.SensorIDs != nil {
+		args = append(args, filter.SensorIDs)
+		clauses = append(clauses, fmt.Sprintf("sensor_id = ANY($%d)", len(args)))
+	}
+	if filter.QuantityKind != "" {
+		args = append(args, filter.QuantityKind)
+		clauses = append(clauses, fmt.Sprintf("quantity_kind = $%d", len(args)))
+	}
+
+	switch filter.Status {
+	case SensorStale:
+		clauses = append(clauses, "stale_since IS NOT NULL")
+	case SensorReporting:
+		clauses = append(clauses, "stale_since IS NULL")
+	}
+
+	args = append(args, page*size, size)
+
+	rows, err := db.pool.Query(ctx, fmt.Sprintf(`
+		SELECT %s, count(*) OVER() AS full_count
+		FROM sensor_status
+		WHERE %s
+		ORDER BY sensor_id ASC
+		OFFSET $%d LIMIT $%d`, sensorStatusColumns, strings.Join(clauses, " AND "), len(args)-1, len(args)), args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	statuses := make([]SensorStatus, 0)
+	var fullCount int64
+
+	for rows.Next() {
+		s, err := scanSensorStatus(rows, &fullCount)
+		if err != nil {
+			return 0, nil, err
+		}
+		statuses = append(statuses, s)
+	}
+
+	return fullCount, statuses, rows.Err()
+}
+
+// SetSensorStaleSince marks a sensor as stale, or as reporting if staleSince is nil, unless it has
+// reported after lastObservationTime. It reports whether the status of the sensor was changed.
+func (db *databaseImpl) SetSensorStaleSince(ctx context.Context, sensorID string, lastObservationTime time.Time, staleSince *time.Time) (bool, error) {
+	tag, err := db.pool.Exec(ctx, `
+		UPDATE sensor_status SET stale_since = $3
+		WHERE sensor_id = $1 AND last_observation_time = $2 AND stale_since IS DISTINCT FROM $3`,
+		sensorID, lastObservationTime, staleSince)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// GetObservationGaps returns the periods between observations within the time range of the filter that
+// are longer than minGap. The periods before the first and after the last observation of each sensor
+// are always returned, so that a sensor without gaps can be told from a sensor without observations.
+func (db *databaseImpl) GetObservationGaps(ctx context.Context, filter ObservationFilter, minGap time.Duration) ([]ObservationGap, error) {
+	where, args := filter.where()
+	args = append(args, minGap.Seconds())
+
+	rows, err := db.pool.Query(ctx, fmt.Sprintf(`
+		SELECT sensor_id, quantity_kind, prev, observation_time, is_last
+		FROM (
+			SELECT sensor_id, quantity_kind, observation_time,
+				lag(observation_time) OVER w AS prev,
+				lead(observation_time) OVER w IS NULL AS is_last
+			FROM observations
+			WHERE %s
+			WINDOW w AS (PARTITION BY sensor_id ORDER BY observation_time)
+		) o
+		WHERE prev IS NULL OR is_last OR observation_time - prev > make_interval(secs => $%d)
+		ORDER BY sensor_id ASC, observation_time ASC`, where, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	gaps := make([]ObservationGap, 0)
+
+	for rows.Next() {
+		var sensorID, quantityKind string
+		var prev *time.Time
+		var observationTime time.Time
+		var isLast bool
+
+		err := rows.Scan(&sensorID, &quantityKind, &prev, &observationTime, &isLast)
+		if err != nil {
+			return nil, err
+		}
+
+		if prev == nil {
+			gaps = append(gaps, NewObservationGap(sensorID, quantityKind, filter.Starting, observationTime))
+		} else if observationTime.Sub(*prev) > minGap {
+			gaps = append(gaps, NewObservationGap(sensorID, quantityKind, *prev, observationTime))
+		}
+
+		if isLast {
+			gaps = append(gaps, NewObservationGap(sensorID, quantityKind, observationTime, filter.Ending))
+		}
+	}
+
+	return gaps, rows.Err()
+}
@@ -0,0 +1,244 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func (db *databaseImpl) AddSubscription(ctx context.Context, s Subscription) error {
+	var rootID, rootType *string
+	if s.Root != nil {
+		rootID, rootType = &s.Root.Id, &s.Root.Type
+	}
+
+	types := s.Types
+	if types == nil {
+		types = []string{}
+	}
+
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO subscriptions (subscription_id, endpoint, types, root_id, root_type, sensor_id, quantity_kind, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), $8)`,
+		s.Id, s.Endpoint, types, rootID, rootType, s.SensorID, s.QuantityKind, s.CreatedAt)
+	return err
+}
+
+const subscriptionColumns = "subscription_id, endpoint, types, root_id, root_type, coalesce(sensor_id, ''), coalesce(quantity_kind, ''), created_at"
+
+func scanSubscription(row pgx.Row, extra ...any) (Subscription, error) {
+	var s Subscription
+	var rootID, rootType *string
+
+	dest := append([]any{&s.Id, &s.Endpoint, &s.Types, &rootID, &rootType, &s.SensorID, &s.QuantityKind, &s.CreatedAt}, extra...)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return Subscription{}, err
+	}
+
+	if rootID != nil && rootType != nil {
+		s.Root = &Property{Id: *rootID, Type: *rootType}
+	}
+
+	return s, nil
+}
+
+func (db *databaseImpl) GetSubscription(ctx context.Context, id string) (Subscription, error) {
+	row := db.pool.QueryRow(ctx, "SELECT "+subscriptionColumns+" FROM subscriptions WHERE subscription_id = $1", id)
+
+	s, err := scanSubscription(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Subscription{}, ErrNotFound
+		}
+		return Subscription{}, err
+	}
+
+	return s, nil
+}
+
+func (db *databaseImpl) GetSubscriptions(ctx context.Context, page, size int) (int64, []Subscription, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+subscriptionColumns+`, count(*) OVER() AS full_count
+		FROM subscriptions
+		ORDER BY created_at ASC, subscription_id ASC
+		OFFSET $1 LIMIT $2`, page*size, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := make([]Subscription, 0)
+	var fullCount int64
+
+	for rows.Next() {
+		s, err := scanSubscription(rows, &fullCount)
+		if err != nil {
+			return 0, nil, err
+		}
+		subscriptions = append(subscriptions, s)
+	}
+
+	return fullCount, subscriptions, rows.Err()
+}
+
+// DeleteSubscription deletes a subscription together with its deliveries.
+func (db *databaseImpl) DeleteSubscription(ctx context.Context, id string) error {
+	tag, err := db.pool.Exec(ctx, "DELETE FROM subscriptions WHERE subscription_id = $1", id)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// AddDeliveries adds pending deliveries. A delivery of an event that has already been added for the
+// same subscription, e.g. by another instance of the service, is ignored.
+func (db *databaseImpl) AddDeliveries(ctx context.Context, deliveries []Delivery) error {
+	if len(deliveries) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+
+	for _, d := range deliveries {
+		batch.Queue(`
+			INSERT INTO subscription_deliveries (subscription_id, event_id, event_type, data, status, created_at, next_attempt_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $6)
+			ON CONFLICT (subscription_id, event_id) DO NOTHING`,
+			d.SubscriptionID, d.EventID, d.EventType, string(d.Data), DeliveryPending, d.CreatedAt)
+	}
+
+	return db.pool.SendBatch(ctx, batch).Close()
+}
+
+const deliveryColumns = "d.delivery_id, d.subscription_id, d.event_id, d.event_type, d.data, d.status, d.attempts, d.created_at, d.next_attempt_at, d.delivered_at, d.last_status_code, d.last_error"
+
+func scanDelivery(row pgx.Row, extra ...any) (Delivery, error) {
+	var d Delivery
+	var data string
+
+	dest := append([]any{&d.Id, &d.SubscriptionID, &d.EventID, &d.EventType, &data, &d.Status, &d.Attempts, &d.CreatedAt, &d.NextAttemptAt, &d.DeliveredAt, &d.LastStatusCode, &d.LastError}, extra...)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return Delivery{}, err
+	}
+
+	d.Data = []byte(data)
+
+	return d, nil
+}
+
+// ClaimDeliveries returns at most limit pending deliveries that are due, and postpones their next
+// attempt by lease so that they are not claimed again while they are being delivered.
+func (db *databaseImpl) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]Delivery, error) {
+	rows, err := db.pool.Query(ctx, `
+		UPDATE subscription_deliveries d
+		SET next_attempt_at = now() + make_interval(secs => $3)
+		FROM subscriptions s
+		WHERE s.subscription_id = d.subscription_id
+		  AND d.delivery_id IN (
+			SELECT delivery_id
+			FROM subscription_deliveries
+			WHERE status = $1
+			  AND next_attempt_at <= now()
+			ORDER BY next_attempt_at ASC, delivery_id ASC
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		  )
+		RETURNING `+deliveryColumns+`, s.endpoint`, DeliveryPending, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]Delivery, 0)
+
+	for rows.Next() {
+		var endpoint string
+		d, err := scanDelivery(rows, &endpoint)
+		if err != nil {
+			return nil, err
+		}
+		d.Endpoint = endpoint
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// UpdateDelivery stores the outcome of an attempt to deliver.
+func (db *databaseImpl) UpdateDelivery(ctx context.Context, d Delivery) error {
+	_, err := db.pool.Exec(ctx, `
+		UPDATE subscription_deliveries
+		SET status = $2, attempts = $3, next_attempt_at = $4, delivered_at = $5, last_status_code = $6, last_error = $7
+		WHERE delivery_id = $1`,
+		d.Id, d.Status, d.Attempts, d.NextAttemptAt, d.DeliveredAt, d.LastStatusCode, d.LastError)
+	return err
+}
+
+// GetDeliveries returns the deliveries of a subscription, newest first.
+func (db *databaseImpl) GetDeliveries(ctx context.Context, subscriptionID string, page, size int) (int64, []Delivery, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+deliveryColumns+`, count(*) OVER() AS full_count
+		FROM subscription_deliveries d
+		WHERE d.subscription_id = $1
+		ORDER BY d.delivery_id DESC
+		OFFSET $2 LIMIT $3`, subscriptionID, page*size, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]Delivery, 0)
+	var fullCount int64
+
+	for rows.Next() {
+		d, err := scanDelivery(rows, &fullCount)
+		if err != nil {
+			return 0, nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	return fullCount, deliveries, rows.Err()
+}
+
+// DeleteDeliveries deletes deliveries that were created before the given time and are no longer pending.
+func (db *databaseImpl) DeleteDeliveries(ctx context.Context, before time.Time) error {
+	_, err := db.pool.Exec(ctx, "DELETE FROM subscription_deliveries WHERE created_at < $1 AND status <> $2", before, DeliveryPending)
+	return err
+}
+
+// GetConsumedObservationID returns the id of the last stored observation a consumer has consumed,
+// or 0 if it has not consumed any.
+func (db *databaseImpl) GetConsumedObservationID(ctx context.Context, consumer string) (int64, error) {
+	var id int64
+
+	err := db.pool.QueryRow(ctx, "SELECT last_observation_id FROM observation_consumers WHERE consumer = $1", consumer).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, nil
+	}
+
+	return id, err
+}
+
+// SetConsumedObservationID records the id of the last stored observation a consumer has consumed. The
+// id never moves backwards, since several instances of the service consume the same observations.
+func (db *databaseImpl) SetConsumedObservationID(ctx context.Context, consumer string, id int64) error {
+	_, err := db.pool.Exec(ctx, `
+		INSERT INTO observation_consumers (consumer, last_observation_id, updated_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (consumer) DO UPDATE SET
+			last_observation_id = GREATEST(observation_consumers.last_observation_id, EXCLUDED.last_observation_id),
+			updated_at = EXCLUDED.updated_at`, consumer, id, time.Now().UTC())
+	return err
+}
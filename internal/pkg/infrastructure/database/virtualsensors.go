@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// AddVirtualSensor stores the definition of a virtual sensor. ErrAlreadyExists is returned if the
+// sensor already has a definition.
+func (db *databaseImpl) AddVirtualSensor(ctx context.Context, v VirtualSensor) error {
+	var rootID, rootType *string
+	if v.Root != nil {
+		rootID, rootType = &v.Root.Id, &v.Root.Type
+	}
+
+	inputs, err := json.Marshal(v.Inputs)
+	if err != nil {
+		return err
+	}
+
+	tag, err := db.pool.Exec(ctx, `
+		INSERT INTO virtual_sensors (sensor_id, quantity_kind, formula, inputs, aggregate, root_id, root_type, source_quantity_kind, max_age, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (sensor_id) DO NOTHING`,
+		v.SensorID, v.QuantityKind, v.Formula, string(inputs), v.Aggregate, rootID, rootType, v.SourceQuantityKind, v.MaxAge, v.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrAlreadyExists
+	}
+
+	return nil
+}
+
+const virtualSensorColumns = "sensor_id, quantity_kind, formula, inputs, aggregate, root_id, root_type, source_quantity_kind, max_age, created_at"
+
+func scanVirtualSensor(row pgx.Row, extra ...any) (VirtualSensor, error) {
+	var v VirtualSensor
+	var inputs string
+	var rootID, rootType *string
+
+	dest := append([]any{&v.SensorID, &v.QuantityKind, &v.Formula, &inputs, &v.Aggregate, &rootID, &rootType, &v.SourceQuantityKind, &v.MaxAge, &v.CreatedAt}, extra...)
+
+	err := row.Scan(dest...)
+	if err != nil {
+		return VirtualSensor{}, err
+	}
+
+	err = json.Unmarshal([]byte(inputs), &v.Inputs)
+	if err != nil {
+		return VirtualSensor{}, err
+	}
+
+	if rootID != nil && rootType != nil {
+		v.Root = &Property{Id: *rootID, Type: *rootType}
+	}
+
+	return v, nil
+}
+
+func (db *databaseImpl) GetVirtualSensor(ctx context.Context, sensorID string) (VirtualSensor, error) {
+	row := db.pool.QueryRow(ctx, "SELECT "+virtualSensorColumns+" FROM virtual_sensors WHERE sensor_id = $1", sensorID)
+
+	v, err := scanVirtualSensor(row)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return VirtualSensor{}, ErrNotFound
+		}
+		return VirtualSensor{}, err
+	}
+
+	return v, nil
+}
+
+func (db *databaseImpl) GetVirtualSensors(ctx context.Context, page, size int) (int64, []VirtualSensor, error) {
+	rows, err := db.pool.Query(ctx, `
+		SELECT `+virtualSensorColumns+`, count(*) OVER() AS full_count
+		FROM virtual_sensors
+		ORDER BY created_at ASC, sensor_id ASC
+		OFFSET $1 LIMIT $2`, page*size, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	sensors := make([]VirtualSensor, 0)
+	var fullCount int64
+
+	for rows.Next() {
+		v, err := scanVirtualSensor(rows, &fullCount)
+		if err != nil {
+			return 0, nil, err
+		}
+		sensors = append(sensors, v)
+	}
+
+	return fullCount, sensors, rows.Err()
+}
+
+// DeleteVirtualSensor deletes the definition of a virtual sensor. The sensor entity and the
+// observations computed for it are kept.
+func (db *databaseImpl) DeleteVirtualSensor(ctx context.Context, sensorID string) error {
+	tag, err := db.pool.Exec(ctx, "DELETE FROM virtual_sensors WHERE sensor_id = $1", sensorID)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,269 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/service-chassis/pkg/infrastructure/env"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("api-rec/amqp")
+
+type Config struct {
+	enabled  bool
+	host     string
+	port     string
+	vhost    string
+	user     string
+	password string
+	exchange string
+	queue    string
+	prefetch int
+}
+
+type Consumer interface {
+	Start(ctx context.Context) error
+	Stop()
+}
+
+type consumer struct {
+	cfg  Config
+	app  application.Application
+	conn *amqp091.Connection
+	mu   sync.Mutex
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+var requeueDelay = 1 * time.Second
+
+// routingKeys are the topics that are bound to the queue, each is mapped as an event of the same type.
+var routingKeys = []string{
+	application.MessageAcceptedName,
+	application.FunctionUpdatedName,
+}
+
+func LoadConfiguration(ctx context.Context) Config {
+	return Config{
+		enabled:  env.GetVariableOrDefault(ctx, "RABBITMQ_ENABLED", "false") == "true",
+		host:     env.GetVariableOrDefault(ctx, "RABBITMQ_HOST", "localhost"),
+		port:     env.GetVariableOrDefault(ctx, "RABBITMQ_PORT", "5672"),
+		vhost:    env.GetVariableOrDefault(ctx, "RABBITMQ_VHOST", "/"),
+		user:     env.GetVariableOrDefault(ctx, "RABBITMQ_USER", "user"),
+		password: env.GetVariableOrDefault(ctx, "RABBITMQ_PASS", "bitnami"),
+		exchange: env.GetVariableOrDefault(ctx, "RABBITMQ_EXCHANGE", "iot-msg-exchange-topic"),
+		queue:    env.GetVariableOrDefault(ctx, "RABBITMQ_QUEUE", "api-rec"),
+		prefetch: 10,
+	}
+}
+
+func (c Config) Enabled() bool {
+	return c.enabled
+}
+
+func (c Config) url() string {
+	u := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(c.user, c.password),
+		Host:   c.host + ":" + c.port,
+		Path:   "/" + url.PathEscape(c.vhost),
+	}
+	return u.String()
+}
+
+func New(cfg Config, app application.Application) Consumer {
+	return &consumer{
+		cfg:  cfg,
+		app:  app,
+		done: make(chan struct{}),
+	}
+}
+
+// Start connects to the broker and starts consuming. If the connection is lost the consumer
+// reconnects until it is stopped, unacknowledged messages are redelivered by the broker.
+func (c *consumer) Start(ctx context.Context) error {
+	deliveries, closed, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	c.wg.Add(1)
+	go c.run(ctx, deliveries, closed)
+
+	return nil
+}
+
+func (c *consumer) Stop() {
+	c.mu.Lock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+
+	c.wg.Wait()
+}
+
+func (c *consumer) connect() (<-chan amqp091.Delivery, chan *amqp091.Error, error) {
+	conn, err := amqp091.Dial(c.cfg.url())
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to rabbitmq %s: %w", c.cfg.host, err)
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	err = ch.ExchangeDeclare(c.cfg.exchange, amqp091.ExchangeTopic, true, false, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to declare exchange %s: %w", c.cfg.exchange, err)
+	}
+
+	q, err := ch.QueueDeclare(c.cfg.queue, true, false, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to declare queue %s: %w", c.cfg.queue, err)
+	}
+
+	for _, key := range routingKeys {
+		err = ch.QueueBind(q.Name, key, c.cfg.exchange, false, nil)
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("failed to bind queue %s to %s: %w", q.Name, key, err)
+		}
+	}
+
+	err = ch.Qos(c.cfg.prefetch, 0, false)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to set prefetch count: %w", err)
+	}
+
+	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("failed to consume from queue %s: %w", q.Name, err)
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+
+	return deliveries, conn.NotifyClose(make(chan *amqp091.Error, 1)), nil
+}
+
+func (c *consumer) run(ctx context.Context, deliveries <-chan amqp091.Delivery, closed chan *amqp091.Error) {
+	defer c.wg.Done()
+
+	log := logging.GetFromContext(ctx)
+
+	for {
+		for d := range deliveries {
+			c.handle(ctx, d)
+		}
+
+		select {
+		case <-c.done:
+			return
+		case err := <-closed:
+			if err != nil {
+				log.Warn("lost connection to rabbitmq", "err", err.Error())
+			}
+		default:
+		}
+
+		backoff := time.Second
+
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+
+			var err error
+			deliveries, closed, err = c.connect()
+			if err == nil {
+				log.Info("reconnected to rabbitmq")
+				break
+			}
+
+			log.Error("failed to reconnect to rabbitmq", "err", err.Error())
+			backoff = min(backoff*2, time.Minute)
+		}
+	}
+}
+
+// handle stores the observation in a delivery and acknowledges it once it is stored. Messages
+// that can not be mapped are stored as dead letters and acknowledged, messages that fail to be
+// stored are requeued.
+func (c *consumer) handle(ctx context.Context, d amqp091.Delivery) {
+	var err error
+
+	ctx, span := tracer.Start(ctx, "handle-amqp-delivery")
+	defer span.End()
+
+	log := logging.GetFromContext(ctx)
+
+	evt := application.Event{
+		ID:       d.MessageId,
+		Source:   c.cfg.exchange,
+		Type:     d.RoutingKey,
+		Time:     d.Timestamp,
+		Received: time.Now().UTC(),
+		Data:     d.Body,
+	}
+
+	err = c.app.StoreEvent(ctx, evt)
+	if err != nil {
+		if errors.Is(err, application.ErrEventProcessed) {
+			log.Debug("message has already been processed", "routing_key", d.RoutingKey, "id", evt.ID)
+			ack(ctx, d)
+			return
+		}
+		if errors.Is(err, application.ErrUnmappableEvent) {
+			log.Warn("message could not be mapped to an observation", "routing_key", d.RoutingKey, "err", err.Error())
+			ack(ctx, d)
+			return
+		}
+
+		log.Error("failed to store observation, message will be redelivered", "routing_key", d.RoutingKey, "err", err.Error())
+
+		// avoid redelivering the message in a tight loop while the database is unavailable
+		select {
+		case <-c.done:
+		case <-time.After(requeueDelay):
+		}
+
+		if nackErr := d.Nack(false, true); nackErr != nil {
+			log.Error("failed to nack message", "err", nackErr.Error())
+		}
+		return
+	}
+
+	ack(ctx, d)
+}
+
+func ack(ctx context.Context, d amqp091.Delivery) {
+	err := d.Ack(false)
+	if err != nil {
+		logging.GetFromContext(ctx).Error("failed to ack message", "err", err.Error())
+	}
+}
@@ -0,0 +1,121 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/matryer/is"
+	amqp091 "github.com/rabbitmq/amqp091-go"
+)
+
+func TestHandleAcksStoredMessage(t *testing.T) {
+	is := is.New(t)
+
+	app := &appMock{}
+	c := New(Config{exchange: "iot-msg-exchange-topic"}, app).(*consumer)
+	a := &acknowledgerMock{}
+
+	c.handle(context.Background(), delivery(a, "1"))
+
+	is.Equal(1, len(app.stored))
+	is.Equal(application.MessageAcceptedName, app.stored[0].Type)
+	is.Equal("iot-msg-exchange-topic", app.stored[0].Source)
+	is.Equal("1", app.stored[0].ID)
+	is.Equal(1, a.acks)
+	is.Equal(0, a.nacks)
+}
+
+func TestHandleAcksUnmappableMessage(t *testing.T) {
+	is := is.New(t)
+
+	app := &appMock{err: application.ErrUnmappableEvent}
+	c := New(Config{}, app).(*consumer)
+	a := &acknowledgerMock{}
+
+	c.handle(context.Background(), delivery(a, "1"))
+
+	is.Equal(1, a.acks)
+	is.Equal(0, a.nacks)
+}
+
+func TestHandleRequeuesMessageThatFailsToBeStored(t *testing.T) {
+	is := is.New(t)
+	requeueDelay = time.Millisecond
+
+	app := &appMock{err: errors.New("database unavailable")}
+	c := New(Config{}, app).(*consumer)
+	a := &acknowledgerMock{}
+
+	c.handle(context.Background(), delivery(a, "1"))
+
+	is.Equal(0, a.acks)
+	is.Equal(1, a.nacks)
+	is.True(a.requeue)
+}
+
+func TestHandleAcksProcessedMessage(t *testing.T) {
+	is := is.New(t)
+
+	app := &appMock{processed: true}
+	c := New(Config{}, app).(*consumer)
+	a := &acknowledgerMock{}
+
+	c.handle(context.Background(), delivery(a, "1"))
+
+	is.Equal(0, len(app.stored))
+	is.Equal(1, a.acks)
+}
+
+func delivery(a amqp091.Acknowledger, id string) amqp091.Delivery {
+	return amqp091.Delivery{
+		Acknowledger: a,
+		DeliveryTag:  1,
+		MessageId:    id,
+		RoutingKey:   application.MessageAcceptedName,
+		Body:         []byte(`{}`),
+	}
+}
+
+type appMock struct {
+	application.Application
+	processed bool
+	err       error
+	stored    []application.Event
+}
+
+func (a *appMock) StoreEvent(ctx context.Context, evt application.Event) error {
+	if a.processed {
+		return application.ErrEventProcessed
+	}
+	if a.err != nil {
+		return a.err
+	}
+	a.stored = append(a.stored, evt)
+	return nil
+}
+
+type acknowledgerMock struct {
+	acks    int
+	nacks   int
+	requeue bool
+}
+
+func (a *acknowledgerMock) Ack(tag uint64, multiple bool) error {
+	a.acks++
+	return nil
+}
+
+func (a *acknowledgerMock) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacks++
+	a.requeue = requeue
+	return nil
+}
+
+func (a *acknowledgerMock) Reject(tag uint64, requeue bool) error {
+	a.nacks++
+	a.requeue = requeue
+	return nil
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/go-chi/chi/v5"
+)
+
+func getDeadLetters(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-deadletters")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		totalItems, deadLetters, err := app.GetDeadLetters(ctx, getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10))
+		if err != nil {
+			requestLogger.Error("unable to load dead letters", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		result := newHydraCollectionResult(ctx, r.URL, deadLetters, int(totalItems))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func getDeadLetter(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-deadletter")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			requestLogger.Error("invalid dead letter id", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		dl, err := app.GetDeadLetter(ctx, id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			requestLogger.Error("unable to load dead letter", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(dl)
+		if err != nil {
+			requestLogger.Error("unable marshal dead letter", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func replayDeadLetter(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "replay-deadletter")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			requestLogger.Error("invalid dead letter id", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		dl, err := app.ReplayDeadLetter(ctx, id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, application.ErrDeadLetterReplayed) || errors.Is(err, application.ErrEventProcessed) {
+				requestLogger.Info("dead letter not replayed", "id", id, "err", err.Error())
+				writeErrors(w, http.StatusConflict, err)
+				return
+			}
+			if !errors.Is(err, application.ErrUnmappableEvent) {
+				requestLogger.Error("unable to replay dead letter", "id", id, "err", err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+
+		b, err := json.Marshal(dl)
+		if err != nil {
+			requestLogger.Error("unable marshal dead letter", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		if dl.ReplayedAt == nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		w.Write(b)
+	}
+}
@@ -0,0 +1,265 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/go-chi/chi/v5"
+)
+
+func createRule(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer r.Body.Close()
+
+		ctx, span := tracer.Start(r.Context(), "create-rule")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			requestLogger.Error("unable to read body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var rule database.Rule
+		err = json.Unmarshal(body, &rule)
+		if err != nil {
+			requestLogger.Error("unable to unmarshal body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		rule, err = app.AddRule(ctx, rule)
+		if err != nil {
+			if errors.Is(err, application.ErrInvalidRule) {
+				requestLogger.Info("invalid rule", "err", err.Error())
+				writeErrors(w, http.StatusBadRequest, err)
+				return
+			}
+			requestLogger.Error("unable to add rule", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(rule)
+		if err != nil {
+			requestLogger.Error("unable marshal rule", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Location", r.URL.Path+"/"+rule.Id)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+func getRules(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-rules")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		totalItems, rules, err := app.GetRules(ctx, getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10))
+		if err != nil {
+			requestLogger.Error("unable to load rules", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		result := newHydraCollectionResult(ctx, r.URL, rules, int(totalItems))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func getRule(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-rule")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id := chi.URLParam(r, "id")
+
+		rule, err := app.GetRule(ctx, id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			requestLogger.Error("unable to load rule", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(rule)
+		if err != nil {
+			requestLogger.Error("unable marshal rule", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func deleteRule(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "delete-rule")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id := chi.URLParam(r, "id")
+
+		err = app.DeleteRule(ctx, id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, application.ErrInvalidRule) {
+				writeErrors(w, http.StatusBadRequest, err)
+				return
+			}
+			requestLogger.Error("unable to delete rule", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func getAlarms(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-alarms")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		filter := database.AlarmFilter{
+			Status:   r.URL.Query().Get("status"),
+			RuleID:   r.URL.Query().Get("ruleId"),
+			SensorID: r.URL.Query().Get("sensorId"),
+		}
+
+		totalItems, alarms, err := app.GetAlarms(ctx, filter, getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10))
+		if err != nil {
+			requestLogger.Error("unable to load alarms", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		result := newHydraCollectionResult(ctx, r.URL, alarms, int(totalItems))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func getAlarm(ctx context.Context, app application.Application) http.HandlerFunc {
+	return alarmHandler(ctx, "get-alarm", app.GetAlarm)
+}
+
+func acknowledgeAlarm(ctx context.Context, app application.Application) http.HandlerFunc {
+	return alarmHandler(ctx, "acknowledge-alarm", app.AcknowledgeAlarm)
+}
+
+func closeAlarm(ctx context.Context, app application.Application) http.HandlerFunc {
+	return alarmHandler(ctx, "close-alarm", app.CloseAlarm)
+}
+
+// alarmHandler responds with the alarm returned by fn for the id in the path
+func alarmHandler(ctx context.Context, name string, fn func(context.Context, int64) (database.Alarm, error)) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), name)
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			requestLogger.Error("invalid alarm id", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		alarm, err := fn(ctx, id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, application.ErrAlarmStatus) {
+				requestLogger.Info("alarm status can not be changed", "id", id, "err", err.Error())
+				writeErrors(w, http.StatusConflict, err)
+				return
+			}
+			requestLogger.Error("unable to handle alarm", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(alarm)
+		if err != nil {
+			requestLogger.Error("unable marshal alarm", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
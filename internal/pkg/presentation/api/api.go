@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -19,6 +20,7 @@ import (
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/cors"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/metric"
@@ -83,6 +85,24 @@ func getTimeOrDefault(url *url.URL, key string, t time.Time) (time.Time, error)
 	return pt, nil
 }
 
+// getQuality returns the qualities in a comma separated quality parameter, or nil if there is none.
+func getQuality(url *url.URL) ([]string, error) {
+	value := url.Query().Get("quality")
+	if value == "" {
+		return nil, nil
+	}
+
+	qualities := strings.Split(value, ",")
+	for i, q := range qualities {
+		qualities[i] = strings.TrimSpace(q)
+		if !database.IsQuality(qualities[i]) {
+			return nil, fmt.Errorf("unknown quality %s", qualities[i])
+		}
+	}
+
+	return qualities, nil
+}
+
 func newHydraCollectionResult(ctx context.Context, url *url.URL, member any, totalItems int) hydraCollectionResult {
 	r := hydraCollectionResult{
 		Context:    "http://www.w3.org/ns/hydra/context.jsonld",
@@ -154,6 +174,7 @@ func RegisterEndpoints(ctx context.Context, r *chi.Mux, app application.Applicat
 	r.Route("/api", func(r chi.Router) {
 		r.Group(func(r chi.Router) {
 			r.Use(SettingsCtx)
+			r.Use(middleware.Timeout(10 * time.Second))
 
 			r.Route("/spaces", func(r chi.Router) {
 				r.Get("/", getEntities(ctx, app, database.SpaceType))
@@ -162,18 +183,81 @@ func RegisterEndpoints(ctx context.Context, r *chi.Mux, app application.Applicat
 			r.Route("/buildings", func(r chi.Router) {
 				r.Get("/", getEntities(ctx, app, database.BuildingType))
 				r.Post("/", createEntity(ctx, app))
+				r.Get("/{id}/energy", getBuildingEnergy(ctx, app))
 			})
 			r.Route("/sensors", func(r chi.Router) {
-				r.Get("/", getEntities(ctx, app, database.SensorType))
+				r.Get("/", getSensors(ctx, app))
+				r.Get("/unassigned", getUnassignedSensors(ctx, app))
+				r.Get("/gaps", getObservationGaps(ctx, app))
+				r.Get("/virtual", getVirtualSensors(ctx, app))
+				r.Post("/virtual", createVirtualSensor(ctx, app))
+				r.Get("/virtual/{id}", getVirtualSensor(ctx, app))
+				r.Delete("/virtual/{id}", deleteVirtualSensor(ctx, app))
 				r.Post("/", createEntity(ctx, app))
 			})
-			r.Route("/observations", func(r chi.Router) {
-				r.Get("/", getObservations(ctx, app))
-				r.Post("/", createObservation(ctx, app))
+			r.Route("/devices", func(r chi.Router) {
+				r.Get("/", getEntities(ctx, app, database.DeviceType))
+				r.Post("/", createEntity(ctx, app))
 			})
 			r.Route("/cloudevents", func(r chi.Router) {
 				r.Post("/", handleCloudevents(ctx, app))
 			})
+			r.Route("/subscriptions", func(r chi.Router) {
+				r.Get("/", getSubscriptions(ctx, app))
+				r.Post("/", createSubscription(ctx, app))
+				r.Get("/{id}", getSubscription(ctx, app))
+				r.Delete("/{id}", deleteSubscription(ctx, app))
+				r.Get("/{id}/deliveries", getDeliveries(ctx, app))
+			})
+			r.Route("/rules", func(r chi.Router) {
+				r.Get("/", getRules(ctx, app))
+				r.Post("/", createRule(ctx, app))
+				r.Get("/{id}", getRule(ctx, app))
+				r.Delete("/{id}", deleteRule(ctx, app))
+			})
+			r.Route("/occupancy", func(r chi.Router) {
+				r.Get("/", getOccupancy(ctx, app))
+			})
+			r.Route("/alarms", func(r chi.Router) {
+				r.Get("/", getAlarms(ctx, app))
+				r.Get("/{id}", getAlarm(ctx, app))
+				r.Post("/{id}/acknowledge", acknowledgeAlarm(ctx, app))
+				r.Post("/{id}/close", closeAlarm(ctx, app))
+			})
+		})
+
+		// exports and imports may run for much longer than regular requests, so timeouts are set per route
+		r.Group(func(r chi.Router) {
+			r.Use(SettingsCtx)
+
+			r.Route("/observations", func(r chi.Router) {
+				r.Get("/", getObservations(ctx, app))
+				r.Get("/stream", streamObservations(ctx, app))
+				r.With(middleware.Timeout(10*time.Second)).Post("/", createObservation(ctx, app))
+				r.With(middleware.Timeout(importTimeout(ctx))).Post("/import", importObservations(ctx, app))
+				r.With(middleware.Timeout(importTimeout(ctx))).Post("/quality", setObservationQuality(ctx, app))
+			})
+
+			// changing a calibration recalibrates the stored observations it applies to
+			r.Route("/calibrations", func(r chi.Router) {
+				r.With(middleware.Timeout(10*time.Second)).Get("/", getCalibrations(ctx, app))
+				r.With(middleware.Timeout(10*time.Second)).Get("/{id}", getCalibration(ctx, app))
+				r.With(middleware.Timeout(importTimeout(ctx))).Post("/", createCalibration(ctx, app))
+				r.With(middleware.Timeout(importTimeout(ctx))).Delete("/{id}", deleteCalibration(ctx, app))
+			})
+		})
+	})
+
+	r.Route("/admin", func(r chi.Router) {
+		r.Group(func(r chi.Router) {
+			r.Use(SettingsCtx)
+			r.Use(middleware.Timeout(10 * time.Second))
+
+			r.Route("/deadletters", func(r chi.Router) {
+				r.Get("/", getDeadLetters(ctx, app))
+				r.Get("/{id}", getDeadLetter(ctx, app))
+				r.Post("/{id}/replay", replayDeadLetter(ctx, app))
+			})
 		})
 	})
 }
@@ -290,6 +374,38 @@ func getEntities(ctx context.Context, app application.Application, entityType st
 	}
 }
 
+func getUnassignedSensors(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-unassigned-sensors")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		totalItems, entities, err := app.GetUnassignedSensors(ctx, getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10))
+		if err != nil {
+			requestLogger.Error("unable to load unassigned sensors", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		result := newHydraCollectionResult(ctx, r.URL, entities, int(totalItems))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
 func getRootEntity(ctx context.Context, r *http.Request, app application.Application) (database.Entity, bool) {
 	rootId := r.URL.Query().Get("root[id]")
 	if rootId == "" {
@@ -309,10 +425,42 @@ func getRootEntity(ctx context.Context, r *http.Request, app application.Applica
 	return root, true
 }
 
+// getSensorFilter returns the sensors to filter observations on, the sensor in sensorId or the sensors in
+// the subtree of the root entity, or nil if neither is given. If the sensors can not be resolved the
+// error is returned with the status to respond with.
+func getSensorFilter(ctx context.Context, r *http.Request, app application.Application) ([]string, int, error) {
+	if sensorId := r.URL.Query().Get("sensorId"); sensorId != "" {
+		return []string{sensorId}, http.StatusOK, nil
+	}
+
+	root, ok := getRootEntity(ctx, r, app)
+	if !ok {
+		if r.URL.Query().Get("root[id]") != "" {
+			return nil, http.StatusNotFound, errors.New("root entity not found")
+		}
+		return nil, http.StatusOK, nil
+	}
+
+	sensorIDs, err := app.GetSensorIDs(ctx, root)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("could not load sensors for root entity: %w", err)
+	}
+
+	return sensorIDs, http.StatusOK, nil
+}
+
+// getObservations responds with resampled observations if an interval to resample with is given and
+// with stored observations otherwise.
 func getObservations(ctx context.Context, app application.Application) http.HandlerFunc {
 	log := logging.GetFromContext(ctx)
+	resampled := getResampledObservations(ctx, app)
 
 	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("resample") {
+			resampled(w, r)
+			return
+		}
+
 		var err error
 
 		ctx, span := tracer.Start(r.Context(), "get-observations")
@@ -320,8 +468,12 @@ func getObservations(ctx context.Context, app application.Application) http.Hand
 		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
 
 		sensorId := r.URL.Query().Get("sensorId")
-		if sensorId == "" {
-			requestLogger.Error("no ID in query string", "err", err.Error())
+		deviceId := r.URL.Query().Get("deviceId")
+		hasRoot := r.URL.Query().Get("root[id]") != ""
+		format := exportFormat(r)
+
+		if sensorId == "" && deviceId == "" && !(hasRoot && format != "") {
+			requestLogger.Error("no ID in query string")
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
@@ -339,7 +491,62 @@ func getObservations(ctx context.Context, app application.Application) http.Hand
 			return
 		}
 
-		totalItems, observations, err := app.GetObservations(ctx, sensorId, startingTime, endingTime, getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10))
+		quality, err := getQuality(r.URL)
+		if err != nil {
+			requestLogger.Error("invalid quality", "err", err.Error())
+			writeErrors(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if format != "" {
+			ctx, cancel := context.WithTimeout(ctx, exportTimeout(ctx))
+			defer cancel()
+
+			filter := database.ObservationFilter{
+				DeviceID:     deviceId,
+				QuantityKind: r.URL.Query().Get("quantityKind"),
+				Quality:      quality,
+				Starting:     startingTime,
+				Ending:       endingTime,
+			}
+
+			var status int
+			filter.SensorIDs, status, err = getSensorFilter(ctx, r, app)
+			if err != nil {
+				requestLogger.Error("could not get sensors to filter on", "err", err.Error())
+				w.WriteHeader(status)
+				return
+			}
+
+			var n int
+			n, err = exportObservations(ctx, w, format, filter, app, requestLogger)
+			if err != nil {
+				requestLogger.Error("could not export observations", "count", n, "err", err.Error())
+				if n == 0 {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		page, size := getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10)
+
+		filter := database.ObservationFilter{
+			Quality:  quality,
+			Starting: startingTime,
+			Ending:   endingTime,
+		}
+
+		if sensorId != "" {
+			filter.SensorIDs = []string{sensorId}
+		} else {
+			filter.DeviceID = deviceId
+		}
+
+		totalItems, observations, err := app.QueryObservations(ctx, filter, page, size)
 		if err != nil {
 			requestLogger.Error("could not load observations", "err", err.Error())
 			w.WriteHeader(http.StatusInternalServerError)
@@ -379,14 +586,30 @@ func createObservation(ctx context.Context, app application.Application) http.Ha
 			return
 		}
 
-		var so database.SensorObservation
-		err = json.Unmarshal(body, &so)
+		so, err := application.DecodeEdgeMessage(body)
 		if err != nil {
 			requestLogger.Error("unable to unmarshal body", "err", err.Error())
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 
+		err = application.Validate(so)
+		if err != nil {
+			requestLogger.Info("invalid observation", "err", err.Error())
+
+			var verrs application.ValidationErrors
+			errors.As(err, &verrs)
+
+			b, _ := json.Marshal(struct {
+				Errors application.ValidationErrors `json:"errors"`
+			}{verrs})
+
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(b)
+			return
+		}
+
 		err = app.AddObservation(ctx, so)
 		if err != nil {
 			requestLogger.Error("unable to create observation", "err", err.Error())
@@ -411,6 +634,18 @@ func handleCloudevents(ctx context.Context, app application.Application) http.Ha
 		log.Error("failed to create otel cloudevent counter", "err", err.Error())
 	}
 
+	redeliveryCounter, err := otel.Meter("api-rec/cloudevents").Int64Counter(
+		"diwise.cloudevents.redelivered",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of received cloudevents that had already been processed"),
+	)
+
+	if err != nil {
+		log.Error("failed to create otel cloudevent redelivery counter", "err", err.Error())
+	}
+
+	retryAfter := env.GetVariableOrDefault(ctx, "INGESTION_RETRY_AFTER", "5")
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		var err error
 		defer r.Body.Close()
@@ -419,6 +654,48 @@ func handleCloudevents(ctx context.Context, app application.Application) http.Ha
 		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
 		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
 
+		if cloudevents.IsHTTPBatch(r.Header) {
+			events, err := cloudevents.NewEventsFromHTTPRequest(r)
+			if err != nil {
+				requestLogger.Error("failed to parse cloud event batch from request", "err", err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			eventCounter.Add(ctx, int64(len(events)))
+
+			evts := make([]application.Event, 0, len(events))
+			for _, event := range events {
+				evts = append(evts, newEvent(event))
+			}
+
+			results := app.HandleEvents(ctx, evts)
+
+			statusCode := http.StatusOK
+			for _, result := range results {
+				switch result.Status {
+				case application.EventDuplicate:
+					redeliveryCounter.Add(ctx, 1)
+				case application.EventFailed:
+					statusCode = http.StatusServiceUnavailable
+				}
+			}
+
+			b, err := json.Marshal(struct {
+				Results []application.EventResult `json:"results"`
+			}{results})
+			if err != nil {
+				requestLogger.Error("unable to marshal batch result", "err", err.Error())
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(statusCode)
+			w.Write(b)
+			return
+		}
+
 		event, err := cloudevents.NewEventFromHTTPRequest(r)
 		if err != nil {
 			requestLogger.Error("failed to parse cloud event from request", "err", err.Error())
@@ -428,43 +705,41 @@ func handleCloudevents(ctx context.Context, app application.Application) http.Ha
 
 		eventCounter.Add(ctx, 1)
 
-		var observation database.SensorObservation
-		var observationOk bool = false
-
-		switch event.Type() {
-		case application.MessageAcceptedName:
-			var ma application.MessageAccepted
-			err := json.Unmarshal(event.Data(), &ma)
-			if err != nil {
-				requestLogger.Error("failed to parse message.accepted in cloud event", "err", err.Error())
-				w.WriteHeader(http.StatusBadRequest)
+		err = app.HandleEvent(ctx, newEvent(*event))
+		if err != nil {
+			if errors.Is(err, application.ErrEventProcessed) {
+				requestLogger.Debug("event has already been processed", "source", event.Source(), "id", event.ID())
+				redeliveryCounter.Add(ctx, 1)
+				w.WriteHeader(http.StatusOK)
 				return
 			}
-			observation, observationOk = ma.MapToObservation()
-		case application.FunctionUpdatedName:
-			var fu application.FunctionUpdated
-			err := json.Unmarshal(event.Data(), &fu)
-			if err != nil {
-				requestLogger.Error("failed to parse function.updated in cloud event", "err", err.Error())
+			if errors.Is(err, application.ErrUnmappableEvent) {
+				requestLogger.Error("failed to map incoming message to observation", "err", err.Error())
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			observation, observationOk = fu.MapToObservation()
-		}
-
-		if observationOk {
-			err = app.AddObservation(ctx, observation)
-			if err != nil {
-				requestLogger.Error("failed to store observation", "err", err.Error())
-				w.WriteHeader(http.StatusInternalServerError)
+			if errors.Is(err, application.ErrQueueFull) {
+				requestLogger.Warn("ingestion queue is full, asking sender to retry", "retry_after", retryAfter)
+				w.Header().Add("Retry-After", retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
 				return
 			}
-			w.WriteHeader(http.StatusCreated)
-			return
-		} else {
-			requestLogger.Error("failed to map incomming message to observation", "err", err.Error())
-			w.WriteHeader(http.StatusBadRequest)
+			requestLogger.Error("failed to enqueue observation", "err", err.Error())
+			w.WriteHeader(http.StatusServiceUnavailable)
 			return
 		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func newEvent(event cloudevents.Event) application.Event {
+	return application.Event{
+		ID:       event.ID(),
+		Source:   event.Source(),
+		Type:     event.Type(),
+		Time:     event.Time(),
+		Received: time.Now().UTC(),
+		Data:     event.Data(),
 	}
 }
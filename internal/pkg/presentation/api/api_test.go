@@ -1,12 +1,15 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,6 +17,7 @@ import (
 	"github.com/diwise/api-rec/internal/pkg/application"
 	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
 	"github.com/farshidtz/senml/v2"
+	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 	"github.com/matryer/is"
 	"golang.org/x/sys/unix"
@@ -102,7 +106,8 @@ func TestCloudevents(t *testing.T) {
 		t.SkipNow()
 	}
 
-	app := application.New(db)
+	app := application.New(db, application.NewConfig(false, ""))
+	app.Start(ctx)
 
 	srv := httptest.NewServer(handleCloudevents(ctx, app))
 
@@ -156,6 +161,13 @@ func TestCloudevents(t *testing.T) {
 		t.FailNow()
 	}
 
+	// wait for queued observations to be stored
+	err = app.Shutdown(ctx)
+	if err != nil {
+		t.Log("could not drain ingestion queue")
+		t.FailNow()
+	}
+
 	count, observations, err := db.GetObservations(ctx, sensorID, now.Add(-1*time.Second), now.Add(1*time.Minute), 0, 10)
 	if err != nil {
 		t.Log("could not fetch observations")
@@ -173,6 +185,74 @@ func TestCloudevents(t *testing.T) {
 	}
 }
 
+func TestCloudeventsBatch(t *testing.T) {
+	ctx, cancel, db, err := connect()
+	defer cancel()
+
+	if err != nil {
+		t.Log("could not connect to database or create tables, will skip test")
+		t.SkipNow()
+	}
+
+	is := is.New(t)
+
+	app := application.New(db, application.NewConfig(false, ""))
+
+	srv := httptest.NewServer(handleCloudevents(ctx, app))
+	defer srv.Close()
+
+	sensorID := uuid.New().String()
+	now := time.Now()
+
+	v := 1.5
+	m := application.MessageAccepted{
+		SensorID:  sensorID,
+		Timestamp: now,
+		Pack: senml.Pack{
+			senml.Record{
+				BaseName:    "test",
+				StringValue: sensorID,
+				BaseTime:    float64(now.Unix()),
+			},
+			senml.Record{
+				Value: &v,
+			},
+		},
+	}
+
+	newEvent := func(eventType string, data any) cloudevents.Event {
+		event := cloudevents.NewEvent()
+		event.SetID(uuid.New().String())
+		event.SetTime(now)
+		event.SetSource("test")
+		event.SetType(eventType)
+		event.SetData(cloudevents.ApplicationJSON, data)
+		return event
+	}
+
+	events := []cloudevents.Event{
+		newEvent(application.MessageAcceptedName, m),
+		newEvent("unknown.type", m),
+	}
+
+	b, _ := json.Marshal(events)
+
+	resp, err := http.Post(srv.URL, "application/cloudevents-batch+json", bytes.NewReader(b))
+	is.NoErr(err)
+	defer resp.Body.Close()
+
+	is.Equal(http.StatusOK, resp.StatusCode)
+
+	var result struct {
+		Results []application.EventResult `json:"results"`
+	}
+	is.NoErr(json.NewDecoder(resp.Body).Decode(&result))
+
+	is.Equal(2, len(result.Results))
+	is.Equal(application.EventStored, result.Results[0].Status)
+	is.Equal(application.EventRejected, result.Results[1].Status)
+}
+
 func TestNewHydraCollectionResult(t *testing.T) {
 	is := is.New(t)
 
@@ -194,3 +274,551 @@ func TestNewHydraCollectionResult(t *testing.T) {
 	is.True(result.View != nil)
 	is.True(result.View.Next == "")
 }
+
+func TestCreateObservationReturnsValidationErrors(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	app := application.New(nil, application.NewConfig(false, ""))
+
+	body := `{"format":"rec3.3","deviceId":"device-1","observations":[{"observationTime":"2019-05-27T20:07:44Z","quantityKind":"Temperature","sensorId":"sensor-1"}]}`
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/observations", bytes.NewBufferString(body))
+
+	createObservation(ctx, app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusBadRequest, w.Code)
+
+	var result struct {
+		Errors []application.ValidationError `json:"errors"`
+	}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &result))
+	is.Equal(1, len(result.Errors))
+	is.Equal(0, *result.Errors[0].Observation)
+	is.Equal("value", result.Errors[0].Field)
+}
+
+func TestImportObservationsDryRun(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	app := application.New(nil, application.NewConfig(false, ""))
+
+	body := "meter,time,value,quantityKind\nmeter-1,2021-01-01T00:00:00Z,21.5,Temperature\nmeter-1,,21.5,Temperature\n"
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/observations/import?dryRun=true&column[sensorId]=meter&column[observationTime]=time", bytes.NewBufferString(body))
+
+	importObservations(ctx, app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusOK, w.Code)
+
+	var result application.ImportResult
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &result))
+	is.True(result.DryRun)
+	is.Equal(int64(2), result.Rows)
+	is.Equal(int64(1), result.Imported)
+	is.Equal(int64(1), result.Skipped)
+}
+
+func TestExportFormat(t *testing.T) {
+	is := is.New(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/api/observations?sensorId=s1", nil)
+	is.Equal("", exportFormat(r))
+
+	r.Header.Set("Accept", "text/csv")
+	is.Equal(formatCSV, exportFormat(r))
+
+	r = httptest.NewRequest(http.MethodGet, "/api/observations?sensorId=s1&format=ndjson", nil)
+	r.Header.Set("Accept", "text/csv")
+	is.Equal(formatNDJSON, exportFormat(r))
+}
+
+func TestGetObservationsAsCSV(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	v := 21.5
+	ts := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	app := &streamingAppMock{observations: []database.Observation{
+		{SensorId: "s1", ObservationTime: ts, Value: &v, QuantityKind: "Temperature"},
+		{SensorId: "s1", ObservationTime: ts.Add(time.Hour), Value: &v, QuantityKind: "Temperature"},
+	}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/observations?sensorId=s1&format=csv", nil)
+
+	getObservations(ctx, app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusOK, w.Code)
+	is.Equal("text/csv", w.Header().Get("Content-Type"))
+	is.Equal([]string{"s1"}, app.filter.SensorIDs)
+	is.Equal("deviceId,sensorId,observationTime,value,valueString,valueBoolean,quantityKind\n"+
+		"d1,s1,2023-10-01T12:00:00Z,21.5,,,Temperature\n"+
+		"d1,s1,2023-10-01T13:00:00Z,21.5,,,Temperature\n", w.Body.String())
+}
+
+func TestGetObservationsAsNDJSON(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	b := true
+	ts := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	app := &streamingAppMock{observations: []database.Observation{
+		{SensorId: "s1", ObservationTime: ts, ValueBoolean: &b, QuantityKind: "diwise:Presence"},
+	}}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/observations?deviceId=d1", nil)
+	r.Header.Set("Accept", "application/x-ndjson")
+
+	getObservations(ctx, app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusOK, w.Code)
+	is.Equal("d1", app.filter.DeviceID)
+	is.Equal(`{"deviceId":"d1","observationTime":"2023-10-01T12:00:00Z","valueBoolean":true,"quantityKind":"diwise:Presence","sensorId":"s1"}`+"\n", w.Body.String())
+}
+
+type streamingAppMock struct {
+	application.Application
+	observations []database.Observation
+	filter       database.ObservationFilter
+}
+
+func (a *streamingAppMock) StreamObservations(ctx context.Context, filter database.ObservationFilter, fn func(deviceID string, o database.Observation) error) error {
+	a.filter = filter
+	for _, o := range a.observations {
+		if err := fn("d1", o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStreamObservationsResumesFromLastEventID(t *testing.T) {
+	is := is.New(t)
+
+	v := 21.5
+	ts := time.Date(2023, 10, 1, 12, 0, 0, 0, time.UTC)
+	observation := func(id int64) database.StoredObservation {
+		return database.StoredObservation{ID: id, DeviceID: "d1", Observation: database.Observation{SensorId: "s1", ObservationTime: ts, Value: &v, QuantityKind: "Temperature"}}
+	}
+
+	// the subscription is closed after the live observations, which ends the stream
+	live := make(chan database.StoredObservation, 2)
+	live <- observation(4)
+	live <- observation(5)
+	close(live)
+
+	app := &subscribingAppMock{
+		live:    live,
+		resumed: []database.StoredObservation{observation(4)},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/observations/stream?sensorId=s1", nil)
+	r.Header.Set("Last-Event-ID", "3")
+
+	streamObservations(context.Background(), app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusOK, w.Code)
+	is.Equal("text/event-stream", w.Header().Get("Content-Type"))
+	is.Equal(int64(3), app.afterID)
+	is.Equal([]string{"s1"}, app.filter.SensorIDs)
+
+	data := `{"id":%d,"deviceId":"d1","observationTime":"2023-10-01T12:00:00Z","value":21.5,"quantityKind":"Temperature","sensorId":"s1"}`
+	is.Equal(fmt.Sprintf("id: 4\nevent: observation\ndata: "+data+"\n\nid: 5\nevent: observation\ndata: "+data+"\n\n", 4, 5), w.Body.String())
+}
+
+func TestStreamObservationsClosesWhenResumeLimitIsReached(t *testing.T) {
+	is := is.New(t)
+
+	live := make(chan database.StoredObservation, 1)
+	live <- database.StoredObservation{ID: maxResumedObservations + 100}
+
+	app := &subscribingAppMock{
+		live:      live,
+		unbounded: true,
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/observations/stream?lastEventId=3", nil)
+
+	streamObservations(context.Background(), app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusOK, w.Code)
+	is.Equal(maxResumedObservations, strings.Count(w.Body.String(), "event: observation"))
+	is.True(strings.Contains(w.Body.String(), fmt.Sprintf("id: %d\n", maxResumedObservations+3)))
+	is.True(!strings.Contains(w.Body.String(), fmt.Sprintf("id: %d\n", maxResumedObservations+100)))
+}
+
+func TestStreamObservationsRejectsInvalidLastEventID(t *testing.T) {
+	is := is.New(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/observations/stream?lastEventId=abc", nil)
+
+	streamObservations(context.Background(), &subscribingAppMock{}).ServeHTTP(w, r)
+
+	is.Equal(http.StatusBadRequest, w.Code)
+}
+
+type subscribingAppMock struct {
+	application.Application
+	live    chan database.StoredObservation
+	resumed []database.StoredObservation
+	// unbounded returns a full batch of stored observations after any id
+	unbounded bool
+	filter    database.ObservationFilter
+	afterID   int64
+}
+
+func (a *subscribingAppMock) SubscribeObservations(filter database.ObservationFilter) (<-chan database.StoredObservation, func()) {
+	a.filter = filter
+	return a.live, func() {}
+}
+
+func (a *subscribingAppMock) GetObservationsAfter(ctx context.Context, filter database.ObservationFilter, afterID int64, limit int) ([]database.StoredObservation, error) {
+	if a.unbounded {
+		batch := make([]database.StoredObservation, limit)
+		for i := range batch {
+			batch[i] = database.StoredObservation{ID: afterID + int64(i) + 1}
+		}
+		return batch, nil
+	}
+	a.afterID = afterID
+	return a.resumed, nil
+}
+
+func TestCreateSubscription(t *testing.T) {
+	is := is.New(t)
+	app := &subscriptionAppMock{}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/subscriptions", strings.NewReader(`{"endpoint":"https://example.com/hook","types":["observation.stored"],"quantityKind":"Temperature"}`))
+
+	createSubscription(context.Background(), app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusCreated, w.Code)
+	is.Equal("/api/subscriptions/sub-1", w.Header().Get("Location"))
+	is.Equal("https://example.com/hook", app.subscription.Endpoint)
+	is.Equal([]string{"observation.stored"}, app.subscription.Types)
+}
+
+func TestCreateInvalidSubscriptionReturnsErrors(t *testing.T) {
+	is := is.New(t)
+	app := &subscriptionAppMock{}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/subscriptions", strings.NewReader(`{"endpoint":"ftp://example.com"}`))
+
+	createSubscription(context.Background(), app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusBadRequest, w.Code)
+	is.True(strings.Contains(w.Body.String(), `"errors":["invalid subscription`))
+}
+
+type subscriptionAppMock struct {
+	application.Application
+	subscription database.Subscription
+}
+
+func (a *subscriptionAppMock) AddSubscription(ctx context.Context, s database.Subscription) (database.Subscription, error) {
+	if !strings.HasPrefix(s.Endpoint, "http") {
+		return database.Subscription{}, fmt.Errorf("%w: endpoint must be an absolute http or https url", application.ErrInvalidSubscription)
+	}
+	s.Id = "sub-1"
+	a.subscription = s
+	return s, nil
+}
+
+func TestCreateInvalidRuleReturnsErrors(t *testing.T) {
+	is := is.New(t)
+	app := &alarmAppMock{}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/rules", strings.NewReader(`{"quantityKind":"Temperature","condition":"between","value":20}`))
+
+	createRule(context.Background(), app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusBadRequest, w.Code)
+	is.True(strings.Contains(w.Body.String(), `"errors":["invalid rule`))
+}
+
+func TestAcknowledgeClosedAlarmReturnsConflict(t *testing.T) {
+	is := is.New(t)
+	app := &alarmAppMock{}
+
+	router := chi.NewRouter()
+	router.Post("/api/alarms/{id}/acknowledge", acknowledgeAlarm(context.Background(), app))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/alarms/7/acknowledge", nil))
+
+	is.Equal(http.StatusConflict, w.Code)
+	is.Equal(int64(7), app.alarmID)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/alarms/seven/acknowledge", nil))
+
+	is.Equal(http.StatusBadRequest, w.Code)
+}
+
+type alarmAppMock struct {
+	application.Application
+	alarmID int64
+}
+
+func (a *alarmAppMock) AddRule(ctx context.Context, r database.Rule) (database.Rule, error) {
+	return database.Rule{}, fmt.Errorf("%w: condition must be above, below or equals", application.ErrInvalidRule)
+}
+
+func (a *alarmAppMock) AcknowledgeAlarm(ctx context.Context, id int64) (database.Alarm, error) {
+	a.alarmID = id
+	return database.Alarm{}, fmt.Errorf("%w: alarm %d is closed", application.ErrAlarmStatus, id)
+}
+
+func TestGetSensorsWithStatusReturnsSensorStatuses(t *testing.T) {
+	is := is.New(t)
+	app := &sensorStatusAppMock{}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/sensors?status=stale&quantityKind=Temperature", nil)
+
+	getSensors(context.Background(), app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusOK, w.Code)
+	is.Equal(database.SensorStale, app.filter.Status)
+	is.Equal("Temperature", app.filter.QuantityKind)
+	is.True(strings.Contains(w.Body.String(), `"expectedInterval":"1h0m0s"`))
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodGet, "/api/sensors?status=silent", nil)
+
+	getSensors(context.Background(), app).ServeHTTP(w, r)
+
+	is.Equal(http.StatusBadRequest, w.Code)
+}
+
+type sensorStatusAppMock struct {
+	application.Application
+	filter database.SensorStatusFilter
+}
+
+func (a *sensorStatusAppMock) GetSensorStatuses(ctx context.Context, filter database.SensorStatusFilter, page, size int) (int64, []database.SensorStatus, error) {
+	a.filter = filter
+	return 1, []database.SensorStatus{{SensorID: "s1", QuantityKind: "Temperature", Status: database.SensorStale, ExpectedInterval: "1h0m0s"}}, nil
+}
+
+func TestGetBuildingEnergyRejectsUnknownInterval(t *testing.T) {
+	is := is.New(t)
+	app := &energyAppMock{}
+
+	router := chi.NewRouter()
+	router.Get("/api/buildings/{id}/energy", getBuildingEnergy(context.Background(), app))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/buildings/building-1/energy?interval=week", nil))
+
+	is.Equal(http.StatusBadRequest, w.Code)
+	is.Equal("building-1", app.buildingID)
+	is.True(strings.Contains(w.Body.String(), `"errors":["invalid energy report`))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/buildings/building-1/energy?timezone=Mars/Olympus", nil))
+
+	is.Equal(http.StatusBadRequest, w.Code)
+}
+
+type energyAppMock struct {
+	application.Application
+	buildingID string
+}
+
+func (a *energyAppMock) GetBuildingEnergy(ctx context.Context, buildingID string, from, to time.Time, interval string, loc *time.Location) (application.EnergyReport, error) {
+	a.buildingID = buildingID
+	return application.EnergyReport{}, fmt.Errorf("%w: interval must be hour, day or month", application.ErrInvalidEnergyReport)
+}
+
+func TestGetOccupancyDefaultsToHourlyPresence(t *testing.T) {
+	is := is.New(t)
+	app := &occupancyAppMock{}
+
+	w := httptest.NewRecorder()
+	getOccupancy(context.Background(), app)(w, httptest.NewRequest(http.MethodGet, "/api/occupancy?sensorId=room-1&hasObservationTime[starting]=2024-01-01T00:00:00Z&hasObservationTime[ending]=2024-01-02T00:00:00Z", nil))
+
+	is.Equal(http.StatusOK, w.Code)
+	is.Equal(application.IntervalHour, app.interval)
+	is.Equal([]string{"room-1"}, app.filter.SensorIDs)
+	is.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), app.filter.Starting)
+}
+
+type occupancyAppMock struct {
+	application.Application
+	filter   database.ObservationFilter
+	interval string
+}
+
+func (a *occupancyAppMock) GetOccupancy(ctx context.Context, filter database.ObservationFilter, interval string, loc *time.Location) (application.OccupancyReport, error) {
+	a.filter, a.interval = filter, interval
+	return application.OccupancyReport{Interval: interval, Sensors: []application.SensorOccupancy{}}, nil
+}
+
+func TestCreateVirtualSensor(t *testing.T) {
+	is := is.New(t)
+	app := &virtualSensorAppMock{}
+
+	body := `{"sensorId":"avg-temperature","quantityKind":"Temperature","aggregate":"avg","root":{"@id":"building-1","@type":"building"}}`
+
+	w := httptest.NewRecorder()
+	createVirtualSensor(context.Background(), app)(w, httptest.NewRequest(http.MethodPost, "/api/sensors/virtual", strings.NewReader(body)))
+	is.Equal(http.StatusCreated, w.Code)
+	is.Equal("/api/sensors/virtual/avg-temperature", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	createVirtualSensor(context.Background(), app)(w, httptest.NewRequest(http.MethodPost, "/api/sensors/virtual", strings.NewReader(body)))
+	is.Equal(http.StatusConflict, w.Code)
+
+	w = httptest.NewRecorder()
+	createVirtualSensor(context.Background(), app)(w, httptest.NewRequest(http.MethodPost, "/api/sensors/virtual", strings.NewReader(`{"sensorId":"v"}`)))
+	is.Equal(http.StatusBadRequest, w.Code)
+	is.True(strings.Contains(w.Body.String(), `"errors":["invalid virtual sensor`))
+}
+
+type virtualSensorAppMock struct {
+	application.Application
+	sensors map[string]database.VirtualSensor
+}
+
+func (a *virtualSensorAppMock) AddVirtualSensor(ctx context.Context, v database.VirtualSensor) (database.VirtualSensor, error) {
+	if v.QuantityKind == "" {
+		return database.VirtualSensor{}, fmt.Errorf("%w: sensorId and quantityKind are required", application.ErrInvalidVirtualSensor)
+	}
+	if a.sensors == nil {
+		a.sensors = make(map[string]database.VirtualSensor)
+	}
+	if _, ok := a.sensors[v.SensorID]; ok {
+		return database.VirtualSensor{}, database.ErrAlreadyExists
+	}
+	a.sensors[v.SensorID] = v
+	return v, nil
+}
+
+func TestGetObservationsFiltersOnQuality(t *testing.T) {
+	is := is.New(t)
+	app := &qualityAppMock{}
+
+	w := httptest.NewRecorder()
+	getObservations(context.Background(), app)(w, httptest.NewRequest(http.MethodGet, "/api/observations?sensorId=s1&quality=good,estimated", nil))
+
+	is.Equal(http.StatusOK, w.Code)
+	is.Equal([]string{"s1"}, app.filter.SensorIDs)
+	is.Equal([]string{database.QualityGood, database.QualityEstimated}, app.filter.Quality)
+
+	w = httptest.NewRecorder()
+	getObservations(context.Background(), app)(w, httptest.NewRequest(http.MethodGet, "/api/observations?sensorId=s1&quality=fine", nil))
+
+	is.Equal(http.StatusBadRequest, w.Code)
+	is.True(strings.Contains(w.Body.String(), "unknown quality fine"))
+}
+
+type qualityAppMock struct {
+	application.Application
+	filter database.ObservationFilter
+}
+
+func (a *qualityAppMock) QueryObservations(ctx context.Context, filter database.ObservationFilter, page, size int) (int64, []database.Observation, error) {
+	a.filter = filter
+	return 0, []database.Observation{}, nil
+}
+
+func TestGetObservationsResamples(t *testing.T) {
+	is := is.New(t)
+	app := &resampleAppMock{}
+
+	w := httptest.NewRecorder()
+	SettingsCtx(getObservations(context.Background(), app)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/observations?sensorId=s1&quantityKind=Temperature&resample=15m&fill=linear&hasObservationTime[starting]=2024-01-01T00:00:00Z&hasObservationTime[ending]=2024-01-02T00:00:00Z&page=1&size=2", nil))
+
+	is.Equal(http.StatusOK, w.Code)
+	is.Equal(15*time.Minute, app.interval)
+	is.Equal(application.FillLinear, app.fill)
+	is.Equal([]string{"s1"}, app.filter.SensorIDs)
+	is.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), app.filter.Starting)
+	is.True(strings.Contains(w.Body.String(), `"hydra:totalItems":3`))
+	is.True(strings.Contains(w.Body.String(), `"observationTime":"2024-01-01T00:30:00Z"`))
+	is.True(!strings.Contains(w.Body.String(), `"observationTime":"2024-01-01T00:15:00Z"`))
+
+	w = httptest.NewRecorder()
+	getObservations(context.Background(), app)(w, httptest.NewRequest(http.MethodGet, "/api/observations?sensorId=s1&resample=often", nil))
+	is.Equal(http.StatusBadRequest, w.Code)
+}
+
+type resampleAppMock struct {
+	application.Application
+	filter   database.ObservationFilter
+	interval time.Duration
+	fill     string
+}
+
+func (a *resampleAppMock) ResampleObservations(ctx context.Context, filter database.ObservationFilter, interval time.Duration, fill string) ([]database.Observation, error) {
+	a.filter, a.interval, a.fill = filter, interval, fill
+
+	points := make([]database.Observation, 0)
+	for i := 0; i < 3; i++ {
+		points = append(points, database.Observation{SensorId: "s1", QuantityKind: "Temperature", ObservationTime: filter.Starting.Add(time.Duration(i) * interval)})
+	}
+	return points, nil
+}
+
+func TestGetSensorFilter(t *testing.T) {
+	is := is.New(t)
+	app := &sensorFilterAppMock{}
+
+	request := func(query string) *http.Request {
+		return httptest.NewRequest(http.MethodGet, "/api/observations?"+query, nil)
+	}
+
+	ids, _, err := getSensorFilter(context.Background(), request("sensorId=s1"), app)
+	is.NoErr(err)
+	is.Equal([]string{"s1"}, ids)
+
+	ids, _, err = getSensorFilter(context.Background(), request("root[id]=building-1&root[type]=building"), app)
+	is.NoErr(err)
+	is.Equal([]string{"s2", "s3"}, ids)
+
+	_, status, err := getSensorFilter(context.Background(), request("root[id]=unknown&root[type]=building"), app)
+	is.True(err != nil)
+	is.Equal(http.StatusNotFound, status)
+
+	ids, _, err = getSensorFilter(context.Background(), request("deviceId=d1"), app)
+	is.NoErr(err)
+	is.True(ids == nil)
+}
+
+func TestExportObservationsOfUnknownRootIsNotFound(t *testing.T) {
+	is := is.New(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/observations?root[id]=unknown&root[type]=building&format=csv", nil)
+
+	getObservations(context.Background(), &sensorFilterAppMock{}).ServeHTTP(w, r)
+
+	is.Equal(http.StatusNotFound, w.Code)
+}
+
+type sensorFilterAppMock struct {
+	application.Application
+}
+
+func (a *sensorFilterAppMock) GetEntity(ctx context.Context, entityID, entityType string) (database.Entity, error) {
+	if entityID != "building-1" {
+		return database.Entity{}, database.ErrNotFound
+	}
+	return database.Entity{Id: entityID, Type: entityType}, nil
+}
+
+func (a *sensorFilterAppMock) GetSensorIDs(ctx context.Context, root database.Entity) ([]string, error) {
+	return []string{"s2", "s3"}, nil
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/go-chi/chi/v5"
+)
+
+func createCalibration(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer r.Body.Close()
+
+		ctx, span := tracer.Start(r.Context(), "create-calibration")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			requestLogger.Error("unable to read body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var calibration database.Calibration
+		err = json.Unmarshal(body, &calibration)
+		if err != nil {
+			requestLogger.Error("unable to unmarshal body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		calibration, err = app.AddCalibration(ctx, calibration)
+		if err != nil {
+			if errors.Is(err, application.ErrInvalidCalibration) {
+				requestLogger.Info("invalid calibration", "err", err.Error())
+				writeErrors(w, http.StatusBadRequest, err)
+				return
+			}
+			requestLogger.Error("unable to add calibration", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(calibration)
+		if err != nil {
+			requestLogger.Error("unable marshal calibration", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Location", r.URL.Path+"/"+strconv.FormatInt(calibration.Id, 10))
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+func getCalibrations(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-calibrations")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		calibrations, err := app.GetCalibrations(ctx, r.URL.Query().Get("sensorId"))
+		if err != nil {
+			requestLogger.Error("unable to load calibrations", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		result := newHydraCollectionResult(ctx, r.URL, calibrations, len(calibrations))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func getCalibration(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-calibration")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		calibration, err := app.GetCalibration(ctx, id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			requestLogger.Error("unable to load calibration", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(calibration)
+		if err != nil {
+			requestLogger.Error("unable marshal calibration", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func deleteCalibration(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "delete-calibration")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		err = app.DeleteCalibration(ctx, id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			requestLogger.Error("unable to delete calibration", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/go-chi/chi/v5"
+)
+
+func getBuildingEnergy(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-building-energy")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id := chi.URLParam(r, "id")
+
+		interval := r.URL.Query().Get("interval")
+		if interval == "" {
+			interval = application.IntervalDay
+		}
+
+		loc, err := time.LoadLocation(r.URL.Query().Get("timezone"))
+		if err != nil {
+			requestLogger.Error("unknown time zone", "err", err.Error())
+			writeErrors(w, http.StatusBadRequest, err)
+			return
+		}
+
+		endingTime, err := getTimeOrDefault(r.URL, "hasObservationTime[ending]", time.Now().UTC())
+		if err != nil {
+			requestLogger.Error("ending time in wrong format, must be RFC3339", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		startingTime, err := getTimeOrDefault(r.URL, "hasObservationTime[starting]", endingTime.AddDate(0, 0, -30))
+		if err != nil {
+			requestLogger.Error("starting time in wrong format, must be RFC3339", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		report, err := app.GetBuildingEnergy(ctx, id, startingTime, endingTime, interval, loc)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if errors.Is(err, application.ErrInvalidEnergyReport) {
+				requestLogger.Info("invalid energy report", "err", err.Error())
+				writeErrors(w, http.StatusBadRequest, err)
+				return
+			}
+			requestLogger.Error("unable to compute energy report", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(report)
+		if err != nil {
+			requestLogger.Error("unable marshal energy report", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/env"
+)
+
+const (
+	formatCSV    = "csv"
+	formatNDJSON = "ndjson"
+
+	contentTypeCSV    = "text/csv"
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+const flushInterval = 1000
+
+func exportTimeout(ctx context.Context) time.Duration {
+	d, err := time.ParseDuration(env.GetVariableOrDefault(ctx, "EXPORT_TIMEOUT", "30m"))
+	if err != nil {
+		return 30 * time.Minute
+	}
+	return d
+}
+
+// exportFormat returns the format observations should be streamed in, from the format parameter
+// or the Accept header, or an empty string if a paged JSON-LD result was asked for.
+func exportFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case formatCSV:
+		return formatCSV
+	case formatNDJSON:
+		return formatNDJSON
+	}
+
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, contentTypeCSV) {
+		return formatCSV
+	}
+	if strings.Contains(accept, contentTypeNDJSON) {
+		return formatNDJSON
+	}
+
+	return ""
+}
+
+type observationWriter interface {
+	Write(deviceID string, o database.Observation) error
+	Flush() error
+}
+
+type csvObservationWriter struct {
+	w *csv.Writer
+}
+
+func newCsvObservationWriter(w io.Writer) (*csvObservationWriter, error) {
+	cw := &csvObservationWriter{w: csv.NewWriter(w)}
+	err := cw.w.Write([]string{"deviceId", "sensorId", "observationTime", "value", "valueString", "valueBoolean", "quantityKind"})
+	return cw, err
+}
+
+func (cw *csvObservationWriter) Write(deviceID string, o database.Observation) error {
+	record := []string{deviceID, o.SensorId, o.ObservationTime.UTC().Format(time.RFC3339Nano), "", "", "", o.QuantityKind}
+	if o.Value != nil {
+		record[3] = strconv.FormatFloat(*o.Value, 'f', -1, 64)
+	}
+	if o.ValueString != nil {
+		record[4] = *o.ValueString
+	}
+	if o.ValueBoolean != nil {
+		record[5] = strconv.FormatBool(*o.ValueBoolean)
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvObservationWriter) Flush() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type ndjsonObservationWriter struct {
+	enc *json.Encoder
+}
+
+type exportedObservation struct {
+	DeviceID string `json:"deviceId"`
+	database.Observation
+}
+
+func (nw *ndjsonObservationWriter) Write(deviceID string, o database.Observation) error {
+	return nw.enc.Encode(exportedObservation{DeviceID: deviceID, Observation: o})
+}
+
+func (nw *ndjsonObservationWriter) Flush() error {
+	return nil
+}
+
+// exportObservations streams every observation that matches the filter, without paging, and returns
+// the number of observations written.
+func exportObservations(ctx context.Context, w http.ResponseWriter, format string, filter database.ObservationFilter, app application.Application, log *slog.Logger) (int, error) {
+	var ow observationWriter
+	var err error
+
+	switch format {
+	case formatCSV:
+		w.Header().Add("Content-Type", contentTypeCSV)
+		ow, err = newCsvObservationWriter(w)
+	default:
+		w.Header().Add("Content-Type", contentTypeNDJSON)
+		ow = &ndjsonObservationWriter{enc: json.NewEncoder(w)}
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	flusher, _ := w.(http.Flusher)
+	n := 0
+
+	err = app.StreamObservations(ctx, filter, func(deviceID string, o database.Observation) error {
+		err := ow.Write(deviceID, o)
+		if err != nil {
+			return err
+		}
+
+		n++
+		if n%flushInterval == 0 {
+			err = ow.Flush()
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		return err
+	})
+
+	if err != nil && n == 0 {
+		// nothing has been written, let the caller respond with an error
+		return 0, err
+	}
+
+	if flushErr := ow.Flush(); err == nil {
+		err = flushErr
+	}
+
+	log.Debug("exported observations", "format", format, "count", n)
+
+	return n, err
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/service-chassis/pkg/infrastructure/env"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+func importTimeout(ctx context.Context) time.Duration {
+	d, err := time.ParseDuration(env.GetVariableOrDefault(ctx, "IMPORT_TIMEOUT", "30m"))
+	if err != nil {
+		return 30 * time.Minute
+	}
+	return d
+}
+
+// NewImportOptions reads import options from query parameters, i.e. dryRun, deviceId, separator
+// and column[field]=name to map an import field to a CSV column.
+func NewImportOptions(u *url.URL) application.ImportOptions {
+	q := u.Query()
+
+	opts := application.ImportOptions{
+		Columns:  make(map[string]string),
+		DeviceID: q.Get("deviceId"),
+		DryRun:   q.Get("dryRun") == "true",
+	}
+
+	if sep := q.Get("separator"); sep != "" {
+		opts.Separator, _ = utf8.DecodeRuneInString(sep)
+	}
+
+	for key, values := range q {
+		if strings.HasPrefix(key, "column[") && strings.HasSuffix(key, "]") && len(values) > 0 {
+			opts.Columns[strings.TrimSuffix(strings.TrimPrefix(key, "column["), "]")] = values[0]
+		}
+	}
+
+	return opts
+}
+
+func importObservations(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer r.Body.Close()
+
+		ctx, span := tracer.Start(r.Context(), "import-observations")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		opts := NewImportOptions(r.URL)
+		opts.Progress = func(result application.ImportResult) {
+			requestLogger.Info("importing observations", "rows", result.Rows, "skipped", result.Skipped, "dry_run", result.DryRun)
+		}
+
+		result, err := app.ImportObservations(ctx, r.Body, opts)
+		statusCode := http.StatusOK
+		if errors.Is(err, application.ErrInvalidImport) {
+			requestLogger.Error("unable to import observations", "err", err.Error())
+			result.Errors = []application.ImportError{{Message: err.Error()}}
+			statusCode = http.StatusBadRequest
+		} else if err != nil {
+			requestLogger.Error("import of observations failed", "rows", result.Rows, "err", err.Error())
+			statusCode = http.StatusInternalServerError
+		}
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable to marshal import result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(statusCode)
+		w.Write(b)
+	}
+}
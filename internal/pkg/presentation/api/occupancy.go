@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+func getOccupancy(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-occupancy")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		interval := r.URL.Query().Get("interval")
+		if interval == "" {
+			interval = application.IntervalHour
+		}
+
+		loc, err := time.LoadLocation(r.URL.Query().Get("timezone"))
+		if err != nil {
+			requestLogger.Error("unknown time zone", "err", err.Error())
+			writeErrors(w, http.StatusBadRequest, err)
+			return
+		}
+
+		endingTime, err := getTimeOrDefault(r.URL, "hasObservationTime[ending]", time.Now().UTC())
+		if err != nil {
+			requestLogger.Error("ending time in wrong format, must be RFC3339", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		startingTime, err := getTimeOrDefault(r.URL, "hasObservationTime[starting]", endingTime.AddDate(0, 0, -7))
+		if err != nil {
+			requestLogger.Error("starting time in wrong format, must be RFC3339", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		filter := database.ObservationFilter{
+			QuantityKind: r.URL.Query().Get("quantityKind"),
+			Starting:     startingTime,
+			Ending:       endingTime,
+		}
+
+		var status int
+		filter.SensorIDs, status, err = getSensorFilter(ctx, r, app)
+		if err != nil {
+			requestLogger.Error("could not get sensors to filter on", "err", err.Error())
+			w.WriteHeader(status)
+			return
+		}
+
+		report, err := app.GetOccupancy(ctx, filter, interval, loc)
+		if err != nil {
+			if errors.Is(err, application.ErrInvalidOccupancyReport) {
+				requestLogger.Info("invalid occupancy report", "err", err.Error())
+				writeErrors(w, http.StatusBadRequest, err)
+				return
+			}
+			requestLogger.Error("unable to compute occupancy report", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(report)
+		if err != nil {
+			requestLogger.Error("unable marshal occupancy report", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
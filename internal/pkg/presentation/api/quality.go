@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+func setObservationQuality(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer r.Body.Close()
+
+		ctx, span := tracer.Start(r.Context(), "set-observation-quality")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			requestLogger.Error("unable to read body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var override database.QualityOverride
+		err = json.Unmarshal(body, &override)
+		if err != nil {
+			requestLogger.Error("unable to unmarshal body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		n, err := app.SetObservationQuality(ctx, override)
+		if err != nil {
+			if errors.Is(err, application.ErrInvalidQualityOverride) {
+				requestLogger.Info("invalid quality override", "err", err.Error())
+				writeErrors(w, http.StatusBadRequest, err)
+				return
+			}
+			requestLogger.Error("unable to set observation quality", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		requestLogger.Info("set observation quality", "sensor_id", override.SensorID, "quality", override.Quality, "count", n)
+
+		b, err := json.Marshal(struct {
+			Updated int64 `json:"updated"`
+		}{n})
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+func getResampledObservations(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-resampled-observations")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		interval, err := time.ParseDuration(r.URL.Query().Get("resample"))
+		if err != nil {
+			requestLogger.Error("invalid resample interval", "err", err.Error())
+			writeErrors(w, http.StatusBadRequest, err)
+			return
+		}
+
+		fill := r.URL.Query().Get("fill")
+		if fill == "" {
+			fill = application.FillPrevious
+		}
+
+		endingTime, err := getTimeOrDefault(r.URL, "hasObservationTime[ending]", time.Now().UTC())
+		if err != nil {
+			requestLogger.Error("ending time in wrong format, must be RFC3339", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		startingTime, err := getTimeOrDefault(r.URL, "hasObservationTime[starting]", endingTime.Add(-24*time.Hour))
+		if err != nil {
+			requestLogger.Error("starting time in wrong format, must be RFC3339", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		quality, err := getQuality(r.URL)
+		if err != nil {
+			requestLogger.Error("invalid quality", "err", err.Error())
+			writeErrors(w, http.StatusBadRequest, err)
+			return
+		}
+
+		filter := database.ObservationFilter{
+			DeviceID:     r.URL.Query().Get("deviceId"),
+			QuantityKind: r.URL.Query().Get("quantityKind"),
+			Quality:      quality,
+			Starting:     startingTime,
+			Ending:       endingTime,
+		}
+
+		var status int
+		filter.SensorIDs, status, err = getSensorFilter(ctx, r, app)
+		if err != nil {
+			requestLogger.Error("could not get sensors to filter on", "err", err.Error())
+			w.WriteHeader(status)
+			return
+		}
+
+		if filter.SensorIDs == nil && filter.DeviceID == "" {
+			requestLogger.Error("no ID in query string")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		points, err := app.ResampleObservations(ctx, filter, interval, fill)
+		if err != nil {
+			if errors.Is(err, application.ErrInvalidResample) {
+				requestLogger.Info("invalid resample", "err", err.Error())
+				writeErrors(w, http.StatusBadRequest, err)
+				return
+			}
+			requestLogger.Error("could not resample observations", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		page, size := getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10)
+
+		from := min(max(page*size, 0), len(points))
+		to := min(from+max(size, 0), len(points))
+
+		result := newHydraCollectionResult(ctx, r.URL, points[from:to], len(points))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
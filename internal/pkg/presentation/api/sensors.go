@@ -0,0 +1,145 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+)
+
+// getSensors responds with the status of sensors if a status is asked for and with sensor entities otherwise.
+func getSensors(ctx context.Context, app application.Application) http.HandlerFunc {
+	entities := getEntities(ctx, app, database.SensorType)
+	statuses := getSensorStatuses(ctx, app)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("status") {
+			statuses(w, r)
+			return
+		}
+		entities(w, r)
+	}
+}
+
+func getSensorStatuses(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-sensor-statuses")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		filter := database.SensorStatusFilter{
+			QuantityKind: r.URL.Query().Get("quantityKind"),
+			Status:       r.URL.Query().Get("status"),
+		}
+
+		if filter.Status != database.SensorStale && filter.Status != database.SensorReporting {
+			requestLogger.Error("invalid sensor status", "status", filter.Status)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var status int
+		filter.SensorIDs, status, err = getSensorFilter(ctx, r, app)
+		if err != nil {
+			requestLogger.Error("could not get sensors to filter on", "err", err.Error())
+			w.WriteHeader(status)
+			return
+		}
+
+		totalItems, statuses, err := app.GetSensorStatuses(ctx, filter, getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10))
+		if err != nil {
+			requestLogger.Error("unable to load sensor statuses", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		result := newHydraCollectionResult(ctx, r.URL, statuses, int(totalItems))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func getObservationGaps(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-observation-gaps")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		endingTime, err := getTimeOrDefault(r.URL, "hasObservationTime[ending]", time.Now().UTC())
+		if err != nil {
+			requestLogger.Error("ending time in wrong format, must be RFC3339", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		startingTime, err := getTimeOrDefault(r.URL, "hasObservationTime[starting]", endingTime.Add(-24*time.Hour))
+		if err != nil {
+			requestLogger.Error("starting time in wrong format, must be RFC3339", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !startingTime.Before(endingTime) {
+			requestLogger.Error("starting time must be before ending time")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		filter := database.ObservationFilter{
+			DeviceID:     r.URL.Query().Get("deviceId"),
+			QuantityKind: r.URL.Query().Get("quantityKind"),
+			Starting:     startingTime,
+			Ending:       endingTime,
+		}
+
+		var status int
+		filter.SensorIDs, status, err = getSensorFilter(ctx, r, app)
+		if err != nil {
+			requestLogger.Error("could not get sensors to filter on", "err", err.Error())
+			w.WriteHeader(status)
+			return
+		}
+
+		gaps, err := app.GetObservationGaps(ctx, filter)
+		if err != nil {
+			requestLogger.Error("unable to load observation gaps", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		result := newHydraCollectionResult(ctx, r.URL, gaps, len(gaps))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
@@ -0,0 +1,223 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/gorilla/websocket"
+)
+
+const keepAliveInterval = 30 * time.Second
+
+// maxResumedObservations limits how many stored observations are sent to a client that resumes a stream
+const maxResumedObservations = 10000
+
+const resumeBatchSize = 1000
+
+var errSubscriberTooSlow = errors.New("subscriber did not keep up with new observations")
+
+// errResumeLimitReached closes a resumed stream so that the client reconnects from the last observation it received
+var errResumeLimitReached = errors.New("too many stored observations to resume, client has to reconnect")
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// streamObservations pushes observations as they are stored, as Server-Sent Events or, if the request is a
+// WebSocket upgrade, as WebSocket messages. Clients can resume from the last observation they received
+// with the Last-Event-ID header or the lastEventId parameter.
+func streamObservations(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "stream-observations")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		quality, err := getQuality(r.URL)
+		if err != nil {
+			requestLogger.Error("invalid quality", "err", err.Error())
+			writeErrors(w, http.StatusBadRequest, err)
+			return
+		}
+
+		filter := database.ObservationFilter{
+			DeviceID:     r.URL.Query().Get("deviceId"),
+			QuantityKind: r.URL.Query().Get("quantityKind"),
+			Quality:      quality,
+		}
+
+		var status int
+		filter.SensorIDs, status, err = getSensorFilter(ctx, r, app)
+		if err != nil {
+			requestLogger.Error("could not get sensors to filter on", "err", err.Error())
+			w.WriteHeader(status)
+			return
+		}
+
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("lastEventId")
+		}
+
+		var afterID int64
+		if lastEventID != "" {
+			afterID, err = strconv.ParseInt(lastEventID, 10, 64)
+			if err != nil {
+				requestLogger.Error("invalid last event id", "last_event_id", lastEventID)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		if websocket.IsWebSocketUpgrade(r) {
+			err = streamToWebSocket(ctx, w, r, app, filter, afterID)
+		} else {
+			err = streamToEventSource(ctx, w, app, filter, afterID)
+		}
+
+		if err != nil && !errors.Is(err, context.Canceled) {
+			requestLogger.Info("observation stream closed", "err", err.Error())
+		}
+	}
+}
+
+func streamToEventSource(ctx context.Context, w http.ResponseWriter, app application.Application, filter database.ObservationFilter, afterID int64) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return errors.New("streaming is not supported by the response writer")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(o database.StoredObservation) error {
+		b, err := json.Marshal(o)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: observation\ndata: %s\n\n", o.ID, b)
+		flusher.Flush()
+		return err
+	}
+
+	keepAlive := func() error {
+		_, err := fmt.Fprint(w, ": keep-alive\n\n")
+		flusher.Flush()
+		return err
+	}
+
+	return stream(ctx, app, filter, afterID, send, keepAlive)
+}
+
+func streamToWebSocket(ctx context.Context, w http.ResponseWriter, r *http.Request, app application.Application, filter database.ObservationFilter, afterID int64) error {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// control frames are only processed while reading, and a failed read means the client has gone
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(o database.StoredObservation) error {
+		return conn.WriteJSON(o)
+	}
+
+	keepAlive := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+	}
+
+	err = stream(ctx, app, filter, afterID, send, keepAlive)
+
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+
+	return err
+}
+
+// stream sends observations stored after afterID, if set, followed by new observations until ctx is done
+func stream(ctx context.Context, app application.Application, filter database.ObservationFilter, afterID int64, send func(database.StoredObservation) error, keepAlive func() error) error {
+	observations, cancel := app.SubscribeObservations(filter)
+	defer cancel()
+
+	// observations that are both resumed and received from the subscription are only sent once
+	resumed := make(map[int64]struct{})
+
+	for afterID > 0 {
+		batch, err := app.GetObservationsAfter(ctx, filter, afterID, resumeBatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, o := range batch {
+			err = send(o)
+			if err != nil {
+				return err
+			}
+			resumed[o.ID] = struct{}{}
+			afterID = o.ID
+		}
+
+		if len(batch) < resumeBatchSize {
+			break
+		}
+
+		// switching to new observations here would silently skip those not yet resumed
+		if len(resumed) >= maxResumedObservations {
+			return errResumeLimitReached
+		}
+	}
+
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case o, ok := <-observations:
+			if !ok {
+				return errSubscriberTooSlow
+			}
+			if _, ok := resumed[o.ID]; ok {
+				delete(resumed, o.ID)
+				continue
+			}
+			err := send(o)
+			if err != nil {
+				return err
+			}
+		case <-ticker.C:
+			err := keepAlive()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/api-rec/internal/pkg/infrastructure/database"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/tracing"
+	"github.com/go-chi/chi/v5"
+)
+
+func createSubscription(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		defer r.Body.Close()
+
+		ctx, span := tracer.Start(r.Context(), "create-subscription")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			requestLogger.Error("unable to read body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var s database.Subscription
+		err = json.Unmarshal(body, &s)
+		if err != nil {
+			requestLogger.Error("unable to unmarshal body", "err", err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s, err = app.AddSubscription(ctx, s)
+		if err != nil {
+			if errors.Is(err, application.ErrInvalidSubscription) {
+				requestLogger.Info("invalid subscription", "err", err.Error())
+				writeErrors(w, http.StatusBadRequest, err)
+				return
+			}
+			requestLogger.Error("unable to add subscription", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(s)
+		if err != nil {
+			requestLogger.Error("unable marshal subscription", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.Header().Add("Location", r.URL.Path+"/"+s.Id)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+}
+
+func writeErrors(w http.ResponseWriter, statusCode int, err error) {
+	b, _ := json.Marshal(struct {
+		Errors []string `json:"errors"`
+	}{[]string{err.Error()}})
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(b)
+}
+
+func getSubscriptions(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-subscriptions")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		totalItems, subscriptions, err := app.GetSubscriptions(ctx, getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10))
+		if err != nil {
+			requestLogger.Error("unable to load subscriptions", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		result := newHydraCollectionResult(ctx, r.URL, subscriptions, int(totalItems))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func getSubscription(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-subscription")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id := chi.URLParam(r, "id")
+
+		s, err := app.GetSubscription(ctx, id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			requestLogger.Error("unable to load subscription", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		b, err := json.Marshal(s)
+		if err != nil {
+			requestLogger.Error("unable marshal subscription", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
+
+func deleteSubscription(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "delete-subscription")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id := chi.URLParam(r, "id")
+
+		err = app.DeleteSubscription(ctx, id)
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			requestLogger.Error("unable to delete subscription", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func getDeliveries(ctx context.Context, app application.Application) http.HandlerFunc {
+	log := logging.GetFromContext(ctx)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var err error
+
+		ctx, span := tracer.Start(r.Context(), "get-deliveries")
+		defer func() { tracing.RecordAnyErrorAndEndSpan(err, span) }()
+		_, ctx, requestLogger := o11y.AddTraceIDToLoggerAndStoreInContext(span, log, ctx)
+
+		id := chi.URLParam(r, "id")
+
+		totalItems, deliveries, err := app.GetDeliveries(ctx, id, getIntOrDefault(r.URL, "page", 0), getIntOrDefault(r.URL, "size", 10))
+		if err != nil {
+			if errors.Is(err, database.ErrNotFound) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			requestLogger.Error("unable to load deliveries", "id", id, "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		result := newHydraCollectionResult(ctx, r.URL, deliveries, int(totalItems))
+
+		b, err := json.Marshal(result)
+		if err != nil {
+			requestLogger.Error("unable marshal result", "err", err.Error())
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Add("Content-Type", "application/ld+json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}
+}
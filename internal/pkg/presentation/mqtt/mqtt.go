@@ -0,0 +1,227 @@
+package mqtt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	cloudevents "github.com/cloudevents/sdk-go/v2"
+	"github.com/diwise/api-rec/internal/pkg/application"
+	"github.com/diwise/service-chassis/pkg/infrastructure/env"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"go.opentelemetry.io/otel"
+)
+
+var tracer = otel.Tracer("api-rec/mqtt")
+
+type Config struct {
+	enabled  bool
+	broker   string
+	clientID string
+	username string
+	password string
+	topics   []string
+	qos      byte
+}
+
+type Subscriber interface {
+	Start(ctx context.Context) error
+	Stop()
+}
+
+type subscriber struct {
+	cfg    Config
+	app    application.Application
+	client paho.Client
+}
+
+func LoadConfiguration(ctx context.Context) Config {
+	topics := make([]string, 0)
+	for _, t := range strings.Split(env.GetVariableOrDefault(ctx, "MQTT_TOPICS", ""), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			topics = append(topics, t)
+		}
+	}
+
+	return Config{
+		enabled:  env.GetVariableOrDefault(ctx, "MQTT_ENABLED", "false") == "true",
+		broker:   env.GetVariableOrDefault(ctx, "MQTT_BROKER", "tcp://localhost:1883"),
+		clientID: env.GetVariableOrDefault(ctx, "MQTT_CLIENT_ID", "api-rec"),
+		username: env.GetVariableOrDefault(ctx, "MQTT_USER", ""),
+		password: env.GetVariableOrDefault(ctx, "MQTT_PASSWORD", ""),
+		topics:   topics,
+		qos:      1,
+	}
+}
+
+func NewConfig(broker, clientID string, topics []string) Config {
+	return Config{
+		enabled:  true,
+		broker:   broker,
+		clientID: clientID,
+		topics:   topics,
+		qos:      1,
+	}
+}
+
+func (c Config) Enabled() bool {
+	return c.enabled && len(c.topics) > 0
+}
+
+func New(cfg Config, app application.Application) Subscriber {
+	return &subscriber{
+		cfg: cfg,
+		app: app,
+	}
+}
+
+// Start connects to the broker and subscribes to the configured topics. Subscriptions are
+// restored by the client when it reconnects.
+func (s *subscriber) Start(ctx context.Context) error {
+	log := logging.GetFromContext(ctx)
+
+	opts := paho.NewClientOptions()
+	opts.AddBroker(s.cfg.broker)
+	opts.SetClientID(s.cfg.clientID)
+	opts.SetUsername(s.cfg.username)
+	opts.SetPassword(s.cfg.password)
+	opts.SetCleanSession(false)
+	opts.SetAutoReconnect(true)
+	opts.SetOrderMatters(false)
+	opts.SetOnConnectHandler(func(c paho.Client) {
+		filters := make(map[string]byte)
+		for _, t := range s.cfg.topics {
+			filters[t] = s.cfg.qos
+		}
+
+		token := c.SubscribeMultiple(filters, s.messageHandler(ctx))
+		if token.Wait() && token.Error() != nil {
+			log.Error("failed to subscribe to topics", "topics", s.cfg.topics, "err", token.Error().Error())
+			return
+		}
+
+		log.Info("subscribed to topics", "topics", s.cfg.topics)
+	})
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		log.Warn("lost connection to mqtt broker", "err", err.Error())
+	})
+
+	s.client = paho.NewClient(opts)
+
+	token := s.client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return fmt.Errorf("failed to connect to mqtt broker %s: %w", s.cfg.broker, token.Error())
+	}
+
+	return nil
+}
+
+func (s *subscriber) Stop() {
+	if s.client != nil {
+		s.client.Disconnect(250)
+	}
+}
+
+func (s *subscriber) messageHandler(ctx context.Context) paho.MessageHandler {
+	log := logging.GetFromContext(ctx)
+
+	return func(c paho.Client, m paho.Message) {
+		var err error
+
+		ctx, span := tracer.Start(ctx, "handle-mqtt-message")
+		defer span.End()
+
+		evt, err := decode(m.Topic(), m.Payload(), time.Now().UTC())
+		if err != nil {
+			log.Error("failed to decode mqtt message", "topic", m.Topic(), "err", err.Error())
+			return
+		}
+
+		// the broker will not redeliver a message that has been received, so wait for
+		// the ingestion queue rather than dropping the message when it is full
+		for {
+			err = s.app.HandleEvent(ctx, evt)
+			if !errors.Is(err, application.ErrQueueFull) {
+				break
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		if err != nil {
+			if errors.Is(err, application.ErrEventProcessed) {
+				log.Debug("event has already been processed", "source", evt.Source, "id", evt.ID)
+				return
+			}
+			if errors.Is(err, application.ErrUnmappableEvent) {
+				log.Warn("mqtt message could not be mapped to an observation", "topic", m.Topic(), "err", err.Error())
+				return
+			}
+			log.Error("failed to handle mqtt message", "topic", m.Topic(), "err", err.Error())
+		}
+	}
+}
+
+// decode detects the format of a payload and wraps it in an event. Supported formats are
+// structured cloudevents, REC edge messages (SensorObservation) and SenML packs.
+func decode(topic string, payload []byte, received time.Time) (application.Event, error) {
+	payload = bytes.TrimSpace(payload)
+
+	if len(payload) == 0 {
+		return application.Event{}, errors.New("empty payload")
+	}
+
+	evt := application.Event{
+		Source:   topic,
+		Received: received,
+		Data:     payload,
+	}
+
+	if payload[0] == '[' {
+		evt.Type = application.SenMLName
+		return evt, nil
+	}
+
+	var probe struct {
+		SpecVersion  string          `json:"specversion"`
+		Observations json.RawMessage `json:"observations"`
+	}
+
+	err := json.Unmarshal(payload, &probe)
+	if err != nil {
+		return application.Event{}, err
+	}
+
+	if probe.SpecVersion != "" {
+		event := cloudevents.NewEvent()
+		err = json.Unmarshal(payload, &event)
+		if err != nil {
+			return application.Event{}, err
+		}
+
+		return application.Event{
+			ID:       event.ID(),
+			Source:   event.Source(),
+			Type:     event.Type(),
+			Time:     event.Time(),
+			Received: received,
+			Data:     event.Data(),
+		}, nil
+	}
+
+	if probe.Observations != nil {
+		evt.Type = application.SensorObservationName
+		return evt, nil
+	}
+
+	return application.Event{}, errors.New("unknown payload format")
+}
@@ -0,0 +1,113 @@
+package mqtt
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/diwise/api-rec/internal/pkg/application"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/matryer/is"
+	server "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+func TestDecode(t *testing.T) {
+	is := is.New(t)
+	now := time.Now().UTC()
+
+	evt, err := decode("sensors/1", []byte(`[{"bn":"urn:oma:lwm2m:ext:3303","vs":"sensor-1","bt":1700000000},{"n":"5700","v":21.5}]`), now)
+	is.NoErr(err)
+	is.Equal(application.SenMLName, evt.Type)
+	is.Equal("sensors/1", evt.Source)
+	is.Equal(now, evt.Received)
+
+	evt, err = decode("rec/edge", []byte(`{"deviceId":"device-1","observations":[{"sensorId":"sensor-1","quantityKind":"Temperature","value":21.5}]}`), now)
+	is.NoErr(err)
+	is.Equal(application.SensorObservationName, evt.Type)
+
+	evt, err = decode("events", []byte(`{"specversion":"1.0","id":"1","source":"iot-core","type":"message.accepted","datacontenttype":"application/json","data":{"sensorID":"sensor-1"}}`), now)
+	is.NoErr(err)
+	is.Equal("message.accepted", evt.Type)
+	is.Equal("iot-core", evt.Source)
+	is.Equal("1", evt.ID)
+	is.Equal(`{"sensorID":"sensor-1"}`, string(evt.Data))
+
+	_, err = decode("events", []byte(`{"temperature":21.5}`), now)
+	is.True(err != nil)
+
+	_, err = decode("events", []byte(` `), now)
+	is.True(err != nil)
+}
+
+func TestSubscriber(t *testing.T) {
+	is := is.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr := freeAddress(t)
+
+	broker := server.New(&server.Options{})
+	is.NoErr(broker.AddHook(new(auth.AllowHook), nil))
+	is.NoErr(broker.AddListener(listeners.NewTCP("t1", addr, nil)))
+	go broker.Serve()
+	defer broker.Close()
+
+	app := &appMock{events: make(chan application.Event, 1)}
+
+	s := New(NewConfig("tcp://"+addr, "api-rec-test", []string{"rec/#"}), app)
+	is.NoErr(s.Start(ctx))
+	defer s.Stop()
+
+	opts := paho.NewClientOptions()
+	opts.AddBroker("tcp://" + addr)
+	opts.SetClientID("publisher")
+	publisher := paho.NewClient(opts)
+	token := publisher.Connect()
+	is.True(token.WaitTimeout(5 * time.Second))
+	is.NoErr(token.Error())
+	defer publisher.Disconnect(250)
+
+	payload := `{"deviceId":"device-1","observations":[{"sensorId":"sensor-1","quantityKind":"Temperature","value":21.5}]}`
+
+	// the subscription is made asynchronously once connected, so publish until the message arrives
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		publisher.Publish("rec/edge", 1, false, payload).Wait()
+
+		select {
+		case evt := <-app.events:
+			is.Equal(application.SensorObservationName, evt.Type)
+			is.Equal("rec/edge", evt.Source)
+			is.Equal(payload, string(evt.Data))
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.Fatal("no message received")
+}
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+type appMock struct {
+	application.Application
+	events chan application.Event
+}
+
+func (a *appMock) HandleEvent(ctx context.Context, evt application.Event) error {
+	select {
+	case a.events <- evt:
+	default:
+	}
+	return nil
+}